@@ -2,8 +2,11 @@ package batchbuilder
 
 import (
 	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/historydb"
 	"tokamak-sybil-resistance/database/kvdb"
 	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/scoring"
 	"tokamak-sybil-resistance/txprocessor"
 )
 
@@ -18,6 +21,7 @@ type ConfigCircuit struct {
 // functionalities
 type BatchBuilder struct {
 	localStateDB *statedb.LocalStateDB
+	historyDB    *historydb.HistoryDB
 }
 
 // ConfigBatch contains the batch configuration
@@ -26,8 +30,10 @@ type ConfigBatch struct {
 }
 
 // NewBatchBuilder constructs a new BatchBuilder, and executes the bb.Reset
-// method
-func NewBatchBuilder(dbpath string, synchronizerStateDB *statedb.StateDB, batchNum common.BatchNum,
+// method.  The seed set of the score epochs is read from the historyDB, where
+// the synchronizer stores its governance updates.
+func NewBatchBuilder(dbpath string, synchronizerStateDB *statedb.StateDB,
+	historyDB *historydb.HistoryDB, batchNum common.BatchNum,
 	nLevels uint64) (*BatchBuilder, error) {
 	localStateDB, err := statedb.NewLocalStateDB(
 		statedb.Config{
@@ -43,6 +49,7 @@ func NewBatchBuilder(dbpath string, synchronizerStateDB *statedb.StateDB, batchN
 
 	bb := BatchBuilder{
 		localStateDB: localStateDB,
+		historyDB:    historyDB,
 	}
 
 	err = bb.Reset(batchNum, true)
@@ -54,7 +61,34 @@ func NewBatchBuilder(dbpath string, synchronizerStateDB *statedb.StateDB, batchN
 // copy of the rollup state from the Synchronizer at that `batchNum`, otherwise
 // it can just roll back the internal copy.
 func (bb *BatchBuilder) Reset(batchNum common.BatchNum, fromSynchronizer bool) error {
-	return nil
-	//TODO: Check and Update this reseting functionality
-	// return tracerr.Wrap(bb.localStateDB.Reset(batchNum, fromSynchronizer))
+	return common.Wrap(bb.localStateDB.Reset(batchNum, fromSynchronizer))
+}
+
+// BuildBatch takes the transactions and returns the common.ZKInputs of the
+// next batch.  If the batch is a score epoch, the scores are recomputed and
+// the ZKInputs contain the old & new roots of the ScoreTree.  The scores are
+// computed with the seed set of the last governance update synchronized in the
+// HistoryDB, or with the one of the config if it has never been updated, like
+// the synchronizer does.  A seed set that the circuit can't prove is ignored
+// (see scoring.ErrSeedsUnsupported).
+func (bb *BatchBuilder) BuildBatch(coordIdxs []common.AccountIdx, configBatch *ConfigBatch,
+	l1usertxs, l1coordinatortxs []common.L1Tx, pooll2txs []common.PoolL2Tx) (*common.ZKInputs, error) {
+	bbStateDB := bb.localStateDB.StateDB
+	tpConfig := configBatch.TxProcessorConfig
+	seeds, err := bb.historyDB.GetScoreSeeds(tpConfig.ScoreSeeds)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if err := scoring.CheckSeeds(seeds); err != nil {
+		log.Warnw("Ignoring the seed set of the last governance update", "err", err)
+		seeds = nil
+	}
+	tpConfig.ScoreSeeds = seeds
+	tp := txprocessor.NewTxProcessor(bbStateDB, tpConfig)
+
+	ptOut, err := tp.ProcessTxs(coordIdxs, l1usertxs, l1coordinatortxs, pooll2txs)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return ptOut.ZKInputs, nil
 }
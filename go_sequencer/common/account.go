@@ -23,14 +23,51 @@ type Account struct {
 	EthAddr  ethCommon.Address     `meddler:"eth_addr"`
 	Nonce    Nonce                 `meddler:"-"` // max of 40 bits used
 	Balance  *big.Int              `meddler:"-"` // max of 192 bits used
+	// VouchCount is the number of active vouches given by the account and
+	// Score is its score.  They are only part of the AccountLeafV2 leafs.
+	VouchCount uint32 `meddler:"-"`
+	Score      uint32 `meddler:"-"`
+	// LeafVersion is the layout of the leaf of the account
+	LeafVersion AccountLeafVersion `meddler:"-"`
+}
+
+// AccountLeafVersion identifies the layout of the leaf of an account in the
+// account tree
+type AccountLeafVersion uint8
+
+const (
+	// AccountLeafV1 is the layout with the nonce, balance, BJJ and eth
+	// address in NAccountLeafElemsV1 elements.  It is the zero value, as
+	// the V1 leafs don't contain their version.
+	AccountLeafV1 AccountLeafVersion = iota
+	// AccountLeafV2 appends to the AccountLeafV1 elements a fifth one with
+	// the version, the VouchCount and the Score of the account, so that a
+	// single proof of the account tree shows the score of an eth address
+	AccountLeafV2
+)
+
+// NLeafElems returns the number of elements hashed in a leaf with the layout
+// v
+func (v AccountLeafVersion) NLeafElems() int {
+	if v == AccountLeafV1 {
+		return NAccountLeafElemsV1
+	}
+	return NAccountLeafElems
 }
 
 // AccountIdx represents the account Index in the MerkleTree
 type AccountIdx uint32
 
 const (
-	// NAccountLeafElems is the number of elements for a leaf in account tree
-	NAccountLeafElems = 4
+	// NAccountLeafElems is the maximum number of elements for a leaf in
+	// account tree, the ones of the AccountLeafV2 layout
+	NAccountLeafElems = 5
+	// NAccountLeafElemsV1 is the number of elements for a leaf in account
+	// tree with the AccountLeafV1 layout
+	NAccountLeafElemsV1 = 4
+	// AccountLeafEthAddrElem is the element of the leaf that contains the
+	// eth address in its lowest 20 bytes
+	AccountLeafEthAddrElem = 3
 
 	// maxBalanceBytes is the maximum bytes that can use the
 	// Account.Balance *big.Int
@@ -48,6 +85,9 @@ const (
 	// IdxUserThreshold is a Idx type value that determines the threshold
 	// from the User Idxs can be
 	IdxUserThreshold = AccountIdx(UserThreshold)
+	// ReportSybilIdx is the ToIdx of the L1Txs that report the FromIdx
+	// account as sybil
+	ReportSybilIdx = AccountIdx(2)
 )
 
 var (
@@ -101,7 +141,8 @@ func (idx AccountIdx) BigInt() *big.Int {
 // Bytes returns the bytes representing the Account, in a way that each BigInt
 // is represented by 32 bytes, in spite of the BigInt could be represented in
 // less bytes (due a small big.Int), so in this way each BigInt is always 32
-// bytes and can be automatically parsed from a byte array.
+// bytes and can be automatically parsed from a byte array.  The bytes of the
+// fifth element are 0 in the AccountLeafV1 layout.
 func (a *Account) Bytes() ([32 * NAccountLeafElems]byte, error) {
 	var b [32 * NAccountLeafElems]byte
 
@@ -139,20 +180,31 @@ func (a *Account) Bytes() ([32 * NAccountLeafElems]byte, error) {
 	ayBytes = pkY.Bytes()
 	copy(b[96-len(ayBytes):96], ayBytes)
 	copy(b[108:128], a.EthAddr.Bytes())
+
+	switch a.LeafVersion {
+	case AccountLeafV1:
+	case AccountLeafV2:
+		b[151] = byte(a.LeafVersion)
+		binary.BigEndian.PutUint32(b[152:156], a.VouchCount)
+		binary.BigEndian.PutUint32(b[156:160], a.Score)
+	default:
+		return b, Wrap(fmt.Errorf("%w: %d", ErrUnknownAccountLeafVersion, a.LeafVersion))
+	}
 	return b, nil
 }
 
-// HashValue returns the value of the Account, which is the Poseidon hash of its
-// *big.Int representation
+// HashValue returns the value of the Account, which is the Poseidon hash of the
+// elements of its *big.Int representation used by its LeafVersion
 func (a *Account) HashValue() (*big.Int, error) {
 	bi, err := a.BigInts()
 	if err != nil {
 		return nil, Wrap(err)
 	}
-	return poseidon.Hash(bi[:])
+	return poseidon.Hash(bi[:a.LeafVersion.NLeafElems()])
 }
 
-// BigInts returns the [5]*big.Int, where each *big.Int is inside the Finite Field
+// BigInts returns the [5]*big.Int, where each *big.Int is inside the Finite
+// Field.  The fifth element is 0 in the AccountLeafV1 layout.
 func (a *Account) BigInts() ([NAccountLeafElems]*big.Int, error) {
 	e := [NAccountLeafElems]*big.Int{}
 
@@ -165,11 +217,14 @@ func (a *Account) BigInts() ([NAccountLeafElems]*big.Int, error) {
 	e[1] = new(big.Int).SetBytes(b[32:64])
 	e[2] = new(big.Int).SetBytes(b[64:96])
 	e[3] = new(big.Int).SetBytes(b[96:128])
+	e[4] = new(big.Int).SetBytes(b[128:160])
 
 	return e, nil
 }
 
-// AccountFromBytes returns a Account from a byte array
+// AccountFromBytes returns a Account from a byte array.  The bytes of an
+// AccountLeafV1 leaf, which only has NAccountLeafElemsV1 elements, are
+// followed by zeros.
 func AccountFromBytes(b [32 * NAccountLeafElems]byte) (*Account, error) {
 	// tokenID, err := TokenIDFromBytes(b[28:32])
 	// if err != nil {
@@ -202,6 +257,23 @@ func AccountFromBytes(b [32 * NAccountLeafElems]byte) (*Account, error) {
 		BJJ:     publicKeyComp,
 		EthAddr: ethAddr,
 	}
+	// the fifth element only contains the version, VouchCount and Score
+	if !bytes.Equal(b[128:151], make([]byte, 151-128)) { //nolint:gomnd
+		return nil, Wrap(fmt.Errorf("%s account leaf", ErrNumOverflow))
+	}
+	a.LeafVersion = AccountLeafVersion(b[151])
+	switch a.LeafVersion {
+	case AccountLeafV1:
+		if !bytes.Equal(b[152:160], make([]byte, 8)) { //nolint:gomnd
+			return nil, Wrap(fmt.Errorf("%w: V1 leaf with VouchCount or Score",
+				ErrUnknownAccountLeafVersion))
+		}
+	case AccountLeafV2:
+		a.VouchCount = binary.BigEndian.Uint32(b[152:156])
+		a.Score = binary.BigEndian.Uint32(b[156:160])
+	default:
+		return nil, Wrap(fmt.Errorf("%w: %d", ErrUnknownAccountLeafVersion, a.LeafVersion))
+	}
 	return &a, nil
 }
 
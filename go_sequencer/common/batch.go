@@ -26,6 +26,17 @@ type Batch struct {
 	GasUsed            uint64               `meddler:"gas_used"`
 	GasPrice           *big.Int             `meddler:"gas_price,bigint"`
 	EtherPriceUSD      float64              `meddler:"ether_price_usd"`
+	// ScoreAlgorithm is the scoring algorithm that produced the scores of
+	// the batch
+	ScoreAlgorithm string `meddler:"score_algorithm,zeroisnull"`
+	// AccountRoot, VouchRoot and ScoreRoot are the roots of the trees
+	// committed by StateRoot
+	AccountRoot *big.Int `meddler:"account_root,bigintnull"`
+	VouchRoot   *big.Int `meddler:"vouch_root,bigintnull"`
+	ScoreRoot   *big.Int `meddler:"score_root,bigintnull"`
+	// ScoreSeeds is the seed set of the PageRank walks active in the
+	// batch, empty if every account is a seed
+	ScoreSeeds []AccountIdx `meddler:"score_seeds,json"`
 	// ForgeL1TxsNum is optional, Only when the batch forges L1 txs. Identifier that corresponds
 	// to the group of L1 txs forged in the current batch.
 	ForgeL1TxsNum *int64   `meddler:"forge_l1_txs_num"`
@@ -42,6 +53,11 @@ func (bn BatchNum) Bytes() []byte {
 	return batchNumBytes[:]
 }
 
+// BigInt returns a *big.Int representing the BatchNum
+func (bn BatchNum) BigInt() *big.Int {
+	return big.NewInt(int64(bn))
+}
+
 // BatchNumFromBytes returns BatchNum from a []byte
 func BatchNumFromBytes(b []byte) (BatchNum, error) {
 	if len(b) != batchNumBytesLen {
@@ -62,6 +78,7 @@ type BatchData struct {
 	L2Txs            []L2Tx
 	CreatedAccounts  []Account
 	UpdatedAccounts  []AccountUpdate
+	SybilReports     []SybilReport
 	ExitTree         []ExitInfo
 	Batch            Batch
 }
@@ -29,6 +29,7 @@ type RollupData struct {
 	UpdateBucketWithdraw []BucketUpdate
 	Vars                 *RollupVariables
 	AddedTokens          []Token
+	ScoreSeedsUpdates    []ScoreSeedsUpdate
 }
 
 // NewRollupData creates an empty RollupData with the slices initialized.
@@ -16,6 +16,14 @@ var ErrIdxOverflow = errors.New("idx overflow, max value: 2**24 -1")
 // ErrScoreOverflow is used when a given score overflows the maximum capacity of the Score (2**32-1)
 var ErrScoreOverflow = errors.New("Score overflow, max value: 2**32-1")
 
+// ErrUnknownAccountLeafVersion is used when an account leaf has a layout
+// version that is not supported
+var ErrUnknownAccountLeafVersion = errors.New("unknown account leaf version")
+
+// ErrNonZeroPadding is used when the padding bytes of an encoded Vouch or
+// VouchIdx are not zero
+var ErrNonZeroPadding = errors.New("non-zero padding bytes")
+
 // ErrBatchQueueEmpty is used when the coordinator.BatchQueue.Pop() is called and has no elements
 var ErrBatchQueueEmpty = errors.New("BatchQueue empty")
 
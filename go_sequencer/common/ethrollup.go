@@ -39,6 +39,12 @@ const (
 	RollupConstMaxWithdrawalDelay = 2 * 7 * 24 * 60 * 60
 	// RollupConstExchangeMultiplier exchange multiplier
 	RollupConstExchangeMultiplier = 1e14
+	// RollupConstAccountLeafVersion is the layout of the account leafs of
+	// the protocol.  It's AccountLeafV1 because the ZKInputs don't support
+	// the AccountLeafV2 leafs yet: their VouchCount and Score change with
+	// the vouches and the score epochs, which the circuit doesn't prove as
+	// account updates.
+	RollupConstAccountLeafVersion = AccountLeafV1
 )
 
 // TODO: Check and Set the following
@@ -77,6 +83,14 @@ type BucketUpdate struct {
 	Withdrawals *big.Int `meddler:"withdrawals,bigint"`
 }
 
+// ScoreSeedsUpdate is a replacement of the seed set of the PageRank walks
+// made by the governance in an Ethereum block, which is active from the
+// batches forged in the following blocks
+type ScoreSeedsUpdate struct {
+	EthBlockNum int64        `meddler:"eth_block_num"`
+	Seeds       []AccountIdx `meddler:"seeds,json"`
+}
+
 // RollupVariables are the variables of the Rollup Smart Contract
 type RollupVariables struct {
 	EthBlockNum           int64          `meddler:"eth_block_num"`
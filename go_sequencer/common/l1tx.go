@@ -93,6 +93,8 @@ func (tx *L1Tx) SetType() error {
 			tx.Type = TxTypeDeposit
 		} else if tx.ToIdx == AccountIdx(1) {
 			tx.Type = TxTypeForceExit
+		} else if tx.ToIdx == ReportSybilIdx {
+			tx.Type = TxTypeReportSybil
 		} else if tx.ToIdx >= IdxUserThreshold {
 			if tx.DepositAmount.Int64() == int64(0) {
 				tx.Type = TxTypeForceTransfer
@@ -238,6 +240,13 @@ func L1UserTxFromBytes(b []byte) (*L1Tx, error) {
 	if err != nil {
 		return nil, Wrap(err)
 	}
+	if tx.ToIdx == ReportSybilIdx {
+		// the reports are told apart from the rest of L1UserTxs
+		// before being forged, as they don't move funds
+		if err := tx.SetType(); err != nil {
+			return nil, Wrap(err)
+		}
+	}
 
 	return tx, nil
 }
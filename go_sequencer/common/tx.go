@@ -98,6 +98,9 @@ const (
 	TxTypeCreateVouch TxType = "CreateVouch"
 	// TxTypeDeleteVouch
 	TxTypeDeleteVouch TxType = "DeleteVouch"
+	// TxTypeReportSybil represents the report of the FromIdx account as
+	// sybil by the governance, which slashes the stake of its vouchers
+	TxTypeReportSybil TxType = "ReportSybil"
 )
 
 // Tx is a struct used by the TxSelector & BatchBuilder as a generic type generated from L1Tx &
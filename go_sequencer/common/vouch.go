@@ -1,23 +1,37 @@
 package common
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"math/big"
+
+	"github.com/iden3/go-iden3-crypto/poseidon"
 )
 
 // Vouch is a struct that gives an information about vouch
 // between accounts. Each Idx is represented by fromIdx and toIdx
 // of each accounts.
 type Vouch struct {
-	Idx      VouchIdx `meddler:"idx"`
+	Idx VouchIdx `meddler:"idx"`
+	// BatchNum is the batch in which the vouch was created
 	BatchNum BatchNum `meddler:"batch_num"`
-	Value    bool     `meddler:"value"`
+	// Value is true while the vouch is active, and false once it has been
+	// deleted
+	Value bool `meddler:"value"`
+	// Amount is the stake locked from the balance of the voucher, which is
+	// the weight of the vouch while it is active
+	Amount *big.Int `meddler:"amount,bigint"`
 }
 
 type VouchIdx uint64
 
 const (
+	// NVouchLeafElems is the number of elements hashed for a leaf in the
+	// vouch tree
+	NVouchLeafElems = 2
+	// NVouchLeafBytes is the length of the byte representation of a Vouch
+	NVouchLeafBytes = 32 * NVouchLeafElems
 
 	// VouchIdxBytesLen idx bytes
 	VouchIdxBytesLen = 6
@@ -46,11 +60,26 @@ func GenerateVouchIdx(fromIdx AccountIdx, toIdx AccountIdx) VouchIdx {
 	return VouchIdx(vouchIdx)
 }
 
+// FromIdx returns the AccountIdx of the account that gives the vouch
+func (idx VouchIdx) FromIdx() AccountIdx {
+	return AccountIdx(uint64(idx) >> 32) //nolint:gomnd
+}
+
+// ToIdx returns the AccountIdx of the account that receives the vouch
+func (idx VouchIdx) ToIdx() AccountIdx {
+	return AccountIdx(uint64(idx) & 0xffffffff) //nolint:gomnd
+}
+
 func VouchIdxFromBytes(b []byte) (VouchIdx, error) {
 	if len(b) != VouchIdxBytesLen {
 		return 0, Wrap(fmt.Errorf("can not parse Idx, bytes len %d, expected %d",
 			len(b), VouchIdxBytesLen))
 	}
+	// the ToIdx takes the 4 lower bytes, and the one over its
+	// NLevelsAsBytes bytes is padding
+	if b[VouchIdxBytesLen-NLevelsAsBytes-1] != 0 {
+		return 0, Wrap(fmt.Errorf("%w: VouchIdx", ErrNonZeroPadding))
+	}
 	var idxBytes [8]byte
 	copy(idxBytes[8-2*NLevelsAsBytes:], b[:])
 	idx := binary.BigEndian.Uint64(idxBytes[:])
@@ -62,34 +91,117 @@ func (idx VouchIdx) BigInt() *big.Int {
 	return big.NewInt(int64(idx))
 }
 
-// BytesFromBool returns []byte representing the vouch's value
-func (b *Vouch) BytesFromBool() []byte {
-	if b.Value {
-		return []byte{1}
-	} else {
-		return []byte{0}
+// Weight returns the weight of the edge given by the vouch in the vouch graph,
+// which is the locked Amount while the vouch is active and 0 once deleted
+func (v *Vouch) Weight() *big.Int {
+	if !v.Value || v.Amount == nil {
+		return big.NewInt(0)
 	}
+	return new(big.Int).Set(v.Amount)
 }
 
-// BigIntFromBool returns bool from *big.Int
-func BigIntFromBool(b bool) *big.Int {
-	if b {
-		return big.NewInt(1)
-	} else {
+// DecayedWeight returns the Weight of the vouch at the batch batchNum, which
+// is halved once every halfLife batches since the batch in which the vouch was
+// created.  If halfLife is 0 the weight doesn't decay.
+func (v *Vouch) DecayedWeight(batchNum BatchNum, halfLife uint32) *big.Int {
+	weight := v.Weight()
+	if halfLife == 0 || batchNum <= v.BatchNum {
+		return weight
+	}
+	halvings := uint64(batchNum-v.BatchNum) / uint64(halfLife)
+	if halvings >= uint64(weight.BitLen()) {
 		return big.NewInt(0)
 	}
+	return weight.Rsh(weight, uint(halvings))
+}
+
+// IsExpired returns true if at the batch batchNum the vouch is active and was
+// created at least expiry batches ago.  If expiry is 0 vouches never expire.
+func (v *Vouch) IsExpired(batchNum BatchNum, expiry uint32) bool {
+	return v.Value && expiry != 0 && batchNum > v.BatchNum &&
+		uint64(batchNum-v.BatchNum) >= uint64(expiry)
 }
 
-// VouchFromBytes returns a vouch from [1]byte
-func VouchFromBytes(b [1]byte) (*Vouch, error) {
-	var value bool
-	if b[0] == 1 {
-		value = true
-	} else {
-		value = false
+// Bytes returns the bytes representing the Vouch, in a way that each BigInt
+// is represented by 32 bytes, so the Vouch can be parsed back with
+// VouchFromBytes
+func (v *Vouch) Bytes() ([NVouchLeafBytes]byte, error) {
+	var b [NVouchLeafBytes]byte
+	amount := v.Amount
+	if amount == nil {
+		amount = big.NewInt(0)
+	}
+	if amount.Sign() < 0 || len(amount.Bytes()) > maxBalanceBytes {
+		return b, Wrap(fmt.Errorf("%s Amount", ErrNumOverflow))
+	}
+	if v.Value {
+		b[23] = 1
+	}
+	copy(b[24:32], v.BatchNum.Bytes())
+	amountBytes := amount.Bytes()
+	copy(b[64-len(amountBytes):64], amountBytes)
+	return b, nil
+}
+
+// BigInts returns the [NVouchLeafElems]*big.Int of the leaf of the Vouch: the
+// weight and the creation BatchNum
+func (v *Vouch) BigInts() [NVouchLeafElems]*big.Int {
+	return [NVouchLeafElems]*big.Int{v.Weight(), v.BatchNum.BigInt()}
+}
+
+// HashValue returns the value of the leaf of the Vouch in the VouchTree, which
+// is the Poseidon hash of its weight and creation BatchNum
+func (v *Vouch) HashValue() (*big.Int, error) {
+	bi := v.BigInts()
+	return poseidon.Hash(bi[:])
+}
+
+// VouchFromBytes returns a Vouch from a byte array
+func VouchFromBytes(b [NVouchLeafBytes]byte) (*Vouch, error) {
+	if !bytes.Equal(b[:23], make([]byte, 23)) || b[23] > 1 { //nolint:gomnd
+		return nil, Wrap(fmt.Errorf("%w: Vouch", ErrNonZeroPadding))
+	}
+	// Amount is max of 192 bits (24 bytes)
+	if !bytes.Equal(b[32:40], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
+		return nil, Wrap(fmt.Errorf("%s Amount", ErrNumOverflow))
+	}
+	batchNum, err := BatchNumFromBytes(b[24:32])
+	if err != nil {
+		return nil, Wrap(err)
 	}
 	v := Vouch{
-		Value: value,
+		BatchNum: batchNum,
+		Value:    b[23] == 1,
+		Amount:   new(big.Int).SetBytes(b[40:64]),
 	}
 	return &v, nil
 }
+
+// SybilReport is an account reported as sybil by a ReportSybil L1Tx, with the
+// vouches removed because of it
+type SybilReport struct {
+	EthBlockNum int64      `meddler:"eth_block_num"`
+	BatchNum    BatchNum   `meddler:"batch_num"`
+	Idx         AccountIdx `meddler:"idx"`
+	// Slashed is the sum of the stake slashed from the vouchers of the
+	// account
+	Slashed *big.Int `meddler:"slashed,bigint"`
+	// Slashes contains the vouches received and given by the account,
+	// that have been removed
+	Slashes []VouchSlash `meddler:"-"`
+}
+
+// VouchSlash is a vouch removed because its receiver or its sender has been
+// reported as sybil
+type VouchSlash struct {
+	BatchNum BatchNum `meddler:"batch_num"`
+	// SybilIdx is the account reported as sybil
+	SybilIdx AccountIdx `meddler:"sybil_idx"`
+	FromIdx  AccountIdx `meddler:"from_idx"`
+	ToIdx    AccountIdx `meddler:"to_idx"`
+	// Slashed is the part of the stake of the vouch that has been burned
+	Slashed *big.Int `meddler:"slashed,bigint"`
+	// Unlocked is the part of the stake of the vouch that has been
+	// returned to the voucher
+	Unlocked *big.Int `meddler:"unlocked,bigint"`
+}
@@ -32,6 +32,8 @@ type ZKMetadata struct {
 	NewLastIdxRaw   AccountIdx
 	NewStateRootRaw *merkletree.Hash
 	NewExitRootRaw  *merkletree.Hash
+	// ScoreEpoch is true when the scores are recomputed in the batch
+	ScoreEpoch bool
 }
 
 // ZKInputs represents the inputs that will be used to generate the zkSNARK
@@ -48,8 +50,15 @@ type ZKInputs struct {
 	// inputs for final `hashGlobalInputs`
 	// OldLastIdx is the last index assigned to an account
 	OldLastIdx *big.Int `json:"oldLastIdx"` // uint64 (max nLevels bits)
-	// OldStateRoot is the current state merkle tree root
+	// OldStateRoot is the current state root, the Poseidon hash of the
+	// account, vouch and score merkle tree roots
 	OldStateRoot *big.Int `json:"oldStateRoot"` // Hash
+	// OldScoreRoot is the score merkle tree root before the batch
+	OldScoreRoot *big.Int `json:"oldScoreRoot"` // Hash
+	// NewScoreRoot is the score merkle tree root after the batch, which
+	// differs from OldScoreRoot in the score epochs and in the batches
+	// with a ReportSybil L1Tx
+	NewScoreRoot *big.Int `json:"newScoreRoot"` // Hash
 	// GlobalChainID is the blockchain ID (0 for Ethereum mainnet). This
 	// value can be get from the smart contract.
 	GlobalChainID *big.Int `json:"globalChainID"` // uint16
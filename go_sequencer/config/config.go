@@ -278,8 +278,25 @@ type Node struct {
 	StateDB struct {
 		// Path where the synchronizer StateDB is stored
 		Path string `validate:"required" env:"TONNODE_STATEDB_PATH"`
-		// Keep is the number of checkpoints to keep
+		// Keep is the number of checkpoints to keep, not counting the
+		// archival ones
 		Keep int `validate:"required,gte=128" env:"TONNODE_STATEDB_KEEP"`
+		// Retention limits the checkpoints kept besides Keep, see
+		// kvdb.Retention
+		Retention struct {
+			// MaxAge is the maximum age in batches of the
+			// checkpoints.  If 0, there's no limit.
+			MaxAge int `validate:"omitempty,gte=128" env:"TONNODE_STATEDB_RETENTION_MAXAGE"`
+			// MaxBytes is the maximum disk size of the checkpoints.
+			// It can leave less checkpoints than needed to handle
+			// reorgs.  If 0, there's no limit.
+			MaxBytes int64 `validate:"gte=0" env:"TONNODE_STATEDB_RETENTION_MAXBYTES"`
+			// KeepEvery keeps forever the checkpoints of the
+			// batches multiple of it.  It can't be changed once
+			// there are archival checkpoints.  If 0, there are no
+			// archival checkpoints.
+			KeepEvery int `validate:"gte=0" env:"TONNODE_STATEDB_RETENTION_KEEPEVERY"`
+		}
 	} `validate:"required"`
 	PostgreSQL PostgreSQL `validate:"required"`
 	Web3       struct {
@@ -309,6 +326,100 @@ type Node struct {
 		// Rollup is the address of the Hermez.sol smart contract
 		Rollup ethCommon.Address `validate:"required" env:"TONNODE_SMARTCONTRACTS_ROLLUP"`
 	} `validate:"required"`
+	Scoring struct {
+		// Algorithm is the algorithm used to compute the scores of the
+		// accounts, one of "pagerank" or "conductance".  It must match
+		// the circuit used to prove the scores.  The conductance
+		// circuit scores at most Conductance.NumVerts accounts, so it
+		// can only be used with EpochBatches 0, to generate witnesses
+		Algorithm string `validate:"required,oneof=pagerank conductance" env:"TONNODE_SCORING_ALGORITHM"`
+		// EpochBatches is the number of batches between score epochs,
+		// the batches in which the scores are recomputed and updated
+		// in the ScoreTree.  If 0, the scores are never recomputed.
+		// All the nodes of the network must use the same value
+		EpochBatches uint32 `validate:"gte=0" env:"TONNODE_SCORING_EPOCHBATCHES"`
+		// VouchHalfLife is the number of batches after which the
+		// weight of a vouch in the vouch graph is halved.  If 0, the
+		// weights don't decay.  All the nodes of the network must use
+		// the same value
+		VouchHalfLife uint32 `validate:"gte=0" env:"TONNODE_SCORING_VOUCHHALFLIFE"`
+		// VouchUnit is the stake, in wei, of a vouch with weight 1 in
+		// the vouch graph.  The weights given by each account are then
+		// scaled down to the maximum degree accepted by the circuit.
+		// If not set, the weight is the stake.  All the nodes of the
+		// network must use the same value
+		VouchUnit *big.Int `env:"TONNODE_SCORING_VOUCHUNIT"`
+		// Seeds is the initial seed set of the PageRank walks, the
+		// accounts toward which the scores are personalized, used
+		// until the governance updates it with an UpdateScoreSeeds
+		// event.  If empty, every account is a seed.  It must be empty
+		// until the circuit supports seed sets, see
+		// scoring.ErrSeedsUnsupported.  All the nodes of the network
+		// must use the same value
+		Seeds []common.AccountIdx `env:"TONNODE_SCORING_SEEDS" envSeparator:","`
+		// Incremental makes the synchronizer recompute in the score
+		// epochs only the scores of the accounts affected by the
+		// vouches changed since the previous epoch.  Only supported by
+		// the "pagerank" algorithm
+		Incremental bool `env:"TONNODE_SCORING_INCREMENTAL"`
+		// IncrementalCheck compares the incremental scores of every
+		// epoch with a full recompute, stopping the sync if they
+		// differ
+		IncrementalCheck bool `env:"TONNODE_SCORING_INCREMENTALCHECK"`
+		// PageRank contains the parameters of the personalized
+		// PageRank circuit, used when Algorithm is "pagerank"
+		PageRank struct {
+			// P is the proportion (in tenths) of the residual of a
+			// vertex that is moved to its rank at each step
+			P int64 `validate:"gte=0,lte=10" env:"TONNODE_SCORING_PAGERANK_P"`
+			// Q multiplies the degree of a vertex to obtain the
+			// threshold that its residual has to exceed
+			Q int64 `validate:"gte=0" env:"TONNODE_SCORING_PAGERANK_Q"`
+			// NumSteps is the number of push steps of each walk
+			NumSteps int `validate:"gte=0" env:"TONNODE_SCORING_PAGERANK_NUMSTEPS"`
+			// ComparatorBits is the number of bits of the circuit
+			// comparators
+			ComparatorBits uint `validate:"gte=0" env:"TONNODE_SCORING_PAGERANK_COMPARATORBITS"`
+		}
+		// Conductance contains the parameters of the subset
+		// conductance circuit, used when Algorithm is "conductance"
+		Conductance struct {
+			// NumVerts is the maximum number of vertices of the
+			// circuit
+			NumVerts int `validate:"gte=0" env:"TONNODE_SCORING_CONDUCTANCE_NUMVERTS"`
+			// ComparatorBits is the number of bits of the circuit
+			// comparators
+			ComparatorBits uint `validate:"gte=0" env:"TONNODE_SCORING_CONDUCTANCE_COMPARATORBITS"`
+		}
+	} `validate:"required"`
+	// Vouches contains the protocol rules that limit, expire and slash the
+	// vouches, see txprocessor.VouchRules
+	Vouches struct {
+		// VouchExpiry is the number of batches after which a vouch is
+		// removed, unlocking its stake.  If 0, the vouches never
+		// expire.  All the nodes of the network must use the same
+		// value
+		VouchExpiry uint32 `validate:"gte=0" env:"TONNODE_VOUCHES_VOUCHEXPIRY"`
+		// SybilReporter is the address, usually the governance, whose
+		// ReportSybil L1Txs are applied.  If it is the zero address,
+		// every report is ignored.  All the nodes of the network must
+		// use the same value
+		SybilReporter ethCommon.Address `env:"TONNODE_VOUCHES_SYBILREPORTER"`
+		// SybilSlashPerMille is the part, in thousandths, of the stake
+		// of each vouch received by an account reported as sybil that
+		// is slashed, the rest being unlocked to the voucher.  All the
+		// nodes of the network must use the same value
+		SybilSlashPerMille uint32 `validate:"lte=1000" env:"TONNODE_VOUCHES_SYBILSLASHPERMILLE"`
+		// MaxOutVouches is the maximum number of active vouches that
+		// an account can give, 0 meaning no limit.  All the nodes of
+		// the network must use the same value
+		MaxOutVouches uint32 `validate:"gte=0" env:"TONNODE_VOUCHES_MAXOUTVOUCHES"`
+		// VouchCooldown is the minimum number of batches between two
+		// changes (vouch or unvouch) of the vouch of the same pair of
+		// accounts, 0 meaning no cooldown.  All the nodes of the
+		// network must use the same value
+		VouchCooldown uint32 `validate:"gte=0" env:"TONNODE_VOUCHES_VOUCHCOOLDOWN"`
+	} `validate:"required"`
 	API                  APIConfigParameters                  `validate:"required"`
 	RecommendedFeePolicy stateapiupdater.RecommendedFeePolicy `validate:"required"`
 	Debug                NodeDebug                            `validate:"required"`
@@ -0,0 +1,41 @@
+package historydb
+
+import (
+	"fmt"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+
+	"github.com/iden3/go-merkletree"
+)
+
+// VerifyScoreClaim checks the ScoreClaim against the roots stored for its
+// batch: the account, vouch and score roots must hash to the stored
+// StateRoot, and the claim must prove the score of the account against them
+// (see statedb.VerifyScoreClaim).  The batches synchronized before the roots
+// of the trees were stored can not be checked.
+func (hdb *HistoryDB) VerifyScoreClaim(claim *statedb.ScoreClaim) error {
+	batch, err := hdb.GetBatch(claim.BatchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if batch.AccountRoot == nil || batch.VouchRoot == nil || batch.ScoreRoot == nil ||
+		batch.StateRoot == nil {
+		return common.Wrap(fmt.Errorf("%w: the roots of batch %d are not stored",
+			statedb.ErrInvalidScoreClaim, claim.BatchNum))
+	}
+	roots := statedb.TreeRoots{
+		Account: merkletree.NewHashFromBigInt(batch.AccountRoot),
+		Vouch:   merkletree.NewHashFromBigInt(batch.VouchRoot),
+		Score:   merkletree.NewHashFromBigInt(batch.ScoreRoot),
+	}
+	stateRoot, err := roots.StateRoot()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if stateRoot.Cmp(batch.StateRoot) != 0 {
+		return common.Wrap(fmt.Errorf("%w: the roots of batch %d hash to %s instead of "+
+			"the stored StateRoot %s", statedb.ErrInvalidScoreClaim, claim.BatchNum,
+			stateRoot, batch.StateRoot))
+	}
+	return common.Wrap(statedb.VerifyScoreClaim(claim, roots))
+}
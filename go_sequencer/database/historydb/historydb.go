@@ -1,6 +1,7 @@
 package historydb
 
 import (
+	"database/sql"
 	"math/big"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/database"
@@ -128,12 +129,91 @@ func (hdb *HistoryDB) GetLastBatch() (*common.Batch, error) {
 		hdb.dbRead, &batch, `SELECT batch.batch_num, batch.eth_block_num, batch.forger_addr,
 		batch.fees_collected, batch.fee_idxs_coordinator, batch.state_root,
 		batch.num_accounts, batch.last_idx, batch.exit_root, batch.forge_l1_txs_num,
-		batch.slot_num, batch.total_fees_usd, batch.gas_price, batch.gas_used, batch.ether_price_usd
+		batch.slot_num, batch.total_fees_usd, batch.gas_price, batch.gas_used, batch.ether_price_usd,
+		batch.score_algorithm, batch.account_root, batch.vouch_root, batch.score_root,
+		batch.score_seeds
 		FROM batch ORDER BY batch_num DESC LIMIT 1;`,
 	)
 	return &batch, common.Wrap(err)
 }
 
+// AddScoreSeedsUpdates insert the updates of the seed set into the DB
+func (hdb *HistoryDB) AddScoreSeedsUpdates(updates []common.ScoreSeedsUpdate) error {
+	return common.Wrap(hdb.addScoreSeedsUpdates(hdb.dbWrite, updates))
+}
+func (hdb *HistoryDB) addScoreSeedsUpdates(d meddler.DB, updates []common.ScoreSeedsUpdate) error {
+	for i := range updates {
+		if err := meddler.Insert(d, "score_seeds_update", &updates[i]); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// AddSybilReports inserts the sybil reports and their removed vouches into
+// the DB
+func (hdb *HistoryDB) AddSybilReports(reports []common.SybilReport) error {
+	return common.Wrap(hdb.addSybilReports(hdb.dbWrite, reports))
+}
+func (hdb *HistoryDB) addSybilReports(d meddler.DB, reports []common.SybilReport) error {
+	for i := range reports {
+		if err := meddler.Insert(d, "sybil_report", &reports[i]); err != nil {
+			return common.Wrap(err)
+		}
+		for j := range reports[i].Slashes {
+			if err := meddler.Insert(d, "vouch_slash", &reports[i].Slashes[j]); err != nil {
+				return common.Wrap(err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetSybilReport returns the report of the account idx as sybil, with the
+// vouches removed by it.  If the account has not been reported
+// sql.ErrNoRows is returned.
+func (hdb *HistoryDB) GetSybilReport(idx common.AccountIdx) (*common.SybilReport, error) {
+	var report common.SybilReport
+	if err := meddler.QueryRow(
+		hdb.dbRead, &report, `SELECT eth_block_num, batch_num, idx, slashed
+		FROM sybil_report WHERE idx = $1;`, idx,
+	); err != nil {
+		return nil, common.Wrap(err)
+	}
+	var slashes []*common.VouchSlash
+	if err := meddler.QueryAll(
+		hdb.dbRead, &slashes, `SELECT batch_num, sybil_idx, from_idx, to_idx, slashed, unlocked
+		FROM vouch_slash WHERE sybil_idx = $1 ORDER BY item_id;`, idx,
+	); err != nil {
+		return nil, common.Wrap(err)
+	}
+	report.Slashes = database.SlicePtrsToSlice(slashes).([]common.VouchSlash)
+	return &report, nil
+}
+
+// GetLastScoreSeedsUpdate returns the last update of the seed set.  If the
+// seed set has never been updated sql.ErrNoRows is returned.
+func (hdb *HistoryDB) GetLastScoreSeedsUpdate() (*common.ScoreSeedsUpdate, error) {
+	var update common.ScoreSeedsUpdate
+	err := meddler.QueryRow(
+		hdb.dbRead, &update, `SELECT eth_block_num, seeds FROM score_seeds_update
+		ORDER BY item_id DESC LIMIT 1;`,
+	)
+	return &update, common.Wrap(err)
+}
+
+// GetScoreSeeds returns the seed set of the last update, or defaultSeeds if
+// the seed set has never been updated
+func (hdb *HistoryDB) GetScoreSeeds(defaultSeeds []common.AccountIdx) ([]common.AccountIdx, error) {
+	update, err := hdb.GetLastScoreSeedsUpdate()
+	if common.Unwrap(err) == sql.ErrNoRows {
+		return defaultSeeds, nil
+	} else if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return update.Seeds, nil
+}
+
 // GetLastL1BatchBlockNum returns the blockNum of the latest forged l1Batch
 func (hdb *HistoryDB) GetLastL1BatchBlockNum() (int64, error) {
 	row := hdb.dbRead.QueryRow(`SELECT eth_block_num FROM batch
@@ -191,7 +271,8 @@ func (hdb *HistoryDB) GetAllBatches() ([]common.Batch, error) {
 		hdb.dbRead, &batches,
 		`SELECT batch.batch_num, batch.eth_block_num, batch.forger_addr, batch.fees_collected,
 		 batch.fee_idxs_coordinator, batch.state_root, batch.num_accounts, batch.last_idx, batch.exit_root,
-		 batch.forge_l1_txs_num, batch.slot_num, batch.total_fees_usd, batch.eth_tx_hash FROM batch
+		 batch.forge_l1_txs_num, batch.slot_num, batch.total_fees_usd, batch.eth_tx_hash, batch.score_algorithm,
+		 batch.account_root, batch.vouch_root, batch.score_root, batch.score_seeds FROM batch
 		 ORDER BY item_id;`,
 	)
 	return database.SlicePtrsToSlice(batches).([]common.Batch), common.Wrap(err)
@@ -203,8 +284,8 @@ func (hdb *HistoryDB) GetBatches(from, to common.BatchNum) ([]common.Batch, erro
 	err := meddler.QueryAll(
 		hdb.dbRead, &batches,
 		`SELECT batch_num, eth_block_num, forger_addr, fees_collected, fee_idxs_coordinator, 
-		state_root, num_accounts, last_idx, exit_root, forge_l1_txs_num, slot_num, total_fees_usd, gas_price, gas_used, ether_price_usd 
-		FROM batch WHERE $1 <= batch_num AND batch_num < $2 ORDER BY batch_num;`,
+		state_root, num_accounts, last_idx, exit_root, forge_l1_txs_num, slot_num, total_fees_usd, gas_price, gas_used, ether_price_usd,
+		score_algorithm, account_root, vouch_root, score_root, score_seeds FROM batch WHERE $1 <= batch_num AND batch_num < $2 ORDER BY batch_num;`,
 		from, to,
 	)
 	return database.SlicePtrsToSlice(batches).([]common.Batch), common.Wrap(err)
@@ -224,7 +305,9 @@ func (hdb *HistoryDB) GetBatch(batchNum common.BatchNum) (*common.Batch, error)
 		hdb.dbRead, &batch, `SELECT batch.batch_num, batch.eth_block_num, batch.forger_addr,
 		batch.fees_collected, batch.fee_idxs_coordinator, batch.state_root,
 		batch.num_accounts, batch.last_idx, batch.exit_root, batch.forge_l1_txs_num,
-		batch.slot_num, batch.total_fees_usd, batch.gas_price, batch.gas_used, batch.ether_price_usd
+		batch.slot_num, batch.total_fees_usd, batch.gas_price, batch.gas_used, batch.ether_price_usd,
+		batch.score_algorithm, batch.account_root, batch.vouch_root, batch.score_root,
+		batch.score_seeds
 		FROM batch WHERE batch_num = $1;`,
 		batchNum,
 	)
@@ -301,6 +384,21 @@ func (hdb *HistoryDB) GetAllAccounts() ([]common.Account, error) {
 	return database.SlicePtrsToSlice(accs).([]common.Account), common.Wrap(err)
 }
 
+// GetAccountCreations returns the creation metadata of the accounts created
+// up to the batch batchNum, ordered by idx
+func (hdb *HistoryDB) GetAccountCreations(batchNum common.BatchNum) ([]AccountCreation, error) {
+	var creations []*AccountCreation
+	err := meddler.QueryAll(
+		hdb.dbRead, &creations,
+		`SELECT account.idx, account.batch_num, account.eth_addr, tx.to_forge_l1_txs_num
+		FROM account LEFT JOIN tx ON tx.effective_from_idx = account.idx
+		AND tx.is_l1 AND tx.type = $1
+		WHERE account.batch_num <= $2 ORDER BY account.idx;`,
+		common.TxTypeCreateAccountDeposit, batchNum,
+	)
+	return database.SlicePtrsToSlice(creations).([]AccountCreation), common.Wrap(err)
+}
+
 // AddAccountUpdates inserts accUpdates into the DB
 func (hdb *HistoryDB) AddAccountUpdates(accUpdates []common.AccountUpdate) error {
 	return common.Wrap(hdb.addAccountUpdates(hdb.dbWrite, accUpdates))
@@ -665,6 +763,11 @@ func (hdb *HistoryDB) AddBlockSCData(blockData *common.BlockData) (err error) {
 			return common.Wrap(err)
 		}
 
+		// Add the sybil reports, after the accounts that they target
+		if err := hdb.addSybilReports(txn, batch.SybilReports); err != nil {
+			return common.Wrap(err)
+		}
+
 		// // Set the EffectiveAmount and EffectiveDepositAmount of all the
 		// // L1UserTxs that have been forged in this batch
 		// if err = hdb.setExtraInfoForgedL1UserTxs(txn, batch.L1UserTxs); err != nil {
@@ -700,6 +803,11 @@ func (hdb *HistoryDB) AddBlockSCData(blockData *common.BlockData) (err error) {
 		}
 	}
 
+	// Add the seed set updates
+	if err := hdb.addScoreSeedsUpdates(txn, blockData.Rollup.ScoreSeedsUpdates); err != nil {
+		return common.Wrap(err)
+	}
+
 	// Set SC Vars if there was an update
 	if blockData.Rollup.Vars != nil {
 		if err := hdb.setRollupVars(txn, blockData.Rollup.Vars); err != nil {
@@ -2,12 +2,14 @@ package historydb
 
 import (
 	"database/sql"
+	"errors"
 	"math/big"
 	"os"
 	"testing"
 	"time"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/database"
+	"tokamak-sybil-resistance/database/statedb"
 	"tokamak-sybil-resistance/test/til"
 
 	ethCommon "github.com/ethereum/go-ethereum/common"
@@ -203,6 +205,186 @@ func TestBatches(t *testing.T) {
 	assert.Equal(t, sql.ErrNoRows, common.Unwrap(err))
 }
 
+func TestScoreSeedsUpdates(t *testing.T) {
+	// Reset DB
+	WipeDB(historyDB.DB())
+	set := `
+		Type: Blockchain
+		> block // blockNum=2
+		> block // blockNum=3
+	`
+	tc := til.NewContext(uint16(0), 1)
+	blocks, err := tc.GenerateBlocks(set)
+	require.NoError(t, err)
+	for i := range blocks {
+		require.NoError(t, historyDB.AddBlock(&blocks[i].Block))
+	}
+
+	// without updates there is no seed set
+	_, err = historyDB.GetLastScoreSeedsUpdate()
+	assert.Equal(t, sql.ErrNoRows, common.Unwrap(err))
+	seeds, err := historyDB.GetScoreSeeds([]common.AccountIdx{300})
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{300}, seeds)
+
+	updates := []common.ScoreSeedsUpdate{
+		{EthBlockNum: 2, Seeds: []common.AccountIdx{256, 257}},
+		{EthBlockNum: 3, Seeds: []common.AccountIdx{258}},
+	}
+	require.NoError(t, historyDB.AddScoreSeedsUpdates(updates))
+	update, err := historyDB.GetLastScoreSeedsUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, &updates[1], update)
+	seeds, err = historyDB.GetScoreSeeds([]common.AccountIdx{300})
+	require.NoError(t, err)
+	assert.Equal(t, updates[1].Seeds, seeds)
+
+	// the updates of the blocks discarded by a reorg are deleted
+	require.NoError(t, historyDB.Reorg(2))
+	update, err = historyDB.GetLastScoreSeedsUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, &updates[0], update)
+}
+
+func TestSybilReports(t *testing.T) {
+	// Reset DB
+	WipeDB(historyDB.DB())
+	set := `
+		Type: Blockchain
+
+		CreateAccountDeposit A: 2000
+		CreateAccountDeposit B: 1000
+		> batchL1
+		> batchL1
+		> block // blockNum=2
+		> batch
+		> block // blockNum=3
+	`
+	tc := til.NewContext(uint16(0), common.RollupConstMaxL1UserTx)
+	tilCfgExtra := til.ConfigExtra{
+		BootCoordAddr: ethCommon.HexToAddress("0xE39fEc6224708f0772D2A74fd3f9055A90E0A9f2"),
+		CoordUser:     "A",
+	}
+	blocks, err := tc.GenerateBlocks(set)
+	require.NoError(t, err)
+	require.NoError(t, tc.FillBlocksExtra(blocks, &tilCfgExtra))
+	for i := range blocks {
+		require.NoError(t, historyDB.AddBlock(&blocks[i].Block))
+		for j := range blocks[i].Rollup.Batches {
+			batch := &blocks[i].Rollup.Batches[j]
+			batch.Batch.GasPrice = big.NewInt(0)
+			require.NoError(t, historyDB.AddBatch(&batch.Batch))
+			require.NoError(t, historyDB.AddAccounts(batch.CreatedAccounts))
+		}
+	}
+
+	// A has not been reported
+	_, err = historyDB.GetSybilReport(256)
+	assert.Equal(t, sql.ErrNoRows, common.Unwrap(err))
+
+	report := common.SybilReport{
+		EthBlockNum: 3,
+		BatchNum:    3,
+		Idx:         256,
+		Slashed:     big.NewInt(50),
+		Slashes: []common.VouchSlash{
+			{BatchNum: 3, SybilIdx: 256, FromIdx: 257, ToIdx: 256,
+				Slashed: big.NewInt(50), Unlocked: big.NewInt(50)},
+			{BatchNum: 3, SybilIdx: 256, FromIdx: 256, ToIdx: 257,
+				Slashed: big.NewInt(0), Unlocked: big.NewInt(100)},
+		},
+	}
+	require.NoError(t, historyDB.AddSybilReports([]common.SybilReport{report}))
+	fetched, err := historyDB.GetSybilReport(256)
+	require.NoError(t, err)
+	assert.Equal(t, &report, fetched)
+
+	// the reports of the batches discarded by a reorg are deleted
+	require.NoError(t, historyDB.Reorg(2))
+	_, err = historyDB.GetSybilReport(256)
+	assert.Equal(t, sql.ErrNoRows, common.Unwrap(err))
+}
+
+func TestVerifyScoreClaim(t *testing.T) {
+	// Reset DB
+	WipeDB(historyDB.DB())
+
+	// the state of batch 1, whose roots are stored like the synchronizer
+	// does
+	sdb, err := statedb.NewStateDB(statedb.Config{Keep: 128, Type: statedb.TypeSynchronizer,
+		NLevels: 32, InMemory: true})
+	require.NoError(t, err)
+	defer sdb.Close()
+	_, err = sdb.CreateAccount(256, &common.Account{Idx: 256, Balance: big.NewInt(2000),
+		EthAddr: ethCommon.BigToAddress(big.NewInt(1))})
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(256, &common.Score{Idx: 256, Value: 7})
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+	stateRoot, err := sdb.StateRoot()
+	require.NoError(t, err)
+
+	set := `
+		Type: Blockchain
+
+		CreateAccountDeposit A: 2000
+		> batchL1
+		> batchL1
+		> block // blockNum=2
+		> batch
+		> block // blockNum=3
+	`
+	tc := til.NewContext(uint16(0), common.RollupConstMaxL1UserTx)
+	tilCfgExtra := til.ConfigExtra{
+		BootCoordAddr: ethCommon.HexToAddress("0xE39fEc6224708f0772D2A74fd3f9055A90E0A9f2"),
+		CoordUser:     "A",
+	}
+	blocks, err := tc.GenerateBlocks(set)
+	require.NoError(t, err)
+	require.NoError(t, tc.FillBlocksExtra(blocks, &tilCfgExtra))
+	for i := range blocks {
+		require.NoError(t, historyDB.AddBlock(&blocks[i].Block))
+		for j := range blocks[i].Rollup.Batches {
+			batch := &blocks[i].Rollup.Batches[j]
+			batch.Batch.GasPrice = big.NewInt(0)
+			switch batch.Batch.BatchNum {
+			case 1:
+				batch.Batch.StateRoot = stateRoot
+			case 2:
+				// the stored roots don't hash to the StateRoot
+				batch.Batch.StateRoot = big.NewInt(1)
+			}
+			if batch.Batch.BatchNum != 3 {
+				batch.Batch.AccountRoot = roots.Account.BigInt()
+				batch.Batch.VouchRoot = roots.Vouch.BigInt()
+				batch.Batch.ScoreRoot = roots.Score.BigInt()
+			}
+			require.NoError(t, historyDB.AddBatch(&batch.Batch))
+		}
+	}
+
+	claim, err := sdb.NewScoreClaim(256)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(1), claim.BatchNum)
+	require.NoError(t, historyDB.VerifyScoreClaim(claim))
+
+	// a claimed score that doesn't match the proof
+	claim.Score = 8
+	assert.True(t, errors.Is(historyDB.VerifyScoreClaim(claim), statedb.ErrInvalidScoreClaim))
+	claim.Score = 7
+
+	// the roots of batch 2 don't match its StateRoot, and the ones of
+	// batch 3 are not stored
+	for _, batchNum := range []common.BatchNum{2, 3} {
+		claim.BatchNum = batchNum
+		assert.True(t, errors.Is(historyDB.VerifyScoreClaim(claim),
+			statedb.ErrInvalidScoreClaim))
+	}
+	claim.BatchNum = 4
+	assert.Equal(t, sql.ErrNoRows, common.Unwrap(historyDB.VerifyScoreClaim(claim)))
+}
+
 func assertEqualBlock(t *testing.T, expected *common.Block, actual *common.Block) {
 	assert.Equal(t, expected.Num, actual.Num)
 	assert.Equal(t, expected.Hash, actual.Hash)
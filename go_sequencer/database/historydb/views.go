@@ -41,6 +41,16 @@ type txWrite struct {
 	Nonce *common.Nonce       `meddler:"nonce"`
 }
 
+// AccountCreation contains the metadata of the creation of an account
+type AccountCreation struct {
+	Idx      common.AccountIdx `meddler:"idx"`
+	BatchNum common.BatchNum   `meddler:"batch_num"`
+	EthAddr  ethCommon.Address `meddler:"eth_addr"`
+	// ToForgeL1TxsNum is the L1 queue of the CreateAccountDeposit that
+	// created the account, nil if it wasn't created by an L1 user tx
+	ToForgeL1TxsNum *int64 `meddler:"to_forge_l1_txs_num"`
+}
+
 // TokenWithUSD add USD info to common.Token
 type TokenWithUSD struct {
 	ItemID      uint64            `json:"itemId" meddler:"item_id"`
@@ -116,11 +126,16 @@ type BatchAPI struct {
 	CollectedFeesAPI apitypes.CollectedFeesAPI   `json:"collectedFees" meddler:"-"`
 	TotalFeesUSD     *float64                    `json:"historicTotalCollectedFeesUSD" meddler:"total_fees_usd"`
 	StateRoot        apitypes.BigIntStr          `json:"stateRoot" meddler:"state_root"`
+	AccountRoot      *apitypes.BigIntStr         `json:"accountRoot" meddler:"account_root"`
+	VouchRoot        *apitypes.BigIntStr         `json:"vouchRoot" meddler:"vouch_root"`
+	ScoreRoot        *apitypes.BigIntStr         `json:"scoreRoot" meddler:"score_root"`
+	ScoreSeeds       []common.AccountIdx         `json:"scoreSeeds" meddler:"score_seeds,json"`
 	NumAccounts      int                         `json:"numAccounts" meddler:"num_accounts"`
 	ExitRoot         apitypes.BigIntStr          `json:"exitRoot" meddler:"exit_root"`
 	ForgeL1TxsNum    *int64                      `json:"forgeL1TransactionsNum" meddler:"forge_l1_txs_num"`
 	SlotNum          int64                       `json:"slotNum" meddler:"slot_num"`
 	ForgedTxs        int                         `json:"forgedTransactions" meddler:"forged_txs"`
+	ScoreAlgorithm   *string                     `json:"scoreAlgorithm" meddler:"score_algorithm"`
 	TotalItems       uint64                      `json:"-" meddler:"total_items"`
 	FirstItem        uint64                      `json:"-" meddler:"first_item"`
 	LastItem         uint64                      `json:"-" meddler:"last_item"`
@@ -0,0 +1,308 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/log"
+
+	pebbledb "github.com/cockroachdb/pebble"
+	"github.com/iden3/go-merkletree/db"
+	"github.com/iden3/go-merkletree/db/pebble"
+)
+
+// pebbleLockFile is the lock file of a pebble db, which is not copied with the
+// db
+const pebbleLockFile = "LOCK"
+
+// backend is the storage of the current db and of the checkpoints of a KVDB.
+// The KVDB uses a diskBackend, or a memoryBackend if Config.InMemory is set.
+type backend interface {
+	// current returns the current db
+	current() db.Storage
+	// openCurrent replaces the current db by a copy of the checkpoint at
+	// batchNum, or by an empty db if batchNum is 0
+	openCurrent(batchNum common.BatchNum) error
+	// closeCurrent closes the current db
+	closeCurrent()
+	// write writes atomically in the current db the values of the entries
+	// in order, deleting the keys of the entries not found
+	write(entries []journalEntry) error
+	// checkpoint stores a copy of the current db as the checkpoint at
+	// batchNum, replacing it if it exists
+	checkpoint(batchNum common.BatchNum) error
+	// checkpoints returns the batchNums of the checkpoints, unsorted
+	checkpoints() ([]int, error)
+	// hasCheckpoint returns true if the checkpoint at batchNum exists
+	hasCheckpoint(batchNum common.BatchNum) (bool, error)
+	// deleteCheckpoint removes the checkpoint at batchNum
+	deleteCheckpoint(batchNum common.BatchNum) error
+	// openCheckpoint opens the checkpoint at batchNum read-only
+	openCheckpoint(batchNum common.BatchNum) (db.Storage, error)
+	// copyCheckpoint copies the checkpoint at batchNum to a pebble db in
+	// the dest folder, also while it's opened by views
+	copyCheckpoint(batchNum common.BatchNum, dest string) error
+	// loadCheckpoint stores a copy of the checkpoint of the view, of
+	// another KVDB, as the checkpoint at the same batchNum
+	loadCheckpoint(view *View) error
+	// usage returns the size of the checkpoint at batchNum
+	usage(batchNum common.BatchNum) (checkpointUsage, error)
+}
+
+// diskBackend stores the current db and the checkpoints as pebble dbs in the
+// subfolders PathCurrent and PathBatchNum<batchNum> of path
+type diskBackend struct {
+	path string
+	sto  *pebble.Storage
+}
+
+// newDiskBackend returns a diskBackend with the current db opened
+func newDiskBackend(dir string) (*diskBackend, error) {
+	sto, err := pebble.NewPebbleStorage(path.Join(dir, PathCurrent), false)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &diskBackend{path: dir, sto: sto}, nil
+}
+
+// checkpointPath returns the folder of the checkpoint at batchNum
+func (b *diskBackend) checkpointPath(batchNum common.BatchNum) string {
+	return path.Join(b.path, fmt.Sprintf("%s%d", PathBatchNum, batchNum))
+}
+
+func (b *diskBackend) current() db.Storage {
+	return b.sto
+}
+
+func (b *diskBackend) openCurrent(batchNum common.BatchNum) error {
+	currentPath := path.Join(b.path, PathCurrent)
+	b.closeCurrent()
+	// remove 'current'
+	if err := os.RemoveAll(currentPath); err != nil {
+		return common.Wrap(err)
+	}
+	if batchNum != 0 {
+		// copy 'batchNum' to 'current'
+		if err := b.copyCheckpoint(batchNum, currentPath); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	sto, err := pebble.NewPebbleStorage(currentPath, false)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	b.sto = sto
+	return nil
+}
+
+func (b *diskBackend) closeCurrent() {
+	if b.sto != nil {
+		b.sto.Close()
+		b.sto = nil
+	}
+}
+
+func (b *diskBackend) write(entries []journalEntry) error {
+	batch := b.sto.Pebble().NewBatch()
+	for i := range entries {
+		var err error
+		if entries[i].found {
+			err = batch.Set(entries[i].key, entries[i].value, nil)
+		} else {
+			err = batch.Delete(entries[i].key, nil)
+		}
+		if err != nil {
+			return common.Wrap(err)
+		}
+	}
+	return common.Wrap(batch.Commit(nil))
+}
+
+func (b *diskBackend) checkpoint(batchNum common.BatchNum) error {
+	checkpointPath := b.checkpointPath(batchNum)
+	// if checkpoint BatchNum already exist in disk, delete it
+	if err := os.RemoveAll(checkpointPath); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(b.sto.Pebble().Checkpoint(checkpointPath))
+}
+
+func (b *diskBackend) checkpoints() ([]int, error) {
+	files, err := os.ReadDir(b.path)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	checkpoints := []int{}
+	var checkpoint int
+	pattern := fmt.Sprintf("%s%%d", PathBatchNum)
+	for _, file := range files {
+		fileName := file.Name()
+		if file.IsDir() && strings.HasPrefix(fileName, PathBatchNum) {
+			if _, err := fmt.Sscanf(fileName, pattern, &checkpoint); err != nil {
+				return nil, common.Wrap(err)
+			}
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+	return checkpoints, nil
+}
+
+func (b *diskBackend) hasCheckpoint(batchNum common.BatchNum) (bool, error) {
+	if _, err := os.Stat(b.checkpointPath(batchNum)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, common.Wrap(err)
+	}
+	return true, nil
+}
+
+func (b *diskBackend) deleteCheckpoint(batchNum common.BatchNum) error {
+	return common.Wrap(os.RemoveAll(b.checkpointPath(batchNum)))
+}
+
+func (b *diskBackend) openCheckpoint(batchNum common.BatchNum) (db.Storage, error) {
+	return openPebbleReadOnly(b.checkpointPath(batchNum))
+}
+
+func (b *diskBackend) loadCheckpoint(view *View) error {
+	return common.Wrap(view.kvdb.MakeCheckpointFromTo(view.batchNum,
+		b.checkpointPath(view.batchNum)))
+}
+
+// copyCheckpoint copies the files of the checkpoint, which are not modified
+// once the checkpoint is made and are only opened read-only, so the copy is
+// consistent also while views have it opened
+func (b *diskBackend) copyCheckpoint(batchNum common.BatchNum, dest string) error {
+	return copyPebbleFiles(b.checkpointPath(batchNum), dest)
+}
+
+// copyPebbleFiles copies the files of the pebble db in the folder src, except
+// its lock, to the folder dest, replacing it
+func copyPebbleFiles(src, dest string) error {
+	if err := os.RemoveAll(dest); err != nil {
+		return common.Wrap(err)
+	}
+	if err := os.MkdirAll(dest, 0750); err != nil { //nolint:gomnd
+		return common.Wrap(err)
+	}
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Name() == pebbleLockFile {
+			continue
+		}
+		if err := copyFile(path.Join(src, file.Name()), path.Join(dest, file.Name())); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file src to the new file dest
+func copyFile(src, dest string) error {
+	in, err := os.Open(src) //nolint:gosec
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer in.Close()                                                       //nolint:errcheck
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) //nolint:gomnd
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close() //nolint:errcheck
+		return common.Wrap(err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close() //nolint:errcheck
+		return common.Wrap(err)
+	}
+	return common.Wrap(out.Close())
+}
+
+// pebbleReadOnly is a db.Storage of a pebble db opened in read-only mode,
+// which doesn't write the files of the db, used for the checkpoints
+type pebbleReadOnly struct {
+	pdb    *pebbledb.DB
+	prefix []byte
+}
+
+// openPebbleReadOnly opens read-only the pebble db in the folder dir, which
+// must exist
+func openPebbleReadOnly(dir string) (*pebbleReadOnly, error) {
+	pdb, err := pebbledb.Open(dir, &pebbledb.Options{
+		ErrorIfNotExists: true,
+		ReadOnly:         true,
+	})
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &pebbleReadOnly{pdb: pdb}, nil
+}
+
+// NewTx returns ErrReadOnly
+func (p *pebbleReadOnly) NewTx() (db.Tx, error) {
+	return nil, common.Wrap(ErrReadOnly)
+}
+
+// WithPrefix implements the method WithPrefix of the interface db.Storage
+func (p *pebbleReadOnly) WithPrefix(prefix []byte) db.Storage {
+	return &pebbleReadOnly{pdb: p.pdb, prefix: db.Concat(p.prefix, prefix)}
+}
+
+// Get retrieves a value from a key in the db.Storage
+func (p *pebbleReadOnly) Get(key []byte) ([]byte, error) {
+	v, closer, err := p.pdb.Get(db.Concat(p.prefix, key))
+	if err == pebbledb.ErrNotFound {
+		return nil, db.ErrNotFound
+	} else if err != nil {
+		return nil, common.Wrap(err)
+	}
+	value := append([]byte{}, v...)
+	if err := closer.Close(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	return value, nil
+}
+
+// Iterate implements the method Iterate of the interface db.Storage.  The
+// keys are iterated in ascending order.
+func (p *pebbleReadOnly) Iterate(f func([]byte, []byte) (bool, error)) error {
+	iter := p.pdb.NewIter(&pebbledb.IterOptions{LowerBound: p.prefix})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), p.prefix) {
+			break
+		}
+		key := append([]byte{}, iter.Key()[len(p.prefix):]...)
+		if cont, err := f(key, append([]byte{}, iter.Value()...)); err != nil {
+			iter.Close() //nolint:errcheck
+			return common.Wrap(err)
+		} else if !cont {
+			break
+		}
+	}
+	return common.Wrap(iter.Close())
+}
+
+// List implements the method List of the interface db.Storage
+func (p *pebbleReadOnly) List(limit int) ([]db.KV, error) {
+	kvs := []db.KV{}
+	err := p.Iterate(func(k, v []byte) (bool, error) {
+		kvs = append(kvs, db.KV{K: k, V: v})
+		return limit <= 0 || len(kvs) < limit, nil
+	})
+	return kvs, common.Wrap(err)
+}
+
+// Close closes the pebble db
+func (p *pebbleReadOnly) Close() {
+	if err := p.pdb.Close(); err != nil {
+		log.Errorw("pebbleReadOnly.Close", "err", err)
+	}
+}
@@ -1,15 +1,16 @@
 package kvdb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
-	"strings"
 	"sync"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/metric"
 
 	"github.com/iden3/go-merkletree/db"
 	"github.com/iden3/go-merkletree/db/pebble"
@@ -34,15 +35,38 @@ var (
 	KeyCurrentBatch = []byte("k:currentbatch")
 	// keyCurrentIdx is used as key in the db to store the CurrentIdx
 	keyCurrentIdx = []byte("k:idx")
+	// keyKeepEvery is used as key in the db to store the KeepEvery of the
+	// Retention the checkpoints were made with
+	keyKeepEvery = []byte("k:keepevery")
 	// ErrNoLast is returned when the KVDB has been configured to not have
 	// a Last checkpoint but a Last method is used
 	ErrNoLast = fmt.Errorf("no last checkpoint")
+	// ErrSavepointNotFound is returned when a Savepoint that has been
+	// released, rolled back or invalidated by a checkpoint or a reset is
+	// used
+	ErrSavepointNotFound = fmt.Errorf("savepoint not found")
+	// ErrInMemory is returned when a method that needs the KVDB to be on
+	// disk is used with an in-memory KVDB
+	ErrInMemory = fmt.Errorf("not supported by an in-memory KVDB")
+	// ErrCheckpointNotFound is returned when a checkpoint that doesn't
+	// exist is used
+	ErrCheckpointNotFound = fmt.Errorf("checkpoint does not exist")
+	// ErrPathRequired is returned when a KVDB that is not in memory is
+	// configured without a Path
+	ErrPathRequired = fmt.Errorf("path required by a KVDB on disk")
+	// ErrKeepEveryMismatch is returned when a KVDB is opened with a
+	// Retention.KeepEvery different from the one of its checkpoints
+	ErrKeepEveryMismatch = fmt.Errorf("retention KeepEvery doesn't match the stored one")
+	// ErrCheckpointGap is returned when there's a gap between the
+	// checkpoints that is not allowed by the Retention
+	ErrCheckpointGap = fmt.Errorf("gap between checkpoints")
 )
 
 // KVDB represents the Key-Value DB object
 type KVDB struct {
 	cfg Config
-	db  *pebble.Storage
+	// backend stores the current db and the checkpoints
+	backend backend
 	// CurrentIdx holds the current Idx that the BatchBuilder is using
 	CurrentAccountIdx common.AccountIdx
 	CurrentBatch      common.BatchNum
@@ -50,6 +74,13 @@ type KVDB struct {
 	mutexDelOld       sync.Mutex
 	wg                sync.WaitGroup
 	last              *Last
+	savepoints        savepoints
+	// views contains the checkpoints opened by views, see OpenAt
+	views      map[common.BatchNum]*openCheckpoint
+	mutexViews sync.Mutex
+	// viewsClosed is signaled, with mutexViews, when the last view of a
+	// checkpoint is closed
+	viewsClosed *sync.Cond
 }
 
 // Last is a consistent view to the last batch of the stateDB that can
@@ -62,17 +93,27 @@ type Last struct {
 
 // Config of the KVDB
 type Config struct {
-	// Path where the checkpoints will be stored
+	// Path where the checkpoints will be stored.  Optional if InMemory is
+	// set.
 	Path string
-	// Keep is the number of old checkpoints to keep.  If 0, all
-	// checkpoints are kept.
+	// Keep is the number of old checkpoints to keep, not counting the
+	// archival ones of the Retention.  If 0, there's no limit.
 	Keep int
+	// Retention limits the checkpoints kept besides Keep
+	Retention Retention
+	// Name identifies the KVDB in the logs and the metrics
+	Name string
 	// At every checkpoint, check that there are no gaps between the
 	// checkpoints
 	NoGapsCheck bool
 	// NoLast skips having an opened DB with a checkpoint to the last
 	// batchNum for thread-safe reads.
 	NoLast bool
+	// InMemory keeps the current db and the checkpoints in memory instead
+	// of in Path, which is not needed.  The checkpoints are copy-on-write
+	// snapshots of the current db, and are lost when the KVDB is closed.
+	// An in-memory KVDB has no Last checkpoint.
+	InMemory bool
 }
 
 func (k *Last) setNew() error {
@@ -125,28 +166,39 @@ func (k *Last) close() {
 // NewKVDB creates a new KVDB, allowing to use an in-memory or in-disk storage.
 // Checkpoints older than the value defined by `keep` will be deleted.
 func NewKVDB(cfg Config) (*KVDB, error) {
-	var sto *pebble.Storage
+	var b backend
 	var err error
-	sto, err = pebble.NewPebbleStorage(path.Join(cfg.Path, PathCurrent), false)
-	if err != nil {
-		return nil, common.Wrap(err)
+	if cfg.InMemory {
+		b = newMemoryBackend()
+	} else if cfg.Path == "" {
+		return nil, common.Wrap(ErrPathRequired)
+	} else {
+		b, err = newDiskBackend(cfg.Path)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
 	}
 	var last *Last
-	if !cfg.NoLast {
+	if !cfg.NoLast && !cfg.InMemory {
 		last = &Last{
 			path: cfg.Path,
 		}
 	}
 	kvdb := &KVDB{
-		cfg:  cfg,
-		db:   sto,
-		last: last,
+		cfg:     cfg,
+		backend: b,
+		last:    last,
 	}
+	kvdb.viewsClosed = sync.NewCond(&kvdb.mutexViews)
 	// load currentBatch
 	kvdb.CurrentBatch, err = kvdb.GetCurrentBatch()
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
+	if err := kvdb.checkKeepEvery(); err != nil {
+		kvdb.backend.closeCurrent()
+		return nil, common.Wrap(err)
+	}
 
 	// make reset (get checkpoint) at currentBatch
 	err = kvdb.reset(kvdb.CurrentBatch, true)
@@ -157,21 +209,22 @@ func NewKVDB(cfg Config) (*KVDB, error) {
 	return kvdb, nil
 }
 
-// DB returns the *pebble.Storage from the KVDB
-func (k *KVDB) DB() *pebble.Storage {
-	return k.db
+// DB returns the *Storage from the KVDB
+func (k *KVDB) DB() *Storage {
+	return &Storage{sto: k.backend.current(), kvdb: k}
 }
 
 // StorageWithPrefix returns the db.Storage with the given prefix from the
 // current KVDB
 func (k *KVDB) StorageWithPrefix(prefix []byte) db.Storage {
-	return k.db.WithPrefix(prefix)
+	return k.DB().WithPrefix(prefix)
 }
 
 // Reset resets the KVDB to the checkpoint at the given batchNum. Reset does
 // not delete the checkpoints between old current and the new current, those
 // checkpoints will remain in the storage, and eventually will be deleted when
-// MakeCheckpoint overwrites them.
+// MakeCheckpoint overwrites them.  The open savepoints are discarded.  The
+// checkpoints after batchNum are deleted once their views are closed.
 func (k *KVDB) Reset(batchNum common.BatchNum) error {
 	return k.reset(batchNum, true)
 }
@@ -182,15 +235,10 @@ func (k *KVDB) Reset(batchNum common.BatchNum) error {
 // MakeCheckpoint overwrites them.  `closeCurrent` will close the currently
 // opened db before doing the reset.
 func (k *KVDB) reset(batchNum common.BatchNum, closeCurrent bool) error {
-	currentPath := path.Join(k.cfg.Path, PathCurrent)
+	k.savepoints.clear()
 
-	if closeCurrent && k.db != nil {
-		k.db.Close()
-		k.db = nil
-	}
-	// remove 'current'
-	if err := os.RemoveAll(currentPath); err != nil {
-		return common.Wrap(err)
+	if closeCurrent {
+		k.backend.closeCurrent()
 	}
 	// remove all checkpoints > batchNum
 	list, err := k.ListCheckpoints()
@@ -213,11 +261,9 @@ func (k *KVDB) reset(batchNum common.BatchNum, closeCurrent bool) error {
 
 	if batchNum == 0 {
 		// if batchNum == 0, open the new fresh 'current'
-		sto, err := pebble.NewPebbleStorage(currentPath, false)
-		if err != nil {
+		if err := k.backend.openCurrent(0); err != nil {
 			return common.Wrap(err)
 		}
-		k.db = sto
 		k.CurrentAccountIdx = common.RollupConstReservedIDx // 255
 		k.CurrentBatch = 0
 		if k.last != nil {
@@ -226,11 +272,11 @@ func (k *KVDB) reset(batchNum common.BatchNum, closeCurrent bool) error {
 			}
 		}
 
-		return nil
+		return common.Wrap(k.setKeepEvery())
 	}
 
-	// copy 'batchNum' to 'current'
-	if err := k.MakeCheckpointFromTo(batchNum, currentPath); err != nil {
+	// copy 'batchNum' to 'current' and open it
+	if err := k.openCurrent(batchNum); err != nil {
 		return common.Wrap(err)
 	}
 	// copy 'batchNum' to 'last'
@@ -240,13 +286,6 @@ func (k *KVDB) reset(batchNum common.BatchNum, closeCurrent bool) error {
 		}
 	}
 
-	// open the new 'current'
-	sto, err := pebble.NewPebbleStorage(currentPath, false)
-	if err != nil {
-		return common.Wrap(err)
-	}
-	k.db = sto
-
 	// get currentBatch num
 	k.CurrentBatch, err = k.GetCurrentBatch()
 	if err != nil {
@@ -258,13 +297,78 @@ func (k *KVDB) reset(batchNum common.BatchNum, closeCurrent bool) error {
 		return common.Wrap(err)
 	}
 
+	return common.Wrap(k.setKeepEvery())
+}
+
+// ResetFromSynchronizer resets the KVDB to a copy of the checkpoint of
+// synchronizerKVDB at the given batchNum, deleting all the checkpoints of the
+// KVDB.  If synchronizerKVDB doesn't have the checkpoint, an error wrapping
+// ErrCheckpointNotFound is returned and the KVDB is not modified.  The open
+// savepoints are discarded.
+func (k *KVDB) ResetFromSynchronizer(batchNum common.BatchNum, synchronizerKVDB *KVDB) error {
+	if synchronizerKVDB == nil {
+		return common.Wrap(fmt.Errorf("synchronizerKVDB can not be nil"))
+	}
+	var view *View
+	if batchNum != 0 {
+		// the view keeps the checkpoint from being deleted by the
+		// synchronizer while it's copied
+		var err error
+		view, err = synchronizerKVDB.OpenAt(batchNum)
+		if err != nil {
+			return common.Wrap(err)
+		}
+		defer view.Close()
+	}
+	// remove all checkpoints
+	list, err := k.ListCheckpoints()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for _, bn := range list {
+		if err := k.DeleteCheckpoint(common.BatchNum(bn)); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	if view != nil {
+		// copy synchronizer 'BatchNumX' to 'BatchNumX'
+		if err := k.backend.loadCheckpoint(view); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	// copy 'BatchNumX' to 'current'
+	return common.Wrap(k.reset(batchNum, true))
+}
+
+// openCurrent opens as current db a copy of the checkpoint at batchNum
+func (k *KVDB) openCurrent(batchNum common.BatchNum) error {
+	if err := k.checkpointExists(batchNum); err != nil {
+		return common.Wrap(err)
+	}
+	k.mutexCheckpoint.Lock()
+	defer k.mutexCheckpoint.Unlock()
+	k.mutexViews.Lock()
+	defer k.mutexViews.Unlock()
+	return common.Wrap(k.backend.openCurrent(batchNum))
+}
+
+// checkpointExists returns an error if the checkpoint at batchNum does not
+// exist
+func (k *KVDB) checkpointExists(batchNum common.BatchNum) error {
+	ok, err := k.backend.hasCheckpoint(batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if !ok {
+		return common.Wrap(fmt.Errorf("%w: batchNum %d", ErrCheckpointNotFound, batchNum))
+	}
 	return nil
 }
 
 // GetCurrentIdx returns the stored Idx from the KVDB, which is the last Idx
 // used for an Account in the k.
 func (k *KVDB) GetCurrentAccountIdx() (common.AccountIdx, error) {
-	idxBytes, err := k.db.Get(keyCurrentIdx)
+	idxBytes, err := k.backend.current().Get(keyCurrentIdx)
 	if common.Unwrap(err) == db.ErrNotFound {
 		return common.RollupConstReservedIDx, nil // 255, nil
 	}
@@ -276,7 +380,7 @@ func (k *KVDB) GetCurrentAccountIdx() (common.AccountIdx, error) {
 
 // GetCurrentBatch returns the current BatchNum stored in the KVDB
 func (k *KVDB) GetCurrentBatch() (common.BatchNum, error) {
-	cbBytes, err := k.db.Get(KeyCurrentBatch)
+	cbBytes, err := k.backend.current().Get(KeyCurrentBatch)
 	if common.Unwrap(err) == db.ErrNotFound {
 		return 0, nil
 	}
@@ -288,7 +392,7 @@ func (k *KVDB) GetCurrentBatch() (common.BatchNum, error) {
 
 // setCurrentBatch stores the current BatchNum in the KVDB
 func (k *KVDB) setCurrentBatch() error {
-	tx, err := k.db.NewTx()
+	tx, err := k.backend.current().NewTx()
 	if err != nil {
 		return common.Wrap(err)
 	}
@@ -302,11 +406,61 @@ func (k *KVDB) setCurrentBatch() error {
 	return nil
 }
 
+// checkKeepEvery returns ErrKeepEveryMismatch if the current db stores a
+// KeepEvery different from the one of the Retention, as the checkpoints kept
+// for it would fail the gaps check.  The dbs made before KeepEvery was stored
+// are accepted.
+func (k *KVDB) checkKeepEvery() error {
+	b, err := k.backend.current().Get(keyKeepEvery)
+	if common.Unwrap(err) == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if len(b) != 8 { //nolint:gomnd
+		return common.Wrap(fmt.Errorf("can not parse KeepEvery, bytes len %d", len(b)))
+	}
+	if stored := binary.BigEndian.Uint64(b); stored != uint64(k.cfg.Retention.KeepEvery) {
+		return common.Wrap(fmt.Errorf("%w: stored %d, configured %d", ErrKeepEveryMismatch,
+			stored, k.cfg.Retention.KeepEvery))
+	}
+	return nil
+}
+
+// setKeepEvery stores in the current db the KeepEvery of the Retention, so
+// that the next checkpoints keep it, unless it's already stored
+func (k *KVDB) setKeepEvery() error {
+	b := keepEveryBytes(k.cfg.Retention.KeepEvery)
+	stored, err := k.backend.current().Get(keyKeepEvery)
+	if err == nil && bytes.Equal(stored, b) {
+		return nil
+	} else if err != nil && common.Unwrap(err) != db.ErrNotFound {
+		return common.Wrap(err)
+	}
+	tx, err := k.backend.current().NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer tx.Close()
+	if err := tx.Put(keyKeepEvery, b); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Commit())
+}
+
+// keepEveryBytes returns the bytes of keepEvery stored in the db
+func keepEveryBytes(keepEvery int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(keepEvery))
+	return b[:]
+}
+
 // SetCurrentIdx stores Idx in the KVDB
 func (k *KVDB) SetCurrentAccountIdx(idx common.AccountIdx) error {
 	k.CurrentAccountIdx = idx
 
-	tx, err := k.db.NewTx()
+	tx, err := k.DB().NewTx()
 	if err != nil {
 		return common.Wrap(err)
 	}
@@ -325,60 +479,64 @@ func (k *KVDB) SetCurrentAccountIdx(idx common.AccountIdx) error {
 }
 
 // ListCheckpoints returns the list of batchNums of the checkpoints, sorted.
-// If there's a gap between the list of checkpoints, an error is returned.
+// If there's a gap between the list of checkpoints, other than after the
+// archival checkpoints of the Retention, an error is returned.
 func (k *KVDB) ListCheckpoints() ([]int, error) {
-	files, err := ioutil.ReadDir(k.cfg.Path)
+	checkpoints, err := k.backend.checkpoints()
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
-	checkpoints := []int{}
-	var checkpoint int
-	pattern := fmt.Sprintf("%s%%d", PathBatchNum)
-	for _, file := range files {
-		fileName := file.Name()
-		if file.IsDir() && strings.HasPrefix(fileName, PathBatchNum) {
-			if _, err := fmt.Sscanf(fileName, pattern, &checkpoint); err != nil {
-				return nil, common.Wrap(err)
-			}
-			checkpoints = append(checkpoints, checkpoint)
-		}
-	}
 	sort.Ints(checkpoints)
 	if !k.cfg.NoGapsCheck && len(checkpoints) > 0 {
 		first := checkpoints[0]
-		for _, checkpoint := range checkpoints[1:] {
+		for n, checkpoint := range checkpoints[1:] {
 			first++
+			// the archival checkpoints are followed by the gaps of
+			// the deleted ones
+			if checkpoint != first && k.cfg.Retention.allArchival(checkpoints[:n+1]) {
+				first = checkpoint
+			}
 			if checkpoint != first {
-				log.Fatalf("gap between checkpoints", "checkpoints", checkpoints)
-				return nil, common.Wrap(fmt.Errorf("checkpoint gap at %v", checkpoint))
+				return nil, common.Wrap(fmt.Errorf("%w at %v: %v", ErrCheckpointGap,
+					checkpoint, checkpoints))
 			}
 		}
 	}
 	return checkpoints, nil
 }
 
-// DeleteCheckpoint removes if exist the checkpoint of the given batchNum
+// DeleteCheckpoint removes if exist the checkpoint of the given batchNum.  If
+// the checkpoint has open views, it can't be opened again, and it's removed
+// once they are closed.
 func (k *KVDB) DeleteCheckpoint(batchNum common.BatchNum) error {
-	checkpointPath := path.Join(k.cfg.Path, fmt.Sprintf("%s%d", PathBatchNum, batchNum))
-
-	if _, err := os.Stat(checkpointPath); os.IsNotExist(err) {
-		return common.Wrap(fmt.Errorf("Checkpoint with batchNum %d does not exist in DB", batchNum))
-	} else if err != nil {
+	if err := k.checkpointExists(batchNum); err != nil {
 		return common.Wrap(err)
 	}
+	k.mutexViews.Lock()
+	defer k.mutexViews.Unlock()
+	k.waitViews(batchNum)
+	return common.Wrap(k.backend.deleteCheckpoint(batchNum))
+}
 
-	return os.RemoveAll(checkpointPath)
+// waitViews waits until the open views of the checkpoint at batchNum are
+// closed, not allowing to open new ones, so that the checkpoint can be
+// removed or replaced.  It must be called with mutexViews locked.
+func (k *KVDB) waitViews(batchNum common.BatchNum) {
+	if open, ok := k.views[batchNum]; ok {
+		open.closing = true
+		for open.refs > 0 {
+			k.viewsClosed.Wait()
+		}
+	}
+	delete(k.views, batchNum)
 }
 
 // MakeCheckpointFromTo makes a checkpoint from the current db at fromBatchNum
-// to the dest folder.  This method is locking, so it can be called from
-// multiple places at the same time.
+// to the dest folder, as a pebble db also for an in-memory KVDB.  This method
+// is locking, so it can be called from multiple places at the same time.
 func (k *KVDB) MakeCheckpointFromTo(fromBatchNum common.BatchNum, dest string) error {
-	source := path.Join(k.cfg.Path, fmt.Sprintf("%s%d", PathBatchNum, fromBatchNum))
-	if _, err := os.Stat(source); os.IsNotExist(err) {
-		// if kvdb does not have checkpoint at batchNum, return err
-		return common.Wrap(fmt.Errorf("Checkpoint \"%v\" does not exist", source))
-	} else if err != nil {
+	// if kvdb does not have checkpoint at batchNum, return err
+	if err := k.checkpointExists(fromBatchNum); err != nil {
 		return common.Wrap(err)
 	}
 	// By locking we allow calling MakeCheckpointFromTo from multiple
@@ -388,7 +546,9 @@ func (k *KVDB) MakeCheckpointFromTo(fromBatchNum common.BatchNum, dest string) e
 	// synchronizer to the same batchNum
 	k.mutexCheckpoint.Lock()
 	defer k.mutexCheckpoint.Unlock()
-	return PebbleMakeCheckpoint(source, dest)
+	k.mutexViews.Lock()
+	defer k.mutexViews.Unlock()
+	return common.Wrap(k.backend.copyCheckpoint(fromBatchNum, dest))
 }
 
 // PebbleMakeCheckpoint is a hepler function to make a pebble checkpoint from
@@ -421,28 +581,25 @@ func PebbleMakeCheckpoint(source, dest string) error {
 
 // MakeCheckpoint does a checkpoint at the given batchNum in the defined path.
 // Internally this advances & stores the current BatchNum, and then stores a
-// Checkpoint of the current state of the k.
+// Checkpoint of the current state of the k.  The open savepoints are
+// discarded.
 func (k *KVDB) MakeCheckpoint() error {
+	// the savepoints can't undo the writes of a previous batch
+	k.savepoints.clear()
 	// advance currentBatch
 	k.CurrentBatch++
 
-	checkpointPath := path.Join(k.cfg.Path, fmt.Sprintf("%s%d", PathBatchNum, k.CurrentBatch))
-
 	if err := k.setCurrentBatch(); err != nil {
 		return common.Wrap(err)
 	}
 
-	// if checkpoint BatchNum already exist in disk, delete it
-	if _, err := os.Stat(checkpointPath); os.IsNotExist(err) {
-	} else if err != nil {
-		return common.Wrap(err)
-	} else {
-		if err := os.RemoveAll(checkpointPath); err != nil {
-			return common.Wrap(err)
-		}
-	}
-	// execute Checkpoint
-	if err := k.db.Pebble().Checkpoint(checkpointPath); err != nil {
+	// execute Checkpoint, replacing the existing one at CurrentBatch once
+	// its views are closed
+	k.mutexViews.Lock()
+	k.waitViews(k.CurrentBatch)
+	err := k.backend.checkpoint(k.CurrentBatch)
+	k.mutexViews.Unlock()
+	if err != nil {
 		return common.Wrap(err)
 	}
 	// copy 'CurrentBatch' to 'last'
@@ -464,8 +621,11 @@ func (k *KVDB) MakeCheckpoint() error {
 	return nil
 }
 
-// DeleteOldCheckpoints deletes old checkpoints when there are more than
-// `s.keep` checkpoints
+// DeleteOldCheckpoints deletes the oldest checkpoints while there are more
+// than `Keep` or the Retention limits are exceeded, logging the reason, and
+// updates the metrics of the checkpoints.  The archival checkpoints and the
+// last one are kept.  The checkpoints with open views are also kept, together
+// with the ones after them so that there are no gaps between checkpoints.
 func (k *KVDB) DeleteOldCheckpoints() error {
 	k.mutexDelOld.Lock()
 	defer k.mutexDelOld.Unlock()
@@ -474,22 +634,75 @@ func (k *KVDB) DeleteOldCheckpoints() error {
 	if err != nil {
 		return common.Wrap(err)
 	}
-	if k.cfg.Keep > 0 && len(list) > k.cfg.Keep {
-		for _, checkpoint := range list[:len(list)-k.cfg.Keep] {
-			if err := k.DeleteCheckpoint(common.BatchNum(checkpoint)); err != nil {
-				return common.Wrap(err)
-			}
+	if len(list) == 0 {
+		return nil
+	}
+	retention := k.cfg.Retention
+	usages := make(map[int]checkpointUsage, len(list))
+	var total diskUsage
+	nRecent := 0
+	for _, checkpoint := range list {
+		usage, err := k.backend.usage(common.BatchNum(checkpoint))
+		if err != nil {
+			return common.Wrap(err)
+		}
+		usages[checkpoint] = usage
+		total.add(usage)
+		if !retention.archival(checkpoint) {
+			nRecent++
 		}
 	}
+	last := list[len(list)-1]
+
+	var old []int
+	k.mutexViews.Lock()
+	for _, checkpoint := range list[:len(list)-1] {
+		if retention.archival(checkpoint) {
+			continue
+		}
+		if k.inUse(common.BatchNum(checkpoint)) {
+			break
+		}
+		old = append(old, checkpoint)
+	}
+	k.mutexViews.Unlock()
+	nPruned := 0
+	for _, checkpoint := range old {
+		var reason string
+		switch {
+		case k.cfg.Keep > 0 && nRecent-nPruned > k.cfg.Keep:
+			reason = PruneReasonCount
+		case retention.MaxAge > 0 && checkpoint <= last-retention.MaxAge:
+			reason = PruneReasonAge
+		case retention.MaxBytes > 0 && total.total > retention.MaxBytes:
+			reason = PruneReasonSize
+		}
+		// the limits are not exceeded by the newer checkpoints either
+		if reason == "" {
+			break
+		}
+		if err := k.DeleteCheckpoint(common.BatchNum(checkpoint)); err != nil {
+			return common.Wrap(err)
+		}
+		total.remove(usages[checkpoint])
+		nPruned++
+		log.Infow("checkpoint pruned", "kvdb", k.cfg.Name, "batchNum", checkpoint,
+			"reason", reason, "bytes", usages[checkpoint].size())
+		metric.CheckpointsPruned.WithLabelValues(k.cfg.Name, reason).Inc()
+	}
+	if retention.MaxBytes > 0 && total.total > retention.MaxBytes {
+		log.Warnw("checkpoints exceed the retention MaxBytes", "kvdb", k.cfg.Name,
+			"bytes", total.total, "maxBytes", retention.MaxBytes)
+	}
+	metric.Checkpoints.WithLabelValues(k.cfg.Name).Set(float64(len(list) - nPruned))
+	metric.CheckpointsBytes.WithLabelValues(k.cfg.Name).Set(float64(total.total))
+	metric.LastCheckpointBytes.WithLabelValues(k.cfg.Name).Set(float64(usages[last].size()))
 	return nil
 }
 
 // Close the DB
 func (k *KVDB) Close() {
-	if k.db != nil {
-		k.db.Close()
-		k.db = nil
-	}
+	k.backend.closeCurrent()
 	if k.last != nil {
 		k.last.close()
 	}
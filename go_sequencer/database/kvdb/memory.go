@@ -0,0 +1,345 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/iden3/go-merkletree/db"
+	"github.com/iden3/go-merkletree/db/pebble"
+)
+
+// memoryTxKeys is the number of keys written in each db tx when a memory
+// checkpoint is copied to disk
+const memoryTxKeys = 1024
+
+// memoryDB is a key-value map that can be shared with the checkpoints of a
+// memoryBackend.  Once shared, the map is not modified anymore: the next write
+// copies it first (copy-on-write), so a checkpoint costs no copy and only the
+// batches that write pay for one.
+type memoryDB struct {
+	mutex  sync.RWMutex
+	kv     map[string][]byte
+	shared bool
+}
+
+// newMemoryDB returns an empty memoryDB
+func newMemoryDB() *memoryDB {
+	return &memoryDB{kv: make(map[string][]byte)}
+}
+
+// snapshot returns the map of the memoryDB, which is not modified anymore
+func (m *memoryDB) snapshot() map[string][]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.shared = true
+	return m.kv
+}
+
+// load replaces the map of the memoryDB by a shared one
+func (m *memoryDB) load(kv map[string][]byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.kv = kv
+	m.shared = true
+}
+
+// write calls f with the map of the memoryDB, copied first if it's shared
+func (m *memoryDB) write(f func(kv map[string][]byte)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.shared {
+		kv := make(map[string][]byte, len(m.kv))
+		for k, v := range m.kv {
+			kv[k] = v
+		}
+		m.kv = kv
+		m.shared = false
+	}
+	f(m.kv)
+}
+
+func (m *memoryDB) get(key []byte) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	v, ok := m.kv[string(key)]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+// list returns the keys and values with the given prefix, sorted by key and
+// with the prefix removed from the keys
+func (m *memoryDB) list(prefix []byte) []db.KV {
+	m.mutex.RLock()
+	kvs := []db.KV{}
+	for k, v := range m.kv {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			kvs = append(kvs, db.KV{K: []byte(k[len(prefix):]), V: append([]byte{}, v...)})
+		}
+	}
+	m.mutex.RUnlock()
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].K, kvs[j].K) < 0 })
+	return kvs
+}
+
+// MemoryStorage is a db.Storage kept in memory, used by the KVDBs with
+// Config.InMemory
+type MemoryStorage struct {
+	mdb    *memoryDB
+	prefix []byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{mdb: newMemoryDB()}
+}
+
+// NewTx implements the method NewTx of the interface db.Storage
+func (s *MemoryStorage) NewTx() (db.Tx, error) {
+	return &MemoryStorageTx{sto: s, kv: make(map[string][]byte)}, nil
+}
+
+// WithPrefix implements the method WithPrefix of the interface db.Storage
+func (s *MemoryStorage) WithPrefix(prefix []byte) db.Storage {
+	return &MemoryStorage{mdb: s.mdb, prefix: db.Concat(s.prefix, prefix)}
+}
+
+// Get retrieves a value from a key in the db.Storage
+func (s *MemoryStorage) Get(key []byte) ([]byte, error) {
+	return s.mdb.get(db.Concat(s.prefix, key))
+}
+
+// Iterate implements the method Iterate of the interface db.Storage.  The
+// keys are iterated in ascending order, over the ones stored when Iterate is
+// called.
+func (s *MemoryStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
+	for _, kv := range s.mdb.list(s.prefix) {
+		if cont, err := f(kv.K, kv.V); err != nil {
+			return common.Wrap(err)
+		} else if !cont {
+			break
+		}
+	}
+	return nil
+}
+
+// List implements the method List of the interface db.Storage
+func (s *MemoryStorage) List(limit int) ([]db.KV, error) {
+	kvs := s.mdb.list(s.prefix)
+	if limit > 0 && len(kvs) > limit {
+		kvs = kvs[:limit]
+	}
+	return kvs, nil
+}
+
+// Close implements the method Close of the interface db.Storage
+func (s *MemoryStorage) Close() {}
+
+// MemoryStorageTx implements the db.Tx interface over a MemoryStorage.  The
+// writes are applied atomically by Commit.
+type MemoryStorageTx struct {
+	sto *MemoryStorage
+	kv  map[string][]byte
+}
+
+// Get retrieves a value from a key in the MemoryStorageTx, or in its
+// MemoryStorage if it has not been written in the tx
+func (tx *MemoryStorageTx) Get(key []byte) ([]byte, error) {
+	fullKey := db.Concat(tx.sto.prefix, key)
+	if v, ok := tx.kv[string(fullKey)]; ok {
+		return append([]byte{}, v...), nil
+	}
+	return tx.sto.mdb.get(fullKey)
+}
+
+// Put saves a key:value into the MemoryStorageTx
+func (tx *MemoryStorageTx) Put(k, v []byte) error {
+	tx.kv[string(db.Concat(tx.sto.prefix, k))] = append([]byte{}, v...)
+	return nil
+}
+
+// Add implements the method Add of the interface db.Tx
+func (tx *MemoryStorageTx) Add(atx db.Tx) error {
+	mtx, ok := atx.(*MemoryStorageTx)
+	if !ok {
+		return common.Wrap(fmt.Errorf("can't add a %T to a MemoryStorageTx", atx))
+	}
+	for k, v := range mtx.kv {
+		tx.kv[k] = v
+	}
+	return nil
+}
+
+// Commit implements the method Commit of the interface db.Tx
+func (tx *MemoryStorageTx) Commit() error {
+	tx.sto.mdb.write(func(kv map[string][]byte) {
+		for k, v := range tx.kv {
+			kv[k] = v
+		}
+	})
+	tx.kv = nil
+	return nil
+}
+
+// Close implements the method Close of the interface db.Tx
+func (tx *MemoryStorageTx) Close() {
+	tx.kv = nil
+}
+
+// memoryBackend keeps the current db and the checkpoints in memory.  The
+// checkpoints share the maps of the current db, see memoryDB.
+type memoryBackend struct {
+	sto   *MemoryStorage
+	mutex sync.Mutex
+	saved map[common.BatchNum]map[string][]byte
+}
+
+// newMemoryBackend returns a memoryBackend without checkpoints
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		sto:   NewMemoryStorage(),
+		saved: make(map[common.BatchNum]map[string][]byte),
+	}
+}
+
+// get returns the map of the checkpoint at batchNum
+func (b *memoryBackend) get(batchNum common.BatchNum) (map[string][]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kv, ok := b.saved[batchNum]
+	if !ok {
+		return nil, common.Wrap(fmt.Errorf("%w: batchNum %d", ErrCheckpointNotFound, batchNum))
+	}
+	return kv, nil
+}
+
+func (b *memoryBackend) current() db.Storage {
+	return b.sto
+}
+
+func (b *memoryBackend) openCurrent(batchNum common.BatchNum) error {
+	if batchNum == 0 {
+		b.sto.mdb.load(make(map[string][]byte))
+		return nil
+	}
+	kv, err := b.get(batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	b.sto.mdb.load(kv)
+	return nil
+}
+
+// closeCurrent keeps the current db, which is not opened again by openCurrent
+func (b *memoryBackend) closeCurrent() {}
+
+func (b *memoryBackend) write(entries []journalEntry) error {
+	b.sto.mdb.write(func(kv map[string][]byte) {
+		for i := range entries {
+			if entries[i].found {
+				kv[string(entries[i].key)] = entries[i].value
+			} else {
+				delete(kv, string(entries[i].key))
+			}
+		}
+	})
+	return nil
+}
+
+func (b *memoryBackend) checkpoint(batchNum common.BatchNum) error {
+	kv := b.sto.mdb.snapshot()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.saved[batchNum] = kv
+	return nil
+}
+
+func (b *memoryBackend) checkpoints() ([]int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	checkpoints := []int{}
+	for batchNum := range b.saved {
+		checkpoints = append(checkpoints, int(batchNum))
+	}
+	return checkpoints, nil
+}
+
+func (b *memoryBackend) hasCheckpoint(batchNum common.BatchNum) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.saved[batchNum]
+	return ok, nil
+}
+
+func (b *memoryBackend) deleteCheckpoint(batchNum common.BatchNum) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.saved, batchNum)
+	return nil
+}
+
+func (b *memoryBackend) openCheckpoint(batchNum common.BatchNum) (db.Storage, error) {
+	kv, err := b.get(batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &MemoryStorage{mdb: &memoryDB{kv: kv, shared: true}}, nil
+}
+
+func (b *memoryBackend) loadCheckpoint(view *View) error {
+	kv := make(map[string][]byte)
+	if err := view.DB().Iterate(func(k, v []byte) (bool, error) {
+		kv[string(k)] = append([]byte{}, v...)
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.saved[view.batchNum] = kv
+	return nil
+}
+
+func (b *memoryBackend) copyCheckpoint(batchNum common.BatchNum, dest string) error {
+	src, err := b.openCheckpoint(batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return common.Wrap(err)
+	}
+	sto, err := pebble.NewPebbleStorage(dest, false)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer sto.Close()
+	kvs, err := src.List(0)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for len(kvs) > 0 {
+		n := memoryTxKeys
+		if n > len(kvs) {
+			n = len(kvs)
+		}
+		tx, err := sto.NewTx()
+		if err != nil {
+			return common.Wrap(err)
+		}
+		for _, kv := range kvs[:n] {
+			if err := tx.Put(kv.K, kv.V); err != nil {
+				return common.Wrap(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return common.Wrap(err)
+		}
+		kvs = kvs[n:]
+	}
+	return nil
+}
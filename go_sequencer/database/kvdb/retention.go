@@ -0,0 +1,153 @@
+package kvdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"tokamak-sybil-resistance/common"
+)
+
+const (
+	// PruneReasonCount is the reason of the checkpoints deleted because
+	// there are more than Config.Keep
+	PruneReasonCount = "count"
+	// PruneReasonAge is the reason of the checkpoints deleted because they
+	// are older than Retention.MaxAge
+	PruneReasonAge = "age"
+	// PruneReasonSize is the reason of the checkpoints deleted because the
+	// checkpoints take more than Retention.MaxBytes
+	PruneReasonSize = "size"
+)
+
+// Retention is the policy of DeleteOldCheckpoints, combined with Config.Keep:
+// the oldest checkpoints are deleted while any of the limits is exceeded,
+// except the archival ones and the last one.  The zero value has no limits.
+type Retention struct {
+	// MaxAge is the maximum age in batches of the checkpoints, relative to
+	// the last one: the checkpoints at batchNum <= last - MaxAge are
+	// deleted.  If 0, there's no limit.
+	MaxAge int
+	// MaxBytes is the maximum size of all the checkpoints, counting once
+	// the files or in-memory entries shared by several of them.  The checkpoints are deleted
+	// from the oldest until they fit, so the last checkpoint can be the
+	// only one kept.  If 0, there's no limit.
+	MaxBytes int64
+	// KeepEvery makes archival the checkpoints at the batchNums multiple
+	// of KeepEvery: they are never deleted by DeleteOldCheckpoints, and
+	// are not counted by Config.Keep.  The gaps after the archival
+	// checkpoints are allowed by the gaps check, so KeepEvery is stored in
+	// the KVDB, and opening it with a different one returns
+	// ErrKeepEveryMismatch.  If 0, there are no archival checkpoints.
+	KeepEvery int
+}
+
+// archival returns true if the checkpoint at batchNum is never deleted
+func (r Retention) archival(batchNum int) bool {
+	return r.KeepEvery > 0 && batchNum%r.KeepEvery == 0
+}
+
+// allArchival returns true if all the checkpoints of the list are archival
+func (r Retention) allArchival(checkpoints []int) bool {
+	for _, checkpoint := range checkpoints {
+		if !r.archival(checkpoint) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkpointUsage is the size of the files of a checkpoint
+type checkpointUsage struct {
+	// shared are the sizes of the files, or of the in-memory entries,
+	// that are shared by name with the other checkpoints
+	shared map[string]int64
+	// own is the size of the rest of the files
+	own int64
+}
+
+// size returns the size of all the files of the checkpoint
+func (u checkpointUsage) size() int64 {
+	size := u.own
+	for _, fileSize := range u.shared {
+		size += fileSize
+	}
+	return size
+}
+
+// diskUsage is the size of a set of checkpoints, counting once the files
+// shared by several of them
+type diskUsage struct {
+	refs  map[string]int
+	total int64
+}
+
+func (d *diskUsage) add(u checkpointUsage) {
+	if d.refs == nil {
+		d.refs = make(map[string]int)
+	}
+	d.total += u.own
+	for name, size := range u.shared {
+		if d.refs[name] == 0 {
+			d.total += size
+		}
+		d.refs[name]++
+	}
+}
+
+func (d *diskUsage) remove(u checkpointUsage) {
+	d.total -= u.own
+	for name, size := range u.shared {
+		d.refs[name]--
+		if d.refs[name] == 0 {
+			d.total -= size
+		}
+	}
+}
+
+// pebbleUsage returns the usage of the pebble db in dir.  The sst files of the
+// pebble checkpoints are hard links to the ones of the db they were made
+// from, and a file number is never reused by the db, so the sst files with
+// the same name are shared.
+func pebbleUsage(dir string) (checkpointUsage, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return checkpointUsage{}, common.Wrap(err)
+	}
+	usage := checkpointUsage{shared: make(map[string]int64)}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return checkpointUsage{}, common.Wrap(err)
+		}
+		if strings.HasSuffix(file.Name(), ".sst") {
+			usage.shared[file.Name()] = info.Size()
+		} else {
+			usage.own += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+// usage returns the usage of the checkpoint at batchNum
+func (b *diskBackend) usage(batchNum common.BatchNum) (checkpointUsage, error) {
+	return pebbleUsage(b.checkpointPath(batchNum))
+}
+
+// usage returns the size of the keys and values of the checkpoint at
+// batchNum.  The maps of the checkpoints are copied on write from the
+// previous ones keeping their values, so the entries with the same key and
+// value slice are shared.
+func (b *memoryBackend) usage(batchNum common.BatchNum) (checkpointUsage, error) {
+	kv, err := b.get(batchNum)
+	if err != nil {
+		return checkpointUsage{}, common.Wrap(err)
+	}
+	usage := checkpointUsage{shared: make(map[string]int64, len(kv))}
+	for k, v := range kv {
+		usage.shared[fmt.Sprintf("%s@%p", k, v)] = int64(len(k) + len(v))
+	}
+	return usage, nil
+}
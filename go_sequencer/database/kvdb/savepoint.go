@@ -0,0 +1,288 @@
+package kvdb
+
+import (
+	"sync"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/iden3/go-merkletree/db"
+)
+
+// Savepoint is a handle to the state of the KVDB at a point of the current
+// batch, obtained with KVDB.Savepoint.  RollbackTo undoes the writes done
+// since the Savepoint, and Release forgets it.
+type Savepoint struct {
+	id int
+	// journalLen is the number of journal entries when the Savepoint was
+	// made
+	journalLen        int
+	currentAccountIdx common.AccountIdx
+}
+
+// journalEntry is the previous value of a key written while there were open
+// savepoints, or a write of a StorageTx with deletes
+type journalEntry struct {
+	key   []byte
+	value []byte
+	// found is false if the key didn't exist
+	found bool
+}
+
+// savepoints contains the open savepoints of a KVDB, in the order in which
+// they were made, and the journal of the writes done since the first one
+type savepoints struct {
+	mutex   sync.Mutex
+	open    []Savepoint
+	journal []journalEntry
+	nextID  int
+}
+
+func (sp *savepoints) clear() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	sp.open = nil
+	sp.journal = nil
+}
+
+// find returns the position of the open savepoint with the given id
+func (sp *savepoints) find(id int) (int, error) {
+	for n := range sp.open {
+		if sp.open[n].id == id {
+			return n, nil
+		}
+	}
+	return 0, common.Wrap(ErrSavepointNotFound)
+}
+
+// record adds to the journal the current value of the key, if there are open
+// savepoints
+func (k *KVDB) record(key []byte) error {
+	k.savepoints.mutex.Lock()
+	defer k.savepoints.mutex.Unlock()
+	if len(k.savepoints.open) == 0 {
+		return nil
+	}
+	entry := journalEntry{key: append([]byte{}, key...)}
+	value, err := k.backend.current().Get(key)
+	if err == nil {
+		entry.value = append([]byte{}, value...)
+		entry.found = true
+	} else if common.Unwrap(err) != db.ErrNotFound {
+		return common.Wrap(err)
+	}
+	k.savepoints.journal = append(k.savepoints.journal, entry)
+	return nil
+}
+
+// Savepoint returns a handle to the current state of the KVDB, to which the
+// KVDB can go back with RollbackTo as long as there are no checkpoints or
+// resets in between.  Savepoints can be nested.
+func (k *KVDB) Savepoint() Savepoint {
+	k.savepoints.mutex.Lock()
+	defer k.savepoints.mutex.Unlock()
+	sp := Savepoint{
+		id:                k.savepoints.nextID,
+		journalLen:        len(k.savepoints.journal),
+		currentAccountIdx: k.CurrentAccountIdx,
+	}
+	k.savepoints.nextID++
+	k.savepoints.open = append(k.savepoints.open, sp)
+	return sp
+}
+
+// RollbackTo undoes all the writes done since the Savepoint, and releases the
+// savepoints made after it.  The Savepoint stays open, so it can be rolled
+// back to again.
+func (k *KVDB) RollbackTo(sp Savepoint) error {
+	k.savepoints.mutex.Lock()
+	defer k.savepoints.mutex.Unlock()
+	n, err := k.savepoints.find(sp.id)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	journal := k.savepoints.journal
+	// the entries are undone from the newest, so each key ends with the
+	// value it had at the savepoint
+	undo := make([]journalEntry, 0, len(journal)-sp.journalLen)
+	for i := len(journal) - 1; i >= sp.journalLen; i-- {
+		undo = append(undo, journal[i])
+	}
+	if err := k.backend.write(undo); err != nil {
+		return common.Wrap(err)
+	}
+	k.savepoints.journal = journal[:sp.journalLen]
+	k.savepoints.open = k.savepoints.open[:n+1]
+	k.CurrentAccountIdx = sp.currentAccountIdx
+	return nil
+}
+
+// Release forgets the Savepoint and the savepoints made after it, keeping the
+// writes done since them.  Once there are no open savepoints, the writes are
+// no longer recorded.
+func (k *KVDB) Release(sp Savepoint) error {
+	k.savepoints.mutex.Lock()
+	defer k.savepoints.mutex.Unlock()
+	n, err := k.savepoints.find(sp.id)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	k.savepoints.open = k.savepoints.open[:n]
+	if n == 0 {
+		k.savepoints.journal = nil
+	}
+	return nil
+}
+
+// Storage is the db.Storage of the KVDB.  While the KVDB has open savepoints,
+// it records the previous value of each key written, so that the writes can
+// be undone with KVDB.RollbackTo.
+type Storage struct {
+	sto    db.Storage
+	prefix []byte
+	kvdb   *KVDB
+}
+
+// NewTx implements the method NewTx of the interface db.Storage
+func (s *Storage) NewTx() (db.Tx, error) {
+	tx, err := s.prefixed().NewTx()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &StorageTx{Tx: tx, sto: s}, nil
+}
+
+// WithPrefix implements the method WithPrefix of the interface db.Storage
+func (s *Storage) WithPrefix(prefix []byte) db.Storage {
+	return &Storage{
+		sto:    s.sto,
+		prefix: append(append([]byte{}, s.prefix...), prefix...),
+		kvdb:   s.kvdb,
+	}
+}
+
+// Get retrieves a value from a key in the db.Storage
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.prefixed().Get(key)
+}
+
+// Iterate implements the method Iterate of the interface db.Storage
+func (s *Storage) Iterate(f func([]byte, []byte) (bool, error)) error {
+	return s.prefixed().Iterate(f)
+}
+
+// List implements the method List of the interface db.Storage
+func (s *Storage) List(limit int) ([]db.KV, error) {
+	return s.prefixed().List(limit)
+}
+
+// Close implements the method Close of the interface db.Storage
+func (s *Storage) Close() {
+	s.sto.Close()
+}
+
+// prefixed returns the db of the KVDB with the prefix of the Storage
+func (s *Storage) prefixed() db.Storage {
+	if len(s.prefix) == 0 {
+		return s.sto
+	}
+	return s.sto.WithPrefix(s.prefix)
+}
+
+// StorageTx implements the db.Tx interface over a Storage, and can also delete
+// keys.  The writes of a StorageTx without deletes are committed by the
+// underlying db.Tx, and the ones of a StorageTx with deletes by the backend of
+// the KVDB, in both cases atomically.
+type StorageTx struct {
+	db.Tx
+	sto *Storage
+	// writes are the puts and deletes of the tx in order, with the keys
+	// of the KVDB
+	writes []journalEntry
+	// deleted are the keys of the KVDB deleted by the tx and not written
+	// again
+	deleted map[string]bool
+	// hasDeletes is true if the tx has deleted any key
+	hasDeletes bool
+	// closed is true once the underlying db.Tx is closed
+	closed bool
+}
+
+// Get retrieves a value from a key in the StorageTx, or in its Storage if it
+// has not been written in the tx
+func (tx *StorageTx) Get(k []byte) ([]byte, error) {
+	if tx.deleted[string(tx.key(k))] {
+		return nil, db.ErrNotFound
+	}
+	return tx.Tx.Get(k)
+}
+
+// Put saves a key:value into the StorageTx, recording the previous value of
+// the key if the KVDB has open savepoints
+func (tx *StorageTx) Put(k, v []byte) error {
+	key := tx.key(k)
+	if err := tx.sto.kvdb.record(key); err != nil {
+		return common.Wrap(err)
+	}
+	tx.add(journalEntry{key: key, value: append([]byte{}, v...), found: true})
+	return tx.Tx.Put(k, v)
+}
+
+// Delete removes a key from the StorageTx, recording the previous value of the
+// key if the KVDB has open savepoints
+func (tx *StorageTx) Delete(k []byte) error {
+	key := tx.key(k)
+	if err := tx.sto.kvdb.record(key); err != nil {
+		return common.Wrap(err)
+	}
+	tx.add(journalEntry{key: key})
+	return nil
+}
+
+// key returns the key of the KVDB of the key k of the StorageTx
+func (tx *StorageTx) key(k []byte) []byte {
+	return append(append([]byte{}, tx.sto.prefix...), k...)
+}
+
+// add appends a put, or a delete if the entry is not found, to the writes of
+// the tx
+func (tx *StorageTx) add(w journalEntry) {
+	tx.writes = append(tx.writes, w)
+	if w.found {
+		delete(tx.deleted, string(w.key))
+		return
+	}
+	if tx.deleted == nil {
+		tx.deleted = make(map[string]bool)
+	}
+	tx.deleted[string(w.key)] = true
+	tx.hasDeletes = true
+}
+
+// Add implements the method Add of the interface db.Tx
+func (tx *StorageTx) Add(atx db.Tx) error {
+	if storageTx, ok := atx.(*StorageTx); ok {
+		for _, w := range storageTx.writes {
+			tx.add(w)
+		}
+		atx = storageTx.Tx
+	}
+	return tx.Tx.Add(atx)
+}
+
+// Commit implements the method Commit of the interface db.Tx
+func (tx *StorageTx) Commit() error {
+	if !tx.hasDeletes {
+		return tx.Tx.Commit()
+	}
+	tx.Close()
+	return common.Wrap(tx.sto.kvdb.backend.write(tx.writes))
+}
+
+// Close implements the method Close of the interface db.Tx.  The underlying
+// db.Tx is closed only once, so Close can be deferred before Commit.
+func (tx *StorageTx) Close() {
+	if tx.closed {
+		return
+	}
+	tx.closed = true
+	tx.Tx.Close()
+}
@@ -0,0 +1,272 @@
+package kvdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/iden3/go-merkletree/db/pebble"
+)
+
+// A snapshot is a portable copy of all the keys of a checkpoint, with the
+// layout:
+//
+//	magic (8 bytes) | version (uint32) | batchNum (8 bytes)
+//	[ len(key) (uvarint) | key | len(value) (uvarint) | value ]*
+//	0 (uvarint) | sha256 of all the previous bytes (32 bytes)
+//
+// The keys are written in ascending order, so two snapshots of the same
+// checkpoint are equal.
+
+const (
+	// SnapshotVersion is the version of the snapshot layout written by
+	// ExportCheckpoint
+	SnapshotVersion = 1
+	// maxSnapshotEntryLen is the maximum length of a key or a value read
+	// from a snapshot
+	maxSnapshotEntryLen = 1 << 20
+	// snapshotTxKeys is the number of keys written in each db tx by
+	// ImportCheckpoint
+	snapshotTxKeys = 1024
+)
+
+var (
+	snapshotMagic = []byte("kvdbsnap")
+	// ErrSnapshotInvalid is returned when a snapshot can't be parsed
+	ErrSnapshotInvalid = fmt.Errorf("invalid snapshot")
+	// ErrSnapshotVersion is returned when a snapshot has a version that
+	// is not supported
+	ErrSnapshotVersion = fmt.Errorf("unsupported snapshot version")
+	// ErrSnapshotChecksum is returned when the checksum of a snapshot
+	// doesn't match its content
+	ErrSnapshotChecksum = fmt.Errorf("snapshot checksum mismatch")
+	// ErrSnapshotPathNotEmpty is returned when a snapshot is imported in a
+	// path that already contains files
+	ErrSnapshotPathNotEmpty = fmt.Errorf("snapshot import path is not empty")
+)
+
+// ExportCheckpoint writes a snapshot of the checkpoint at the given batchNum
+// to w.  The checkpoint is read from a View, so that it can't be deleted by
+// DeleteOldCheckpoints while it's being exported.
+func (k *KVDB) ExportCheckpoint(batchNum common.BatchNum, w io.Writer) error {
+	view, err := k.OpenAt(batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer view.Close()
+	return common.Wrap(view.Export(w))
+}
+
+// Export writes a snapshot of the checkpoint of the View to w, which can be
+// imported with ImportCheckpoint
+func (v *View) Export(w io.Writer) error {
+	batchNum := v.batchNum
+	sto := v.DB()
+
+	h := sha256.New()
+	bw := bufio.NewWriter(w)
+	mw := io.MultiWriter(bw, h)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], SnapshotVersion)
+	if _, err := mw.Write(append(append(append([]byte{}, snapshotMagic...),
+		header[:]...), batchNum.Bytes()...)); err != nil {
+		return common.Wrap(err)
+	}
+	var lenBytes [binary.MaxVarintLen64]byte
+	writeEntry := func(b []byte) error {
+		n := binary.PutUvarint(lenBytes[:], uint64(len(b)))
+		if _, err := mw.Write(lenBytes[:n]); err != nil {
+			return common.Wrap(err)
+		}
+		_, err := mw.Write(b)
+		return common.Wrap(err)
+	}
+	if err := sto.Iterate(func(key, value []byte) (bool, error) {
+		if err := writeEntry(key); err != nil {
+			return false, common.Wrap(err)
+		}
+		if err := writeEntry(value); err != nil {
+			return false, common.Wrap(err)
+		}
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	// the empty key ends the entries
+	if err := writeEntry(nil); err != nil {
+		return common.Wrap(err)
+	}
+	if _, err := bw.Write(h.Sum(nil)); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(bw.Flush())
+}
+
+// ImportCheckpoint reads a snapshot written by ExportCheckpoint and stores it
+// as the checkpoint of its batchNum, and as the current db, in cfg.Path,
+// which must not exist or be empty.  The KVDB opened afterwards with
+// NewKVDB(cfg) is at the batchNum of the snapshot, which is returned.  If the
+// snapshot is not valid, nothing is left in cfg.Path.  The snapshots can't be
+// imported in an in-memory KVDB.
+func ImportCheckpoint(cfg Config, r io.Reader) (common.BatchNum, error) {
+	if cfg.InMemory {
+		return 0, common.Wrap(ErrInMemory)
+	}
+	files, err := os.ReadDir(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, common.Wrap(err)
+	}
+	if len(files) > 0 {
+		return 0, common.Wrap(ErrSnapshotPathNotEmpty)
+	}
+
+	hr := &hashReader{r: bufio.NewReader(r), h: sha256.New()}
+	header := make([]byte, len(snapshotMagic)+4+8) //nolint:gomnd
+	if _, err := io.ReadFull(hr, header); err != nil {
+		return 0, common.Wrap(fmt.Errorf("%w: header: %v", ErrSnapshotInvalid, err))
+	}
+	if !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) {
+		return 0, common.Wrap(fmt.Errorf("%w: wrong magic", ErrSnapshotInvalid))
+	}
+	header = header[len(snapshotMagic):]
+	if version := binary.BigEndian.Uint32(header[:4]); version != SnapshotVersion {
+		return 0, common.Wrap(fmt.Errorf("%w: %d", ErrSnapshotVersion, version))
+	}
+	batchNum, err := common.BatchNumFromBytes(header[4:])
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	if batchNum == 0 {
+		return 0, common.Wrap(fmt.Errorf("%w: batchNum 0", ErrSnapshotInvalid))
+	}
+
+	checkpointPath := path.Join(cfg.Path, fmt.Sprintf("%s%d", PathBatchNum, batchNum))
+	currentPath := path.Join(cfg.Path, PathCurrent)
+	err = importEntries(checkpointPath, hr, batchNum, cfg.Retention.KeepEvery)
+	if err == nil {
+		err = PebbleMakeCheckpoint(checkpointPath, currentPath)
+	}
+	if err != nil {
+		for _, p := range []string{checkpointPath, currentPath} {
+			if rmErr := os.RemoveAll(p); rmErr != nil {
+				return 0, common.Wrap(rmErr)
+			}
+		}
+		return 0, common.Wrap(err)
+	}
+	return batchNum, nil
+}
+
+// hashReader is a reader that hashes the bytes that are read from it
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n]) //nolint:errcheck
+	return n, err
+}
+
+func (hr *hashReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{b}) //nolint:errcheck
+	}
+	return b, err
+}
+
+// importEntries writes the entries of a snapshot read from hr in a new db at
+// dbPath, and then checks the checksum of the snapshot and that the db
+// contains the given batchNum as current batch.  The KeepEvery of the snapshot
+// is replaced by the given one, as its single checkpoint has no gaps.
+func importEntries(dbPath string, hr *hashReader, batchNum common.BatchNum,
+	keepEvery int) error {
+	sto, err := pebble.NewPebbleStorage(dbPath, false)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer sto.Close()
+
+	readEntry := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return nil, common.Wrap(fmt.Errorf("%w: %v", ErrSnapshotInvalid, err))
+		}
+		if n > maxSnapshotEntryLen {
+			return nil, common.Wrap(fmt.Errorf("%w: entry of %d bytes",
+				ErrSnapshotInvalid, n))
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(hr, b); err != nil {
+			return nil, common.Wrap(fmt.Errorf("%w: %v", ErrSnapshotInvalid, err))
+		}
+		return b, nil
+	}
+	for done := false; !done; {
+		tx, err := sto.NewTx()
+		if err != nil {
+			return common.Wrap(err)
+		}
+		for n := 0; n < snapshotTxKeys; n++ {
+			key, err := readEntry()
+			if err != nil {
+				return common.Wrap(err)
+			}
+			if len(key) == 0 {
+				done = true
+				break
+			}
+			value, err := readEntry()
+			if err != nil {
+				return common.Wrap(err)
+			}
+			if err := tx.Put(key, value); err != nil {
+				return common.Wrap(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return common.Wrap(err)
+		}
+	}
+
+	// the checksum is not part of the hashed bytes
+	expected := hr.h.Sum(nil)
+	checksum := make([]byte, len(expected))
+	if _, err := io.ReadFull(hr.r, checksum); err != nil {
+		return common.Wrap(fmt.Errorf("%w: checksum: %v", ErrSnapshotInvalid, err))
+	}
+	if !bytes.Equal(checksum, expected) {
+		return common.Wrap(ErrSnapshotChecksum)
+	}
+
+	cbBytes, err := sto.Get(KeyCurrentBatch)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("%w: current batch: %v", ErrSnapshotInvalid, err))
+	}
+	currentBatch, err := common.BatchNumFromBytes(cbBytes)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if currentBatch != batchNum {
+		return common.Wrap(fmt.Errorf("%w: current batch %d in a snapshot of the batch %d",
+			ErrSnapshotInvalid, currentBatch, batchNum))
+	}
+	tx, err := sto.NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer tx.Close()
+	if err := tx.Put(keyKeepEvery, keepEveryBytes(keepEvery)); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Commit())
+}
@@ -0,0 +1,170 @@
+package kvdb
+
+import (
+	"fmt"
+	"sync"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/iden3/go-merkletree/db"
+)
+
+// ErrReadOnly is returned when a View is written
+var ErrReadOnly = fmt.Errorf("read-only view of a checkpoint")
+
+// openCheckpoint is a checkpoint opened by one or more views
+type openCheckpoint struct {
+	sto  db.Storage
+	refs int
+	// closing is set when the checkpoint is waiting for its views to be
+	// closed to be removed, and no more views can be opened
+	closing bool
+}
+
+// View is a read-only view of a checkpoint of the KVDB, obtained with
+// KVDB.OpenAt.  While a View is open, the checkpoint is not deleted by
+// DeleteOldCheckpoints, and DeleteCheckpoint, Reset and MakeCheckpoint wait
+// for it to be closed before removing or replacing the checkpoint.
+type View struct {
+	// kvdb is nil for the views of OpenCheckpoint
+	kvdb     *KVDB
+	batchNum common.BatchNum
+	open     *openCheckpoint
+	once     sync.Once
+}
+
+// OpenAt returns a read-only View of the checkpoint at the given batchNum,
+// which can be used concurrently with the KVDB.  The views of the same
+// checkpoint share the opened db, which is closed when all of them are
+// closed.
+func (k *KVDB) OpenAt(batchNum common.BatchNum) (*View, error) {
+	// a checkpoint can't be opened while it's being deleted or copied
+	k.mutexDelOld.Lock()
+	defer k.mutexDelOld.Unlock()
+	k.mutexCheckpoint.Lock()
+	defer k.mutexCheckpoint.Unlock()
+	k.mutexViews.Lock()
+	defer k.mutexViews.Unlock()
+
+	if k.views == nil {
+		k.views = make(map[common.BatchNum]*openCheckpoint)
+	}
+	open, ok := k.views[batchNum]
+	if ok && open.closing {
+		return nil, common.Wrap(fmt.Errorf("%w: batchNum %d is being deleted",
+			ErrCheckpointNotFound, batchNum))
+	}
+	if !ok {
+		if err := k.checkpointExists(batchNum); err != nil {
+			return nil, common.Wrap(err)
+		}
+		sto, err := k.backend.openCheckpoint(batchNum)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		open = &openCheckpoint{sto: sto}
+		k.views[batchNum] = open
+	}
+	open.refs++
+	return &View{kvdb: k, batchNum: batchNum, open: open}, nil
+}
+
+// OpenCheckpoint returns a read-only View of the checkpoint at the given
+// batchNum stored in cfg.Path, without opening the KVDB, so it doesn't modify
+// the current db nor the checkpoints, and can be used while another process,
+// like a running node, has the KVDB opened.  That process may still delete
+// the checkpoint if it's old, so the View should be closed soon.  The View is
+// not shared, and closing it closes the checkpoint.
+func OpenCheckpoint(cfg Config, batchNum common.BatchNum) (*View, error) {
+	if cfg.InMemory {
+		return nil, common.Wrap(ErrInMemory)
+	}
+	b := &diskBackend{path: cfg.Path}
+	ok, err := b.hasCheckpoint(batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if !ok {
+		return nil, common.Wrap(fmt.Errorf("%w: batchNum %d", ErrCheckpointNotFound, batchNum))
+	}
+	sto, err := b.openCheckpoint(batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &View{batchNum: batchNum, open: &openCheckpoint{sto: sto, refs: 1}}, nil
+}
+
+// LastCheckpoint returns the batchNum of the last checkpoint stored in
+// cfg.Path, without opening the KVDB, or 0 if there are no checkpoints
+func LastCheckpoint(cfg Config) (common.BatchNum, error) {
+	if cfg.InMemory {
+		return 0, common.Wrap(ErrInMemory)
+	}
+	checkpoints, err := (&diskBackend{path: cfg.Path}).checkpoints()
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	var last int
+	for _, checkpoint := range checkpoints {
+		if checkpoint > last {
+			last = checkpoint
+		}
+	}
+	return common.BatchNum(last), nil
+}
+
+// inUse returns true if the checkpoint at the given batchNum has open views.
+// It must be called with mutexViews locked.
+func (k *KVDB) inUse(batchNum common.BatchNum) bool {
+	open, ok := k.views[batchNum]
+	return ok && open.refs > 0
+}
+
+// BatchNum returns the batchNum of the checkpoint of the View
+func (v *View) BatchNum() common.BatchNum {
+	return v.batchNum
+}
+
+// DB returns the read-only db.Storage of the View
+func (v *View) DB() db.Storage {
+	return readOnlyStorage{v.open.sto}
+}
+
+// Close releases the View.  The checkpoint is closed when it has no more
+// views, and is deleted by the next DeleteOldCheckpoints if it's old.  A View
+// of OpenCheckpoint closes the checkpoint.
+func (v *View) Close() {
+	v.once.Do(func() {
+		k := v.kvdb
+		if k == nil {
+			// opened by OpenCheckpoint
+			v.open.sto.Close()
+			return
+		}
+		k.mutexViews.Lock()
+		defer k.mutexViews.Unlock()
+		v.open.refs--
+		if v.open.refs == 0 {
+			v.open.sto.Close()
+			// the checkpoint may have been deleted and opened again
+			if k.views[v.batchNum] == v.open {
+				delete(k.views, v.batchNum)
+			}
+			k.viewsClosed.Broadcast()
+		}
+	})
+}
+
+// readOnlyStorage is a db.Storage that can't be written
+type readOnlyStorage struct {
+	db.Storage
+}
+
+// NewTx returns ErrReadOnly
+func (s readOnlyStorage) NewTx() (db.Tx, error) {
+	return nil, common.Wrap(ErrReadOnly)
+}
+
+// WithPrefix returns a read-only db.Storage with the given prefix
+func (s readOnlyStorage) WithPrefix(prefix []byte) db.Storage {
+	return readOnlyStorage{s.Storage.WithPrefix(prefix)}
+}
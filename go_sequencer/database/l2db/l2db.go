@@ -242,8 +242,8 @@ func (l2db *L2DB) addTxs(txs []common.PoolL2Tx, checkPoolIsFull bool) error {
 // selectPoolTxCommon select part of queries to get common.PoolL2Tx
 const selectPoolTxCommon = `SELECT  tx_pool.tx_id, from_idx, to_idx, tx_pool.to_eth_addr, 
 tx_pool.to_bjj, tx_pool.token_id, tx_pool.amount, tx_pool.fee, tx_pool.nonce, 
-tx_pool.state, tx_pool.info, tx_pool.signature, tx_pool.timestamp, rq_from_idx, 
-rq_to_idx, tx_pool.rq_to_eth_addr, tx_pool.rq_to_bjj, tx_pool.rq_token_id, tx_pool.rq_amount, 
+tx_pool.state, tx_pool.info, tx_pool.error_code, tx_pool.error_type, 
+tx_pool.signature, tx_pool.timestamp, rq_from_idx, rq_to_idx, tx_pool.rq_to_eth_addr, tx_pool.rq_to_bjj, tx_pool.rq_token_id, tx_pool.rq_amount, 
 tx_pool.rq_fee, tx_pool.rq_nonce, tx_pool.tx_type, tx_pool.rq_offset, tx_pool.atomic_group_id, tx_pool.max_num_batch, 
 (fee_percentage(tx_pool.fee::NUMERIC) * token.usd * tx_pool.amount_f) /
 	(10.0 ^ token.decimals::NUMERIC) AS fee_usd, token.usd_update
@@ -259,6 +259,46 @@ func (l2db *L2DB) GetTx(txID common.TxID) (*common.PoolL2Tx, error) {
 	))
 }
 
+// GetPendingTxs returns the pending txs of the pool that are not marked with
+// external_delete, in the order in which they were added to the pool
+func (l2db *L2DB) GetPendingTxs() ([]common.PoolL2Tx, error) {
+	var txs []*common.PoolL2Tx
+	err := meddler.QueryAll(
+		l2db.dbRead, &txs,
+		selectPoolTxCommon+"WHERE state = $1 AND NOT external_delete ORDER BY tx_pool.item_id ASC;",
+		common.PoolL2TxStatePending,
+	)
+	return database.SlicePtrsToSlice(txs).([]common.PoolL2Tx), common.Wrap(err)
+}
+
+// UpdateTxsInfo updates the Info, ErrorCode and ErrorType of the given pool
+// txs, which have not been selected by the TxSelector in the batch batchNum
+func (l2db *L2DB) UpdateTxsInfo(txs []common.PoolL2Tx, batchNum common.BatchNum) (err error) {
+	if len(txs) == 0 {
+		return nil
+	}
+	const query = `UPDATE tx_pool SET info = $2, error_code = $3, error_type = $4
+	WHERE tx_pool.tx_id = $1;`
+
+	txn, err := l2db.dbWrite.Beginx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer func() {
+		if err != nil {
+			database.Rollback(txn)
+		}
+	}()
+	for i := range txs {
+		info := fmt.Sprintf("BatchNum: %d. %s", batchNum, txs[i].Info)
+		if _, err = txn.Exec(query, txs[i].TxID, info, txs[i].ErrorCode,
+			txs[i].ErrorType); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	return common.Wrap(txn.Commit())
+}
+
 // Update PoolL2Tx transaction in the pool
 func (l2db *L2DB) updateTx(tx common.PoolL2Tx) error {
 	const queryUpdate = `UPDATE tx_pool SET to_idx = ?, to_eth_addr = ?, to_bjj = ?, max_num_batch = ?, 
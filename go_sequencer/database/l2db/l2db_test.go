@@ -153,6 +153,81 @@ func TestAddTxTest(t *testing.T) {
 	assert.Equal(t, fetchedTx.ToIdx, common.AccountIdx(1))
 }
 
+func TestUpdateTxsInfo(t *testing.T) {
+	err := prepareHistoryDB(historyDB)
+	if err != nil {
+		log.Error("Error prepare historyDB", err)
+	}
+	poolL2Txs, err := generatePoolL2Txs()
+	require.NoError(t, err)
+	for i := range poolL2Txs {
+		require.NoError(t, l2DB.AddTxTest(&poolL2Txs[i]))
+	}
+
+	discarded := []common.PoolL2Tx{poolL2Txs[0], poolL2Txs[2]}
+	discarded[0].Info = "max out vouches"
+	discarded[0].ErrorCode = 1
+	discarded[0].ErrorType = "ErrMaxOutVouches"
+	discarded[1].Info = "vouch cooldown"
+	discarded[1].ErrorCode = 2
+	discarded[1].ErrorType = "ErrVouchCooldown"
+	require.NoError(t, l2DB.UpdateTxsInfo(discarded, 5))
+
+	fetchedTx, err := l2DB.GetTx(poolL2Txs[0].TxID)
+	require.NoError(t, err)
+	assert.Equal(t, "BatchNum: 5. max out vouches", fetchedTx.Info)
+	assert.Equal(t, 1, fetchedTx.ErrorCode)
+	assert.Equal(t, "ErrMaxOutVouches", fetchedTx.ErrorType)
+	fetchedTx, err = l2DB.GetTx(poolL2Txs[2].TxID)
+	require.NoError(t, err)
+	assert.Equal(t, "BatchNum: 5. vouch cooldown", fetchedTx.Info)
+	assert.Equal(t, 2, fetchedTx.ErrorCode)
+	assert.Equal(t, "ErrVouchCooldown", fetchedTx.ErrorType)
+	// the other txs are not updated
+	fetchedTx, err = l2DB.GetTx(poolL2Txs[1].TxID)
+	require.NoError(t, err)
+	assert.Equal(t, "", fetchedTx.Info)
+	assert.Equal(t, 0, fetchedTx.ErrorCode)
+
+	require.NoError(t, l2DB.UpdateTxsInfo(nil, 6))
+}
+
+func TestGetPendingTxs(t *testing.T) {
+	err := prepareHistoryDB(historyDB)
+	if err != nil {
+		log.Error("Error prepare historyDB", err)
+	}
+	poolL2Txs, err := generatePoolL2Txs()
+	require.NoError(t, err)
+	for i := range poolL2Txs {
+		require.NoError(t, l2DB.AddTxTest(&poolL2Txs[i]))
+	}
+
+	// the txs are returned in the order of the pool
+	fetchedTxs, err := l2DB.GetPendingTxs()
+	require.NoError(t, err)
+	require.Equal(t, len(poolL2Txs), len(fetchedTxs))
+	for i := range fetchedTxs {
+		assertTx(t, &poolL2Txs[i], &fetchedTxs[i])
+	}
+
+	// the txs discarded by the TxSelector stay pending, with the reason of
+	// the rejection
+	discarded := []common.PoolL2Tx{poolL2Txs[1]}
+	discarded[0].Info = "vouch cooldown"
+	discarded[0].ErrorCode = 2
+	discarded[0].ErrorType = "ErrVouchCooldown"
+	require.NoError(t, l2DB.UpdateTxsInfo(discarded, 3))
+	fetchedTxs, err = l2DB.GetPendingTxs()
+	require.NoError(t, err)
+	require.Equal(t, len(poolL2Txs), len(fetchedTxs))
+	assert.Equal(t, poolL2Txs[1].TxID, fetchedTxs[1].TxID)
+	assert.Equal(t, common.PoolL2TxStatePending, fetchedTxs[1].State)
+	assert.Equal(t, "BatchNum: 3. vouch cooldown", fetchedTxs[1].Info)
+	assert.Equal(t, 2, fetchedTxs[1].ErrorCode)
+	assert.Equal(t, "ErrVouchCooldown", fetchedTxs[1].ErrorType)
+}
+
 func assertTx(t *testing.T, expected, actual *common.PoolL2Tx) {
 	// Check that timestamp has been set within the last 3 seconds
 	assert.Less(t, time.Now().UTC().Unix()-3, actual.Timestamp.Unix())
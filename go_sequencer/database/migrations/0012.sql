@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE batch ADD COLUMN score_algorithm VARCHAR(32);
+
+
+-- +migrate Down
+ALTER TABLE batch DROP COLUMN score_algorithm;
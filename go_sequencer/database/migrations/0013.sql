@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE batch ADD COLUMN account_root DECIMAL(78,0);
+ALTER TABLE batch ADD COLUMN vouch_root DECIMAL(78,0);
+ALTER TABLE batch ADD COLUMN score_root DECIMAL(78,0);
+
+
+-- +migrate Down
+ALTER TABLE batch DROP COLUMN account_root;
+ALTER TABLE batch DROP COLUMN vouch_root;
+ALTER TABLE batch DROP COLUMN score_root;
@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE batch ADD COLUMN score_seeds BYTEA NOT NULL DEFAULT decode('5B5D0A', 'hex');
+
+CREATE TABLE score_seeds_update (
+    item_id SERIAL PRIMARY KEY,
+    eth_block_num BIGINT NOT NULL REFERENCES block (eth_block_num) ON DELETE CASCADE,
+    seeds BYTEA NOT NULL
+);
+
+
+-- +migrate Down
+DROP TABLE IF EXISTS score_seeds_update;
+ALTER TABLE batch DROP COLUMN score_seeds;
@@ -0,0 +1,73 @@
+package migrations_test
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// This migration adds the column `score_seeds` on `batch` table and creates
+// the `score_seeds_update` table
+
+type migrationTest0014 struct{}
+
+func (m migrationTest0014) InsertData(db *sqlx.DB) error {
+	// insert tx
+	const queryInsert = `
+	INSERT INTO block
+	(eth_block_num, "timestamp", hash)
+	VALUES(48295, '2021-09-13 08:28:39.000', decode('2AB24E7021318D6CF0686E8F8FBFB0A63CB79A9FB5CDECE7C09FD4438E67242F','hex'));
+	INSERT INTO block
+	(eth_block_num, "timestamp", hash)
+	VALUES(48286, '2021-09-13 08:28:39.000', decode('2AB24E7021318D6CF0686E8F8FBFB0A63CB79A9FB5CDECE7C09FD4438E67242A','hex'));
+
+	INSERT INTO batch
+	(item_id, batch_num, eth_block_num, forger_addr, fees_collected, fee_idxs_coordinator, state_root, num_accounts, last_idx, exit_root, forge_l1_txs_num, slot_num, total_fees_usd, eth_tx_hash, score_algorithm, account_root, vouch_root, score_root)
+	VALUES(1419, 1419, 48286, decode('DCC5DD922FB1D0FD0C450A0636A8CE827521F0ED','hex'), decode('7B7D0A','hex'), decode('5B5D0A','hex'), 0, 0, 255, 0, 1418, 1205, 0, decode('4BC9C94E8CF93AD475F8C8394BC934AF5EB0802FE4009D13F58AE25F6047DA95','hex'), 'pagerank', 1, 2, 3);
+	`
+	_, err := db.Exec(queryInsert)
+	return err
+}
+
+func (m migrationTest0014) RunAssertsAfterMigrationUp(t *testing.T, db *sqlx.DB) {
+	// batches forged before the migration have an empty seed set
+	const queryGetBatch = `SELECT COUNT(*) FROM batch WHERE eth_tx_hash = decode('4BC9C94E8CF93AD475F8C8394BC934AF5EB0802FE4009D13F58AE25F6047DA95','hex')
+		AND score_seeds = decode('5B5D0A','hex');`
+	row := db.QueryRow(queryGetBatch)
+	var result int
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 1, result)
+
+	insert := `INSERT INTO batch
+	(item_id, batch_num, eth_block_num, forger_addr, fees_collected, fee_idxs_coordinator, state_root, num_accounts, last_idx, exit_root, forge_l1_txs_num, slot_num, total_fees_usd, eth_tx_hash, score_algorithm, account_root, vouch_root, score_root, score_seeds)
+	VALUES(1420, 1420, 48295, decode('DCC5DD922FB1D0FD0C450A0636A8CE827521F0ED','hex'), decode('7B7D0A','hex'), decode('5B5D0A','hex'), 0, 0, 255, 0, 1419, 1205, 0, decode('AE80AB27E97213DEC805C78ED9C637E0414A541D489377F766B3372170F4AD66','hex'), 'pagerank', 1, 2, 3, decode('5B3235365D0A','hex'));
+	INSERT INTO score_seeds_update (eth_block_num, seeds) VALUES(48286, decode('5B3235365D0A','hex'));
+	`
+	_, err := db.Exec(insert)
+	assert.NoError(t, err)
+
+	const queryGetUpdate = `SELECT COUNT(*) FROM score_seeds_update WHERE eth_block_num = 48286;`
+	row = db.QueryRow(queryGetUpdate)
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 1, result)
+}
+
+func (m migrationTest0014) RunAssertsAfterMigrationDown(t *testing.T, db *sqlx.DB) {
+	// check that the batch inserted in previous step is persisted with same content
+	const queryGetTx = `SELECT COUNT(*) FROM batch WHERE eth_tx_hash = decode('AE80AB27E97213DEC805C78ED9C637E0414A541D489377F766B3372170F4AD66','hex');`
+	row := db.QueryRow(queryGetTx)
+	var result int
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 1, result)
+
+	// check that the seed set column and table don't exist anymore
+	row = db.QueryRow(`SELECT COUNT(*) FROM batch WHERE score_seeds IS NULL;`)
+	assert.Equal(t, `pq: column "score_seeds" does not exist`, row.Scan(&result).Error())
+	row = db.QueryRow(`SELECT COUNT(*) FROM score_seeds_update;`)
+	assert.Equal(t, `pq: relation "score_seeds_update" does not exist`, row.Scan(&result).Error())
+}
+
+func TestMigration0014(t *testing.T) {
+	runMigrationTest(t, 14, migrationTest0014{})
+}
@@ -0,0 +1,23 @@
+-- +migrate Up
+CREATE TABLE sybil_report (
+    item_id SERIAL PRIMARY KEY,
+    eth_block_num BIGINT NOT NULL REFERENCES block (eth_block_num) ON DELETE CASCADE,
+    batch_num BIGINT NOT NULL REFERENCES batch (batch_num) ON DELETE CASCADE,
+    idx BIGINT NOT NULL REFERENCES account (idx) ON DELETE CASCADE,
+    slashed DECIMAL(78,0) NOT NULL
+);
+
+CREATE TABLE vouch_slash (
+    item_id SERIAL PRIMARY KEY,
+    batch_num BIGINT NOT NULL REFERENCES batch (batch_num) ON DELETE CASCADE,
+    sybil_idx BIGINT NOT NULL REFERENCES account (idx) ON DELETE CASCADE,
+    from_idx BIGINT NOT NULL,
+    to_idx BIGINT NOT NULL,
+    slashed DECIMAL(78,0) NOT NULL,
+    unlocked DECIMAL(78,0) NOT NULL
+);
+
+
+-- +migrate Down
+DROP TABLE IF EXISTS vouch_slash;
+DROP TABLE IF EXISTS sybil_report;
@@ -0,0 +1,69 @@
+package migrations_test
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// This migration creates the `sybil_report` and `vouch_slash` tables
+
+type migrationTest0015 struct{}
+
+func (m migrationTest0015) InsertData(db *sqlx.DB) error {
+	// insert block, batch and account
+	const queryInsert = `
+	INSERT INTO block
+	(eth_block_num, "timestamp", hash)
+	VALUES(48286, '2021-09-13 08:28:39.000', decode('2AB24E7021318D6CF0686E8F8FBFB0A63CB79A9FB5CDECE7C09FD4438E67242A','hex'));
+
+	INSERT INTO batch
+	(item_id, batch_num, eth_block_num, forger_addr, fees_collected, fee_idxs_coordinator, state_root, num_accounts, last_idx, exit_root, forge_l1_txs_num, slot_num, total_fees_usd, eth_tx_hash, score_algorithm, account_root, vouch_root, score_root)
+	VALUES(1419, 1419, 48286, decode('DCC5DD922FB1D0FD0C450A0636A8CE827521F0ED','hex'), decode('7B7D0A','hex'), decode('5B5D0A','hex'), 0, 0, 256, 0, 1418, 1205, 0, decode('4BC9C94E8CF93AD475F8C8394BC934AF5EB0802FE4009D13F58AE25F6047DA95','hex'), 'pagerank', 1, 2, 3);
+
+	INSERT INTO account
+	(idx, batch_num, bjj, eth_addr, nonce, balance)
+	VALUES(256, 1419, decode('FDDACE21457376B0952CCD19CE66B854FDD7C6E45905B0A0A75747C87D41719A','hex'), decode('A631BE6995643E6085330A31B9E1AF48DD5D6B7F','hex'), 0, 1000);
+	`
+	_, err := db.Exec(queryInsert)
+	return err
+}
+
+func (m migrationTest0015) RunAssertsAfterMigrationUp(t *testing.T, db *sqlx.DB) {
+	insert := `INSERT INTO sybil_report (eth_block_num, batch_num, idx, slashed)
+	VALUES(48286, 1419, 256, 50);
+	INSERT INTO vouch_slash (batch_num, sybil_idx, from_idx, to_idx, slashed, unlocked)
+	VALUES(1419, 256, 257, 256, 50, 50);
+	INSERT INTO vouch_slash (batch_num, sybil_idx, from_idx, to_idx, slashed, unlocked)
+	VALUES(1419, 256, 256, 258, 0, 100);
+	`
+	_, err := db.Exec(insert)
+	assert.NoError(t, err)
+
+	var result int
+	row := db.QueryRow(`SELECT COUNT(*) FROM sybil_report WHERE idx = 256 AND slashed = 50;`)
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 1, result)
+	row = db.QueryRow(`SELECT COUNT(*) FROM vouch_slash WHERE sybil_idx = 256;`)
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 2, result)
+}
+
+func (m migrationTest0015) RunAssertsAfterMigrationDown(t *testing.T, db *sqlx.DB) {
+	// check that the account inserted in the first step is persisted
+	var result int
+	row := db.QueryRow(`SELECT COUNT(*) FROM account WHERE idx = 256;`)
+	assert.NoError(t, row.Scan(&result))
+	assert.Equal(t, 1, result)
+
+	// check that the tables don't exist anymore
+	row = db.QueryRow(`SELECT COUNT(*) FROM sybil_report;`)
+	assert.Equal(t, `pq: relation "sybil_report" does not exist`, row.Scan(&result).Error())
+	row = db.QueryRow(`SELECT COUNT(*) FROM vouch_slash;`)
+	assert.Equal(t, `pq: relation "vouch_slash" does not exist`, row.Scan(&result).Error())
+}
+
+func TestMigration0015(t *testing.T) {
+	runMigrationTest(t, 15, migrationTest0015{})
+}
@@ -0,0 +1,249 @@
+package statedb
+
+import (
+	"errors"
+	"math/big"
+	"tokamak-sybil-resistance/common"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-merkletree/db"
+)
+
+var (
+	// ErrInvalidLimit is used when AccountsPage is called with a limit
+	// lower than 1
+	ErrInvalidLimit = errors.New("limit must be greater than 0")
+	// PrefixKeyAddrIdx is the key prefix for the index of all the accounts
+	// of each eth address in the db
+	PrefixKeyAddrIdx = []byte("ai:")
+	// PrefixKeyBJJIdx is the key prefix for the index of all the accounts
+	// of each babyjubjub public key in the db
+	PrefixKeyBJJIdx = []byte("bi:")
+)
+
+// AccountFilter selects the accounts of AccountsIterFiltered and
+// AccountsPage.  The zero value selects all the accounts.
+type AccountFilter struct {
+	// MinBalance is the minimum balance of the accounts.  If nil, there's
+	// no minimum.
+	MinBalance *big.Int
+	// MinScore is the minimum score of the accounts.  The accounts without
+	// a score have a score of 0.
+	MinScore uint32
+	// HasVouches selects only the accounts that give or receive at least
+	// one active vouch
+	HasVouches bool
+}
+
+// match returns true if the account a is selected by the filter.  The checks
+// that need more reads of the db are done last.
+func (f *AccountFilter) match(s *StateDB, a *common.Account) (bool, error) {
+	if f.MinBalance != nil && (a.Balance == nil || a.Balance.Cmp(f.MinBalance) < 0) {
+		return false, nil
+	}
+	if f.MinScore > 0 {
+		score, err := s.GetScore(a.Idx)
+		if common.Unwrap(err) == db.ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, common.Wrap(err)
+		}
+		if score.Value < f.MinScore {
+			return false, nil
+		}
+	}
+	if f.HasVouches {
+		count, err := s.OutVouchCount(a.Idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if count > 0 {
+			return true, nil
+		}
+		received := false
+		if err := s.VouchesTo(a.Idx, func(_ *common.Vouch) (bool, error) {
+			received = true
+			return false, nil
+		}); err != nil {
+			return false, common.Wrap(err)
+		}
+		return received, nil
+	}
+	return true, nil
+}
+
+// accountsFrom iterates over the accounts stored in the db with an Idx equal
+// or greater than from, in ascending Idx order, until fn returns false or an
+// error.  The keys of the accounts below from are skipped without reading the
+// accounts.
+func accountsFrom(sto db.Storage, from common.AccountIdx,
+	fn func(a *common.Account) (bool, error)) error {
+	return common.Wrap(sto.WithPrefix(PrefixKeyAccIdx).Iterate(func(k []byte, _ []byte) (bool, error) {
+		idx, err := common.AccountIdxFromBytes(k)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if idx < from {
+			return true, nil
+		}
+		acc, err := GetAccountInTreeDB(sto, idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		return fn(acc)
+	}))
+}
+
+// AccountsIterFiltered iterates over the accounts stored in the StateDB that
+// are selected by the filter, in ascending Idx order, until fn returns false
+// or an error
+func (s *StateDB) AccountsIterFiltered(filter AccountFilter,
+	fn func(a *common.Account) (bool, error)) error {
+	return common.Wrap(accountsFrom(s.db.DB(), 0, func(a *common.Account) (bool, error) {
+		ok, err := filter.match(s, a)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !ok {
+			return true, nil
+		}
+		return fn(a)
+	}))
+}
+
+// AccountsPage returns up to limit accounts selected by the filter, in
+// ascending Idx order starting from the Idx from, and the cursor of the next
+// page: the Idx of the next selected account, or 0 if there are no more.  The
+// first page is obtained with from 0, and the next ones with the returned
+// cursor.  The pages are only consistent with each other if the StateDB
+// doesn't change between the calls.
+func (s *StateDB) AccountsPage(filter AccountFilter, from common.AccountIdx,
+	limit int) ([]common.Account, common.AccountIdx, error) {
+	if limit < 1 {
+		return nil, 0, common.Wrap(ErrInvalidLimit)
+	}
+	accounts := []common.Account{}
+	var next common.AccountIdx
+	if err := accountsFrom(s.db.DB(), from, func(a *common.Account) (bool, error) {
+		ok, err := filter.match(s, a)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !ok {
+			return true, nil
+		}
+		if len(accounts) == limit {
+			next = a.Idx
+			return false, nil
+		}
+		accounts = append(accounts, *a)
+		return true, nil
+	}); err != nil {
+		return nil, 0, common.Wrap(err)
+	}
+	return accounts, next, nil
+}
+
+// GetIdxsByEthAddr returns all the Idxs in the StateDB of the accounts of the
+// given Ethereum Address, in ascending order.  Will return ErrIdxNotFound if
+// there is none.
+func (s *StateDB) GetIdxsByEthAddr(addr ethCommon.Address) ([]common.AccountIdx, error) {
+	return s.idxsByIndex(append(append([]byte{}, PrefixKeyAddrIdx...), addr.Bytes()...))
+}
+
+// GetIdxsByBJJ returns all the Idxs in the StateDB of the accounts of the
+// given BabyJubJub PublicKey, whatever their Ethereum Address, in ascending
+// order.  Will return ErrIdxNotFound if there is none.
+func (s *StateDB) GetIdxsByBJJ(pk babyjub.PublicKeyComp) ([]common.AccountIdx, error) {
+	return s.idxsByIndex(append(append([]byte{}, PrefixKeyBJJIdx...), pk[:]...))
+}
+
+// idxsByIndex returns the Idxs of the index entries with the given prefix
+func (s *StateDB) idxsByIndex(prefix []byte) ([]common.AccountIdx, error) {
+	var idxs []common.AccountIdx
+	if err := s.db.DB().WithPrefix(prefix).Iterate(func(k []byte, _ []byte) (bool, error) {
+		idx, err := common.AccountIdxFromBytes(k)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		idxs = append(idxs, idx)
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if len(idxs) == 0 {
+		return nil, common.Wrap(ErrIdxNotFound)
+	}
+	return idxs, nil
+}
+
+// putAccountIndexes stores the entries of the given account in the indexes by
+// Ethereum Address and by BabyJubJub PublicKey.  The keys end with the Idx,
+// so that the entries of each address and public key are sorted by Idx.
+func putAccountIndexes(tx db.Tx, idx common.AccountIdx, addr ethCommon.Address,
+	pk babyjub.PublicKeyComp) error {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	addrKey := append(append(append([]byte{}, PrefixKeyAddrIdx...), addr.Bytes()...), idxBytes[:]...)
+	if err := tx.Put(addrKey, idxBytes[:]); err != nil {
+		return common.Wrap(err)
+	}
+	bjjKey := append(append(append([]byte{}, PrefixKeyBJJIdx...), pk[:]...), idxBytes[:]...)
+	return common.Wrap(tx.Put(bjjKey, idxBytes[:]))
+}
+
+// setAccountIndexes stores the entries of the given account in the indexes
+// of GetIdxsByEthAddr and GetIdxsByBJJ
+func (s *StateDB) setAccountIndexes(idx common.AccountIdx, addr ethCommon.Address,
+	pk babyjub.PublicKeyComp) error {
+	tx, err := s.db.DB().NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := putAccountIndexes(tx, idx, addr, pk); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Commit())
+}
+
+// IndexAccounts adds to the indexes of GetIdxsByEthAddr and GetIdxsByBJJ the
+// accounts stored before the indexes existed.  Returns the number of indexed
+// accounts.
+func (s *StateDB) IndexAccounts() (int, error) {
+	var missing []*common.Account
+	if err := s.AccountsIter(func(a *common.Account) (bool, error) {
+		idxBytes, err := a.Idx.Bytes()
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		_, err = s.db.DB().Get(append(append(append([]byte{}, PrefixKeyBJJIdx...),
+			a.BJJ[:]...), idxBytes[:]...))
+		if common.Unwrap(err) == db.ErrNotFound {
+			missing = append(missing, a)
+		} else if err != nil {
+			return false, common.Wrap(err)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, common.Wrap(err)
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	tx, err := s.db.DB().NewTx()
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	for _, a := range missing {
+		if err := putAccountIndexes(tx, a.Idx, a.EthAddr, a.BJJ); err != nil {
+			return 0, common.Wrap(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, common.Wrap(err)
+	}
+	return len(missing), nil
+}
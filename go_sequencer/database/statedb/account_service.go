@@ -21,19 +21,29 @@ var (
 	PrefixKeyAddr = []byte("a:")
 	// PrefixKeyAddrBJJ is the key prefix for address-babyjubjub in the db
 	PrefixKeyAddrBJJ = []byte("ab:")
+	// PrefixKeySybil is the key prefix for the accounts reported as sybil
+	// in the db
+	PrefixKeySybil = []byte("sy:")
 )
 
 // CreateAccount creates a new Account in the StateDB for the given Idx.  If
 // StateDB.MT==nil, MerkleTree is not affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof.
+// MerkleTree, returning a CircomProcessorProof.  The leaf fields of the
+// account are set by the StateDB, see setAccountLeaf.
 func (s *StateDB) CreateAccount(idx common.AccountIdx, account *common.Account) (
 	*merkletree.CircomProcessorProof, error) {
+	if err := s.setAccountLeaf(idx, account); err != nil {
+		return nil, common.Wrap(err)
+	}
 	cpp, err := CreateAccountInTreeDB(s.db.DB(), s.AccountTree, idx, account)
 	if err != nil {
 		return cpp, common.Wrap(err)
 	}
 	// store idx by EthAddr & BJJ
-	err = s.setIdxByEthAddrBJJ(idx, account.EthAddr, account.BJJ)
+	if err := s.setIdxByEthAddrBJJ(idx, account.EthAddr, account.BJJ); err != nil {
+		return cpp, common.Wrap(err)
+	}
+	err = s.setAccountIndexes(idx, account.EthAddr, account.BJJ)
 	return cpp, common.Wrap(err)
 }
 
@@ -105,6 +115,12 @@ func (s *StateDB) GetAccount(idx common.AccountIdx) (*common.Account, error) {
 	return GetAccountInTreeDB(s.db.DB(), idx)
 }
 
+// AccountsIter iterates over all the accounts stored in the StateDB, in
+// ascending Idx order, until fn returns false or an error
+func (s *StateDB) AccountsIter(fn func(a *common.Account) (bool, error)) error {
+	return accountsIter(s.db.DB(), fn)
+}
+
 func accountsIter(db db.Storage, fn func(a *common.Account) (bool, error)) error {
 	idxDB := db.WithPrefix(PrefixKeyAccIdx)
 	if err := idxDB.Iterate(func(k []byte, v []byte) (bool, error) {
@@ -176,12 +192,86 @@ func GetAccountInTreeDB(sto db.Storage, idx common.AccountIdx) (*common.Account,
 
 // UpdateAccount updates the Account in the StateDB for the given Idx.  If
 // StateDB.mt==nil, MerkleTree is not affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof.
+// MerkleTree, returning a CircomProcessorProof.  The leaf fields of the
+// account are set by the StateDB, see setAccountLeaf.
 func (s *StateDB) UpdateAccount(idx common.AccountIdx, account *common.Account) (
 	*merkletree.CircomProcessorProof, error) {
+	if err := s.setAccountLeaf(idx, account); err != nil {
+		return nil, common.Wrap(err)
+	}
 	return UpdateAccountInTreeDB(s.db.DB(), s.AccountTree, idx, account)
 }
 
+// setAccountLeaf sets the LeafVersion of the account to the
+// Config.AccountLeafVersion, and its VouchCount and Score to the ones stored in
+// the StateDB if the layout contains them
+func (s *StateDB) setAccountLeaf(idx common.AccountIdx, account *common.Account) error {
+	account.LeafVersion = s.cfg.AccountLeafVersion
+	account.VouchCount = 0
+	account.Score = 0
+	if account.LeafVersion == common.AccountLeafV1 {
+		return nil
+	}
+	count, err := s.OutVouchCount(idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	account.VouchCount = count
+	score, err := s.GetScore(idx)
+	if err == nil {
+		account.Score = score.Value
+	} else if common.Unwrap(err) != db.ErrNotFound {
+		return common.Wrap(err)
+	}
+	return nil
+}
+
+// syncAccountLeaf rewrites the leaf of the account idx, if it exists, when its
+// layout contains the VouchCount and the Score, so that they match the ones
+// stored in the StateDB.  The rewrite is not part of the ZKInputs, which is
+// why the AccountLeafV2 layout can't be used by the protocol yet.
+func (s *StateDB) syncAccountLeaf(idx common.AccountIdx) error {
+	if s.cfg.AccountLeafVersion == common.AccountLeafV1 {
+		return nil
+	}
+	account, err := s.GetAccount(idx)
+	if common.Unwrap(err) == db.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return common.Wrap(err)
+	}
+	_, err = s.UpdateAccount(idx, account)
+	return common.Wrap(err)
+}
+
+// MigrateAccountLeafs rewrites the leafs of the accounts stored with a layout
+// other than the Config.AccountLeafVersion with the configured one.  The
+// rewritten leafs only depend on the stored state, but they change the
+// StateRoot outside of a batch, so the layout can only be changed by a
+// protocol upgrade of common.RollupConstAccountLeafVersion.  Returns the
+// number of migrated accounts.
+func (s *StateDB) MigrateAccountLeafs() (int, error) {
+	var outdated []common.AccountIdx
+	if err := s.AccountsIter(func(a *common.Account) (bool, error) {
+		if a.LeafVersion != s.cfg.AccountLeafVersion {
+			outdated = append(outdated, a.Idx)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, common.Wrap(err)
+	}
+	for _, idx := range outdated {
+		account, err := s.GetAccount(idx)
+		if err != nil {
+			return 0, common.Wrap(err)
+		}
+		if _, err := s.UpdateAccount(idx, account); err != nil {
+			return 0, common.Wrap(err)
+		}
+	}
+	return len(outdated), nil
+}
+
 // UpdateAccountInTreeDB is abstracted from StateDB to be used from StateDB and
 // from ExitTree.  Updates the Account in the StateDB for the given Idx.  If
 // StateDB.mt==nil, MerkleTree is not affected, otherwise updates the
@@ -226,6 +316,43 @@ func UpdateAccountInTreeDB(sto db.Storage, mt *merkletree.MerkleTree, idx common
 	return nil, nil
 }
 
+// SetSybil marks the account idx as reported sybil at the batch batchNum.  The
+// mark is not part of any MerkleTree, but it is stored in the checkpoints like
+// the rest of the StateDB.
+func (s *StateDB) SetSybil(idx common.AccountIdx, batchNum common.BatchNum) error {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	tx, err := s.db.DB().NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Put(append(PrefixKeySybil, idxBytes[:]...), batchNum.Bytes()); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Commit())
+}
+
+// IsSybil returns true if the account idx has been reported as sybil
+func (s *StateDB) IsSybil(idx common.AccountIdx) (bool, error) {
+	return isSybil(s.db.DB(), idx)
+}
+
+func isSybil(sto db.Storage, idx common.AccountIdx) (bool, error) {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return false, common.Wrap(err)
+	}
+	_, err = sto.Get(append(PrefixKeySybil, idxBytes[:]...))
+	if common.Unwrap(err) == db.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, common.Wrap(err)
+	}
+	return true, nil
+}
+
 // CurrentIdx returns the current in-memory CurrentIdx of the StateDB.db
 func (s *StateDB) CurrentAccountIdx() common.AccountIdx {
 	return s.db.CurrentAccountIdx
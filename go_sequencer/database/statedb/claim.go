@@ -0,0 +1,340 @@
+package statedb
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-merkletree"
+)
+
+// ErrInvalidScoreClaim is used when a ScoreClaim doesn't prove the score of
+// the account against the given roots
+var ErrInvalidScoreClaim = errors.New("invalid score claim")
+
+// ScoreClaim proves that an account, identified by its Idx and EthAddr, has
+// a score at a batch.  The account proof binds the EthAddr to the Idx, and
+// the score proof binds the Score to the Idx.  It can be verified off-chain
+// with VerifyScoreClaim, and on-chain with the encoding returned by
+// ScoreClaim.ABIEncode.
+type ScoreClaim struct {
+	BatchNum common.BatchNum   `json:"batchNum"`
+	Idx      common.AccountIdx `json:"idx"`
+	EthAddr  ethCommon.Address `json:"ethAddr"`
+	Score    uint32            `json:"score"`
+	// LeafVersion is the layout of AccountLeaf
+	LeafVersion common.AccountLeafVersion `json:"leafVersion"`
+	// AccountLeaf contains the LeafVersion.NLeafElems() elements of the
+	// leaf of the account, where the element common.AccountLeafEthAddrElem
+	// contains the EthAddr.  The last element of the common.AccountLeafV2
+	// leafs contains the Score.
+	AccountLeaf []*merkletree.Hash `json:"accountLeaf"`
+	// AccountProof is the proof of the account leaf in the AccountTree
+	AccountProof *merkletree.CircomVerifierProof `json:"accountProof"`
+	// ScoreProof is the proof of the score leaf in the ScoreTree, whose
+	// siblings are the sibling path of the score
+	ScoreProof *merkletree.CircomVerifierProof `json:"scoreProof"`
+	// Roots are the roots of the StateDB at BatchNum
+	Roots TreeRoots `json:"roots"`
+}
+
+// NewScoreClaim returns the ScoreClaim of the account idx at the current
+// batch of the StateDB
+func (s *StateDB) NewScoreClaim(idx common.AccountIdx) (*ScoreClaim, error) {
+	account, err := s.GetAccount(idx)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	score, err := s.GetScore(idx)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	leaf, err := account.BigInts()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	accountProof, err := s.MTGetAccountProof(idx)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	scoreProof, err := s.MTGetScoreProof(idx)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	claim := &ScoreClaim{
+		BatchNum:     s.CurrentBatch(),
+		Idx:          idx,
+		EthAddr:      account.EthAddr,
+		Score:        score.Value,
+		LeafVersion:  account.LeafVersion,
+		AccountLeaf:  make([]*merkletree.Hash, account.LeafVersion.NLeafElems()),
+		AccountProof: accountProof,
+		ScoreProof:   scoreProof,
+		Roots:        s.TreeRoots(),
+	}
+	for i := range claim.AccountLeaf {
+		claim.AccountLeaf[i] = merkletree.NewHashFromBigInt(leaf[i])
+	}
+	return claim, nil
+}
+
+// VerifyScoreClaim checks that the ScoreClaim proves the score of the account
+// against the given roots, which are the roots stored for the batch of the
+// claim
+func VerifyScoreClaim(claim *ScoreClaim, roots TreeRoots) error {
+	if claim.AccountProof == nil || claim.ScoreProof == nil {
+		return common.Wrap(fmt.Errorf("%w: missing proof", ErrInvalidScoreClaim))
+	}
+	for _, root := range []struct {
+		name            string
+		claimed, stored *merkletree.Hash
+	}{
+		{"account", claim.Roots.Account, roots.Account},
+		{"vouch", claim.Roots.Vouch, roots.Vouch},
+		{"score", claim.Roots.Score, roots.Score},
+	} {
+		if !hashEqual(root.claimed, root.stored) {
+			return common.Wrap(fmt.Errorf("%w: %s root %v doesn't match the stored %v",
+				ErrInvalidScoreClaim, root.name, root.claimed, root.stored))
+		}
+	}
+
+	switch claim.LeafVersion {
+	case common.AccountLeafV1, common.AccountLeafV2:
+	default:
+		return common.Wrap(fmt.Errorf("%w: unknown account leaf version %d",
+			ErrInvalidScoreClaim, claim.LeafVersion))
+	}
+	nElems := claim.LeafVersion.NLeafElems()
+	if len(claim.AccountLeaf) != nElems {
+		return common.Wrap(fmt.Errorf("%w: account leaf has %d elements, expected %d",
+			ErrInvalidScoreClaim, len(claim.AccountLeaf), nElems))
+	}
+	leaf := make([]*big.Int, common.NAccountLeafElems)
+	for i := range leaf {
+		leaf[i] = big.NewInt(0)
+	}
+	for i, e := range claim.AccountLeaf {
+		if e == nil {
+			return common.Wrap(fmt.Errorf("%w: missing account leaf element %d",
+				ErrInvalidScoreClaim, i))
+		}
+		leaf[i] = e.BigInt()
+	}
+	// the element AccountLeafEthAddrElem of the account leaf contains the
+	// EthAddr in its lowest 20 bytes
+	var elem [32]byte
+	leaf[common.AccountLeafEthAddrElem].FillBytes(elem[:])
+	if ethCommon.BytesToAddress(elem[32-ethCommon.AddressLength:]) != claim.EthAddr {
+		return common.Wrap(fmt.Errorf("%w: account leaf doesn't contain EthAddr %s",
+			ErrInvalidScoreClaim, claim.EthAddr.Hex()))
+	}
+	// the leaf must have the layout of its LeafVersion.  A V2 leaf
+	// contains the score, which then is proven by the account proof alone.
+	var b [32 * common.NAccountLeafElems]byte
+	for i := range leaf {
+		leaf[i].FillBytes(b[32*i : 32*(i+1)])
+	}
+	account, err := common.AccountFromBytes(b)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("%w: %v", ErrInvalidScoreClaim, err))
+	}
+	if account.LeafVersion != claim.LeafVersion {
+		return common.Wrap(fmt.Errorf("%w: account leaf version %d doesn't match %d",
+			ErrInvalidScoreClaim, account.LeafVersion, claim.LeafVersion))
+	}
+	if claim.LeafVersion == common.AccountLeafV2 && account.Score != claim.Score {
+		return common.Wrap(fmt.Errorf("%w: account leaf score %d doesn't match %d",
+			ErrInvalidScoreClaim, account.Score, claim.Score))
+	}
+	accountValue, err := merkletree.HashElems(leaf[:nElems]...)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := verifyCircomProof(claim.AccountProof, roots.Account, claim.Idx.BigInt(),
+		accountValue.BigInt()); err != nil {
+		return common.Wrap(fmt.Errorf("account proof: %w", err))
+	}
+	score := common.Score{Idx: claim.Idx, Value: claim.Score}
+	if err := verifyCircomProof(claim.ScoreProof, roots.Score, claim.Idx.BigInt(),
+		score.BigInt()); err != nil {
+		return common.Wrap(fmt.Errorf("score proof: %w", err))
+	}
+	return nil
+}
+
+// verifyCircomProof checks that the CircomVerifierProof is an inclusion proof
+// of the leaf (key, value) in the tree with the given root
+func verifyCircomProof(p *merkletree.CircomVerifierProof, root *merkletree.Hash,
+	key, value *big.Int) error {
+	if p.Fnc != 0 {
+		return common.Wrap(fmt.Errorf("%w: not an inclusion proof", ErrInvalidScoreClaim))
+	}
+	if !hashEqual(p.Root, root) {
+		return common.Wrap(fmt.Errorf("%w: proof root %v doesn't match %v",
+			ErrInvalidScoreClaim, p.Root, root))
+	}
+	if p.Key == nil || p.Key.BigInt().Cmp(key) != 0 ||
+		p.Value == nil || p.Value.BigInt().Cmp(value) != 0 {
+		return common.Wrap(fmt.Errorf("%w: proof leaf doesn't match the claim",
+			ErrInvalidScoreClaim))
+	}
+	// the siblings are padded with zeros up to the levels of the tree, and
+	// the leaf is at the depth of the last non empty sibling
+	depth := 0
+	for i, sibling := range p.Siblings {
+		if sibling == nil {
+			return common.Wrap(fmt.Errorf("%w: missing sibling %d", ErrInvalidScoreClaim, i))
+		}
+		if sibling.BigInt().Sign() != 0 {
+			depth = i + 1
+		}
+	}
+	node, err := merkletree.HashElemsKey(big.NewInt(1), key, value)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for i := depth - 1; i >= 0; i-- {
+		if key.Bit(i) == 1 {
+			node, err = merkletree.HashElems(p.Siblings[i].BigInt(), node.BigInt())
+		} else {
+			node, err = merkletree.HashElems(node.BigInt(), p.Siblings[i].BigInt())
+		}
+		if err != nil {
+			return common.Wrap(err)
+		}
+	}
+	if !hashEqual(node, root) {
+		return common.Wrap(fmt.Errorf("%w: sibling path doesn't lead to the root",
+			ErrInvalidScoreClaim))
+	}
+	return nil
+}
+
+func hashEqual(a, b *merkletree.Hash) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.BigInt().Cmp(b.BigInt()) == 0
+}
+
+// circomVerifierProofABIType is the ABI type of a CircomVerifierProof, in the
+// order of the arguments of the circom SMTVerifier:
+// (root, siblings, oldKey, oldValue, isOld0, key, value, fnc)
+var circomVerifierProofABIType, _ = abi.NewType("tuple", "", []abi.ArgumentMarshaling{
+	{Name: "root", Type: "uint256"},
+	{Name: "siblings", Type: "uint256[]"},
+	{Name: "oldKey", Type: "uint256"},
+	{Name: "oldValue", Type: "uint256"},
+	{Name: "isOld0", Type: "uint256"},
+	{Name: "key", Type: "uint256"},
+	{Name: "value", Type: "uint256"},
+	{Name: "fnc", Type: "uint256"},
+})
+
+// abiCircomVerifierProof is the Go representation of
+// circomVerifierProofABIType used to pack it
+type abiCircomVerifierProof struct {
+	Root     *big.Int
+	Siblings []*big.Int
+	OldKey   *big.Int
+	OldValue *big.Int
+	IsOld0   *big.Int
+	Key      *big.Int
+	Value    *big.Int
+	Fnc      *big.Int
+}
+
+func newABICircomVerifierProof(p *merkletree.CircomVerifierProof) abiCircomVerifierProof {
+	hashBigInt := func(h *merkletree.Hash) *big.Int {
+		if h == nil {
+			return big.NewInt(0)
+		}
+		return h.BigInt()
+	}
+	siblings := make([]*big.Int, len(p.Siblings))
+	for i, sibling := range p.Siblings {
+		siblings[i] = hashBigInt(sibling)
+	}
+	isOld0 := big.NewInt(0)
+	if p.IsOld0 {
+		isOld0 = big.NewInt(1)
+	}
+	return abiCircomVerifierProof{
+		Root:     hashBigInt(p.Root),
+		Siblings: siblings,
+		OldKey:   hashBigInt(p.OldKey),
+		OldValue: hashBigInt(p.OldValue),
+		IsOld0:   isOld0,
+		Key:      hashBigInt(p.Key),
+		Value:    hashBigInt(p.Value),
+		Fnc:      big.NewInt(int64(p.Fnc)),
+	}
+}
+
+// ABIEncode returns the Solidity ABI encoding of the ScoreClaim, as the
+// arguments (uint256 batchNum, uint256 idx, address ethAddr, uint256 score,
+// uint8 leafVersion, uint256[5] accountLeaf, CircomVerifierProof accountProof,
+// CircomVerifierProof scoreProof), where the accountLeaf of a
+// common.AccountLeafV1 leaf is padded with 0 and CircomVerifierProof is the
+// tuple (uint256 root, uint256[] siblings, uint256 oldKey, uint256 oldValue,
+// uint256 isOld0, uint256 key, uint256 value, uint256 fnc) of
+// merkletree.CircomVerifierProof.  The roots of the trees are the roots of
+// the proofs.
+func (c *ScoreClaim) ABIEncode() ([]byte, error) {
+	if c.AccountProof == nil || c.ScoreProof == nil {
+		return nil, common.Wrap(fmt.Errorf("%w: missing proof", ErrInvalidScoreClaim))
+	}
+	uint256Type, err := abi.NewType("uint256", "", nil)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	addressType, err := abi.NewType("address", "", nil)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	uint8Type, err := abi.NewType("uint8", "", nil)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	leafType, err := abi.NewType(fmt.Sprintf("uint256[%d]", common.NAccountLeafElems), "", nil)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	args := abi.Arguments{
+		{Type: uint256Type},
+		{Type: uint256Type},
+		{Type: addressType},
+		{Type: uint256Type},
+		{Type: uint8Type},
+		{Type: leafType},
+		{Type: circomVerifierProofABIType},
+		{Type: circomVerifierProofABIType},
+	}
+	if len(c.AccountLeaf) != c.LeafVersion.NLeafElems() {
+		return nil, common.Wrap(fmt.Errorf("%w: account leaf has %d elements, expected %d",
+			ErrInvalidScoreClaim, len(c.AccountLeaf), c.LeafVersion.NLeafElems()))
+	}
+	var leaf [common.NAccountLeafElems]*big.Int
+	for i := range leaf {
+		leaf[i] = big.NewInt(0)
+	}
+	for i, e := range c.AccountLeaf {
+		if e == nil {
+			return nil, common.Wrap(fmt.Errorf("%w: missing account leaf element %d",
+				ErrInvalidScoreClaim, i))
+		}
+		leaf[i] = e.BigInt()
+	}
+	b, err := args.Pack(c.BatchNum.BigInt(), c.Idx.BigInt(), c.EthAddr,
+		big.NewInt(int64(c.Score)), uint8(c.LeafVersion), leaf,
+		newABICircomVerifierProof(c.AccountProof),
+		newABICircomVerifierProof(c.ScoreProof))
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return b, nil
+}
@@ -0,0 +1,275 @@
+package statedb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"text/tabwriter"
+	"tokamak-sybil-resistance/common"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+)
+
+// DiffKind is the kind of change of an account between two checkpoints
+type DiffKind string
+
+const (
+	// DiffCreated is an account that only exists in the later checkpoint
+	DiffCreated DiffKind = "created"
+	// DiffUpdated is an account whose leaf changed between the checkpoints
+	DiffUpdated DiffKind = "updated"
+	// DiffDeleted is an account that only exists in the earlier checkpoint
+	DiffDeleted DiffKind = "deleted"
+)
+
+// AccountDiff is the change of an account between two checkpoints
+type AccountDiff struct {
+	Idx     common.AccountIdx `json:"idx"`
+	Kind    DiffKind          `json:"kind"`
+	EthAddr ethCommon.Address `json:"ethAddr"`
+	// NonceDelta and BalanceDelta are the changes of the nonce and the
+	// balance, where a missing account has nonce and balance 0
+	NonceDelta   int64  `json:"nonceDelta"`
+	BalanceDelta string `json:"balanceDelta"`
+}
+
+// VouchDiff is a vouch that has been added or removed between two
+// checkpoints
+type VouchDiff struct {
+	Idx    common.VouchIdx   `json:"idx"`
+	From   common.AccountIdx `json:"from"`
+	To     common.AccountIdx `json:"to"`
+	Amount string            `json:"amount"`
+}
+
+// ScoreDiff is the change of a score between two checkpoints, where a
+// missing score is 0
+type ScoreDiff struct {
+	Idx  common.AccountIdx `json:"idx"`
+	From uint32            `json:"from"`
+	To   uint32            `json:"to"`
+}
+
+// StateDiff contains the changes of the state between the checkpoints of the
+// batches From and To, sorted by Idx
+type StateDiff struct {
+	From     common.BatchNum `json:"from"`
+	To       common.BatchNum `json:"to"`
+	Accounts []AccountDiff   `json:"accounts"`
+	// VouchesAdded are the vouches active at To that were not active at
+	// From, and VouchesRemoved the opposite
+	VouchesAdded   []VouchDiff `json:"vouchesAdded"`
+	VouchesRemoved []VouchDiff `json:"vouchesRemoved"`
+	Scores         []ScoreDiff `json:"scores"`
+}
+
+// diffState contains the accounts, active vouches and scores of a checkpoint
+type diffState struct {
+	batchNum common.BatchNum
+	accounts map[common.AccountIdx]*common.Account
+	vouches  map[common.VouchIdx]*common.Vouch
+	scores   map[common.AccountIdx]uint32
+}
+
+// Diff compares the checkpoints of the batches from and to, which must be
+// retained by the StateDB (or be 0, the empty state), and returns the
+// changes of the accounts, vouches and scores
+func (s *StateDB) Diff(from, to common.BatchNum) (*StateDiff, error) {
+	var views [2]*StateView
+	for n, batchNum := range []common.BatchNum{from, to} {
+		if batchNum == 0 {
+			continue
+		}
+		view, err := s.OpenAt(batchNum)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		defer view.Close()
+		views[n] = view
+	}
+	return DiffViews(views[0], views[1])
+}
+
+// DiffViews compares the checkpoints of the StateViews from and to, where a
+// nil StateView is the empty state of the batch 0, and returns the changes of
+// the accounts, vouches and scores
+func DiffViews(from, to *StateView) (*StateDiff, error) {
+	fromState, err := diffStateOf(from)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	toState, err := diffStateOf(to)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	diff := &StateDiff{
+		From:           fromState.batchNum,
+		To:             toState.batchNum,
+		Accounts:       []AccountDiff{},
+		VouchesAdded:   []VouchDiff{},
+		VouchesRemoved: []VouchDiff{},
+		Scores:         []ScoreDiff{},
+	}
+
+	var accountIdxs []common.AccountIdx
+	for idx := range fromState.accounts {
+		accountIdxs = append(accountIdxs, idx)
+	}
+	for idx := range toState.accounts {
+		if _, ok := fromState.accounts[idx]; !ok {
+			accountIdxs = append(accountIdxs, idx)
+		}
+	}
+	sortAccountIdxs(accountIdxs)
+	for _, idx := range accountIdxs {
+		fromAcc, toAcc := fromState.accounts[idx], toState.accounts[idx]
+		accDiff := AccountDiff{Idx: idx}
+		switch {
+		case fromAcc == nil:
+			accDiff.Kind = DiffCreated
+			fromAcc = &common.Account{Balance: big.NewInt(0)}
+		case toAcc == nil:
+			accDiff.Kind = DiffDeleted
+			toAcc = &common.Account{EthAddr: fromAcc.EthAddr, Balance: big.NewInt(0)}
+		default:
+			equal, err := equalAccountLeafs(fromAcc, toAcc)
+			if err != nil {
+				return nil, common.Wrap(err)
+			}
+			if equal {
+				continue
+			}
+			accDiff.Kind = DiffUpdated
+		}
+		accDiff.EthAddr = toAcc.EthAddr
+		accDiff.NonceDelta = int64(toAcc.Nonce) - int64(fromAcc.Nonce)
+		accDiff.BalanceDelta = new(big.Int).Sub(toAcc.Balance, fromAcc.Balance).String()
+		diff.Accounts = append(diff.Accounts, accDiff)
+	}
+
+	diff.VouchesAdded = vouchesNotIn(toState.vouches, fromState.vouches)
+	diff.VouchesRemoved = vouchesNotIn(fromState.vouches, toState.vouches)
+
+	var scoreIdxs []common.AccountIdx
+	for idx := range fromState.scores {
+		scoreIdxs = append(scoreIdxs, idx)
+	}
+	for idx := range toState.scores {
+		if _, ok := fromState.scores[idx]; !ok {
+			scoreIdxs = append(scoreIdxs, idx)
+		}
+	}
+	sortAccountIdxs(scoreIdxs)
+	for _, idx := range scoreIdxs {
+		if fromState.scores[idx] != toState.scores[idx] {
+			diff.Scores = append(diff.Scores, ScoreDiff{Idx: idx,
+				From: fromState.scores[idx], To: toState.scores[idx]})
+		}
+	}
+	return diff, nil
+}
+
+// diffStateOf reads the state of the checkpoint of the StateView, where a nil
+// StateView is the empty state
+func diffStateOf(view *StateView) (*diffState, error) {
+	state := &diffState{
+		accounts: make(map[common.AccountIdx]*common.Account),
+		vouches:  make(map[common.VouchIdx]*common.Vouch),
+		scores:   make(map[common.AccountIdx]uint32),
+	}
+	if view == nil {
+		return state, nil
+	}
+	state.batchNum = view.BatchNum()
+	sto := view.view.DB()
+
+	if err := accountsIter(sto, func(a *common.Account) (bool, error) {
+		state.accounts[a.Idx] = a
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if err := vouchesIter(sto, func(v *common.Vouch) (bool, error) {
+		if v.Value {
+			state.vouches[v.Idx] = v
+		}
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if err := scoresIter(sto, func(score *common.Score) (bool, error) {
+		state.scores[score.Idx] = score.Value
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	return state, nil
+}
+
+// equalAccountLeafs returns true if both accounts have the same leaf
+func equalAccountLeafs(a, b *common.Account) (bool, error) {
+	aBytes, err := a.Bytes()
+	if err != nil {
+		return false, common.Wrap(err)
+	}
+	bBytes, err := b.Bytes()
+	if err != nil {
+		return false, common.Wrap(err)
+	}
+	return bytes.Equal(aBytes[:], bBytes[:]), nil
+}
+
+// sortAccountIdxs sorts the idxs ascending
+func sortAccountIdxs(idxs []common.AccountIdx) {
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+}
+
+// vouchesNotIn returns the vouches of a that are not in b, sorted by Idx
+func vouchesNotIn(a, b map[common.VouchIdx]*common.Vouch) []VouchDiff {
+	diffs := []VouchDiff{}
+	for idx, v := range a {
+		if _, ok := b[idx]; ok {
+			continue
+		}
+		diffs = append(diffs, VouchDiff{Idx: idx, From: idx.FromIdx(), To: idx.ToIdx(),
+			Amount: v.Amount.String()})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Idx < diffs[j].Idx })
+	return diffs
+}
+
+// WriteTable writes the StateDiff as text tables to w
+func (d *StateDiff) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0) //nolint:gomnd
+	fmt.Fprintf(tw, "State diff from batch %d to batch %d\n\n", d.From, d.To)
+	fmt.Fprintf(tw, "ACCOUNT\tCHANGE\tETH ADDR\tNONCE\tBALANCE\n")
+	for _, a := range d.Accounts {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%+d\t%s\n", a.Idx, a.Kind, a.EthAddr.Hex(),
+			a.NonceDelta, signed(a.BalanceDelta))
+	}
+	fmt.Fprintf(tw, "\nVOUCH\tCHANGE\tFROM\tTO\tAMOUNT\n")
+	for _, vouches := range []struct {
+		change string
+		diffs  []VouchDiff
+	}{{"added", d.VouchesAdded}, {"removed", d.VouchesRemoved}} {
+		for _, v := range vouches.diffs {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\n", v.Idx, vouches.change, v.From,
+				v.To, v.Amount)
+		}
+	}
+	fmt.Fprintf(tw, "\nSCORE\tFROM\tTO\n")
+	for _, s := range d.Scores {
+		fmt.Fprintf(tw, "%d\t%d\t%d\n", s.Idx, s.From, s.To)
+	}
+	return common.Wrap(tw.Flush())
+}
+
+// signed prefixes a non negative decimal number with '+'
+func signed(n string) string {
+	if len(n) > 0 && n[0] != '-' {
+		return "+" + n
+	}
+	return n
+}
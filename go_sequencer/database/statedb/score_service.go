@@ -19,13 +19,17 @@ var (
 
 // CreateScore creates a new Score in the StateDB for the given Idx. If
 // StateDB.MT==nil, MerkleTree is not affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof.
+// MerkleTree, returning a CircomProcessorProof.  With the AccountLeafV2
+// layout the leaf of the account is updated with the new score.
 func (s *StateDB) CreateScore(idx common.AccountIdx, score *common.Score) (
 	*merkletree.CircomProcessorProof, error) {
 	cpp, err := CreateScoreInTreeDB(s.db.DB(), s.ScoreTree, idx, score)
 	if err != nil {
 		return cpp, common.Wrap(err)
 	}
+	if err := s.syncAccountLeaf(idx); err != nil {
+		return nil, common.Wrap(err)
+	}
 	return cpp, nil
 }
 
@@ -76,6 +80,18 @@ func CreateScoreInTreeDB(sto db.Storage, mt *merkletree.MerkleTree, idx common.A
 	return nil, nil
 }
 
+// MTGetScoreProof returns the CircomVerifierProof for a given accountIdx
+func (s *StateDB) MTGetScoreProof(idx common.AccountIdx) (*merkletree.CircomVerifierProof, error) {
+	if s.ScoreTree == nil {
+		return nil, common.Wrap(ErrStateDBWithoutMT)
+	}
+	p, err := s.ScoreTree.GenerateSCVerifierProof(idx.BigInt(), s.ScoreTree.Root())
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return p, nil
+}
+
 // GetScore returns the score for the given Idx
 func (s *StateDB) GetScore(idx common.AccountIdx) (*common.Score, error) {
 	return GetScoreInTreeDB(s.db.DB(), idx)
@@ -102,12 +118,48 @@ func GetScoreInTreeDB(sto db.Storage, idx common.AccountIdx) (*common.Score, err
 	return score, nil
 }
 
+// ScoresIter iterates over all the scores stored in the StateDB, in ascending
+// Idx order, until fn returns false or an error
+func (s *StateDB) ScoresIter(fn func(score *common.Score) (bool, error)) error {
+	return scoresIter(s.db.DB(), fn)
+}
+
+func scoresIter(db db.Storage, fn func(score *common.Score) (bool, error)) error {
+	idxDB := db.WithPrefix(PrefixKeyScoIdx)
+	if err := idxDB.Iterate(func(k []byte, v []byte) (bool, error) {
+		idx, err := common.AccountIdxFromBytes(k)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		score, err := GetScoreInTreeDB(db, idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		ok, err := fn(score)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		return ok, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	return nil
+}
+
 // UpdateScore updates the Score in the StateDB for the given Idx.  If
 // StateDB.mt==nil, MerkleTree is not affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof.
+// MerkleTree, returning a CircomProcessorProof.  With the AccountLeafV2
+// layout the leaf of the account is updated with the new score.
 func (s *StateDB) UpdateScore(idx common.AccountIdx, score *common.Score) (
 	*merkletree.CircomProcessorProof, error) {
-	return UpdateScoreInTreeDB(s.db.DB(), s.ScoreTree, idx, score)
+	cpp, err := UpdateScoreInTreeDB(s.db.DB(), s.ScoreTree, idx, score)
+	if err != nil {
+		return cpp, common.Wrap(err)
+	}
+	if err := s.syncAccountLeaf(idx); err != nil {
+		return nil, common.Wrap(err)
+	}
+	return cpp, nil
 }
 
 // UpdateScoreInTreeDB is abstracted from StateDB to be used from StateDB and
@@ -129,9 +181,9 @@ func UpdateScoreInTreeDB(sto db.Storage, mt *merkletree.MerkleTree, idx common.A
 	return nil, nil
 }
 
-// GetMTRoot returns the root of the Merkle Tree
+// GetMTRootScore returns the root of the Score Merkle Tree
 func (s *StateDB) GetMTRootScore() *big.Int {
-	return s.AccountTree.Root().BigInt()
+	return s.ScoreTree.Root().BigInt()
 }
 
 func performTxScore(sto db.Storage, idx common.AccountIdx,
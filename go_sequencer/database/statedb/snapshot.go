@@ -0,0 +1,120 @@
+package statedb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/kvdb"
+
+	"github.com/iden3/go-merkletree"
+	"github.com/iden3/go-merkletree/db"
+	"github.com/iden3/go-merkletree/db/memory"
+)
+
+// ErrSnapshotRootsMismatch is used when the merkle trees of an imported
+// snapshot don't match its accounts, vouches and scores, or its stored
+// StateRoot
+var ErrSnapshotRootsMismatch = errors.New("snapshot roots mismatch")
+
+// ExportSnapshot writes to w a snapshot of the checkpoint of the StateDB at
+// the given batchNum, with all its accounts, vouches, scores, indexes and
+// merkle trees, see kvdb.ExportCheckpoint
+func (s *StateDB) ExportSnapshot(batchNum common.BatchNum, w io.Writer) error {
+	return common.Wrap(s.db.ExportCheckpoint(batchNum, w))
+}
+
+// ExportSnapshot writes to w a snapshot of the checkpoint of the StateView,
+// see StateDB.ExportSnapshot
+func (v *StateView) ExportSnapshot(w io.Writer) error {
+	return common.Wrap(v.view.Export(w))
+}
+
+// ImportSnapshot imports a snapshot written by ExportSnapshot in cfg.Path,
+// which must not exist or be empty, and returns the StateDB opened at the
+// batch of the snapshot.  The roots of the merkle trees of the snapshot are
+// checked against the ones rebuilt from its accounts, vouches and scores,
+// and against the StateRoot stored by its checkpoint.  If the snapshot is not
+// valid, nothing is left in cfg.Path.
+func ImportSnapshot(cfg Config, r io.Reader) (*StateDB, error) {
+	if _, err := kvdb.ImportCheckpoint(kvdb.Config{Path: cfg.Path, Keep: cfg.Keep,
+		Retention: cfg.Retention, NoGapsCheck: cfg.noGapsCheck, NoLast: cfg.NoLast,
+		InMemory: cfg.InMemory, Name: string(cfg.Type)}, r); err != nil {
+		return nil, common.Wrap(err)
+	}
+	s, err := NewStateDB(cfg)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if err := s.checkSnapshotRoots(); err != nil {
+		s.Close()
+		if rmErr := os.RemoveAll(cfg.Path); rmErr != nil {
+			return nil, common.Wrap(rmErr)
+		}
+		return nil, common.Wrap(err)
+	}
+	return s, nil
+}
+
+// checkSnapshotRoots checks that the roots of the merkle trees match the
+// ones rebuilt from the leafs and the StateRoot of the current checkpoint
+func (s *StateDB) checkSnapshotRoots() error {
+	roots := s.TreeRoots()
+	leafRoots, err := s.LeafTreeRoots()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if !roots.Account.Equals(leafRoots.Account) || !roots.Vouch.Equals(leafRoots.Vouch) ||
+		!roots.Score.Equals(leafRoots.Score) {
+		return common.Wrap(fmt.Errorf("%w: trees %+v, leafs %+v",
+			ErrSnapshotRootsMismatch, roots, leafRoots))
+	}
+	stateRoot, err := roots.StateRoot()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	checkpointStateRoot, err := s.CheckpointStateRoot()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if stateRoot.Cmp(checkpointStateRoot) != 0 {
+		return common.Wrap(fmt.Errorf("%w: StateRoot %s, checkpoint StateRoot %s",
+			ErrSnapshotRootsMismatch, stateRoot, checkpointStateRoot))
+	}
+	return nil
+}
+
+// LeafTreeRoots returns the roots of the merkle trees rebuilt in memory from
+// the accounts, vouches and scores stored in the StateDB, which match
+// TreeRoots unless the StateDB is corrupted
+func (s *StateDB) LeafTreeRoots() (TreeRoots, error) {
+	return leafTreeRoots(s.db.DB(), s.trees())
+}
+
+// leafTreeRoots returns the roots of the given merkle trees rebuilt in memory
+// from the accounts, vouches and scores stored in sto
+func leafTreeRoots(sto db.Storage, trees [nTrees]*merkletree.MerkleTree) (TreeRoots, error) {
+	leafs, err := treeLeafs(sto)
+	if err != nil {
+		return TreeRoots{}, common.Wrap(err)
+	}
+	var roots [nTrees]*merkletree.Hash
+	for n, mt := range trees {
+		tree, err := merkletree.NewMerkleTree(memory.NewMemoryStorage(), mt.MaxLevels())
+		if err != nil {
+			return TreeRoots{}, common.Wrap(err)
+		}
+		for _, l := range leafs[n] {
+			if err := tree.Add(l.key, l.value); err != nil {
+				return TreeRoots{}, common.Wrap(err)
+			}
+		}
+		roots[n] = tree.Root()
+	}
+	return TreeRoots{
+		Account: roots[treeAccount],
+		Vouch:   roots[treeVouch],
+		Score:   roots[treeScore],
+	}, nil
+}
@@ -2,11 +2,15 @@ package statedb
 
 import (
 	"errors"
+	"fmt"
+	"math/big"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/database/kvdb"
 	"tokamak-sybil-resistance/log"
 
+	"github.com/iden3/go-iden3-crypto/poseidon"
 	"github.com/iden3/go-merkletree"
+	"github.com/iden3/go-merkletree/db"
 )
 
 const (
@@ -22,24 +26,44 @@ const (
 	// MaxNLevels is the maximum value of NLevels for the merkle tree,
 	// which comes from the fact that AccountIdx has 48 bits.
 	MaxNLevels = 24
+	// VouchNLevels is the number of levels of the vouch merkle tree. The
+	// VouchIdx places the toIdx in the lower bits and the fromIdx above
+	// them, so all the vouches received by the same account share the
+	// lower bits of the key and the tree needs to cover the whole 48 bits
+	// of the VouchIdx.
+	VouchNLevels = 2 * MaxNLevels
 )
 
 // Config of the StateDB
 type Config struct {
-	// Path where the checkpoints will be stored
+	// Path where the checkpoints will be stored.  Optional if InMemory is
+	// set.
 	Path string
-	// Keep is the number of old checkpoints to keep.  If 0, all
-	// checkpoints are kept.
+	// Keep is the number of old checkpoints to keep, not counting the
+	// archival ones of the Retention.  If 0, there's no limit.
 	Keep int
+	// Retention limits the checkpoints kept besides Keep, see
+	// kvdb.Retention
+	Retention kvdb.Retention
 	// NoLast skips having an opened DB with a checkpoint to the last
 	// batchNum for thread-safe reads.
 	NoLast bool
+	// InMemory keeps the StateDB and its checkpoints in memory instead of
+	// in Path, see kvdb.Config.InMemory
+	InMemory bool
 	// Type of StateDB (
 	Type TypeStateDB
 	// NLevels is the number of merkle tree levels in case the Type uses a
 	// merkle tree.  If the Type doesn't use a merkle tree, NLevels should
 	// be 0.
 	NLevels int
+	// AccountLeafVersion is the layout of the account leafs written in the
+	// StateDB, which for the StateDBs of a node is the one of the protocol,
+	// common.RollupConstAccountLeafVersion.  The LocalStateDBs use the one
+	// of their synchronizer StateDB.  The AccountLeafV2 layout is not
+	// supported by the ZKInputs, so a TypeBatchBuilder StateDB can't use
+	// it.
+	AccountLeafVersion common.AccountLeafVersion
 	// At every checkpoint, check that there are no gaps between the
 	// checkpoints
 	noGapsCheck bool
@@ -57,6 +81,14 @@ var (
 	// BJJ with not compatible combination
 	ErrGetIdxNoCase = errors.New(
 		"cannot get Idx due unexpected combination of ethereum Address & BabyJubJub PublicKey")
+	// ErrAccountLeafVersionZKInputs is used when a StateDB that generates
+	// the ZKInputs is configured with an account leaf layout that the
+	// ZKInputs don't support
+	ErrAccountLeafVersionZKInputs = errors.New(
+		"account leaf version not supported by the ZKInputs")
+	// ErrCheckpointPruned is used when a LocalStateDB is reset from a
+	// checkpoint that the synchronizer StateDB has already deleted
+	ErrCheckpointPruned = errors.New("checkpoint pruned by the synchronizer StateDB")
 
 	// PrefixKeyMTAcc is the key prefix for account merkle tree in the db
 	PrefixKeyMTAcc = []byte("ma:")
@@ -64,6 +96,9 @@ var (
 	PrefixKeyMTVoc = []byte("mv:")
 	// PrefixKeyMTSco is the key prefix for score merkle tree in the db
 	PrefixKeyMTSco = []byte("ms:")
+	// KeyStateRoot is the key in the db of the StateRoot stored at each
+	// checkpoint
+	KeyStateRoot = []byte("k:stateroot")
 )
 
 // TypeStateDB determines the type of StateDB
@@ -97,17 +132,22 @@ type LocalStateDB struct {
 
 // NewStateDB initializes a new StateDB.
 func NewStateDB(cfg Config) (*StateDB, error) {
+	if cfg.Type == TypeBatchBuilder && cfg.AccountLeafVersion != common.AccountLeafV1 {
+		return nil, common.Wrap(fmt.Errorf("%w: %d", ErrAccountLeafVersionZKInputs,
+			cfg.AccountLeafVersion))
+	}
 	var kv *kvdb.KVDB
 	var err error
 
 	kv, err = kvdb.NewKVDB(kvdb.Config{Path: cfg.Path, Keep: cfg.Keep,
-		NoGapsCheck: cfg.noGapsCheck, NoLast: cfg.NoLast})
+		Retention: cfg.Retention, NoGapsCheck: cfg.noGapsCheck, NoLast: cfg.NoLast,
+		InMemory: cfg.InMemory, Name: string(cfg.Type)})
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
 
 	mtAccount, _ := merkletree.NewMerkleTree(kv.StorageWithPrefix(PrefixKeyMTAcc), 24)
-	mtVouch, _ := merkletree.NewMerkleTree(kv.StorageWithPrefix(PrefixKeyMTVoc), 24)
+	mtVouch, _ := merkletree.NewMerkleTree(kv.StorageWithPrefix(PrefixKeyMTVoc), VouchNLevels)
 	mtScore, _ := merkletree.NewMerkleTree(kv.StorageWithPrefix(PrefixKeyMTSco), 24)
 	return &StateDB{
 		cfg:         cfg,
@@ -134,6 +174,9 @@ func (sdb *StateDB) Close() {
 func NewLocalStateDB(cfg Config, synchronizerDB *StateDB) (*LocalStateDB, error) {
 	cfg.noGapsCheck = true
 	cfg.NoLast = true
+	if synchronizerDB != nil {
+		cfg.AccountLeafVersion = synchronizerDB.cfg.AccountLeafVersion
+	}
 	s, err := NewStateDB(cfg)
 	if err != nil {
 		return nil, common.Wrap(err)
@@ -153,6 +196,46 @@ func (s *StateDB) Reset(batchNum common.BatchNum) error {
 	if err := s.db.Reset(batchNum); err != nil {
 		return common.Wrap(err)
 	}
+	return common.Wrap(s.openTrees())
+}
+
+// Reset resets the LocalStateDB to the checkpoint at the given batchNum.  If
+// fromSynchronizer is true, the state is copied from the checkpoint of the
+// synchronizer StateDB and the checkpoints of the LocalStateDB are deleted,
+// otherwise the LocalStateDB goes back to its own checkpoint.  If the
+// synchronizer StateDB has already deleted the checkpoint, an error wrapping
+// ErrCheckpointPruned is returned and the LocalStateDB is not modified.
+func (l *LocalStateDB) Reset(batchNum common.BatchNum, fromSynchronizer bool) error {
+	if !fromSynchronizer {
+		// use checkpoint from LocalStateDB
+		return l.StateDB.Reset(batchNum)
+	}
+	if l.synchronizerStateDB == nil {
+		return common.Wrap(fmt.Errorf("LocalStateDB without synchronizer StateDB"))
+	}
+	log.Debugw("Making StateDB ResetFromSynchronizer", "batch", batchNum, "type", l.cfg.Type)
+	err := l.db.ResetFromSynchronizer(batchNum, l.synchronizerStateDB.db)
+	if errors.Is(err, kvdb.ErrCheckpointNotFound) {
+		list, listErr := l.synchronizerStateDB.db.ListCheckpoints()
+		if listErr != nil {
+			return common.Wrap(listErr)
+		}
+		// the checkpoints before the last one have existed, unless
+		// they have been deleted by a reset of the synchronizer
+		if len(list) > 0 && int(batchNum) < list[len(list)-1] {
+			return common.Wrap(fmt.Errorf("%w: batch %d, synchronizer checkpoints %d to %d",
+				ErrCheckpointPruned, batchNum, list[0], list[len(list)-1]))
+		}
+	}
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(l.openTrees())
+}
+
+// openTrees opens again the merkle trees of the StateDB over the current
+// s.db, so that they load their roots from it
+func (s *StateDB) openTrees() error {
 	if s.AccountTree != nil {
 		// open the Account MT for the current s.db
 		accountTree, err := merkletree.NewMerkleTree(s.db.StorageWithPrefix(PrefixKeyMTAcc), s.AccountTree.MaxLevels())
@@ -180,15 +263,113 @@ func (s *StateDB) Reset(batchNum common.BatchNum) error {
 	return nil
 }
 
+// Savepoint returns a handle to the current state of the StateDB inside the
+// current batch.  RollbackTo undoes the account, vouch and score writes, and
+// the updates of the merkle trees, done since the Savepoint, without touching
+// the checkpoints.  Every Savepoint must be released with Release or
+// discarded by the next MakeCheckpoint or Reset.
+func (s *StateDB) Savepoint() kvdb.Savepoint {
+	return s.db.Savepoint()
+}
+
+// RollbackTo undoes the writes done in the StateDB since the Savepoint, which
+// stays open, and releases the savepoints made after it
+func (s *StateDB) RollbackTo(sp kvdb.Savepoint) error {
+	if err := s.db.RollbackTo(sp); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(s.openTrees())
+}
+
+// Release forgets the Savepoint and the savepoints made after it, keeping
+// the writes done since them
+func (s *StateDB) Release(sp kvdb.Savepoint) error {
+	return common.Wrap(s.db.Release(sp))
+}
+
 // MakeCheckpoint does a checkpoint at the given batchNum in the defined path.
-// Internally this advances & stores the current BatchNum, and then stores a
-// Checkpoint of the current state of the StateDB.
+// Internally this stores the StateRoot, advances & stores the current
+// BatchNum, and then stores a Checkpoint of the current state of the StateDB.
+// The open savepoints are discarded.
 func (s *StateDB) MakeCheckpoint() error {
 	log.Debugw("Making StateDB checkpoint", "batch", s.CurrentBatch()+1, "type", s.cfg.Type)
+	stateRoot, err := s.StateRoot()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	tx, err := s.db.DB().NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Put(KeyStateRoot, stateRoot.Bytes()); err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return common.Wrap(err)
+	}
 	return s.db.MakeCheckpoint()
 }
 
+// MakeCheckpointFromTo makes a copy of the checkpoint at fromBatchNum of the
+// StateDB to the dest folder.
+func (s *StateDB) MakeCheckpointFromTo(fromBatchNum common.BatchNum, dest string) error {
+	return s.db.MakeCheckpointFromTo(fromBatchNum, dest)
+}
+
 // CurrentBatch returns the current in-memory CurrentBatch of the StateDB.db
 func (s *StateDB) CurrentBatch() common.BatchNum {
 	return s.db.CurrentBatch
 }
+
+// TreeRoots contains the roots of the merkle trees of the StateDB
+type TreeRoots struct {
+	Account *merkletree.Hash `json:"accountRoot"`
+	Vouch   *merkletree.Hash `json:"vouchRoot"`
+	Score   *merkletree.Hash `json:"scoreRoot"`
+}
+
+// StateRoot returns the global root that commits to the three trees, which is
+// the Poseidon hash of the account, vouch and score roots
+func (r TreeRoots) StateRoot() (*big.Int, error) {
+	stateRoot, err := poseidon.Hash([]*big.Int{r.Account.BigInt(), r.Vouch.BigInt(),
+		r.Score.BigInt()})
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return stateRoot, nil
+}
+
+// TreeRoots returns the current roots of the merkle trees of the StateDB
+func (s *StateDB) TreeRoots() TreeRoots {
+	return TreeRoots{
+		Account: s.AccountTree.Root(),
+		Vouch:   s.VouchTree.Root(),
+		Score:   s.ScoreTree.Root(),
+	}
+}
+
+// StateRoot returns the current global root of the StateDB, see
+// TreeRoots.StateRoot
+func (s *StateDB) StateRoot() (*big.Int, error) {
+	return s.TreeRoots().StateRoot()
+}
+
+// CheckpointStateRoot returns the StateRoot stored by the checkpoint of the
+// current batch.  The StateRoot of the batch 0 is the one of the empty trees.
+func (s *StateDB) CheckpointStateRoot() (*big.Int, error) {
+	return checkpointStateRoot(s.db.DB(), s.CurrentBatch())
+}
+
+// checkpointStateRoot returns the StateRoot stored in sto by the checkpoint
+// of the given batchNum
+func checkpointStateRoot(sto db.Storage, batchNum common.BatchNum) (*big.Int, error) {
+	if batchNum == 0 {
+		return TreeRoots{Account: &merkletree.HashZero, Vouch: &merkletree.HashZero,
+			Score: &merkletree.HashZero}.StateRoot()
+	}
+	b, err := sto.Get(KeyStateRoot)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -1,21 +1,29 @@
 package statedb
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"math/big"
 	"math/rand"
 	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
 	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/kvdb"
 	"tokamak-sybil-resistance/log"
 
 	ethCommon "github.com/ethereum/go-ethereum/common"
 	ethCrypto "github.com/ethereum/go-ethereum/crypto"
 
 	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	"github.com/iden3/go-merkletree"
 	"github.com/iden3/go-merkletree/db"
+	"github.com/iden3/go-merkletree/db/pebble"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -60,8 +68,10 @@ func newVouch(i int) *common.Vouch {
 	r := rand.New(rand.NewSource(int64(time.Now().UnixNano())))
 	v := r.Intn(2) == 1
 	return &common.Vouch{
-		Idx:   common.VouchIdx(256257 + i),
-		Value: v,
+		Idx:      common.VouchIdx(256257 + i),
+		BatchNum: common.BatchNum(1 + i),
+		Value:    v,
+		Amount:   big.NewInt(int64(100 + i)),
 	}
 }
 
@@ -182,6 +192,1500 @@ func TestVouchInStateDB(t *testing.T) {
 	sdb.Close()
 }
 
+func TestVouchPadding(t *testing.T) {
+	idx := common.GenerateVouchIdx(256, 257)
+	vouch := &common.Vouch{BatchNum: 1, Value: true, Amount: big.NewInt(100)}
+	b, err := vouch.Bytes()
+	require.NoError(t, err)
+	stored, err := vouchFromStoredBytes(idx, b[:])
+	require.NoError(t, err)
+	assert.Equal(t, vouch.Amount, stored.Amount)
+
+	b[0] = 1
+	_, err = vouchFromStoredBytes(idx, b[:])
+	assert.True(t, errors.Is(err, common.ErrNonZeroPadding))
+	b[0] = 0
+	b[23] = 2
+	_, err = vouchFromStoredBytes(idx, b[:])
+	assert.True(t, errors.Is(err, common.ErrNonZeroPadding))
+
+	idxBytes, err := idx.Bytes()
+	require.NoError(t, err)
+	parsed, err := common.VouchIdxFromBytes(idxBytes[:])
+	require.NoError(t, err)
+	assert.Equal(t, idx, parsed)
+	idxBytes[2] = 1
+	_, err = common.VouchIdxFromBytes(idxBytes[:])
+	assert.True(t, errors.Is(err, common.ErrNonZeroPadding))
+}
+
+func TestMigrateVouches(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	// store two vouches with the legacy bool encoding, and one with the
+	// current one
+	legacy := map[common.VouchIdx]bool{
+		common.GenerateVouchIdx(256, 257): true,
+		common.GenerateVouchIdx(257, 256): false,
+	}
+	storeLegacy := func(sdb *StateDB) {
+		for idx, value := range legacy {
+			idxBytes, err := idx.Bytes()
+			require.NoError(t, err)
+			tx, err := sdb.db.DB().NewTx()
+			require.NoError(t, err)
+			b := []byte{0}
+			if value {
+				b[0] = 1
+			}
+			require.NoError(t, tx.Put(append(PrefixKeyVocIdx, idxBytes[:]...), b))
+			require.NoError(t, tx.Commit())
+			_, err = sdb.VouchTree.AddAndGetCircomProof(idx.BigInt(),
+				big.NewInt(int64(b[0])))
+			require.NoError(t, err)
+		}
+	}
+	storeLegacy(sdb)
+	current := &common.Vouch{Idx: common.GenerateVouchIdx(256, 258), BatchNum: 1,
+		Value: true, Amount: big.NewInt(10)}
+	_, err = sdb.CreateVouch(current.Idx, current)
+	require.NoError(t, err)
+
+	// legacy vouches can be read before the migration
+	vouch, err := sdb.GetVouch(common.GenerateVouchIdx(256, 257))
+	require.NoError(t, err)
+	assert.True(t, vouch.Value)
+
+	n, err := sdb.MigrateVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for idx, value := range legacy {
+		vouch, err := sdb.GetVouch(idx)
+		require.NoError(t, err)
+		assert.Equal(t, value, vouch.Value)
+		assert.Equal(t, LegacyVouchBatchNum, vouch.BatchNum)
+		assert.Equal(t, 0, vouch.Amount.Sign())
+		leaf, err := vouch.HashValue()
+		require.NoError(t, err)
+		proof, err := sdb.MTGetVouchProof(idx)
+		require.NoError(t, err)
+		assert.Equal(t, leaf, proof.Value.BigInt())
+	}
+	vouch, err = sdb.GetVouch(current.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, current, vouch)
+
+	// migrating again doesn't change anything
+	root := sdb.VouchTree.Root()
+	n, err = sdb.MigrateVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, root, sdb.VouchTree.Root())
+
+	// a node that migrates at a later batch gets the same VouchTree
+	otherDir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, otherDir)
+	other, err := NewStateDB(Config{Path: otherDir, Keep: 128, Type: TypeSynchronizer,
+		NLevels: 32})
+	require.NoError(t, err)
+	defer other.Close()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, other.MakeCheckpoint())
+	}
+	storeLegacy(other)
+	_, err = other.CreateVouch(current.Idx, current)
+	require.NoError(t, err)
+	n, err = other.MigrateVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, root, other.VouchTree.Root())
+}
+
+func TestVouchIndexes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	createVouch := func(from, to common.AccountIdx) *common.Vouch {
+		vouch := &common.Vouch{Idx: common.GenerateVouchIdx(from, to), BatchNum: 1,
+			Value: true, Amount: big.NewInt(1)}
+		_, err := sdb.CreateVouch(vouch.Idx, vouch)
+		require.NoError(t, err)
+		return vouch
+	}
+	collect := func(iter func(common.AccountIdx, func(*common.Vouch) (bool, error)) error,
+		idx common.AccountIdx) []common.VouchIdx {
+		var idxs []common.VouchIdx
+		require.NoError(t, iter(idx, func(v *common.Vouch) (bool, error) {
+			idxs = append(idxs, v.Idx)
+			return true, nil
+		}))
+		return idxs
+	}
+
+	createVouch(256, 258)
+	createVouch(256, 257)
+	createVouch(257, 258)
+	deleted := createVouch(258, 256)
+	deleted.Value = false
+	_, err = sdb.UpdateVouch(deleted.Idx, deleted)
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 257),
+		common.GenerateVouchIdx(256, 258)}, collect(sdb.VouchesFrom, 256))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 258),
+		common.GenerateVouchIdx(257, 258)}, collect(sdb.VouchesTo, 258))
+	// deleted vouches are not listed, and their index entries are removed
+	assert.Nil(t, collect(sdb.VouchesFrom, 258))
+	assert.Nil(t, collect(sdb.VouchesTo, 256))
+	outKey, inKey, err := vouchIndexKeys(deleted.Idx)
+	require.NoError(t, err)
+	for _, key := range [][]byte{outKey, inKey} {
+		_, err = sdb.db.DB().Get(key)
+		assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	}
+
+	// the iteration stops when fn returns false
+	n := 0
+	require.NoError(t, sdb.VouchesFrom(256, func(v *common.Vouch) (bool, error) {
+		n++
+		return false, nil
+	}))
+	assert.Equal(t, 1, n)
+
+	graph, err := sdb.VouchGraph()
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(graph))
+	assert.Equal(t, 2, len(graph[256]))
+	assert.Equal(t, common.GenerateVouchIdx(257, 258), graph[257][0].Idx)
+
+	// the indexes follow the checkpoints of the StateDB
+	createVouch(259, 256)
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(259, 256)},
+		collect(sdb.VouchesTo, 256))
+	require.NoError(t, sdb.Reset(1))
+	assert.Nil(t, collect(sdb.VouchesTo, 256))
+
+	// vouches stored without indexes are indexed by IndexVouches
+	unindexed := &common.Vouch{Idx: common.GenerateVouchIdx(260, 256), BatchNum: 1,
+		Value: true, Amount: big.NewInt(1)}
+	idxBytes, err := unindexed.Idx.Bytes()
+	require.NoError(t, err)
+	vouchBytes, err := unindexed.Bytes()
+	require.NoError(t, err)
+	tx, err := sdb.db.DB().NewTx()
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(append(PrefixKeyVocIdx, idxBytes[:]...), vouchBytes[:]))
+	require.NoError(t, tx.Commit())
+	assert.Nil(t, collect(sdb.VouchesTo, 256))
+
+	nIndexed, err := sdb.IndexVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 1, nIndexed)
+	assert.Equal(t, []common.VouchIdx{unindexed.Idx}, collect(sdb.VouchesTo, 256))
+	nIndexed, err = sdb.IndexVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 0, nIndexed)
+
+	// a rollback restores the index entries removed after the savepoint
+	sp := sdb.Savepoint()
+	vouch, err := sdb.GetVouch(common.GenerateVouchIdx(256, 257))
+	require.NoError(t, err)
+	vouch.Value = false
+	_, err = sdb.UpdateVouch(vouch.Idx, vouch)
+	require.NoError(t, err)
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 258)},
+		collect(sdb.VouchesFrom, 256))
+	require.NoError(t, sdb.RollbackTo(sp))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 257),
+		common.GenerateVouchIdx(256, 258)}, collect(sdb.VouchesFrom, 256))
+	count, err := sdb.OutVouchCount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), count)
+	require.NoError(t, sdb.Release(sp))
+
+	// the index entries kept for the vouches deleted before the entries
+	// were removed are removed by IndexVouches
+	idxBytes, err = deleted.Idx.Bytes()
+	require.NoError(t, err)
+	tx, err = sdb.db.DB().NewTx()
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(outKey, idxBytes[:]))
+	require.NoError(t, tx.Put(inKey, idxBytes[:]))
+	require.NoError(t, tx.Commit())
+	nIndexed, err = sdb.IndexVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 1, nIndexed)
+	for _, key := range [][]byte{outKey, inKey} {
+		_, err = sdb.db.DB().Get(key)
+		assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	}
+}
+
+func TestVouchesCreatedUpTo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	createVouch := func(from, to common.AccountIdx, batchNum common.BatchNum) *common.Vouch {
+		vouch := &common.Vouch{Idx: common.GenerateVouchIdx(from, to), BatchNum: batchNum,
+			Value: true, Amount: big.NewInt(1)}
+		_, err := sdb.CreateVouch(vouch.Idx, vouch)
+		require.NoError(t, err)
+		return vouch
+	}
+	createdUpTo := func(batchNum common.BatchNum) []common.VouchIdx {
+		vouches, err := sdb.VouchesCreatedUpTo(batchNum)
+		require.NoError(t, err)
+		var idxs []common.VouchIdx
+		for _, v := range vouches {
+			idxs = append(idxs, v.Idx)
+		}
+		return idxs
+	}
+
+	createVouch(257, 256, 1)
+	createVouch(256, 257, 1)
+	createVouch(256, 258, 2)
+	deleted := createVouch(258, 256, 2)
+	deleted.Value = false
+	_, err = sdb.UpdateVouch(deleted.Idx, deleted)
+	require.NoError(t, err)
+	// a vouch deleted and created again is only listed at its last
+	// creation batch
+	recreated := createVouch(257, 258, 1)
+	recreated.Value = false
+	_, err = sdb.UpdateVouch(recreated.Idx, recreated)
+	require.NoError(t, err)
+	recreated.Value = true
+	recreated.BatchNum = 3
+	_, err = sdb.UpdateVouch(recreated.Idx, recreated)
+	require.NoError(t, err)
+
+	assert.Nil(t, createdUpTo(0))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 257),
+		common.GenerateVouchIdx(257, 256)}, createdUpTo(1))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 257),
+		common.GenerateVouchIdx(256, 258), common.GenerateVouchIdx(257, 256)},
+		createdUpTo(2))
+
+	// the creation batches up to the stored batch are not read again
+	require.NoError(t, sdb.SetVouchesExpiredUpTo(1))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 258)}, createdUpTo(2))
+	assert.Equal(t, []common.VouchIdx{common.GenerateVouchIdx(256, 258), recreated.Idx},
+		createdUpTo(3))
+	require.NoError(t, sdb.SetVouchesExpiredUpTo(3))
+	assert.Nil(t, createdUpTo(3))
+
+	// vouches stored without the index by creation batch are indexed by
+	// IndexVouches
+	unindexed := &common.Vouch{Idx: common.GenerateVouchIdx(260, 256), BatchNum: 4,
+		Value: true, Amount: big.NewInt(1)}
+	idxBytes, err := unindexed.Idx.Bytes()
+	require.NoError(t, err)
+	vouchBytes, err := unindexed.Bytes()
+	require.NoError(t, err)
+	tx, err := sdb.db.DB().NewTx()
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(append(PrefixKeyVocIdx, idxBytes[:]...), vouchBytes[:]))
+	require.NoError(t, tx.Commit())
+	assert.Nil(t, createdUpTo(4))
+
+	nIndexed, err := sdb.IndexVouches()
+	require.NoError(t, err)
+	assert.Equal(t, 1, nIndexed)
+	assert.Equal(t, []common.VouchIdx{unindexed.Idx}, createdUpTo(4))
+}
+
+func TestStateRoot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	// The StateRoot is Poseidon(accountRoot, vouchRoot, scoreRoot).  The
+	// expected values have been computed with the circomlib
+	// implementation of Poseidon.
+	stateRoot, err := TreeRoots{
+		Account: merkletree.NewHashFromBigInt(big.NewInt(1)),
+		Vouch:   merkletree.NewHashFromBigInt(big.NewInt(2)),
+		Score:   merkletree.NewHashFromBigInt(big.NewInt(3)),
+	}.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t,
+		"6542985608222806190361240322586112750744169038454362455181422643027100751666",
+		stateRoot.String())
+
+	emptyRoot, err := sdb.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t,
+		"5317387130258456662214331362918410991734007599705406860481038345552731150762",
+		emptyRoot.String())
+	checkpointRoot, err := sdb.CheckpointStateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, emptyRoot, checkpointRoot)
+
+	account := newAccount(t, 0)
+	_, err = sdb.CreateAccount(account.Idx, account)
+	require.NoError(t, err)
+	vouch := newVouch(1)
+	_, err = sdb.CreateVouch(vouch.Idx, vouch)
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(account.Idx, newScore(0))
+	require.NoError(t, err)
+
+	// each tree has its own root, and the StateRoot commits to all of
+	// them
+	assert.Equal(t, sdb.AccountTree.Root().BigInt(), sdb.GetMTRootAccount())
+	assert.Equal(t, sdb.VouchTree.Root().BigInt(), sdb.GetMTRootVouch())
+	assert.Equal(t, sdb.ScoreTree.Root().BigInt(), sdb.GetMTRootScore())
+	assert.NotEqual(t, sdb.GetMTRootAccount(), sdb.GetMTRootVouch())
+	assert.NotEqual(t, sdb.GetMTRootAccount(), sdb.GetMTRootScore())
+	stateRoot1, err := sdb.StateRoot()
+	require.NoError(t, err)
+	expected, err := poseidon.Hash([]*big.Int{sdb.GetMTRootAccount(),
+		sdb.GetMTRootVouch(), sdb.GetMTRootScore()})
+	require.NoError(t, err)
+	assert.Equal(t, expected, stateRoot1)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	_, err = sdb.UpdateScore(account.Idx, &common.Score{Idx: account.Idx, Value: 10})
+	require.NoError(t, err)
+	stateRoot2, err := sdb.StateRoot()
+	require.NoError(t, err)
+	assert.NotEqual(t, stateRoot1, stateRoot2)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	// the StateRoot is stored at each checkpoint
+	checkpointRoot, err = sdb.CheckpointStateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, stateRoot2, checkpointRoot)
+	require.NoError(t, sdb.Reset(1))
+	checkpointRoot, err = sdb.CheckpointStateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, stateRoot1, checkpointRoot)
+	stateRoot, err = sdb.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, stateRoot1, stateRoot)
+}
+
+func TestScoreClaim(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 4; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		_, err = sdb.CreateScore(account.Idx, newScore(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	claim, err := sdb.NewScoreClaim(258)
+	require.NoError(t, err)
+	account, err := sdb.GetAccount(258)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(1), claim.BatchNum)
+	assert.Equal(t, account.EthAddr, claim.EthAddr)
+	assert.Equal(t, uint32(3), claim.Score)
+	roots := sdb.TreeRoots()
+	require.NoError(t, VerifyScoreClaim(claim, roots))
+
+	// the claim can be serialized
+	b, err := json.Marshal(claim)
+	require.NoError(t, err)
+	var decoded ScoreClaim
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.NoError(t, VerifyScoreClaim(&decoded, roots))
+	encoded, err := decoded.ABIEncode()
+	require.NoError(t, err)
+	expected, err := claim.ABIEncode()
+	require.NoError(t, err)
+	assert.Equal(t, expected, encoded)
+
+	// a claim with a different score, account or roots is not valid
+	decoded.Score++
+	assert.True(t, errors.Is(VerifyScoreClaim(&decoded, roots), ErrInvalidScoreClaim))
+	decoded.Score--
+	decoded.EthAddr = ethCommon.HexToAddress("0x01")
+	assert.True(t, errors.Is(VerifyScoreClaim(&decoded, roots), ErrInvalidScoreClaim))
+	decoded.EthAddr = claim.EthAddr
+	otherClaim, err := sdb.NewScoreClaim(257)
+	require.NoError(t, err)
+	decoded.ScoreProof = otherClaim.ScoreProof
+	assert.True(t, errors.Is(VerifyScoreClaim(&decoded, roots), ErrInvalidScoreClaim))
+
+	// the roots of the claim must be the ones of its batch
+	_, err = sdb.UpdateScore(258, &common.Score{Idx: 258, Value: 10})
+	require.NoError(t, err)
+	assert.True(t, errors.Is(VerifyScoreClaim(claim, sdb.TreeRoots()), ErrInvalidScoreClaim))
+	require.NoError(t, VerifyScoreClaim(claim, roots))
+
+	// a malformed claim is not valid, and doesn't panic
+	assert.Equal(t, common.AccountLeafV1, claim.LeafVersion)
+	assert.Equal(t, common.NAccountLeafElemsV1, len(claim.AccountLeaf))
+	leaf := claim.AccountLeaf
+	for _, malformed := range []struct {
+		leafVersion common.AccountLeafVersion
+		accountLeaf []*merkletree.Hash
+	}{
+		{common.AccountLeafV1, nil},
+		{common.AccountLeafV1, leaf[:common.AccountLeafEthAddrElem]},
+		{common.AccountLeafV1, append(append([]*merkletree.Hash{}, leaf...),
+			&merkletree.HashZero)},
+		{common.AccountLeafV1, append(append([]*merkletree.Hash{}, leaf[:3]...), nil)},
+		// a V1 leaf claimed as a V2 one
+		{common.AccountLeafV2, append(append([]*merkletree.Hash{}, leaf...),
+			&merkletree.HashZero)},
+		{common.AccountLeafV2, leaf},
+		{common.AccountLeafVersion(7), leaf},
+	} {
+		claim.LeafVersion = malformed.leafVersion
+		claim.AccountLeaf = malformed.accountLeaf
+		assert.True(t, errors.Is(VerifyScoreClaim(claim, roots), ErrInvalidScoreClaim))
+	}
+	claim.LeafVersion = common.AccountLeafV1
+	claim.AccountLeaf = leaf[:common.AccountLeafEthAddrElem]
+	_, err = claim.ABIEncode()
+	assert.True(t, errors.Is(err, ErrInvalidScoreClaim))
+	claim.AccountLeaf = leaf
+	require.NoError(t, VerifyScoreClaim(claim, roots))
+}
+
+func TestAccountLeafV2(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	// accounts stored with the V1 layout
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+	}
+	_, err = sdb.CreateScore(256, &common.Score{Idx: 256, Value: 7})
+	require.NoError(t, err)
+	_, err = sdb.CreateVouch(common.GenerateVouchIdx(256, 257), &common.Vouch{BatchNum: 1,
+		Value: true, Amount: big.NewInt(10)})
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	account, err := sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, common.AccountLeafV1, account.LeafVersion)
+	assert.Equal(t, uint32(0), account.Score)
+	sdb.Close()
+
+	// the V2 layout can't be used to generate the ZKInputs
+	_, err = NewStateDB(Config{Path: dir, Keep: 128, Type: TypeBatchBuilder, NLevels: 32,
+		AccountLeafVersion: common.AccountLeafV2})
+	assert.True(t, errors.Is(err, ErrAccountLeafVersionZKInputs))
+
+	// reopening the StateDB with the V2 layout migrates the leafs, which
+	// then contain the vouch count and the score
+	sdb, err = NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32,
+		AccountLeafVersion: common.AccountLeafV2})
+	require.NoError(t, err)
+	defer sdb.Close()
+	n, err := sdb.MigrateAccountLeafs()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	account, err = sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, common.AccountLeafV2, account.LeafVersion)
+	assert.Equal(t, uint32(1), account.VouchCount)
+	assert.Equal(t, uint32(7), account.Score)
+	leaf, err := account.HashValue()
+	require.NoError(t, err)
+	proof, err := sdb.MTGetAccountProof(256)
+	require.NoError(t, err)
+	assert.Equal(t, leaf, proof.Value.BigInt())
+	root := sdb.AccountTree.Root()
+	n, err = sdb.MigrateAccountLeafs()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, root, sdb.AccountTree.Root())
+
+	// the leaf follows the changes of the score and of the vouches
+	_, err = sdb.UpdateScore(256, &common.Score{Idx: 256, Value: 9})
+	require.NoError(t, err)
+	_, err = sdb.CreateVouch(common.GenerateVouchIdx(256, 258), &common.Vouch{BatchNum: 1,
+		Value: true, Amount: big.NewInt(10)})
+	require.NoError(t, err)
+	account, err = sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), account.VouchCount)
+	assert.Equal(t, uint32(9), account.Score)
+	_, err = sdb.CreateScore(257, &common.Score{Idx: 257, Value: 3})
+	require.NoError(t, err)
+	account, err = sdb.GetAccount(257)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), account.VouchCount)
+	assert.Equal(t, uint32(3), account.Score)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	// the account proof of a claim alone proves the score
+	claim, err := sdb.NewScoreClaim(256)
+	require.NoError(t, err)
+	roots := sdb.TreeRoots()
+	require.NoError(t, VerifyScoreClaim(claim, roots))
+	claim.Score = 10
+	claim.ScoreProof, err = sdb.MTGetScoreProof(256)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(VerifyScoreClaim(claim, roots), ErrInvalidScoreClaim))
+}
+
+func TestSavepoints(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 2; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.SetCurrentAccountIdx(257))
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+	account256, err := sdb.GetAccount(256)
+	require.NoError(t, err)
+
+	// writes after a savepoint
+	sp := sdb.Savepoint()
+	account := newAccount(t, 2)
+	_, err = sdb.CreateAccount(account.Idx, account)
+	require.NoError(t, err)
+	require.NoError(t, sdb.SetCurrentAccountIdx(258))
+	updated := *account256
+	updated.Balance = big.NewInt(1)
+	_, err = sdb.UpdateAccount(256, &updated)
+	require.NoError(t, err)
+	vouchIdx := common.GenerateVouchIdx(256, 257)
+	_, err = sdb.CreateVouch(vouchIdx, &common.Vouch{BatchNum: 2, Value: true,
+		Amount: big.NewInt(10)})
+	require.NoError(t, err)
+	rootsAfterVouch := sdb.TreeRoots()
+
+	// writes after a nested savepoint
+	nested := sdb.Savepoint()
+	_, err = sdb.CreateScore(256, newScore(0))
+	require.NoError(t, err)
+	assert.NotEqual(t, rootsAfterVouch, sdb.TreeRoots())
+	require.NoError(t, sdb.RollbackTo(nested))
+	assert.Equal(t, rootsAfterVouch, sdb.TreeRoots())
+	_, err = sdb.GetScore(256)
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+
+	// rolling back to the first savepoint undoes all the writes and
+	// releases the nested one
+	require.NoError(t, sdb.RollbackTo(sp))
+	assert.Equal(t, roots, sdb.TreeRoots())
+	assert.Equal(t, common.AccountIdx(257), sdb.CurrentAccountIdx())
+	_, err = sdb.GetAccount(258)
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	acc, err := sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, account256, acc)
+	_, err = sdb.GetVouch(vouchIdx)
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	count, err := sdb.OutVouchCount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), count)
+	assert.Equal(t, kvdb.ErrSavepointNotFound, common.Unwrap(sdb.RollbackTo(nested)))
+
+	// the writes after a released savepoint are kept
+	_, err = sdb.UpdateAccount(256, &updated)
+	require.NoError(t, err)
+	require.NoError(t, sdb.Release(sp))
+	assert.Equal(t, kvdb.ErrSavepointNotFound, common.Unwrap(sdb.RollbackTo(sp)))
+	acc, err = sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(1), acc.Balance)
+
+	// a checkpoint discards the open savepoints
+	sp = sdb.Savepoint()
+	require.NoError(t, sdb.MakeCheckpoint())
+	assert.Equal(t, kvdb.ErrSavepointNotFound, common.Unwrap(sdb.Release(sp)))
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 3; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		_, err = sdb.CreateScore(account.Idx, newScore(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.SetCurrentAccountIdx(258))
+	for i := 0; i < 2; i++ {
+		vouch := newVouch(i)
+		_, err = sdb.CreateVouch(vouch.Idx, vouch)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+	accounts, err := sdb.TestGetAccounts()
+	require.NoError(t, err)
+	// the snapshot is of the checkpoint, not of the current state
+	_, err = sdb.UpdateScore(256, newScore(10))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	var snapshot bytes.Buffer
+	require.NoError(t, sdb.ExportSnapshot(1, &snapshot))
+	var again bytes.Buffer
+	require.NoError(t, sdb.ExportSnapshot(1, &again))
+	assert.Equal(t, snapshot.Bytes(), again.Bytes())
+	// the same snapshot is exported from a checkpoint opened without the
+	// StateDB
+	view, err := OpenCheckpoint(Config{Path: dir, Type: TypeSynchronizer}, 1)
+	require.NoError(t, err)
+	again.Reset()
+	require.NoError(t, view.ExportSnapshot(&again))
+	view.Close()
+	assert.Equal(t, snapshot.Bytes(), again.Bytes())
+
+	importDir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, importDir)
+	cfg := Config{Path: importDir, Keep: 128, Type: TypeSynchronizer, NLevels: 32}
+
+	// a corrupted snapshot is rejected, and nothing is imported
+	corrupted := append([]byte{}, snapshot.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	_, err = ImportSnapshot(cfg, bytes.NewReader(corrupted))
+	require.Error(t, err)
+	files, err := os.ReadDir(importDir)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+	_, err = ImportSnapshot(cfg, bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1]))
+	assert.True(t, errors.Is(err, kvdb.ErrSnapshotInvalid))
+
+	imported, err := ImportSnapshot(cfg, bytes.NewReader(snapshot.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(1), imported.CurrentBatch())
+	assert.Equal(t, common.AccountIdx(258), imported.CurrentAccountIdx())
+	assert.Equal(t, roots, imported.TreeRoots())
+	importedAccounts, err := imported.TestGetAccounts()
+	require.NoError(t, err)
+	assert.Equal(t, accounts, importedAccounts)
+	score, err := imported.GetScore(256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+
+	// the imported StateDB continues from the batch of the snapshot
+	_, err = imported.UpdateScore(256, newScore(10))
+	require.NoError(t, err)
+	require.NoError(t, imported.MakeCheckpoint())
+	assert.Equal(t, sdb.TreeRoots(), imported.TreeRoots())
+	imported.Close()
+
+	// the path must be empty
+	_, err = ImportSnapshot(cfg, bytes.NewReader(snapshot.Bytes()))
+	assert.Equal(t, kvdb.ErrSnapshotPathNotEmpty, common.Unwrap(err))
+}
+
+func TestOpenAt(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 2, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	account := newAccount(t, 0)
+	_, err = sdb.CreateAccount(account.Idx, account)
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(account.Idx, newScore(0))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+
+	view, err := sdb.OpenAt(1)
+	require.NoError(t, err)
+	other, err := sdb.OpenAt(1)
+	require.NoError(t, err)
+
+	// the views don't see the changes of the following batches
+	for i := 1; i <= 3; i++ {
+		_, err = sdb.UpdateScore(account.Idx, newScore(i))
+		require.NoError(t, err)
+		require.NoError(t, sdb.MakeCheckpoint())
+	}
+	assert.Equal(t, common.BatchNum(1), view.BatchNum())
+	assert.Equal(t, roots, view.TreeRoots())
+	score, err := view.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+	acc, err := view.GetAccount(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, account.EthAddr, acc.EthAddr)
+	_, err = view.MTGetScoreProof(account.Idx)
+	require.NoError(t, err)
+	_, err = GetScoreInTreeDB(view.view.DB(), 257)
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	_, err = CreateScoreInTreeDB(view.view.DB(), nil, 257, newScore(1))
+	assert.Equal(t, kvdb.ErrReadOnly, common.Unwrap(err))
+	score, err = sdb.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(3), score)
+
+	// the checkpoint in use, and the ones after it, are not deleted
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err := sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, list)
+	view.Close()
+	view.Close()
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err = sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, list)
+	score, err = other.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+	other.Close()
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err = sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{3, 4}, list)
+	_, err = sdb.OpenAt(1)
+	require.Error(t, err)
+}
+
+func TestOpenAtReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	account := newAccount(t, 0)
+	_, err = sdb.CreateAccount(account.Idx, account)
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(account.Idx, newScore(0))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	_, err = sdb.UpdateScore(account.Idx, newScore(1))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	view, err := sdb.OpenAt(2)
+	require.NoError(t, err)
+
+	// the reset waits for the view of the checkpoint it deletes
+	done := make(chan error)
+	go func() {
+		done <- sdb.Reset(1)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("reset did not wait for the view: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	score, err := view.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(1), score)
+	_, err = sdb.db.OpenAt(2)
+	assert.True(t, errors.Is(err, kvdb.ErrCheckpointNotFound))
+
+	view.Close()
+	require.NoError(t, <-done)
+	list, err := sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, list)
+	score, err = sdb.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+}
+
+func TestOpenCheckpoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	cfg := Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32}
+	sdb, err := NewStateDB(cfg)
+	require.NoError(t, err)
+	defer sdb.Close()
+	last, err := LastCheckpoint(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(0), last)
+
+	account := newAccount(t, 0)
+	_, err = sdb.CreateAccount(account.Idx, account)
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(account.Idx, newScore(0))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+	_, err = sdb.UpdateScore(account.Idx, newScore(1))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	// the checkpoint is read while the StateDB is open, and without
+	// modifying it
+	view, err := OpenCheckpoint(cfg, 1)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(1), view.BatchNum())
+	assert.Equal(t, roots, view.TreeRoots())
+	score, err := view.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+	_, err = CreateScoreInTreeDB(view.view.DB(), nil, 257, newScore(1))
+	assert.Equal(t, kvdb.ErrReadOnly, common.Unwrap(err))
+	view.Close()
+
+	score, err = sdb.GetScore(account.Idx)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(1), score)
+	assert.Equal(t, common.BatchNum(2), sdb.CurrentBatch())
+	last, err = LastCheckpoint(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(2), last)
+
+	_, err = OpenCheckpoint(cfg, 3)
+	assert.True(t, errors.Is(err, kvdb.ErrCheckpointNotFound))
+}
+
+func TestDiff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	var accounts []*common.Account
+	for i := 0; i < 3; i++ {
+		accounts = append(accounts, newAccount(t, i))
+	}
+	for _, account := range accounts[:2] {
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+	}
+	_, err = sdb.CreateScore(256, newScore(0))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	updated := *accounts[0]
+	updated.Nonce++
+	updated.Balance = big.NewInt(900)
+	_, err = sdb.UpdateAccount(256, &updated)
+	require.NoError(t, err)
+	_, err = sdb.CreateAccount(258, accounts[2])
+	require.NoError(t, err)
+	vouchIdx := common.GenerateVouchIdx(256, 257)
+	_, err = sdb.CreateVouch(vouchIdx, &common.Vouch{BatchNum: 2, Value: true,
+		Amount: big.NewInt(100)})
+	require.NoError(t, err)
+	_, err = sdb.UpdateScore(256, newScore(4))
+	require.NoError(t, err)
+	_, err = sdb.CreateScore(257, newScore(1))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	diff, err := sdb.Diff(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []AccountDiff{
+		{Idx: 256, Kind: DiffUpdated, EthAddr: accounts[0].EthAddr, NonceDelta: 1,
+			BalanceDelta: "-100"},
+		{Idx: 258, Kind: DiffCreated, EthAddr: accounts[2].EthAddr, NonceDelta: 2,
+			BalanceDelta: "1000"},
+	}, diff.Accounts)
+	assert.Equal(t, []VouchDiff{{Idx: vouchIdx, From: 256, To: 257, Amount: "100"}},
+		diff.VouchesAdded)
+	assert.Equal(t, []VouchDiff{}, diff.VouchesRemoved)
+	assert.Equal(t, []ScoreDiff{{Idx: 256, From: 1, To: 5}, {Idx: 257, From: 0, To: 2}},
+		diff.Scores)
+
+	// the reverse diff deletes what has been created
+	diff, err = sdb.Diff(2, 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(diff.Accounts))
+	assert.Equal(t, DiffDeleted, diff.Accounts[1].Kind)
+	assert.Equal(t, "-1000", diff.Accounts[1].BalanceDelta)
+	assert.Equal(t, []VouchDiff{}, diff.VouchesAdded)
+	assert.Equal(t, 1, len(diff.VouchesRemoved))
+
+	// the batch 0 is the empty state
+	diff, err = sdb.Diff(0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(diff.Accounts))
+	assert.Equal(t, DiffCreated, diff.Accounts[0].Kind)
+
+	var table strings.Builder
+	require.NoError(t, diff.WriteTable(&table))
+	assert.Regexp(t, `256\s+created`, table.String())
+
+	// the diff of the checkpoints opened without the StateDB is the same
+	from, err := OpenCheckpoint(Config{Path: dir, Type: TypeSynchronizer}, 1)
+	require.NoError(t, err)
+	defer from.Close()
+	to, err := OpenCheckpoint(Config{Path: dir, Type: TypeSynchronizer}, 2)
+	require.NoError(t, err)
+	defer to.Close()
+	viewsDiff, err := DiffViews(from, to)
+	require.NoError(t, err)
+	diff, err = sdb.Diff(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, diff, viewsDiff)
+	viewsDiff, err = DiffViews(nil, from)
+	require.NoError(t, err)
+	diff, err = sdb.Diff(0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, diff, viewsDiff)
+	_, err = sdb.Diff(1, 3)
+	require.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	var accounts []*common.Account
+	for i := 0; i < 3; i++ {
+		account := newAccount(t, i)
+		accounts = append(accounts, account)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		_, err = sdb.CreateScore(account.Idx, newScore(i))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		vouch := newVouch(i)
+		_, err = sdb.CreateVouch(vouch.Idx, vouch)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.MakeCheckpoint())
+	stateRoot, err := sdb.StateRoot()
+	require.NoError(t, err)
+
+	divergence, err := sdb.Verify(nil)
+	require.NoError(t, err)
+	assert.Nil(t, divergence)
+	divergence, err = sdb.Verify(stateRoot)
+	require.NoError(t, err)
+	assert.Nil(t, divergence)
+	divergence, err = sdb.Verify(big.NewInt(1))
+	require.NoError(t, err)
+	assert.Equal(t, &Divergence{Check: "historyStateRoot", Key: "batch 1",
+		Stored: stateRoot.String(), Expected: "1"}, divergence)
+
+	// the checkpoint is verified the same when it's opened without the
+	// StateDB
+	last, err := LastCheckpoint(Config{Path: dir})
+	require.NoError(t, err)
+	view, err := OpenCheckpoint(Config{Path: dir}, last)
+	require.NoError(t, err)
+	divergence, err = view.Verify(stateRoot)
+	require.NoError(t, err)
+	assert.Nil(t, divergence)
+	divergence, err = view.Verify(big.NewInt(1))
+	require.NoError(t, err)
+	assert.Equal(t, &Divergence{Check: "historyStateRoot", Key: "batch 1",
+		Stored: stateRoot.String(), Expected: "1"}, divergence)
+	view.Close()
+
+	put := func(key, value []byte) {
+		tx, err := sdb.db.DB().NewTx()
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(key, value))
+		require.NoError(t, tx.Commit())
+	}
+	idxBytes, err := common.AccountIdx(257).Bytes()
+	require.NoError(t, err)
+	scoreKey := append(append([]byte{}, PrefixKeyScoIdx...), idxBytes[:]...)
+	scoreBytes, err := sdb.db.DB().Get(scoreKey)
+	require.NoError(t, err)
+
+	// a score that doesn't match its leaf
+	corrupted := &common.Score{Value: 100}
+	corruptedBytes, err := corrupted.Bytes()
+	require.NoError(t, err)
+	put(scoreKey, corruptedBytes[:])
+	divergence, err = sdb.Verify(nil)
+	require.NoError(t, err)
+	require.NotNil(t, divergence)
+	assert.Equal(t, "scoreTree", divergence.Check)
+	assert.Equal(t, "257", divergence.Key)
+	assert.Equal(t, newScore(1).BigInt().String(), divergence.Stored)
+	assert.Equal(t, corrupted.BigInt().String(), divergence.Expected)
+	put(scoreKey, scoreBytes)
+
+	// an index that points to another account
+	addrBJJKey := append(append([]byte{}, PrefixKeyAddrBJJ...),
+		concatEthAddrBJJ(accounts[1].EthAddr, accounts[1].BJJ)...)
+	wrongIdx, err := common.AccountIdx(258).Bytes()
+	require.NoError(t, err)
+	put(addrBJJKey, wrongIdx[:])
+	divergence, err = sdb.Verify(nil)
+	require.NoError(t, err)
+	require.NotNil(t, divergence)
+	assert.Equal(t, "addrBJJIndex", divergence.Check)
+	assert.Equal(t, "258", divergence.Stored)
+	assert.Equal(t, "257", divergence.Expected)
+	put(addrBJJKey, idxBytes[:])
+	divergence, err = sdb.Verify(nil)
+	require.NoError(t, err)
+	assert.Nil(t, divergence)
+}
+
+func TestInMemory(t *testing.T) {
+	sdb, err := NewStateDB(Config{Keep: 2, Type: TypeSynchronizer, NLevels: 32,
+		InMemory: true})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 2; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+	}
+	_, err = sdb.CreateScore(256, newScore(0))
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+	roots := sdb.TreeRoots()
+
+	// the checkpoints are not modified by the following writes
+	for i := 1; i <= 2; i++ {
+		_, err = sdb.UpdateScore(256, newScore(i))
+		require.NoError(t, err)
+		require.NoError(t, sdb.MakeCheckpoint())
+	}
+	view, err := sdb.OpenAt(2)
+	require.NoError(t, err)
+	score, err := view.GetScore(256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(1), score)
+	view.Close()
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err := sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, list)
+
+	// savepoints roll back the writes in memory
+	sp := sdb.Savepoint()
+	_, err = sdb.UpdateScore(256, newScore(5))
+	require.NoError(t, err)
+	require.NoError(t, sdb.RollbackTo(sp))
+	require.NoError(t, sdb.Release(sp))
+	score, err = sdb.GetScore(256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(2), score)
+
+	// reset to a checkpoint, and write after it
+	require.NoError(t, sdb.Reset(2))
+	assert.Equal(t, common.BatchNum(2), sdb.CurrentBatch())
+	score, err = sdb.GetScore(256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(1), score)
+	_, err = sdb.UpdateScore(256, newScore(0))
+	require.NoError(t, err)
+	assert.Equal(t, roots, sdb.TreeRoots())
+	view, err = sdb.OpenAt(2)
+	require.NoError(t, err)
+	score, err = view.GetScore(256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(1), score)
+	view.Close()
+	_, err = sdb.OpenAt(3)
+	require.Error(t, err)
+
+	require.NoError(t, sdb.Reset(0))
+	_, err = sdb.GetAccount(256)
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	list, err = sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{}, list)
+
+	// only a StateDB on disk needs a Path
+	_, err = NewStateDB(Config{Keep: 2, Type: TypeSynchronizer, NLevels: 32})
+	assert.True(t, errors.Is(err, kvdb.ErrPathRequired))
+}
+
+func TestInMemoryAndOnDisk(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Keep: 2, Type: TypeSynchronizer, NLevels: 32,
+		InMemory: true})
+	require.NoError(t, err)
+	defer sdb.Close()
+	diskDB, err := NewStateDB(Config{Path: dir, Keep: 2, Type: TypeSynchronizer,
+		NLevels: 32})
+	require.NoError(t, err)
+	defer diskDB.Close()
+
+	// the same writes give the same roots in memory and on disk
+	for _, s := range []*StateDB{sdb, diskDB} {
+		for i := 0; i < 2; i++ {
+			account := newAccount(t, i)
+			_, err = s.CreateAccount(account.Idx, account)
+			require.NoError(t, err)
+		}
+		_, err = s.CreateScore(256, newScore(0))
+		require.NoError(t, err)
+		require.NoError(t, s.MakeCheckpoint())
+	}
+	assert.Equal(t, diskDB.TreeRoots(), sdb.TreeRoots())
+
+	// a checkpoint in memory can be copied to disk
+	checkpointPath := path.Join(dir, "copy")
+	require.NoError(t, sdb.MakeCheckpointFromTo(1, checkpointPath))
+	sto, err := pebble.NewPebbleStorage(checkpointPath, true)
+	require.NoError(t, err)
+	score, err := GetScoreInTreeDB(sto, 256)
+	require.NoError(t, err)
+	assert.Equal(t, newScore(0), score)
+	sto.Close()
+}
+
+func TestRetention(t *testing.T) {
+	for _, tc := range []struct {
+		keep      int
+		retention kvdb.Retention
+		expected  []int
+	}{
+		{keep: 3, expected: []int{8, 9, 10}},
+		{retention: kvdb.Retention{MaxAge: 3}, expected: []int{8, 9, 10}},
+		{keep: 4, retention: kvdb.Retention{MaxAge: 2}, expected: []int{9, 10}},
+		{retention: kvdb.Retention{MaxBytes: 1}, expected: []int{10}},
+		{keep: 3, retention: kvdb.Retention{KeepEvery: 4}, expected: []int{4, 7, 8, 9, 10}},
+		{keep: 1, retention: kvdb.Retention{KeepEvery: 3, MaxBytes: 1},
+			expected: []int{3, 6, 9, 10}},
+	} {
+		for _, inMemory := range []bool{false, true} {
+			var dir string
+			if !inMemory {
+				var err error
+				dir, err = os.MkdirTemp("", "tmpdb")
+				require.NoError(t, err)
+				deleteme = append(deleteme, dir)
+			}
+
+			sdb, err := NewStateDB(Config{Path: dir, Keep: tc.keep, Retention: tc.retention,
+				Type: TypeSynchronizer, NLevels: 32, InMemory: inMemory})
+			require.NoError(t, err)
+			account := newAccount(t, 0)
+			_, err = sdb.CreateAccount(account.Idx, account)
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				_, err = sdb.CreateScore(common.AccountIdx(256+i), newScore(i))
+				require.NoError(t, err)
+				require.NoError(t, sdb.MakeCheckpoint())
+			}
+			require.NoError(t, sdb.db.DeleteOldCheckpoints())
+			// the gaps after the archival checkpoints are allowed
+			list, err := sdb.db.ListCheckpoints()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, list, "keep %d, retention %+v, inMemory %v",
+				tc.keep, tc.retention, inMemory)
+
+			// the archival checkpoints can be reset to
+			if tc.retention.KeepEvery > 0 {
+				batchNum := common.BatchNum(tc.retention.KeepEvery)
+				require.NoError(t, sdb.Reset(batchNum))
+				score, err := sdb.GetScore(common.AccountIdx(256 + tc.retention.KeepEvery - 1))
+				require.NoError(t, err)
+				assert.Equal(t, newScore(tc.retention.KeepEvery-1), score)
+				list, err = sdb.db.ListCheckpoints()
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected[:1], list)
+			}
+			sdb.Close()
+		}
+	}
+}
+
+func TestRetentionKeepEvery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+	cfg := Config{Path: dir, Keep: 1, Retention: kvdb.Retention{KeepEvery: 2},
+		Type: TypeSynchronizer, NLevels: 32}
+
+	sdb, err := NewStateDB(cfg)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = sdb.CreateScore(common.AccountIdx(256+i), newScore(i))
+		require.NoError(t, err)
+		require.NoError(t, sdb.MakeCheckpoint())
+	}
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err := sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 4, 5}, list)
+	sdb.Close()
+
+	// the gaps left by the KeepEvery are only allowed with the same one
+	cfg.Retention.KeepEvery = 3
+	_, err = NewStateDB(cfg)
+	assert.True(t, errors.Is(err, kvdb.ErrKeepEveryMismatch))
+	cfg.Retention.KeepEvery = 2
+	sdb, err = NewStateDB(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(5), sdb.CurrentBatch())
+	sdb.Close()
+}
+
+func TestRetentionInMemoryShared(t *testing.T) {
+	newStateDB := func(maxBytes int64) *StateDB {
+		sdb, err := NewStateDB(Config{Type: TypeSynchronizer, NLevels: 32, InMemory: true,
+			Retention: kvdb.Retention{MaxBytes: maxBytes}})
+		require.NoError(t, err)
+		for i := 0; i < 64; i++ {
+			account := newAccount(t, i)
+			_, err = sdb.CreateAccount(account.Idx, account)
+			require.NoError(t, err)
+		}
+		require.NoError(t, sdb.MakeCheckpoint())
+		return sdb
+	}
+	sdb := newStateDB(0)
+	var size int64
+	require.NoError(t, sdb.db.DB().Iterate(func(k, v []byte) (bool, error) {
+		size += int64(len(k) + len(v))
+		return true, nil
+	}))
+	sdb.Close()
+
+	// the checkpoints share the accounts, so they take less than twice
+	// the size of one of them and none is pruned
+	sdb = newStateDB(2 * size)
+	defer sdb.Close()
+	for i := 0; i < 4; i++ {
+		_, err := sdb.CreateScore(common.AccountIdx(256+i), newScore(i))
+		require.NoError(t, err)
+		require.NoError(t, sdb.MakeCheckpoint())
+	}
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+	list, err := sdb.db.ListCheckpoints()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, list)
+}
+
+func TestLocalStateDBReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: path.Join(dir, "synchronizer"), Keep: 2,
+		Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+	var roots []TreeRoots
+	for i := 0; i < 4; i++ {
+		account := newAccount(t, i)
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		_, err = sdb.CreateScore(account.Idx, newScore(i))
+		require.NoError(t, err)
+		require.NoError(t, sdb.SetCurrentAccountIdx(account.Idx))
+		require.NoError(t, sdb.MakeCheckpoint())
+		roots = append(roots, sdb.TreeRoots())
+	}
+	// the synchronizer keeps the checkpoints 3 and 4
+	require.NoError(t, sdb.db.DeleteOldCheckpoints())
+
+	for _, inMemory := range []bool{false, true} {
+		localPath := path.Join(dir, "local")
+		if inMemory {
+			localPath = ""
+		}
+		ldb, err := NewLocalStateDB(Config{Path: localPath,
+			Keep: 128, Type: TypeBatchBuilder, NLevels: 32, InMemory: inMemory}, sdb)
+		require.NoError(t, err)
+
+		require.NoError(t, ldb.Reset(3, true))
+		assert.Equal(t, common.BatchNum(3), ldb.CurrentBatch())
+		assert.Equal(t, common.AccountIdx(258), ldb.CurrentAccountIdx())
+		assert.Equal(t, roots[2], ldb.TreeRoots())
+		_, err = ldb.GetAccount(259)
+		assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+
+		// the local writes don't change the synchronizer StateDB
+		account := newAccount(t, 10)
+		_, err = ldb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		require.NoError(t, ldb.MakeCheckpoint())
+		_, err = sdb.GetAccount(account.Idx)
+		assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+		require.NoError(t, ldb.Reset(3, false))
+		assert.Equal(t, roots[2], ldb.TreeRoots())
+
+		// the checkpoints deleted by the synchronizer can't be copied,
+		// and the LocalStateDB is kept
+		err = ldb.Reset(1, true)
+		assert.True(t, errors.Is(err, ErrCheckpointPruned))
+		assert.Equal(t, common.BatchNum(3), ldb.CurrentBatch())
+		assert.Equal(t, roots[2], ldb.TreeRoots())
+		err = ldb.Reset(5, true)
+		assert.True(t, errors.Is(err, kvdb.ErrCheckpointNotFound))
+		assert.False(t, errors.Is(err, ErrCheckpointPruned))
+
+		require.NoError(t, ldb.Reset(4, true))
+		assert.Equal(t, roots[3], ldb.TreeRoots())
+		list, err := ldb.db.ListCheckpoints()
+		require.NoError(t, err)
+		assert.Equal(t, []int{4}, list)
+
+		require.NoError(t, ldb.Reset(0, true))
+		assert.Equal(t, common.BatchNum(0), ldb.CurrentBatch())
+		_, err = ldb.GetAccount(256)
+		assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+		ldb.Close()
+	}
+}
+
+func TestAccountQueries(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := NewStateDB(Config{Path: dir, Keep: 128, Type: TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	var accounts []*common.Account
+	for i := 0; i < 5; i++ {
+		account := newAccount(t, i)
+		account.Balance = big.NewInt(int64(100 * (i + 1)))
+		accounts = append(accounts, account)
+	}
+	// the accounts 256 and 260 have the same eth address, and all of them
+	// the same BJJ
+	accounts[4].EthAddr = accounts[0].EthAddr
+	for i, account := range accounts {
+		_, err = sdb.CreateAccount(account.Idx, account)
+		require.NoError(t, err)
+		if i < 3 {
+			_, err = sdb.CreateScore(account.Idx, newScore(i))
+			require.NoError(t, err)
+		}
+	}
+	vouch := &common.Vouch{Idx: common.GenerateVouchIdx(256, 257), BatchNum: 1,
+		Value: true, Amount: big.NewInt(1)}
+	_, err = sdb.CreateVouch(vouch.Idx, vouch)
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	idxs, err := sdb.GetIdxsByEthAddr(accounts[0].EthAddr)
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{256, 260}, idxs)
+	idxs, err = sdb.GetIdxsByBJJ(accounts[0].BJJ)
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258, 259, 260}, idxs)
+	_, err = sdb.GetIdxsByEthAddr(ethCommon.HexToAddress("0x1234"))
+	assert.True(t, errors.Is(err, ErrIdxNotFound))
+	_, err = sdb.GetIdxsByBJJ(common.EmptyBJJComp)
+	assert.True(t, errors.Is(err, ErrIdxNotFound))
+
+	pages := func(filter AccountFilter, limit int) [][]common.AccountIdx {
+		var pages [][]common.AccountIdx
+		var from common.AccountIdx
+		for {
+			page, next, err := sdb.AccountsPage(filter, from, limit)
+			require.NoError(t, err)
+			var idxs []common.AccountIdx
+			for _, account := range page {
+				idxs = append(idxs, account.Idx)
+			}
+			pages = append(pages, idxs)
+			if next == 0 {
+				return pages
+			}
+			from = next
+		}
+	}
+	assert.Equal(t, [][]common.AccountIdx{{256, 257}, {258, 259}, {260}},
+		pages(AccountFilter{}, 2))
+	assert.Equal(t, [][]common.AccountIdx{{258, 259}, {260}},
+		pages(AccountFilter{MinBalance: big.NewInt(300)}, 2))
+	assert.Equal(t, [][]common.AccountIdx{{257, 258}},
+		pages(AccountFilter{MinScore: 2}, 2))
+	assert.Equal(t, [][]common.AccountIdx{{256, 257}},
+		pages(AccountFilter{HasVouches: true}, 10))
+	_, _, err = sdb.AccountsPage(AccountFilter{}, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalidLimit))
+
+	var filtered []common.AccountIdx
+	require.NoError(t, sdb.AccountsIterFiltered(
+		AccountFilter{MinBalance: big.NewInt(200), HasVouches: true},
+		func(a *common.Account) (bool, error) {
+			filtered = append(filtered, a.Idx)
+			return true, nil
+		}))
+	assert.Equal(t, []common.AccountIdx{257}, filtered)
+
+	// accounts stored without indexes are indexed by IndexAccounts
+	unindexed := newAccount(t, 5)
+	_, err = CreateAccountInTreeDB(sdb.db.DB(), nil, unindexed.Idx, unindexed)
+	require.NoError(t, err)
+	_, err = sdb.GetIdxsByEthAddr(unindexed.EthAddr)
+	assert.True(t, errors.Is(err, ErrIdxNotFound))
+
+	nIndexed, err := sdb.IndexAccounts()
+	require.NoError(t, err)
+	assert.Equal(t, 1, nIndexed)
+	idxs, err = sdb.GetIdxsByEthAddr(unindexed.EthAddr)
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{unindexed.Idx}, idxs)
+	nIndexed, err = sdb.IndexAccounts()
+	require.NoError(t, err)
+	assert.Equal(t, 0, nIndexed)
+}
+
 func TestScoreInStateDB(t *testing.T) {
 	dir, err := os.MkdirTemp("", "tmpdb")
 	require.NoError(t, err)
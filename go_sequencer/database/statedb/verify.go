@@ -0,0 +1,317 @@
+package statedb
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/iden3/go-merkletree"
+	"github.com/iden3/go-merkletree/db"
+)
+
+// ErrStateDBCorrupted is used when Verify finds a divergence in the StateDB
+var ErrStateDBCorrupted = errors.New("statedb corrupted")
+
+const (
+	treeAccount = iota
+	treeVouch
+	treeScore
+	nTrees
+)
+
+// treeNames are the names of the trees in the Divergences
+var treeNames = [nTrees]string{"accountTree", "vouchTree", "scoreTree"}
+
+// Divergence is the first inconsistency found by Verify
+type Divergence struct {
+	// Check is the check that failed: "accountTree", "vouchTree" or
+	// "scoreTree" for a leaf of a tree, "stateRoot" for the StateRoot of
+	// the checkpoint, "historyStateRoot" for the StateRoot of the batch in
+	// the HistoryDB, "addrBJJIndex" and "addrIndex" for the indexes of
+	// GetIdxByEthAddrBJJ
+	Check string `json:"check"`
+	// Key is the divergent key: the key of the leaf in the trees, the
+	// eth address (and BJJ) in the indexes
+	Key string `json:"key"`
+	// Stored is the value found in the StateDB, and Expected the one
+	// computed from the accounts, vouches and scores.  An empty value is a
+	// missing key.
+	Stored   string `json:"stored"`
+	Expected string `json:"expected"`
+}
+
+// String returns a human readable description of the Divergence
+func (d *Divergence) String() string {
+	return fmt.Sprintf("%s: key %s: stored %q, expected %q", d.Check, d.Key,
+		d.Stored, d.Expected)
+}
+
+// leaf is a leaf of a merkle tree
+type leaf struct {
+	key   *big.Int
+	value *big.Int
+}
+
+// trees returns the merkle trees of the StateDB, indexed by treeAccount,
+// treeVouch and treeScore
+func (s *StateDB) trees() [nTrees]*merkletree.MerkleTree {
+	return [nTrees]*merkletree.MerkleTree{s.AccountTree, s.VouchTree, s.ScoreTree}
+}
+
+// trees returns the merkle trees of the StateView, indexed by treeAccount,
+// treeVouch and treeScore
+func (v *StateView) trees() [nTrees]*merkletree.MerkleTree {
+	return [nTrees]*merkletree.MerkleTree{v.AccountTree, v.VouchTree, v.ScoreTree}
+}
+
+// treeLeafs returns the leafs of the merkle trees computed from the
+// accounts, vouches and scores stored in sto, sorted by key
+func treeLeafs(sto db.Storage) ([nTrees][]leaf, error) {
+	var leafs [nTrees][]leaf
+	if err := accountsIter(sto, func(a *common.Account) (bool, error) {
+		v, err := a.HashValue()
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		leafs[treeAccount] = append(leafs[treeAccount], leaf{a.Idx.BigInt(), v})
+		return true, nil
+	}); err != nil {
+		return leafs, common.Wrap(err)
+	}
+	if err := vouchesIter(sto, func(v *common.Vouch) (bool, error) {
+		value, err := v.HashValue()
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		leafs[treeVouch] = append(leafs[treeVouch], leaf{v.Idx.BigInt(), value})
+		return true, nil
+	}); err != nil {
+		return leafs, common.Wrap(err)
+	}
+	if err := scoresIter(sto, func(score *common.Score) (bool, error) {
+		leafs[treeScore] = append(leafs[treeScore], leaf{score.Idx.BigInt(), score.BigInt()})
+		return true, nil
+	}); err != nil {
+		return leafs, common.Wrap(err)
+	}
+	return leafs, nil
+}
+
+// storedLeafs returns the leafs stored in the merkle tree, sorted by key
+func storedLeafs(mt *merkletree.MerkleTree) ([]leaf, error) {
+	var leafs []leaf
+	if err := mt.Walk(mt.Root(), func(n *merkletree.Node) {
+		if n.Type == merkletree.NodeTypeLeaf {
+			leafs = append(leafs, leaf{n.Entry[0].BigInt(), n.Entry[1].BigInt()})
+		}
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	sort.Slice(leafs, func(i, j int) bool { return leafs[i].key.Cmp(leafs[j].key) < 0 })
+	return leafs, nil
+}
+
+// firstDivergentLeaf compares the leafs stored in a tree with the expected
+// ones, both sorted by key, and returns the Divergence of the first key that
+// differs, or nil if they are equal
+func firstDivergentLeaf(check string, stored, expected []leaf) *Divergence {
+	for i, j := 0, 0; i < len(stored) || j < len(expected); {
+		switch {
+		case j == len(expected) || (i < len(stored) && stored[i].key.Cmp(expected[j].key) < 0):
+			return &Divergence{Check: check, Key: stored[i].key.String(),
+				Stored: stored[i].value.String()}
+		case i == len(stored) || stored[i].key.Cmp(expected[j].key) > 0:
+			return &Divergence{Check: check, Key: expected[j].key.String(),
+				Expected: expected[j].value.String()}
+		case stored[i].value.Cmp(expected[j].value) != 0:
+			return &Divergence{Check: check, Key: stored[i].key.String(),
+				Stored: stored[i].value.String(), Expected: expected[j].value.String()}
+		}
+		i++
+		j++
+	}
+	return nil
+}
+
+// Verify checks the integrity of the current state of the StateDB, which must
+// be the one of its last checkpoint, and returns the first Divergence found,
+// or nil if there is none:
+//   - the leafs of the account, vouch and score trees are compared with the
+//     ones computed from the accounts (i:/h:), vouches (v:) and scores (s:)
+//     stored in the StateDB, rebuilding each tree in memory
+//   - the StateRoot of the trees is compared with the one stored by the
+//     checkpoint, and with historyStateRoot, the StateRoot of the batch in
+//     the HistoryDB, if it's not nil
+//   - the indexes of GetIdxByEthAddrBJJ are compared with the ones computed
+//     from the accounts
+func (s *StateDB) Verify(historyStateRoot *big.Int) (*Divergence, error) {
+	return verify(s.db.DB(), s.trees(), s.CurrentBatch(), historyStateRoot)
+}
+
+// Verify checks the integrity of the checkpoint of the StateView, see
+// StateDB.Verify
+func (v *StateView) Verify(historyStateRoot *big.Int) (*Divergence, error) {
+	return verify(v.view.DB(), v.trees(), v.BatchNum(), historyStateRoot)
+}
+
+// verify implements Verify on the storage and the merkle trees of the state
+// of the given batchNum
+func verify(sto db.Storage, trees [nTrees]*merkletree.MerkleTree, batchNum common.BatchNum,
+	historyStateRoot *big.Int) (*Divergence, error) {
+	expected, err := treeLeafs(sto)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	roots := TreeRoots{
+		Account: trees[treeAccount].Root(),
+		Vouch:   trees[treeVouch].Root(),
+		Score:   trees[treeScore].Root(),
+	}
+	for n, mt := range trees {
+		stored, err := storedLeafs(mt)
+		if common.Unwrap(err) == db.ErrNotFound {
+			// a node of the tree is missing
+			return &Divergence{Check: treeNames[n], Key: "node", Stored: err.Error()}, nil
+		} else if err != nil {
+			return nil, common.Wrap(err)
+		}
+		if d := firstDivergentLeaf(treeNames[n], stored, expected[n]); d != nil {
+			return d, nil
+		}
+	}
+	leafRoots, err := leafTreeRoots(sto, trees)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	for n, root := range [nTrees][2]*merkletree.Hash{
+		{roots.Account, leafRoots.Account},
+		{roots.Vouch, leafRoots.Vouch},
+		{roots.Score, leafRoots.Score},
+	} {
+		// the leafs are the same, so the roots can only differ if the
+		// stored intermediate nodes are corrupted
+		if !root[0].Equals(root[1]) {
+			return &Divergence{Check: treeNames[n], Key: "root",
+				Stored: root[0].BigInt().String(), Expected: root[1].BigInt().String()}, nil
+		}
+	}
+
+	stateRoot, err := roots.StateRoot()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	storedStateRoot, err := checkpointStateRoot(sto, batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if storedStateRoot.Cmp(stateRoot) != 0 {
+		return &Divergence{Check: "stateRoot", Key: string(KeyStateRoot),
+			Stored: storedStateRoot.String(), Expected: stateRoot.String()}, nil
+	}
+	if historyStateRoot != nil && historyStateRoot.Cmp(stateRoot) != 0 {
+		return &Divergence{Check: "historyStateRoot",
+			Key:    fmt.Sprintf("batch %d", batchNum),
+			Stored: stateRoot.String(), Expected: historyStateRoot.String()}, nil
+	}
+	return verifyIndexes(sto)
+}
+
+// verifyIndexes compares the indexes of GetIdxByEthAddrBJJ with the accounts:
+// the index of each EthAddr & BJJ must be the smallest Idx of the accounts
+// with them, and the index of each EthAddr must be the Idx of an account
+// with it
+func verifyIndexes(sto db.Storage) (*Divergence, error) {
+	addrBJJIdx := make(map[string]common.AccountIdx)
+	addrIdxs := make(map[string]map[common.AccountIdx]bool)
+	if err := accountsIter(sto, func(a *common.Account) (bool, error) {
+		k := string(concatEthAddrBJJ(a.EthAddr, a.BJJ))
+		if idx, ok := addrBJJIdx[k]; !ok || a.Idx < idx {
+			addrBJJIdx[k] = a.Idx
+		}
+		addr := string(concatEthAddr(a.EthAddr))
+		if addrIdxs[addr] == nil {
+			addrIdxs[addr] = make(map[common.AccountIdx]bool)
+		}
+		addrIdxs[addr][a.Idx] = true
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+
+	var d *Divergence
+	seen := make(map[string]bool)
+	if err := sto.WithPrefix(PrefixKeyAddrBJJ).Iterate(func(k, v []byte) (bool, error) {
+		idx, err := common.AccountIdxFromBytes(v)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		expected, ok := addrBJJIdx[string(k)]
+		if !ok || idx != expected {
+			d = &Divergence{Check: "addrBJJIndex", Key: fmt.Sprintf("%x", k),
+				Stored: fmt.Sprint(idx)}
+			if ok {
+				d.Expected = fmt.Sprint(expected)
+			}
+			return false, nil
+		}
+		seen[string(k)] = true
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if d != nil {
+		return d, nil
+	}
+	if d := firstMissingIndex("addrBJJIndex", addrBJJIdx, seen); d != nil {
+		return d, nil
+	}
+
+	seen = make(map[string]bool)
+	if err := sto.WithPrefix(PrefixKeyAddr).Iterate(func(k, v []byte) (bool, error) {
+		idx, err := common.AccountIdxFromBytes(v)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !addrIdxs[string(k)][idx] {
+			d = &Divergence{Check: "addrIndex", Key: fmt.Sprintf("%x", k),
+				Stored: fmt.Sprint(idx)}
+			return false, nil
+		}
+		seen[string(k)] = true
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if d != nil {
+		return d, nil
+	}
+	addrIdx := make(map[string]common.AccountIdx, len(addrIdxs))
+	for addr, idxs := range addrIdxs {
+		for idx := range idxs {
+			if smallest, ok := addrIdx[addr]; !ok || idx < smallest {
+				addrIdx[addr] = idx
+			}
+		}
+	}
+	return firstMissingIndex("addrIndex", addrIdx, seen), nil
+}
+
+// firstMissingIndex returns the Divergence of the smallest key of expected
+// that has not been seen in the StateDB, or nil if all have been seen
+func firstMissingIndex(check string, expected map[string]common.AccountIdx,
+	seen map[string]bool) *Divergence {
+	var missing []string
+	for k := range expected {
+		if !seen[k] {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &Divergence{Check: check, Key: fmt.Sprintf("%x", missing[0]),
+		Expected: fmt.Sprint(expected[missing[0]])}
+}
@@ -0,0 +1,174 @@
+package statedb
+
+import (
+	"math/big"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/kvdb"
+
+	"github.com/iden3/go-merkletree"
+)
+
+// StateView is a read-only view of the StateDB at a retained checkpoint,
+// obtained with StateDB.OpenAt.  It can be used concurrently with the
+// StateDB, and must be closed when it's not needed anymore so that the
+// checkpoint can be deleted.
+type StateView struct {
+	view        *kvdb.View
+	AccountTree *merkletree.MerkleTree
+	VouchTree   *merkletree.MerkleTree
+	ScoreTree   *merkletree.MerkleTree
+}
+
+// OpenAt returns a read-only StateView of the checkpoint at the given
+// batchNum, which must be one of the Keep checkpoints retained by the
+// StateDB.  The checkpoint is not deleted while the StateView is open.
+func (s *StateDB) OpenAt(batchNum common.BatchNum) (*StateView, error) {
+	view, err := s.db.OpenAt(batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return newStateView(view)
+}
+
+// OpenCheckpoint returns a read-only StateView of the checkpoint at the given
+// batchNum of the StateDB stored in cfg.Path, without opening the StateDB, so
+// that it can be read while a node is running, see kvdb.OpenCheckpoint
+func OpenCheckpoint(cfg Config, batchNum common.BatchNum) (*StateView, error) {
+	view, err := kvdb.OpenCheckpoint(kvdb.Config{Path: cfg.Path, InMemory: cfg.InMemory,
+		Name: string(cfg.Type)}, batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return newStateView(view)
+}
+
+// LastCheckpoint returns the batchNum of the last checkpoint of the StateDB
+// stored in cfg.Path, without opening the StateDB, or 0 if there are no
+// checkpoints
+func LastCheckpoint(cfg Config) (common.BatchNum, error) {
+	return kvdb.LastCheckpoint(kvdb.Config{Path: cfg.Path, InMemory: cfg.InMemory,
+		Name: string(cfg.Type)})
+}
+
+// newStateView returns a StateView with the merkle trees of the checkpoint of
+// the view, which is closed on error
+func newStateView(view *kvdb.View) (*StateView, error) {
+	sv := &StateView{view: view}
+	for _, tree := range []struct {
+		mt     **merkletree.MerkleTree
+		prefix []byte
+		levels int
+	}{
+		{&sv.AccountTree, PrefixKeyMTAcc, MaxNLevels},
+		{&sv.VouchTree, PrefixKeyMTVoc, VouchNLevels},
+		{&sv.ScoreTree, PrefixKeyMTSco, MaxNLevels},
+	} {
+		mt, err := merkletree.NewMerkleTree(view.DB().WithPrefix(tree.prefix), tree.levels)
+		if err != nil {
+			view.Close()
+			return nil, common.Wrap(err)
+		}
+		*tree.mt = mt
+	}
+	return sv, nil
+}
+
+// Close releases the StateView
+func (v *StateView) Close() {
+	v.view.Close()
+}
+
+// BatchNum returns the batchNum of the checkpoint of the StateView
+func (v *StateView) BatchNum() common.BatchNum {
+	return v.view.BatchNum()
+}
+
+// GetAccount returns the account for the given Idx at the checkpoint
+func (v *StateView) GetAccount(idx common.AccountIdx) (*common.Account, error) {
+	return GetAccountInTreeDB(v.view.DB(), idx)
+}
+
+// GetVouch returns the vouch for the given Idx at the checkpoint
+func (v *StateView) GetVouch(idx common.VouchIdx) (*common.Vouch, error) {
+	return GetVouchInTreeDB(v.view.DB(), idx)
+}
+
+// GetScore returns the score for the given Idx at the checkpoint
+func (v *StateView) GetScore(idx common.AccountIdx) (*common.Score, error) {
+	return GetScoreInTreeDB(v.view.DB(), idx)
+}
+
+// AccountsIter iterates over all the accounts at the checkpoint, see
+// StateDB.AccountsIter
+func (v *StateView) AccountsIter(fn func(a *common.Account) (bool, error)) error {
+	return accountsIter(v.view.DB(), fn)
+}
+
+// VouchesIter iterates over all the vouches at the checkpoint, see
+// StateDB.VouchesIter
+func (v *StateView) VouchesIter(fn func(v *common.Vouch) (bool, error)) error {
+	return vouchesIter(v.view.DB(), fn)
+}
+
+// ScoresIter iterates over all the scores at the checkpoint, see
+// StateDB.ScoresIter
+func (v *StateView) ScoresIter(fn func(score *common.Score) (bool, error)) error {
+	return scoresIter(v.view.DB(), fn)
+}
+
+// IsSybil returns true if the account was reported as sybil at the
+// checkpoint
+func (v *StateView) IsSybil(idx common.AccountIdx) (bool, error) {
+	return isSybil(v.view.DB(), idx)
+}
+
+// VouchGraph returns the active vouches at the checkpoint grouped by their
+// sender, see StateDB.VouchGraph
+func (v *StateView) VouchGraph() (map[common.AccountIdx][]*common.Vouch, error) {
+	return vouchGraph(v.view.DB())
+}
+
+// MTGetAccountProof returns the CircomVerifierProof for a given accountIdx
+// at the checkpoint
+func (v *StateView) MTGetAccountProof(idx common.AccountIdx) (*merkletree.CircomVerifierProof, error) {
+	p, err := v.AccountTree.GenerateSCVerifierProof(idx.BigInt(), v.AccountTree.Root())
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return p, nil
+}
+
+// MTGetVouchProof returns the CircomVerifierProof for a given vouchIdx at the
+// checkpoint
+func (v *StateView) MTGetVouchProof(idx common.VouchIdx) (*merkletree.CircomVerifierProof, error) {
+	p, err := v.VouchTree.GenerateSCVerifierProof(idx.BigInt(), v.VouchTree.Root())
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return p, nil
+}
+
+// MTGetScoreProof returns the CircomVerifierProof for a given accountIdx at
+// the checkpoint
+func (v *StateView) MTGetScoreProof(idx common.AccountIdx) (*merkletree.CircomVerifierProof, error) {
+	p, err := v.ScoreTree.GenerateSCVerifierProof(idx.BigInt(), v.ScoreTree.Root())
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return p, nil
+}
+
+// TreeRoots returns the roots of the merkle trees at the checkpoint
+func (v *StateView) TreeRoots() TreeRoots {
+	return TreeRoots{
+		Account: v.AccountTree.Root(),
+		Vouch:   v.VouchTree.Root(),
+		Score:   v.ScoreTree.Root(),
+	}
+}
+
+// StateRoot returns the global root at the checkpoint, see
+// TreeRoots.StateRoot
+func (v *StateView) StateRoot() (*big.Int, error) {
+	return v.TreeRoots().StateRoot()
+}
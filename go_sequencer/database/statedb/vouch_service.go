@@ -1,18 +1,47 @@
 package statedb
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/big"
+	"sort"
 	"tokamak-sybil-resistance/common"
 
 	"github.com/iden3/go-merkletree"
 	"github.com/iden3/go-merkletree/db"
 )
 
+// legacyVouchBytesLen is the length of the vouches stored before they locked
+// an amount, when the value of a vouch was a single byte with its bool Value
+const legacyVouchBytesLen = 1
+
 var (
 	ErrAlreadyVouched = errors.New("can not Vouch because already vouched")
+	// ErrTxWithoutDelete is used when the db.Tx of a storage can't delete
+	// the index entries of a deleted vouch
+	ErrTxWithoutDelete = errors.New("the db.Tx of the storage can't delete keys")
 	// PrefixKeyVocIdx is the key prefix for vouchIdx in the db
 	PrefixKeyVocIdx = []byte("v:")
+	// PrefixKeyVocOut is the key prefix for the index of the vouches given
+	// by an account in the db, keyed by fromIdx|toIdx
+	PrefixKeyVocOut = []byte("vo:")
+	// PrefixKeyVocIn is the key prefix for the index of the vouches
+	// received by an account in the db, keyed by toIdx|fromIdx
+	PrefixKeyVocIn = []byte("vi:")
+	// PrefixKeyVocCount is the key prefix for the number of active vouches
+	// given by an account in the db
+	PrefixKeyVocCount = []byte("vc:")
+	// PrefixKeyVocBatch is the key prefix for the batch in which a vouch was
+	// last created or deleted in the db, keyed by VouchIdx
+	PrefixKeyVocBatch = []byte("vb:")
+	// PrefixKeyVocExpiry is the key prefix for the index of the vouches by
+	// the batch in which they were created in the db, keyed by
+	// BatchNum|VouchIdx
+	PrefixKeyVocExpiry = []byte("ve:")
+	// KeyVocExpiredBatch is the key of the last creation batch whose vouches
+	// have been expired in the db
+	KeyVocExpiredBatch = []byte("k:vouchexpiredbatch")
 )
 
 // CreateVouch creates a new Vouch in the StateDB for the given Idx. If
@@ -20,26 +49,36 @@ var (
 // MerkleTree, returning a CircomProcessorProof.
 func (s *StateDB) CreateVouch(idx common.VouchIdx, vouch *common.Vouch) (
 	*merkletree.CircomProcessorProof, error) {
-	cpp, err := CreateVouchInTreeDB(s.db.DB(), s.VouchTree, idx, vouch)
+	cpp, err := CreateVouchInTreeDB(s.db.DB(), s.VouchTree, idx, vouch, s.CurrentBatch()+1)
 	if err != nil {
 		return cpp, common.Wrap(err)
 	}
+	if vouch.Value {
+		if err := s.syncAccountLeaf(idx.FromIdx()); err != nil {
+			return nil, common.Wrap(err)
+		}
+	}
 	return cpp, nil
 }
 
 // CreateVouchInTreeDB is abstracted from StateDB to be used from StateDB and
-// from ExitTree. Creates a new Vouch in the StateDB for the given Idx. If
-// StateDB.MT==nil, MerkleTree is no affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof
+// from ExitTree. Creates a new Vouch in the StateDB for the given Idx, being
+// batchNum the batch in process. If StateDB.MT==nil, MerkleTree is no
+// affected, otherwise updates the MerkleTree, returning a
+// CircomProcessorProof
 func CreateVouchInTreeDB(sto db.Storage, mt *merkletree.MerkleTree, idx common.VouchIdx,
-	vouch *common.Vouch) (*merkletree.CircomProcessorProof, error) {
-	txError := performTxVouch(sto, idx, vouch, true)
+	vouch *common.Vouch, batchNum common.BatchNum) (*merkletree.CircomProcessorProof, error) {
+	txError := performTxVouch(sto, idx, vouch, true, batchNum)
 	if txError != nil {
 		return nil, txError
 	}
 
 	if mt != nil {
-		return mt.AddAndGetCircomProof(idx.BigInt(), common.BigIntFromBool(vouch.Value))
+		leaf, err := vouch.HashValue()
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		return mt.AddAndGetCircomProof(idx.BigInt(), leaf)
 	}
 
 	return nil, nil
@@ -73,7 +112,18 @@ func GetVouchInTreeDB(sto db.Storage, idx common.VouchIdx) (*common.Vouch, error
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
-	var b [1]byte
+	return vouchFromStoredBytes(idx, vocBytes)
+}
+
+// vouchFromStoredBytes returns the vouch idx from the value of its leaf in
+// the db, stored with the current or the legacy encoding
+func vouchFromStoredBytes(idx common.VouchIdx, vocBytes []byte) (*common.Vouch, error) {
+	if len(vocBytes) == legacyVouchBytesLen {
+		vouch := legacyVouchFromBytes(vocBytes)
+		vouch.Idx = idx
+		return vouch, nil
+	}
+	var b [common.NVouchLeafBytes]byte
 	copy(b[:], vocBytes)
 	vouch, err := common.VouchFromBytes(b)
 	if err != nil {
@@ -83,62 +133,624 @@ func GetVouchInTreeDB(sto db.Storage, idx common.VouchIdx) (*common.Vouch, error
 	return vouch, nil
 }
 
+// legacyVouchFromBytes returns the Vouch stored with the legacy encoding,
+// where the value of the vouch was a single byte with the bool Value and the
+// vouch didn't have a locked amount
+func legacyVouchFromBytes(b []byte) *common.Vouch {
+	return &common.Vouch{
+		Value:  b[0] == 1,
+		Amount: big.NewInt(0),
+	}
+}
+
+// LegacyVouchBatchNum is the creation batch given by MigrateVouches to the
+// legacy vouches, whose creation batch is unknown.  It doesn't depend on the
+// batch at which a node migrates its StateDB, so that all the nodes get the
+// same VouchTree.  With a VouchExpiry, the legacy vouches expire at the batch
+// VouchExpiry.
+const LegacyVouchBatchNum = common.BatchNum(0)
+
+// MigrateVouches rewrites the vouches stored with the legacy bool encoding,
+// and their VouchTree leafs, with the current encoding.  Legacy vouches
+// didn't lock any amount, so they keep their Value with an Amount of 0 (and
+// thus no weight) and LegacyVouchBatchNum as creation batch.  Returns the
+// number of migrated vouches.
+func (s *StateDB) MigrateVouches() (int, error) {
+	var legacy []common.VouchIdx
+	idxDB := s.db.DB().WithPrefix(PrefixKeyVocIdx)
+	if err := idxDB.Iterate(func(k []byte, v []byte) (bool, error) {
+		if len(v) != legacyVouchBytesLen {
+			return true, nil
+		}
+		idx, err := common.VouchIdxFromBytes(k)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		legacy = append(legacy, idx)
+		return true, nil
+	}); err != nil {
+		return 0, common.Wrap(err)
+	}
+	for _, idx := range legacy {
+		vouch, err := s.GetVouch(idx)
+		if err != nil {
+			return 0, common.Wrap(err)
+		}
+		vouch.BatchNum = LegacyVouchBatchNum
+		if _, err := s.UpdateVouch(idx, vouch); err != nil {
+			return 0, common.Wrap(err)
+		}
+	}
+	return len(legacy), nil
+}
+
+// VouchesIter iterates over all the vouches stored in the StateDB, including
+// the deleted ones (Value==false), until fn returns false or an error
+func (s *StateDB) VouchesIter(fn func(v *common.Vouch) (bool, error)) error {
+	return vouchesIter(s.db.DB(), fn)
+}
+
+func vouchesIter(db db.Storage, fn func(v *common.Vouch) (bool, error)) error {
+	idxDB := db.WithPrefix(PrefixKeyVocIdx)
+	if err := idxDB.Iterate(func(k []byte, v []byte) (bool, error) {
+		idx, err := common.VouchIdxFromBytes(k)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		vouch, err := GetVouchInTreeDB(db, idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		ok, err := fn(vouch)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		return ok, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	return nil
+}
+
+// vouchIndexKeys returns the keys of the out-edge and in-edge indexes of the
+// given vouch
+func vouchIndexKeys(idx common.VouchIdx) ([]byte, []byte, error) {
+	fromBytes, err := idx.FromIdx().Bytes()
+	if err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	toBytes, err := idx.ToIdx().Bytes()
+	if err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	outKey := append(append(append([]byte{}, PrefixKeyVocOut...), fromBytes[:]...), toBytes[:]...)
+	inKey := append(append(append([]byte{}, PrefixKeyVocIn...), toBytes[:]...), fromBytes[:]...)
+	return outKey, inKey, nil
+}
+
+// putVouchIndexes stores the out-edge and in-edge index entries of the given
+// vouch.  The value of both entries is the VouchIdx.
+func putVouchIndexes(tx db.Tx, idx common.VouchIdx) error {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	outKey, inKey, err := vouchIndexKeys(idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Put(outKey, idxBytes[:]); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Put(inKey, idxBytes[:]))
+}
+
+// deleteTx is a db.Tx that can also delete keys, like the kvdb.StorageTx
+type deleteTx interface {
+	db.Tx
+	Delete(k []byte) error
+}
+
+// newDeleteTx returns a new deleteTx of the storage sto
+func newDeleteTx(sto db.Storage) (deleteTx, error) {
+	tx, err := sto.NewTx()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	dtx, ok := tx.(deleteTx)
+	if !ok {
+		tx.Close()
+		return nil, common.Wrap(fmt.Errorf("%w: %T", ErrTxWithoutDelete, tx))
+	}
+	return dtx, nil
+}
+
+// deleteVouchIndexes removes the out-edge and in-edge index entries of the
+// given vouch
+func deleteVouchIndexes(tx deleteTx, idx common.VouchIdx) error {
+	outKey, inKey, err := vouchIndexKeys(idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Delete(outKey); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Delete(inKey))
+}
+
+// vouchExpiryKey returns the key of the entry of the vouch idx created at the
+// batch batchNum in the index of the vouches by creation batch
+func vouchExpiryKey(batchNum common.BatchNum, idx common.VouchIdx) ([]byte, error) {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return append(append(append([]byte{}, PrefixKeyVocExpiry...), batchNum.Bytes()...),
+		idxBytes[:]...), nil
+}
+
+// putVouchExpiryIndex stores the entry of the vouch idx created at the batch
+// batchNum in the index of the vouches by creation batch
+func putVouchExpiryIndex(tx db.Tx, idx common.VouchIdx, batchNum common.BatchNum) error {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	key, err := vouchExpiryKey(batchNum, idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Put(key, idxBytes[:]))
+}
+
+// IndexVouches adds to the out-edge and in-edge indexes, and to the index by
+// creation batch, the active vouches stored before the indexes existed, and
+// removes from the out-edge and in-edge indexes the deleted vouches, which were
+// kept in them before.  Returns the number of reindexed vouches.
+func (s *StateDB) IndexVouches() (int, error) {
+	var outdated []*common.Vouch
+	if err := s.VouchesIter(func(v *common.Vouch) (bool, error) {
+		outKey, _, err := vouchIndexKeys(v.Idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		expiryKey, err := vouchExpiryKey(v.BatchNum, v.Idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !v.Value {
+			_, err = s.db.DB().Get(outKey)
+			if err == nil {
+				outdated = append(outdated, v)
+			} else if common.Unwrap(err) != db.ErrNotFound {
+				return false, common.Wrap(err)
+			}
+			return true, nil
+		}
+		for _, key := range [][]byte{outKey, expiryKey} {
+			_, err = s.db.DB().Get(key)
+			if common.Unwrap(err) == db.ErrNotFound {
+				outdated = append(outdated, v)
+				break
+			} else if err != nil {
+				return false, common.Wrap(err)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return 0, common.Wrap(err)
+	}
+	if len(outdated) == 0 {
+		return 0, nil
+	}
+	tx, err := newDeleteTx(s.db.DB())
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	defer tx.Close()
+	for _, vouch := range outdated {
+		if !vouch.Value {
+			if err := deleteVouchIndexes(tx, vouch.Idx); err != nil {
+				return 0, common.Wrap(err)
+			}
+			continue
+		}
+		if err := putVouchIndexes(tx, vouch.Idx); err != nil {
+			return 0, common.Wrap(err)
+		}
+		if err := putVouchExpiryIndex(tx, vouch.Idx, vouch.BatchNum); err != nil {
+			return 0, common.Wrap(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, common.Wrap(err)
+	}
+	return len(outdated), nil
+}
+
+// updateVouchCounters updates in the tx the number of active vouches given by
+// the sender of the vouch idx, and the batch batchNum as the one in which the
+// vouch was last changed, when the vouch goes from active to deleted or the
+// other way around
+func updateVouchCounters(sto db.Storage, tx db.Tx, idx common.VouchIdx,
+	wasActive, active bool, batchNum common.BatchNum) error {
+	if wasActive == active {
+		return nil
+	}
+	count, err := outVouchCount(sto, tx, idx.FromIdx())
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if active {
+		count++
+	} else if count > 0 {
+		count--
+	}
+	countKey, err := vouchIndexPrefix(PrefixKeyVocCount, idx.FromIdx())
+	if err != nil {
+		return common.Wrap(err)
+	}
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	var countBytes [4]byte
+	binary.BigEndian.PutUint32(countBytes[:], count)
+
+	if err := tx.Put(countKey, countBytes[:]); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Put(append(append([]byte{}, PrefixKeyVocBatch...), idxBytes[:]...),
+		batchNum.Bytes()))
+}
+
+// OutVouchCount returns the number of active vouches given by the account
+// idx.  For the accounts without a stored counter, which only happens for the
+// vouches stored before the counters existed, the active vouches are counted
+// from the out-edge index.
+func (s *StateDB) OutVouchCount(idx common.AccountIdx) (uint32, error) {
+	return outVouchCount(s.db.DB(), s.db.DB(), idx)
+}
+
+// outVouchCount returns the number of active vouches given by the account idx,
+// reading the counter from kv, which is the storage sto or a tx of it
+func outVouchCount(sto db.Storage, kv interface {
+	Get([]byte) ([]byte, error)
+}, idx common.AccountIdx) (uint32, error) {
+	countKey, err := vouchIndexPrefix(PrefixKeyVocCount, idx)
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	countBytes, err := kv.Get(countKey)
+	if err == nil {
+		return binary.BigEndian.Uint32(countBytes), nil
+	} else if common.Unwrap(err) != db.ErrNotFound {
+		return 0, common.Wrap(err)
+	}
+	prefix, err := vouchIndexPrefix(PrefixKeyVocOut, idx)
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	var count uint32
+	if err := vouchesByIndex(sto, prefix, func(_ *common.Vouch) (bool, error) {
+		count++
+		return true, nil
+	}); err != nil {
+		return 0, common.Wrap(err)
+	}
+	return count, nil
+}
+
+// VouchChangeBatch returns the batch in which the vouch idx was last created
+// or deleted, or 0 if it hasn't changed since the batches were tracked
+func (s *StateDB) VouchChangeBatch(idx common.VouchIdx) (common.BatchNum, error) {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	b, err := s.db.DB().Get(append(append([]byte{}, PrefixKeyVocBatch...), idxBytes[:]...))
+	if common.Unwrap(err) == db.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, common.Wrap(err)
+	}
+	batchNum, err := common.BatchNumFromBytes(b)
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	return batchNum, nil
+}
+
+// VouchesCreatedUpTo returns the active vouches created at a batch up to
+// batchNum that are still at their creation batch, sorted by VouchIdx.  Only
+// the creation batches after the one stored by the last call to
+// SetVouchesExpiredUpTo are read, so that the vouches expired at every batch
+// are found without reading all the vouches.
+func (s *StateDB) VouchesCreatedUpTo(batchNum common.BatchNum) ([]*common.Vouch, error) {
+	type entry struct {
+		batchNum common.BatchNum
+		idx      common.VouchIdx
+	}
+	var entries []entry
+	collect := func(k []byte, v []byte) (bool, error) {
+		// the key is BatchNum|VouchIdx, and the value the VouchIdx
+		created, err := common.BatchNumFromBytes(k[:len(k)-len(v)])
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if created > batchNum {
+			return false, nil
+		}
+		idx, err := common.VouchIdxFromBytes(v)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		entries = append(entries, entry{batchNum: created, idx: idx})
+		return true, nil
+	}
+	last, err := s.vouchesExpiredUpTo()
+	if common.Unwrap(err) == db.ErrNotFound {
+		// without a stored batch the index is read from the beginning
+		if err := s.db.DB().WithPrefix(PrefixKeyVocExpiry).Iterate(collect); err != nil {
+			return nil, common.Wrap(err)
+		}
+	} else if err != nil {
+		return nil, common.Wrap(err)
+	} else {
+		for created := last + 1; created <= batchNum; created++ {
+			prefix := append(append([]byte{}, PrefixKeyVocExpiry...), created.Bytes()...)
+			if err := s.db.DB().WithPrefix(prefix).Iterate(func(k []byte, v []byte) (bool, error) {
+				return collect(append(created.Bytes(), k...), v)
+			}); err != nil {
+				return nil, common.Wrap(err)
+			}
+		}
+	}
+
+	var vouches []*common.Vouch
+	for _, e := range entries {
+		vouch, err := s.GetVouch(e.idx)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		if !vouch.Value || vouch.BatchNum != e.batchNum {
+			continue
+		}
+		vouches = append(vouches, vouch)
+	}
+	sort.Slice(vouches, func(i, j int) bool { return vouches[i].Idx < vouches[j].Idx })
+	return vouches, nil
+}
+
+// SetVouchesExpiredUpTo stores batchNum as the last creation batch whose
+// vouches have been expired, so that VouchesCreatedUpTo doesn't read them
+// again
+func (s *StateDB) SetVouchesExpiredUpTo(batchNum common.BatchNum) error {
+	tx, err := s.db.DB().NewTx()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := tx.Put(KeyVocExpiredBatch, batchNum.Bytes()); err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(tx.Commit())
+}
+
+// vouchesExpiredUpTo returns the batch stored by SetVouchesExpiredUpTo
+func (s *StateDB) vouchesExpiredUpTo() (common.BatchNum, error) {
+	b, err := s.db.DB().Get(KeyVocExpiredBatch)
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	batchNum, err := common.BatchNumFromBytes(b)
+	if err != nil {
+		return 0, common.Wrap(err)
+	}
+	return batchNum, nil
+}
+
+// VouchesFrom iterates over the active vouches given by the account idx, in
+// ascending order of the receiver, until fn returns false or an error
+func (s *StateDB) VouchesFrom(idx common.AccountIdx,
+	fn func(v *common.Vouch) (bool, error)) error {
+	prefix, err := vouchIndexPrefix(PrefixKeyVocOut, idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return vouchesByIndex(s.db.DB(), prefix, fn)
+}
+
+// VouchesTo iterates over the active vouches received by the account idx, in
+// ascending order of the voucher, until fn returns false or an error
+func (s *StateDB) VouchesTo(idx common.AccountIdx,
+	fn func(v *common.Vouch) (bool, error)) error {
+	prefix, err := vouchIndexPrefix(PrefixKeyVocIn, idx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return vouchesByIndex(s.db.DB(), prefix, fn)
+}
+
+// VouchGraph returns the active vouches of the StateDB grouped by the account
+// that gives them.  The vouches of each account are sorted by receiver.
+func (s *StateDB) VouchGraph() (map[common.AccountIdx][]*common.Vouch, error) {
+	return vouchGraph(s.db.DB())
+}
+
+func vouchGraph(sto db.Storage) (map[common.AccountIdx][]*common.Vouch, error) {
+	graph := make(map[common.AccountIdx][]*common.Vouch)
+	if err := vouchesByIndex(sto, PrefixKeyVocOut,
+		func(v *common.Vouch) (bool, error) {
+			from := v.Idx.FromIdx()
+			graph[from] = append(graph[from], v)
+			return true, nil
+		}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	return graph, nil
+}
+
+// vouchIndexPrefix returns the prefix of the entries of the given index for
+// the account idx
+func vouchIndexPrefix(index []byte, idx common.AccountIdx) ([]byte, error) {
+	idxBytes, err := idx.Bytes()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return append(append([]byte{}, index...), idxBytes[:]...), nil
+}
+
+// vouchesByIndex iterates over the active vouches of the index entries with
+// the given prefix, until fn returns false or an error.  The entries of the
+// deleted vouches are removed from the indexes, but they are skipped in case
+// IndexVouches hasn't removed the ones of a StateDB that kept them.
+func vouchesByIndex(sto db.Storage, prefix []byte,
+	fn func(v *common.Vouch) (bool, error)) error {
+	var vouchIdxs []common.VouchIdx
+	if err := sto.WithPrefix(prefix).Iterate(func(_ []byte, v []byte) (bool, error) {
+		vouchIdx, err := common.VouchIdxFromBytes(v)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		vouchIdxs = append(vouchIdxs, vouchIdx)
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	for _, vouchIdx := range vouchIdxs {
+		vouch, err := GetVouchInTreeDB(sto, vouchIdx)
+		if err != nil {
+			return common.Wrap(err)
+		}
+		if !vouch.Value {
+			continue
+		}
+		ok, err := fn(vouch)
+		if err != nil {
+			return common.Wrap(err)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
 // UpdateVouch updates the Vouch in the StateDB for the given Idx.  If
 // StateDB.mt==nil, MerkleTree is not affected, otherwise updates the
 // MerkleTree, returning a CircomProcessorProof.
 func (s *StateDB) UpdateVouch(idx common.VouchIdx, vouch *common.Vouch) (
 	*merkletree.CircomProcessorProof, error) {
-	return UpdateVouchInTreeDB(s.db.DB(), s.VouchTree, idx, vouch)
+	wasActive := false
+	old, err := s.GetVouch(idx)
+	if err == nil {
+		wasActive = old.Value
+	} else if common.Unwrap(err) != db.ErrNotFound {
+		return nil, common.Wrap(err)
+	}
+	cpp, err := UpdateVouchInTreeDB(s.db.DB(), s.VouchTree, idx, vouch, s.CurrentBatch()+1)
+	if err != nil {
+		return cpp, common.Wrap(err)
+	}
+	if wasActive != vouch.Value {
+		if err := s.syncAccountLeaf(idx.FromIdx()); err != nil {
+			return nil, common.Wrap(err)
+		}
+	}
+	return cpp, nil
 }
 
 // UpdateVouchInTreeDB is abstracted from StateDB to be used from StateDB and
-// from ExitTree.  Updates the Vouch in the StateDB for the given Idx.  If
-// StateDB.mt==nil, MerkleTree is not affected, otherwise updates the
-// MerkleTree, returning a CircomProcessorProof.
+// from ExitTree.  Updates the Vouch in the StateDB for the given Idx, being
+// batchNum the batch in process.  If StateDB.mt==nil, MerkleTree is not
+// affected, otherwise updates the MerkleTree, returning a
+// CircomProcessorProof.
 func UpdateVouchInTreeDB(sto db.Storage, mt *merkletree.MerkleTree, idx common.VouchIdx,
-	vouch *common.Vouch) (*merkletree.CircomProcessorProof, error) {
-	txError := performTxVouch(sto, idx, vouch, false)
+	vouch *common.Vouch, batchNum common.BatchNum) (*merkletree.CircomProcessorProof, error) {
+	txError := performTxVouch(sto, idx, vouch, false, batchNum)
 	if txError != nil {
 		return nil, txError
 	}
 
 	if mt != nil {
-		proof, err := mt.Update(idx.BigInt(), common.BigIntFromBool(vouch.Value))
+		leaf, err := vouch.HashValue()
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		proof, err := mt.Update(idx.BigInt(), leaf)
 		return proof, common.Wrap(err)
 	}
 	return nil, nil
 }
 
-// GetMTRoot returns the root of the Merkle Tree
+// GetMTRootVouch returns the root of the Vouch Merkle Tree
 func (s *StateDB) GetMTRootVouch() *big.Int {
-	return s.AccountTree.Root().BigInt()
+	return s.VouchTree.Root().BigInt()
 }
 
+// performTxVouch writes in a single tx the leaf of the vouch idx, its index
+// entries, and when the vouch is created or deleted the number of active
+// vouches of the sender and the change batch batchNum
 func performTxVouch(sto db.Storage, idx common.VouchIdx,
-	vouch *common.Vouch, addCall bool) error {
-	tx, err := sto.NewTx()
+	vouch *common.Vouch, addCall bool, batchNum common.BatchNum) error {
+	tx, err := newDeleteTx(sto)
 	if err != nil {
 		return common.Wrap(err)
 	}
+	defer tx.Close()
 	idxBytes, err := idx.Bytes()
 	if err != nil {
 		return common.Wrap(err)
 	}
-	if addCall {
-		_, err = tx.Get(append(PrefixKeyVocIdx, idxBytes[:]...))
-		if err != db.ErrNotFound {
+	var old *common.Vouch
+	oldBytes, err := tx.Get(append(PrefixKeyVocIdx, idxBytes[:]...))
+	if err == nil {
+		if addCall {
 			return common.Wrap(ErrAlreadyVouched)
 		}
+		if old, err = vouchFromStoredBytes(idx, oldBytes); err != nil {
+			return common.Wrap(err)
+		}
+	} else if common.Unwrap(err) != db.ErrNotFound {
+		return common.Wrap(err)
 	}
-	err = tx.Put(append(PrefixKeyVocIdx, idxBytes[:]...), vouch.BytesFromBool())
+	vouchBytes, err := vouch.Bytes()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	err = tx.Put(append(PrefixKeyVocIdx, idxBytes[:]...), vouchBytes[:])
 	if err != nil {
 		return common.Wrap(err)
 	}
 
-	if err := tx.Commit(); err != nil {
+	wasActive := old != nil && old.Value
+	if wasActive && (!vouch.Value || old.BatchNum != vouch.BatchNum) {
+		expiryKey, err := vouchExpiryKey(old.BatchNum, idx)
+		if err != nil {
+			return common.Wrap(err)
+		}
+		if err := tx.Delete(expiryKey); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	if vouch.Value {
+		if err := putVouchIndexes(tx, idx); err != nil {
+			return common.Wrap(err)
+		}
+		if err := putVouchExpiryIndex(tx, idx, vouch.BatchNum); err != nil {
+			return common.Wrap(err)
+		}
+	} else if wasActive {
+		if err := deleteVouchIndexes(tx, idx); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	if err := updateVouchCounters(sto, tx, idx, wasActive, vouch.Value,
+		batchNum); err != nil {
 		return common.Wrap(err)
 	}
-	return nil
+
+	return common.Wrap(tx.Commit())
 }
 
 // func BytesLink(l *models.Link) [5]byte {
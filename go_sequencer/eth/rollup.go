@@ -141,6 +141,16 @@ type RollupEventUpdateTokenExchange struct {
 // RollupEventSafeMode is an event of the Rollup Smart Contract
 type RollupEventSafeMode struct{}
 
+// RollupEventUpdateScoreSeeds is an event of the Rollup Smart Contract
+// emitted by the governance to replace the seed set of the PageRank walks
+type RollupEventUpdateScoreSeeds struct {
+	Seeds []common.AccountIdx
+}
+
+type rollupEventUpdateScoreSeedsAux struct {
+	Seeds []*big.Int
+}
+
 // RollupEvents is the list of events in a block of the Rollup Smart Contract
 type RollupEvents struct {
 	L1UserTx                    []RollupEventL1UserTx
@@ -153,6 +163,7 @@ type RollupEvents struct {
 	UpdateBucketsParameters     []RollupEventUpdateBucketsParameters
 	UpdateTokenExchange         []RollupEventUpdateTokenExchange
 	SafeMode                    []RollupEventSafeMode
+	UpdateScoreSeeds            []RollupEventUpdateScoreSeeds
 }
 
 // NewRollupEvents creates an empty RollupEvents with the slices initialized.
@@ -163,6 +174,7 @@ func NewRollupEvents() RollupEvents {
 		UpdateForgeL1L2BatchTimeout: make([]RollupEventUpdateForgeL1L2BatchTimeout, 0),
 		UpdateFeeAddToken:           make([]RollupEventUpdateFeeAddToken, 0),
 		Withdraw:                    make([]RollupEventWithdraw, 0),
+		UpdateScoreSeeds:            make([]RollupEventUpdateScoreSeeds, 0),
 	}
 }
 
@@ -382,6 +394,8 @@ var (
 		"SafeMode()"))
 	logSYBInitialize = crypto.Keccak256Hash([]byte(
 		"InitializeSYBEvent(uint8,uint256,uint64)"))
+	logSYBUpdateScoreSeeds = crypto.Keccak256Hash([]byte(
+		"UpdateScoreSeeds(uint48[])"))
 )
 
 // RollupEventsByBlock returns the events in a block that happened in the
@@ -544,6 +558,21 @@ func (c *RollupClient) RollupEventsByBlock(blockNum int64,
 			}
 			rollupEvents.UpdateBucketsParameters = append(rollupEvents.UpdateBucketsParameters,
 				bucketsParameters)
+		case logSYBUpdateScoreSeeds:
+			var updateScoreSeedsAux rollupEventUpdateScoreSeedsAux
+			err := c.contractAbi.UnpackIntoInterface(&updateScoreSeedsAux,
+				"UpdateScoreSeeds", vLog.Data)
+			if err != nil {
+				return nil, common.Wrap(err)
+			}
+			updateScoreSeeds := RollupEventUpdateScoreSeeds{
+				Seeds: make([]common.AccountIdx, len(updateScoreSeedsAux.Seeds)),
+			}
+			for i, seed := range updateScoreSeedsAux.Seeds {
+				updateScoreSeeds.Seeds[i] = common.AccountIdx(seed.Int64())
+			}
+			rollupEvents.UpdateScoreSeeds = append(rollupEvents.UpdateScoreSeeds,
+				updateScoreSeeds)
 		}
 	}
 	return &rollupEvents, nil
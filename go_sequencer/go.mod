@@ -5,6 +5,7 @@ go 1.22.5
 require (
 	github.com/BurntSushi/toml v1.4.0
 	github.com/caarlos0/env v3.5.0+incompatible
+	github.com/cockroachdb/pebble v0.0.0-20201229190758-9e27ae169fdd
 	github.com/dghubble/sling v1.3.0
 	github.com/ethereum/go-ethereum v1.10.6
 	github.com/gin-contrib/cors v1.3.1
@@ -40,7 +41,6 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/cockroachdb/errors v1.8.1 // indirect
 	github.com/cockroachdb/logtags v0.0.0-20190617123548-eb05cc24525f // indirect
-	github.com/cockroachdb/pebble v0.0.0-20201229190758-9e27ae169fdd // indirect
 	github.com/cockroachdb/redact v1.0.8 // indirect
 	github.com/cockroachdb/sentry-go v0.6.1-cockroachdb.2 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
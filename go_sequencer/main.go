@@ -1,15 +1,26 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"os"
 	"os/signal"
+	"path"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/config"
+	dbUtils "tokamak-sybil-resistance/database"
+	"tokamak-sybil-resistance/database/historydb"
+	"tokamak-sybil-resistance/database/kvdb"
+	"tokamak-sybil-resistance/database/statedb"
 	"tokamak-sybil-resistance/log"
 	"tokamak-sybil-resistance/node"
+	"tokamak-sybil-resistance/scoring"
+	"tokamak-sybil-resistance/sybilscan"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
 	"github.com/urfave/cli"
 )
 
@@ -24,6 +35,15 @@ const (
 	nMigrations = "nMigrations"
 	flagAccount = "account"
 	flagPath    = "path"
+	flagBatch   = "batchnum"
+	flagVerts   = "numverts"
+	flagFirst   = "firstidx"
+	flagRoot    = "stateroot"
+	flagFrom    = "from"
+	flagTo      = "to"
+	flagFormat  = "format"
+	formatJSON  = "json"
+	formatTable = "table"
 )
 
 // Config is the configuration of the node execution
@@ -109,6 +129,305 @@ func cmdRun(c *cli.Context) error {
 	return nil
 }
 
+func cmdWitness(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+	algorithm := scoring.Algorithm(cfg.node.Scoring.Algorithm)
+	numVerts := c.Int(flagVerts)
+	if numVerts == 0 && algorithm == scoring.AlgorithmConductance {
+		numVerts = cfg.node.Scoring.Conductance.NumVerts
+	}
+	if numVerts == 0 {
+		return common.Wrap(fmt.Errorf("flag %v is required for the %v algorithm",
+			flagVerts, algorithm))
+	}
+
+	batchNum := common.BatchNum(c.Int64(flagBatch))
+	view, err := openStateView(cfg, batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer view.Close()
+
+	witness, err := scoring.WitnessFromView(scoring.WitnessConfig{
+		Algorithm: algorithm,
+		NumVerts:  numVerts,
+		FirstIdx:  common.AccountIdx(c.Int64(flagFirst)),
+		// the weights are mapped like in the score epochs
+		Weights: node.ScoringConfig(cfg.node).Weights(),
+	}, view)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("scoring.WitnessFromView: %w", err))
+	}
+	if err := witness.WriteFiles(c.String(flagPath)); err != nil {
+		return common.Wrap(err)
+	}
+	log.Infow("Witness input generated", "batchNum", batchNum,
+		"vertices", len(witness.Mapping.Vertices), "path", c.String(flagPath))
+	return nil
+}
+
+// openStateView opens read-only the checkpoint of the synchronizer StateDB at
+// the given batchNum, without opening the StateDB, so that the commands don't
+// modify it and can be run while the node is running
+func openStateView(cfg *Config, batchNum common.BatchNum) (*statedb.StateView, error) {
+	view, err := statedb.OpenCheckpoint(statedb.Config{
+		Path:    cfg.node.StateDB.Path,
+		Type:    statedb.TypeSynchronizer,
+		NLevels: statedb.MaxNLevels,
+	}, batchNum)
+	if err != nil {
+		return nil, common.Wrap(fmt.Errorf("statedb.OpenCheckpoint: %w", err))
+	}
+	return view, nil
+}
+
+// connectSQLDBRead connects to the read replica of the HistoryDB if there is
+// one, and otherwise to the main one, without running the migrations
+func connectSQLDBRead(cfg *Config) (*sqlx.DB, error) {
+	pg := cfg.node.PostgreSQL
+	port, host, user, password, name := pg.PortWrite, pg.HostWrite, pg.UserWrite,
+		pg.PasswordWrite, pg.NameWrite
+	if pg.HostRead != "" {
+		port, host, user, password, name = pg.PortRead, pg.HostRead, pg.UserRead,
+			pg.PasswordRead, pg.NameRead
+	}
+	db, err := dbUtils.ConnectSQLDB(port, host, user, password, name)
+	if err != nil {
+		return nil, common.Wrap(fmt.Errorf("dbUtils.ConnectSQLDB: %w", err))
+	}
+	return db, nil
+}
+
+func cmdSybilScan(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+
+	batchNum := common.BatchNum(c.Int64(flagBatch))
+	view, err := openStateView(cfg, batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer view.Close()
+
+	// the scan only reads the HistoryDB
+	db, err := connectSQLDBRead(cfg)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer db.Close() //nolint:errcheck
+	historyDB := historydb.NewHistoryDB(db, db, nil)
+
+	g, err := scoring.GraphFromStateDB(view, batchNum,
+		scoring.WeightConfig{HalfLife: cfg.node.Scoring.VouchHalfLife})
+	if err != nil {
+		return common.Wrap(fmt.Errorf("scoring.GraphFromStateDB: %w", err))
+	}
+	creations, err := historyDB.GetAccountCreations(batchNum)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("historyDB.GetAccountCreations: %w", err))
+	}
+	report := sybilscan.Scan(sybilscan.DefaultConfig, batchNum, g, creations)
+	if err := report.WriteFile(c.String(flagPath)); err != nil {
+		return common.Wrap(err)
+	}
+	log.Infow("Sybil scan report generated", "batchNum", batchNum,
+		"accounts", report.Accounts, "clusters", len(report.Clusters),
+		"path", c.String(flagPath))
+	return nil
+}
+
+func cmdStateDBExport(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+
+	batchNum := common.BatchNum(c.Int64(flagBatch))
+	view, err := openStateView(cfg, batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer view.Close()
+
+	file, err := os.Create(c.String(flagPath))
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if err := view.ExportSnapshot(file); err != nil {
+		file.Close() //nolint:errcheck
+		return common.Wrap(fmt.Errorf("view.ExportSnapshot: %w", err))
+	}
+	if err := file.Close(); err != nil {
+		return common.Wrap(err)
+	}
+	log.Infow("StateDB snapshot exported", "batchNum", batchNum,
+		"path", c.String(flagPath))
+	return nil
+}
+
+func cmdStateDBImport(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+	var trusted *big.Int
+	if root := c.String(flagRoot); root != "" {
+		var ok bool
+		if trusted, ok = new(big.Int).SetString(root, 0); !ok {
+			return common.Wrap(fmt.Errorf("invalid %v %q", flagRoot, root))
+		}
+	}
+	dbPath := cfg.node.StateDB.Path
+	if files, err := os.ReadDir(dbPath); err != nil && !os.IsNotExist(err) {
+		return common.Wrap(err)
+	} else if len(files) > 0 {
+		return common.Wrap(fmt.Errorf("%w: %s", kvdb.ErrSnapshotPathNotEmpty, dbPath))
+	}
+
+	file, err := os.Open(c.String(flagPath))
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer file.Close() //nolint:errcheck
+	// the snapshot is imported in a temporary folder next to the StateDB,
+	// which is only moved to the path of the StateDB once it's verified
+	tmpPath, err := os.MkdirTemp(path.Dir(path.Clean(dbPath)),
+		path.Base(path.Clean(dbPath))+".import")
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer os.RemoveAll(tmpPath) //nolint:errcheck
+	stateDB, err := statedb.ImportSnapshot(statedb.Config{
+		Path:               tmpPath,
+		Keep:               cfg.node.StateDB.Keep,
+		Retention:          kvdb.Retention(cfg.node.StateDB.Retention),
+		NoLast:             true,
+		Type:               statedb.TypeSynchronizer,
+		NLevels:            statedb.MaxNLevels,
+		AccountLeafVersion: common.RollupConstAccountLeafVersion,
+	}, file)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("statedb.ImportSnapshot: %w", err))
+	}
+	batchNum := stateDB.CurrentBatch()
+	stateRoot, err := stateDB.CheckpointStateRoot()
+	stateDB.Close()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	// the snapshot is only kept if it has the StateRoot that the operator
+	// trusts, usually the one of the batch forged in the rollup
+	if trusted != nil && stateRoot.Cmp(trusted) != 0 {
+		return common.Wrap(fmt.Errorf("%w: StateRoot %s, expected %s",
+			statedb.ErrSnapshotRootsMismatch, stateRoot, trusted))
+	}
+	// an empty folder of the StateDB is replaced
+	if err := os.Remove(dbPath); err != nil && !os.IsNotExist(err) {
+		return common.Wrap(err)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return common.Wrap(err)
+	}
+	log.Infow("StateDB snapshot imported", "batchNum", batchNum,
+		"stateRoot", stateRoot, "path", dbPath)
+	return nil
+}
+
+func cmdStateDBDiff(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+	format := c.String(flagFormat)
+	if format != formatJSON && format != formatTable {
+		return common.Wrap(fmt.Errorf("invalid %v \"%v\"", flagFormat, format))
+	}
+
+	// the batch 0 is the empty state, without checkpoint
+	var views [2]*statedb.StateView
+	for n, batchNum := range []int64{c.Int64(flagFrom), c.Int64(flagTo)} {
+		if batchNum == 0 {
+			continue
+		}
+		view, err := openStateView(cfg, common.BatchNum(batchNum))
+		if err != nil {
+			return common.Wrap(err)
+		}
+		defer view.Close()
+		views[n] = view
+	}
+	diff, err := statedb.DiffViews(views[0], views[1])
+	if err != nil {
+		return common.Wrap(fmt.Errorf("statedb.DiffViews: %w", err))
+	}
+	if format == formatTable {
+		return common.Wrap(diff.WriteTable(os.Stdout))
+	}
+	b, err := json.MarshalIndent(diff, "", "\t")
+	if err != nil {
+		return common.Wrap(err)
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func cmdStateDBVerify(c *cli.Context) error {
+	cfg, err := parseCli(c)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("error parsing flags and config: %w", err))
+	}
+
+	// the last checkpoint is verified, which is the state of the
+	// synchronizer StateDB once it has synced a batch
+	batchNum, err := statedb.LastCheckpoint(statedb.Config{Path: cfg.node.StateDB.Path})
+	if err != nil {
+		return common.Wrap(fmt.Errorf("statedb.LastCheckpoint: %w", err))
+	}
+	if batchNum == 0 {
+		log.Infow("The StateDB has no checkpoints to verify", "path", cfg.node.StateDB.Path)
+		return nil
+	}
+	view, err := openStateView(cfg, batchNum)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer view.Close()
+
+	db, err := connectSQLDBRead(cfg)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	defer db.Close() //nolint:errcheck
+	historyDB := historydb.NewHistoryDB(db, db, nil)
+
+	var historyStateRoot *big.Int
+	batch, err := historyDB.GetBatch(batchNum)
+	if common.Unwrap(err) == sql.ErrNoRows {
+		log.Warnw("The batch of the StateDB is not in the HistoryDB", "batchNum", batchNum)
+	} else if err != nil {
+		return common.Wrap(fmt.Errorf("historyDB.GetBatch: %w", err))
+	} else {
+		historyStateRoot = batch.StateRoot
+	}
+	divergence, err := view.Verify(historyStateRoot)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("view.Verify: %w", err))
+	}
+	if divergence != nil {
+		log.Errorw("StateDB divergence", "batchNum", batchNum, "check", divergence.Check,
+			"key", divergence.Key, "stored", divergence.Stored,
+			"expected", divergence.Expected)
+		return common.Wrap(fmt.Errorf("%w: %s", statedb.ErrStateDBCorrupted, divergence))
+	}
+	log.Infow("StateDB verified", "batchNum", batchNum, "path", cfg.node.StateDB.Path)
+	return nil
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "tokamak-node"
@@ -135,6 +454,126 @@ func main() {
 			Action:  cmdRun,
 			Flags:   flags,
 		},
+		{
+			Name:    "witness",
+			Aliases: []string{},
+			Usage: "Generate the scoring circuit input and vertex mapping " +
+				"of the StateDB checkpoint of a batch",
+			Action: cmdWitness,
+			Flags: append(flags,
+				&cli.Int64Flag{
+					Name:     flagBatch,
+					Usage:    "`BATCHNUM` of the StateDB checkpoint",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     flagPath,
+					Usage:    "Output `DIR` of the input and mapping files",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  flagVerts,
+					Usage: "num_verts of the circuit (defaults to Scoring.Conductance.NumVerts)",
+				},
+				&cli.Int64Flag{
+					Name:  flagFirst,
+					Usage: "Lowest `IDX` of the accounts included as vertices",
+				},
+			),
+		},
+		{
+			Name:    "sybilscan",
+			Aliases: []string{},
+			Usage: "Look for candidate sybil clusters in the vouch graph " +
+				"of the StateDB checkpoint of a batch",
+			Action: cmdSybilScan,
+			Flags: append(flags,
+				&cli.Int64Flag{
+					Name:     flagBatch,
+					Usage:    "`BATCHNUM` of the StateDB checkpoint",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     flagPath,
+					Usage:    "Output JSON `FILE` of the report",
+					Required: true,
+				},
+			),
+		},
+		{
+			Name:    "statedb",
+			Aliases: []string{},
+			Usage:   "Export, import, compare and verify StateDB checkpoints",
+			Subcommands: []cli.Command{
+				{
+					Name: "export",
+					Usage: "Export the StateDB checkpoint of a batch to a " +
+						"snapshot file",
+					Action: cmdStateDBExport,
+					Flags: append(flags,
+						&cli.Int64Flag{
+							Name:     flagBatch,
+							Usage:    "`BATCHNUM` of the StateDB checkpoint",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:     flagPath,
+							Usage:    "Output snapshot `FILE`",
+							Required: true,
+						},
+					),
+				},
+				{
+					Name: "import",
+					Usage: "Import a snapshot file into an empty StateDB path " +
+						"(the HistoryDB must be synced up to its batch)",
+					Action: cmdStateDBImport,
+					Flags: append(flags,
+						&cli.StringFlag{
+							Name:     flagPath,
+							Usage:    "Input snapshot `FILE`",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  flagRoot,
+							Usage: "Trusted `STATEROOT` of the batch of the snapshot",
+						},
+					),
+				},
+				{
+					Name: "diff",
+					Usage: "Print the changes of the accounts, vouches and scores " +
+						"between the StateDB checkpoints of two batches",
+					Action: cmdStateDBDiff,
+					Flags: append(flags,
+						&cli.Int64Flag{
+							Name:     flagFrom,
+							Usage:    "`BATCHNUM` of the earlier StateDB checkpoint",
+							Required: true,
+						},
+						&cli.Int64Flag{
+							Name:     flagTo,
+							Usage:    "`BATCHNUM` of the later StateDB checkpoint",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name: flagFormat,
+							Usage: fmt.Sprintf("Output `FORMAT` (can be \"%v\" or \"%v\")",
+								formatJSON, formatTable),
+							Value: formatJSON,
+						},
+					),
+				},
+				{
+					Name: "verify",
+					Usage: "Check the merkle trees and indexes of the last StateDB " +
+						"checkpoint against its accounts, vouches and scores and " +
+						"against the HistoryDB",
+					Action: cmdStateDBVerify,
+					Flags:  flags,
+				},
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -3,7 +3,8 @@ package metric
 import "github.com/prometheus/client_golang/prometheus"
 
 const (
-	namespaceSync = "synchronizer"
+	namespaceSync    = "synchronizer"
+	namespaceStateDB = "statedb"
 )
 
 var (
@@ -45,4 +46,38 @@ var (
 			Name:      "eth_last_batch_num",
 			Help:      "",
 		})
+
+	// Checkpoints number of checkpoints of a kvdb
+	Checkpoints = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespaceStateDB,
+			Name:      "checkpoints",
+			Help:      "",
+		}, []string{"kvdb"})
+
+	// CheckpointsBytes size of the checkpoints of a kvdb, counting once
+	// the files shared by several checkpoints
+	CheckpointsBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespaceStateDB,
+			Name:      "checkpoints_bytes",
+			Help:      "",
+		}, []string{"kvdb"})
+
+	// LastCheckpointBytes size of the last checkpoint of a kvdb
+	LastCheckpointBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespaceStateDB,
+			Name:      "last_checkpoint_bytes",
+			Help:      "",
+		}, []string{"kvdb"})
+
+	// CheckpointsPruned checkpoints of a kvdb deleted by the retention
+	// policy, by reason
+	CheckpointsPruned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceStateDB,
+			Name:      "checkpoints_pruned",
+			Help:      "",
+		}, []string{"kvdb", "reason"})
 )
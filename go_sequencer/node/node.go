@@ -29,11 +29,13 @@ import (
 	"tokamak-sybil-resistance/coordinator"
 	dbUtils "tokamak-sybil-resistance/database"
 	"tokamak-sybil-resistance/database/historydb"
+	"tokamak-sybil-resistance/database/kvdb"
 	"tokamak-sybil-resistance/database/l2db"
 	"tokamak-sybil-resistance/database/statedb"
 	"tokamak-sybil-resistance/eth"
 	"tokamak-sybil-resistance/etherscan"
 	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/scoring"
 	"tokamak-sybil-resistance/synchronizer"
 	"tokamak-sybil-resistance/test/debugapi"
 	"tokamak-sybil-resistance/txprocessor"
@@ -129,6 +131,28 @@ func NewNodeAPI(
 	}, nil
 }
 
+// ScoringConfig returns the scoring.Config of the node configuration, used by
+// the score epochs of the synchronizer and the coordinator
+func ScoringConfig(cfg *config.Node) scoring.Config {
+	return scoring.Config{
+		Algorithm: scoring.Algorithm(cfg.Scoring.Algorithm),
+		PageRank: scoring.PageRankConfig{
+			P:              cfg.Scoring.PageRank.P,
+			Q:              cfg.Scoring.PageRank.Q,
+			NumSteps:       cfg.Scoring.PageRank.NumSteps,
+			ComparatorBits: cfg.Scoring.PageRank.ComparatorBits,
+		},
+		Conductance: scoring.ConductanceConfig{
+			NumVerts:       cfg.Scoring.Conductance.NumVerts,
+			ComparatorBits: cfg.Scoring.Conductance.ComparatorBits,
+		},
+		EpochBatches:  cfg.Scoring.EpochBatches,
+		VouchHalfLife: cfg.Scoring.VouchHalfLife,
+		VouchUnit:     cfg.Scoring.VouchUnit,
+		Seeds:         cfg.Scoring.Seeds,
+	}
+}
+
 // NewNode creates a Node
 func NewNode(mode Mode, cfg *config.Node, version string) (*Node, error) {
 	meddler.Debug = cfg.Debug.MeddlerLogs
@@ -255,14 +279,45 @@ func NewNode(mode Mode, cfg *config.Node, version string) (*Node, error) {
 	chainIDU16 := uint16(chainIDU64)
 
 	stateDB, err := statedb.NewStateDB(statedb.Config{
-		Path:    cfg.StateDB.Path,
-		Keep:    cfg.StateDB.Keep,
-		Type:    statedb.TypeSynchronizer,
-		NLevels: statedb.MaxNLevels,
+		Path:               cfg.StateDB.Path,
+		Keep:               cfg.StateDB.Keep,
+		Retention:          kvdb.Retention(cfg.StateDB.Retention),
+		Type:               statedb.TypeSynchronizer,
+		NLevels:            statedb.MaxNLevels,
+		AccountLeafVersion: common.RollupConstAccountLeafVersion,
 	})
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
+	nMigrated, err := stateDB.MigrateVouches()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if nMigrated > 0 {
+		log.Infow("Migrated vouches stored with the legacy encoding", "vouches", nMigrated)
+	}
+	nIndexed, err := stateDB.IndexVouches()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if nIndexed > 0 {
+		log.Infow("Reindexed vouches stored with outdated indexes", "vouches", nIndexed)
+	}
+	nIndexed, err = stateDB.IndexAccounts()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if nIndexed > 0 {
+		log.Infow("Indexed accounts stored without address and BJJ indexes", "accounts", nIndexed)
+	}
+	nMigrated, err = stateDB.MigrateAccountLeafs()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if nMigrated > 0 {
+		log.Infow("Migrated account leafs to the layout of the protocol", "accounts", nMigrated,
+			"version", common.RollupConstAccountLeafVersion)
+	}
 
 	var l2DB *l2db.L2DB
 	if mode == ModeCoordinator {
@@ -277,10 +332,16 @@ func NewNode(mode Mode, cfg *config.Node, version string) (*Node, error) {
 		)
 	}
 
+	scoringCfg := ScoringConfig(cfg)
+	vouchRules := txprocessor.VouchRules(cfg.Vouches)
 	sync, err := synchronizer.NewSynchronizer(client, historyDB, l2DB, stateDB, synchronizer.Config{
 		StatsUpdateBlockNumDiffThreshold: cfg.Synchronizer.StatsUpdateBlockNumDiffThreshold,
 		StatsUpdateFrequencyDivider:      cfg.Synchronizer.StatsUpdateFrequencyDivider,
 		ChainID:                          chainIDU16,
+		Scoring:                          scoringCfg,
+		IncrementalScoring:               cfg.Scoring.Incremental,
+		CheckIncrementalScoring:          cfg.Scoring.IncrementalCheck,
+		VouchRules:                       vouchRules,
 	})
 	if err != nil {
 		return nil, common.Wrap(err)
@@ -381,7 +442,7 @@ func NewNode(mode Mode, cfg *config.Node, version string) (*Node, error) {
 			return nil, common.Wrap(err)
 		}
 		batchBuilder, err := batchbuilder.NewBatchBuilder(cfg.Coordinator.BatchBuilder.Path,
-			stateDB, 0, uint64(cfg.Coordinator.Circuit.NLevels))
+			stateDB, historyDB, 0, uint64(cfg.Coordinator.Circuit.NLevels))
 		if err != nil {
 			return nil, common.Wrap(err)
 		}
@@ -393,12 +454,23 @@ func NewNode(mode Mode, cfg *config.Node, version string) (*Node, error) {
 		// 		cfg.Coordinator.ProofServerPollInterval.Duration)
 		// }
 
+		scorer, err := scoring.NewScorer(scoringCfg)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
 		txProcessorCfg := txprocessor.Config{
-			NLevels:  uint32(cfg.Coordinator.Circuit.NLevels),
-			MaxTx:    uint32(cfg.Coordinator.Circuit.MaxTx),
-			ChainID:  chainIDU16,
-			MaxFeeTx: common.RollupConstMaxFeeIdxCoordinator,
-			MaxL1Tx:  common.RollupConstMaxL1Tx,
+			NLevels:           uint32(cfg.Coordinator.Circuit.NLevels),
+			MaxTx:             uint32(cfg.Coordinator.Circuit.MaxTx),
+			ChainID:           chainIDU16,
+			MaxFeeTx:          common.RollupConstMaxFeeIdxCoordinator,
+			MaxL1Tx:           common.RollupConstMaxL1Tx,
+			ScoreEpochBatches: scoringCfg.EpochBatches,
+			Scorer:            scorer,
+			ScoreWeights:      scoringCfg.Weights(),
+			// the seed set until the governance updates it, see
+			// BatchBuilder.BuildBatch
+			ScoreSeeds: scoringCfg.Seeds,
+			VouchRules: vouchRules,
 		}
 		var verifierIdx int
 		if cfg.Coordinator.Debug.RollupVerifierIndex == nil {
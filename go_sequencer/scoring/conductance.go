@@ -0,0 +1,194 @@
+package scoring
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"tokamak-sybil-resistance/common"
+)
+
+// maxConductanceVerts is the maximum number of vertices supported by
+// ConductanceSubsets, as the number of subsets grows as 2^n
+const maxConductanceVerts = 16
+
+// ConductanceConfig contains the parameters of the ScoringAlgorithm circuit
+// (circuits/scoring_algorithm.circom).  They must match the parameters the
+// circuit has been compiled with.
+type ConductanceConfig struct {
+	// NumVerts is the num_verts of the circuit, the maximum number of
+	// vertices of the graph
+	NumVerts int
+	// ComparatorBits is the n of the LessThan(n) comparators.  The
+	// minimum of each vertex starts at 2^n-1
+	ComparatorBits uint
+}
+
+// DefaultConductanceConfig matches `ScoringAlgorithm(7, 63)` with
+// `LessThan(5)` comparators
+var DefaultConductanceConfig = ConductanceConfig{
+	NumVerts:       7,
+	ComparatorBits: 5,
+}
+
+// Validate checks that the parameters can be used by the circuit
+func (cfg ConductanceConfig) Validate() error {
+	if cfg.NumVerts < 1 || cfg.NumVerts > maxConductanceVerts {
+		return common.Wrap(fmt.Errorf("%w: NumVerts must be in [1, %d], got %d",
+			ErrInvalidConfig, maxConductanceVerts, cfg.NumVerts))
+	}
+	if cfg.ComparatorBits == 0 || cfg.ComparatorBits > maxComparatorBits {
+		return common.Wrap(fmt.Errorf("%w: ComparatorBits must be in [1, %d], got %d",
+			ErrInvalidConfig, maxComparatorBits, cfg.ComparatorBits))
+	}
+	return nil
+}
+
+// MaxDegree returns the maximum degree of a vertex for which the comparators
+// of the circuit are in range: the boundary of a subset divided by its size is
+// at most the maximum degree of its vertices, and it must be lower than 2^n
+func (cfg ConductanceConfig) MaxDegree() *big.Int {
+	limit := new(big.Int).Lsh(big.NewInt(1), cfg.ComparatorBits)
+	return limit.Sub(limit, big.NewInt(1))
+}
+
+// ConductanceSubsets returns the subsets[num_verts][num_subsets] matrix with
+// all the non empty subsets of at most numVerts/2 vertices (at least one
+// vertex), sorted by size and then lexicographically by their vertices, which
+// is the order of circuits/test_input1.json.  For numVerts=7 these are the 63
+// subsets of the circuit main component.  Bigger subsets are not used
+// because the whole set, and any set that contains a whole connected
+// component, has an empty boundary.
+func ConductanceSubsets(numVerts int) [][]bool {
+	maxSize := numVerts / 2 //nolint:gomnd
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	var combinations [][]int
+	for size := 1; size <= maxSize && size <= numVerts; size++ {
+		combinations = appendCombinations(combinations, make([]int, 0, size), 0,
+			numVerts, size)
+	}
+	subsets := make([][]bool, numVerts)
+	for i := 0; i < numVerts; i++ {
+		subsets[i] = make([]bool, len(combinations))
+	}
+	for a, combination := range combinations {
+		for _, i := range combination {
+			subsets[i][a] = true
+		}
+	}
+	return subsets
+}
+
+// appendCombinations appends to combinations all the size-combinations of the
+// vertices [start, numVerts) that extend prefix, in lexicographic order
+func appendCombinations(combinations [][]int, prefix []int, start, numVerts,
+	size int) [][]int {
+	if len(prefix) == size {
+		combination := make([]int, size)
+		copy(combination, prefix)
+		return append(combinations, combination)
+	}
+	for i := start; i < numVerts; i++ {
+		combinations = appendCombinations(combinations, append(prefix, i), i+1,
+			numVerts, size)
+	}
+	return combinations
+}
+
+// SubsetScores computes the output of the ScoringAlgorithm circuit for the
+// given subsets and weights matrices: for every vertex k, the minimum
+// boundary weight divided by the size among the subsets that contain k, or
+// 2^n-1 if there is no smaller one.
+func SubsetScores(comparatorBits uint, subsets [][]bool,
+	weights [][]*big.Int) ([]*big.Int, error) {
+	numVerts := len(weights)
+	if len(subsets) != numVerts {
+		return nil, common.Wrap(fmt.Errorf("subsets has %d rows, expected %d",
+			len(subsets), numVerts))
+	}
+	if numVerts == 0 {
+		return nil, nil
+	}
+	numSubsets := len(subsets[0])
+	for i := 0; i < numVerts; i++ {
+		if len(weights[i]) != numVerts {
+			return nil, common.Wrap(fmt.Errorf("weights row %d has length %d, expected %d",
+				i, len(weights[i]), numVerts))
+		}
+		if len(subsets[i]) != numSubsets {
+			return nil, common.Wrap(fmt.Errorf("subsets row %d has length %d, expected %d",
+				i, len(subsets[i]), numSubsets))
+		}
+	}
+
+	// scaled_bdry[a] = bdry[a] \ size[a], where bdry[a] is the weight of
+	// the edges leaving the subset a
+	scaledBdry := make([]*big.Int, numSubsets)
+	for a := 0; a < numSubsets; a++ {
+		bdry := big.NewInt(0)
+		size := int64(0)
+		for i := 0; i < numVerts; i++ {
+			if !subsets[i][a] {
+				continue
+			}
+			size++
+			for j := 0; j < numVerts; j++ {
+				if !subsets[j][a] {
+					bdry.Add(bdry, weights[i][j])
+				}
+			}
+		}
+		if size == 0 {
+			return nil, common.Wrap(fmt.Errorf("subset %d is empty", a))
+		}
+		scaledBdry[a] = bdry.Div(bdry, big.NewInt(size))
+	}
+
+	initialMin := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), comparatorBits),
+		big.NewInt(1))
+	scores := make([]*big.Int, numVerts)
+	for k := 0; k < numVerts; k++ {
+		minimum := initialMin
+		for b := 0; b < numSubsets; b++ {
+			lt, err := lessThan(comparatorBits, scaledBdry[b], minimum)
+			if err != nil {
+				return nil, common.Wrap(err)
+			}
+			if lt == 1 && subsets[k][b] {
+				minimum = scaledBdry[b]
+			}
+		}
+		scores[k] = new(big.Int).Set(minimum)
+	}
+	return scores, nil
+}
+
+// Conductance computes the subset conductance score of every vertex of the
+// graph, using the subsets of ConductanceSubsets.  The graph can not have more
+// vertices than cfg.NumVerts, and the result is the output of the circuit
+// compiled with num_verts equal to the number of vertices of the graph (adding
+// isolated vertices to fill num_verts would lower the scores, as the size of
+// the subsets grows while their boundary stays the same).
+func Conductance(cfg ConductanceConfig, g *Graph) (map[common.AccountIdx]uint32, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	if len(g.Vertices) > cfg.NumVerts {
+		return nil, common.Wrap(fmt.Errorf("%w: graph has %d vertices, NumVerts is %d",
+			ErrInvalidConfig, len(g.Vertices), cfg.NumVerts))
+	}
+	values, err := SubsetScores(cfg.ComparatorBits, ConductanceSubsets(len(g.Vertices)), g.Weights)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	scores := make(map[common.AccountIdx]uint32, len(g.Vertices))
+	for i, idx := range g.Vertices {
+		// values are bounded by 2^ComparatorBits-1
+		if !values[i].IsUint64() || values[i].Uint64() > math.MaxUint32 {
+			return nil, common.Wrap(common.ErrScoreOverflow)
+		}
+		scores[idx] = uint32(values[i].Uint64())
+	}
+	return scores, nil
+}
@@ -0,0 +1,108 @@
+package scoring
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"tokamak-sybil-resistance/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConductanceSubsets(t *testing.T) {
+	subsets := ConductanceSubsets(7)
+	require.Equal(t, 7, len(subsets))
+	assert.Equal(t, 63, len(subsets[0]))
+	for a := range subsets[0] {
+		size := 0
+		for i := range subsets {
+			if subsets[i][a] {
+				size++
+			}
+		}
+		assert.True(t, size >= 1 && size <= 3)
+	}
+
+	assert.Equal(t, [][]bool{{true}}, ConductanceSubsets(1))
+	assert.Equal(t, [][]bool{{true, false}, {false, true}}, ConductanceSubsets(2))
+	// {0}, {1}, {2}, {3}, {0,1}, {0,2}, {0,3}, {1,2}, {1,3}, {2,3}
+	assert.Equal(t, [][]bool{
+		{true, false, false, false, true, true, true, false, false, false},
+		{false, true, false, false, true, false, false, true, true, false},
+		{false, false, true, false, false, true, false, true, false, true},
+		{false, false, false, true, false, false, true, false, true, true},
+	}, ConductanceSubsets(4))
+}
+
+func TestSubsetScores(t *testing.T) {
+	// circuits/test_input.json
+	subsets := [][]bool{
+		{true, true, true, false},
+		{true, false, false, false},
+		{false, true, false, true},
+		{false, false, true, true},
+	}
+	weights := weightsFromInts([][]int64{
+		{0, 1, 2, 0},
+		{1, 0, 7, 3},
+		{2, 7, 0, 2},
+		{0, 3, 2, 0},
+	})
+	// scaled boundaries of the subsets: 12\2=6, 10\2=5, 8\2=4, 12\2=6
+	scores, err := SubsetScores(DefaultConductanceConfig.ComparatorBits, subsets, weights)
+	require.NoError(t, err)
+	assert.Equal(t, []*big.Int{big.NewInt(4), big.NewInt(6), big.NewInt(5),
+		big.NewInt(4)}, scores)
+
+	// a vertex without subsets keeps the initial minimum 2^5-1
+	subsets[1][0] = false
+	scores, err = SubsetScores(DefaultConductanceConfig.ComparatorBits, subsets, weights)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(31), scores[1])
+
+	// a boundary that doesn't fit in the comparator
+	weights[0][1] = big.NewInt(100)
+	_, err = SubsetScores(DefaultConductanceConfig.ComparatorBits, subsets, weights)
+	assert.True(t, errors.Is(err, ErrComparatorOutOfRange))
+}
+
+func TestConductanceScorer(t *testing.T) {
+	scorer, err := NewScorer(Config{Algorithm: AlgorithmConductance,
+		Conductance: DefaultConductanceConfig})
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmConductance, scorer.Algorithm())
+
+	g := NewGraph([]common.AccountIdx{258, 256, 257, 259})
+	require.NoError(t, g.SetWeight(256, 257, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(257, 256, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(258, 257, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(258, 259, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(259, 258, big.NewInt(1)))
+	// subsets of 1 and 2 vertices, {256,257} and {258,259} have
+	// boundaries 0 and 1\2=0
+	scores, err := scorer.Scores(g)
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{256: 0, 257: 0, 258: 0, 259: 0}, scores)
+
+	require.NoError(t, g.SetWeight(256, 258, big.NewInt(3)))
+	require.NoError(t, g.SetWeight(257, 259, big.NewInt(3)))
+	// {256,257} has boundary 6\2=3, {256,258} 3\2=1, {256,259} 5\2=2,
+	// {257,258} 5\2=2, {257,259} 2\2=1, {258,259} 1\2=0
+	scores, err = scorer.Scores(g)
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{256: 1, 257: 1, 258: 0, 259: 0}, scores)
+
+	// the graph can not be bigger than the circuit
+	g = NewGraph([]common.AccountIdx{256, 257, 258, 259, 260, 261, 262, 263})
+	_, err = scorer.Scores(g)
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	// nor can it score the whole graph in the score epochs
+	_, err = NewScorer(Config{Algorithm: AlgorithmConductance,
+		Conductance: DefaultConductanceConfig, EpochBatches: 10})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	_, err = NewScorer(Config{Algorithm: "unknown"})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+}
@@ -0,0 +1,54 @@
+package scoring
+
+import (
+	"math/big"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+)
+
+// EpochOutput contains the changes applied to the ScoreTree by a score epoch
+type EpochOutput struct {
+	// OldScoreRoot is the root of the ScoreTree before the epoch
+	OldScoreRoot *big.Int
+	// NewScoreRoot is the root of the ScoreTree after the epoch
+	NewScoreRoot *big.Int
+	// UpdatedScores contains the scores created or changed by the epoch
+	UpdatedScores map[common.AccountIdx]uint32
+}
+
+// IsEpoch returns true if the batch batchNum is a score epoch, which happens
+// every epochBatches batches.  If epochBatches is 0 no batch is a score epoch.
+func IsEpoch(batchNum common.BatchNum, epochBatches uint32) bool {
+	return epochBatches != 0 && batchNum != 0 &&
+		uint64(batchNum)%uint64(epochBatches) == 0
+}
+
+// ApplyEpoch recomputes with the given Scorer the scores of the current state
+// of the StateDB, with the vouches mapped with the given WeightConfig at the
+// batch batchNum of the epoch and the walks seeded at the given seed set (see
+// Graph.SetSeeds), and applies the scores that changed to the ScoreTree.  The
+// result only depends on the state, the batch and the seed set, so the
+// coordinator forging the batch and the synchronizers replaying it obtain the
+// same ScoreTree.
+func ApplyEpoch(sdb *statedb.StateDB, scorer Scorer, batchNum common.BatchNum,
+	weightCfg WeightConfig, seeds []common.AccountIdx) (*EpochOutput, error) {
+	oldRoot := sdb.ScoreTree.Root().BigInt()
+	g, err := GraphFromStateDB(sdb, batchNum, weightCfg)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	g.SetSeeds(seeds)
+	scores, err := scorer.Scores(g)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	updated, err := storeScores(sdb, scores)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &EpochOutput{
+		OldScoreRoot:  oldRoot,
+		NewScoreRoot:  sdb.ScoreTree.Root().BigInt(),
+		UpdatedScores: updated,
+	}, nil
+}
@@ -0,0 +1,585 @@
+package scoring
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/log"
+
+	"github.com/iden3/go-merkletree/db"
+)
+
+// ErrIncrementalMismatch is used when, in check mode, the scores computed
+// incrementally differ from the ones of a full recompute
+var ErrIncrementalMismatch = errors.New("incremental scores differ from a full recompute")
+
+// AffectedVertices returns, in ascending order, the vertices of the graph
+// whose PageRank score can change when the given vouches change or the given
+// vertices are added.  A walk of the circuit can't get further than NumSteps
+// hops from its seed, so a changed vouch only affects the walks seeded at the
+// seed vertices that reach its sender in NumSteps hops, and those walks only change
+// the ranks of the vertices that they reach in NumSteps hops.  The changed
+// vouches are followed as edges even if they have been deleted, so that the
+// vertices that lost a vouch are affected too.
+func AffectedVertices(cfg PageRankConfig, g *Graph, changed []common.VouchIdx,
+	added []common.AccountIdx) []common.AccountIdx {
+	sg := newSparseGraph(g)
+	return sg.accountIdxs(affectedVertices(cfg, sg, changed, added))
+}
+
+func affectedVertices(cfg PageRankConfig, sg *sparseGraph, changed []common.VouchIdx,
+	added []common.AccountIdx) []int {
+	out, in := sg.withEdges(changed)
+	var sources []int
+	for _, vouchIdx := range changed {
+		if i, ok := sg.positions[vouchIdx.FromIdx()]; ok {
+			sources = append(sources, i)
+		}
+	}
+	for _, idx := range added {
+		if i, ok := sg.positions[idx]; ok {
+			sources = append(sources, i)
+		}
+	}
+	seeds := sg.filterSeeds(ball(in, sources, cfg.NumSteps))
+	return ball(out, seeds, cfg.NumSteps)
+}
+
+// IncrementalPageRank computes the PageRank score of the given vertices of
+// the graph, running only the walks that can reach them, over the vertices
+// that those walks can reach.  The scores are the same that PageRank returns
+// for those vertices.
+func IncrementalPageRank(cfg PageRankConfig, g *Graph,
+	vertices []common.AccountIdx) (map[common.AccountIdx]uint32, error) {
+	if g.seeded {
+		return nil, common.Wrap(fmt.Errorf("%w: %v", ErrSeedsUnsupported, g.Seeds()))
+	}
+	targets := make([]int, 0, len(vertices))
+	for _, idx := range vertices {
+		i, ok := g.Position(idx)
+		if !ok {
+			return nil, common.Wrap(statedb.ErrIdxNotFound)
+		}
+		targets = append(targets, i)
+	}
+	return incrementalPageRank(cfg, newSparseGraph(g), targets)
+}
+
+func incrementalPageRank(cfg PageRankConfig, sg *sparseGraph,
+	targets []int) (map[common.AccountIdx]uint32, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	seeds := sg.filterSeeds(ball(sg.in, targets, cfg.NumSteps))
+	verts := ball(sg.out, seeds, cfg.NumSteps)
+
+	// the degrees take the whole row, including the vertices outside of
+	// the walks
+	q := big.NewInt(cfg.Q)
+	qDeg := make([]*big.Int, len(sg.vertices))
+	for _, j := range verts {
+		qDeg[j] = new(big.Int).Mul(sg.deg[j], q)
+	}
+
+	position := make(map[int]int, len(verts))
+	for v, j := range verts {
+		position[j] = v
+	}
+	sums := make([]*big.Int, len(targets))
+	for t := range sums {
+		sums[t] = big.NewInt(0)
+	}
+	for _, k := range seeds {
+		rank, err := walk(cfg, qDeg, k, verts)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		for t, i := range targets {
+			sums[t].Add(sums[t], rank[position[i]])
+		}
+	}
+	scores := make(map[common.AccountIdx]uint32, len(targets))
+	for t, i := range targets {
+		score, err := scoreFromRanks(sums[t])
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		scores[sg.vertices[i]] = score
+	}
+	return scores, nil
+}
+
+// sparseGraph is the adjacency of a vouch graph, with the vertices in
+// ascending AccountIdx order like the ones of a Graph.  It is what the
+// incremental scoring walks, so that it never builds the weights matrix.
+type sparseGraph struct {
+	vertices  []common.AccountIdx
+	positions map[common.AccountIdx]int
+	// out[i] and in[i] are the positions of the vertices that the vertex
+	// i vouches for and that vouch for it, with a non zero weight
+	out, in [][]int
+	// deg[i] is the sum of the weights of the vouches given by the vertex i
+	deg []*big.Int
+	// seeds contains the positions of the seed vertices, and is only used
+	// if seeded is true
+	seeds  map[int]struct{}
+	seeded bool
+}
+
+// newSparseGraphVertices returns a sparseGraph without edges for the given
+// vertices, which must be sorted ascending
+func newSparseGraphVertices(vertices []common.AccountIdx) *sparseGraph {
+	sg := &sparseGraph{
+		vertices:  vertices,
+		positions: make(map[common.AccountIdx]int, len(vertices)),
+		out:       make([][]int, len(vertices)),
+		in:        make([][]int, len(vertices)),
+		deg:       make([]*big.Int, len(vertices)),
+	}
+	for i, idx := range vertices {
+		sg.positions[idx] = i
+		sg.deg[i] = big.NewInt(0)
+	}
+	return sg
+}
+
+// newSparseGraph returns the sparseGraph of the Graph, with its seed set
+func newSparseGraph(g *Graph) *sparseGraph {
+	sg := newSparseGraphVertices(g.Vertices)
+	for i := range g.Weights {
+		for j, w := range g.Weights[i] {
+			sg.addEdge(i, j, w)
+		}
+	}
+	sg.setSeedPositions(g.seeded, g.seeds)
+	return sg
+}
+
+// addEdge adds the edge from the vertex i to the vertex j with the given
+// weight, if it is not 0
+func (sg *sparseGraph) addEdge(i, j int, weight *big.Int) {
+	if weight.Sign() == 0 {
+		return
+	}
+	sg.out[i] = append(sg.out[i], j)
+	sg.in[j] = append(sg.in[j], i)
+	sg.deg[i].Add(sg.deg[i], weight)
+}
+
+// setSeeds sets the seed set like Graph.SetSeeds
+func (sg *sparseGraph) setSeeds(idxs []common.AccountIdx) {
+	var positions []int
+	for _, idx := range idxs {
+		if i, ok := sg.positions[idx]; ok {
+			positions = append(positions, i)
+		}
+	}
+	sg.setSeedPositions(len(idxs) > 0, positions)
+}
+
+func (sg *sparseGraph) setSeedPositions(seeded bool, positions []int) {
+	sg.seeded = seeded
+	sg.seeds = make(map[int]struct{}, len(positions))
+	for _, i := range positions {
+		sg.seeds[i] = struct{}{}
+	}
+}
+
+// withEdges returns the adjacency of the graph adding as edges the given
+// vouches between vertices of the graph.  The rows of the graph are not
+// modified.
+func (sg *sparseGraph) withEdges(extra []common.VouchIdx) (out, in [][]int) {
+	out = append([][]int{}, sg.out...)
+	in = append([][]int{}, sg.in...)
+	for _, vouchIdx := range extra {
+		i, okFrom := sg.positions[vouchIdx.FromIdx()]
+		j, okTo := sg.positions[vouchIdx.ToIdx()]
+		if okFrom && okTo {
+			out[i] = append(append([]int{}, out[i]...), j)
+			in[j] = append(append([]int{}, in[j]...), i)
+		}
+	}
+	return out, in
+}
+
+// filterSeeds returns the seed vertices of the given vertex positions
+func (sg *sparseGraph) filterSeeds(positions []int) []int {
+	seeds := make([]int, 0, len(positions))
+	for _, i := range positions {
+		if _, ok := sg.seeds[i]; ok || !sg.seeded {
+			seeds = append(seeds, i)
+		}
+	}
+	return seeds
+}
+
+// accountIdxs returns the AccountIdx of the given vertex positions
+func (sg *sparseGraph) accountIdxs(positions []int) []common.AccountIdx {
+	idxs := make([]common.AccountIdx, len(positions))
+	for n, i := range positions {
+		idxs[n] = sg.vertices[i]
+	}
+	return idxs
+}
+
+// accountIdxs returns the AccountIdx of the given vertex positions
+func (g *Graph) accountIdxs(positions []int) []common.AccountIdx {
+	idxs := make([]common.AccountIdx, len(positions))
+	for n, i := range positions {
+		idxs[n] = g.Vertices[i]
+	}
+	return idxs
+}
+
+// ball returns, in ascending order, the vertices at most hops edges away from
+// the start vertices following the given adjacency
+func ball(adj [][]int, start []int, hops int) []int {
+	visited := make(map[int]bool, len(start))
+	frontier := []int{}
+	for _, v := range start {
+		if !visited[v] {
+			visited[v] = true
+			frontier = append(frontier, v)
+		}
+	}
+	for hop := 0; hop < hops && len(frontier) > 0; hop++ {
+		var next []int
+		for _, v := range frontier {
+			for _, u := range adj[v] {
+				if !visited[u] {
+					visited[u] = true
+					next = append(next, u)
+				}
+			}
+		}
+		frontier = next
+	}
+	vertices := make([]int, 0, len(visited))
+	for v := range visited {
+		vertices = append(vertices, v)
+	}
+	sort.Ints(vertices)
+	return vertices
+}
+
+// Incremental keeps the PageRank scores of the ScoreTree up to date in the
+// score epochs, recomputing only the scores of the accounts affected by the
+// vouches changed since the previous epoch.  The first epoch, and the first
+// one after a Reset or a change of the seed set, recomputes all the scores.
+// The vertices and the active vouches of the graph are read from the StateDB
+// in the first epoch, and then kept in memory and updated with the accounts
+// and vouches changed by every batch, that must be given with
+// AddChangedAccounts, AddSybilReports and AddChangedVouches.  Reset must be
+// called whenever the StateDB goes back to a previous batch.
+type Incremental struct {
+	cfg     PageRankConfig
+	weights WeightConfig
+	// check compares the incremental scores with a full recompute
+	check bool
+	// lastBatch is the batch of the previous epoch, 0 if there isn't one
+	lastBatch common.BatchNum
+	// lastSeeds is the seed set of the previous epoch
+	lastSeeds []common.AccountIdx
+	// vertices and vouches are the accounts that are not sybil and the
+	// active vouches, grouped by sender and receiver, of the StateDB at
+	// the previous epoch.  They are nil if there isn't one.
+	vertices        map[common.AccountIdx]struct{}
+	vouches         map[common.AccountIdx]map[common.AccountIdx]*common.Vouch
+	changed         map[common.VouchIdx]struct{}
+	changedAccounts map[common.AccountIdx]struct{}
+}
+
+// NewIncremental returns an Incremental for the scoring Config, which must
+// use AlgorithmPageRank.  If check is true every epoch is also fully
+// recomputed, and ApplyEpoch fails with ErrIncrementalMismatch if the scores
+// differ.
+func NewIncremental(cfg Config, check bool) (*Incremental, error) {
+	if cfg.Algorithm != AlgorithmPageRank {
+		return nil, common.Wrap(fmt.Errorf("%w: incremental scoring is only supported by %q, got %q",
+			ErrInvalidConfig, AlgorithmPageRank, cfg.Algorithm))
+	}
+	if err := cfg.PageRank.Validate(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	inc := &Incremental{
+		cfg:     cfg.PageRank,
+		weights: cfg.Weights(),
+		check:   check,
+	}
+	inc.Reset()
+	return inc, nil
+}
+
+// AddChangedVouches adds the vouches created or updated by a batch, as
+// returned in txprocessor.ProcessTxOutput.UpdatedVouches
+func (inc *Incremental) AddChangedVouches(vouches map[common.VouchIdx]*common.Vouch) {
+	for idx := range vouches {
+		inc.changed[idx] = struct{}{}
+	}
+}
+
+// AddChangedAccounts adds the accounts created or updated by a batch, as
+// returned in txprocessor.ProcessTxOutput.UpdatedAccounts
+func (inc *Incremental) AddChangedAccounts(accounts map[common.AccountIdx]*common.Account) {
+	for idx := range accounts {
+		inc.changedAccounts[idx] = struct{}{}
+	}
+}
+
+// AddSybilReports adds the accounts reported as sybil by a batch, as returned
+// in txprocessor.ProcessTxOutput.SybilReports
+func (inc *Incremental) AddSybilReports(reports []common.SybilReport) {
+	for _, report := range reports {
+		inc.changedAccounts[report.Idx] = struct{}{}
+	}
+}
+
+// Reset forgets the previous epoch, so that the next one reads the graph
+// from the StateDB and recomputes all the scores
+func (inc *Incremental) Reset() {
+	inc.lastBatch = 0
+	inc.lastSeeds = nil
+	inc.vertices = nil
+	inc.vouches = nil
+	inc.changed = make(map[common.VouchIdx]struct{})
+	inc.changedAccounts = make(map[common.AccountIdx]struct{})
+}
+
+// ApplyEpoch recomputes the scores of the current state of the StateDB at the
+// batch batchNum of the epoch with the given seed set, like ApplyEpoch with a
+// PageRankScorer, but only for the accounts affected by the changed vouches,
+// the vouches whose weight decayed since the previous epoch and the accounts
+// added to the graph.
+func (inc *Incremental) ApplyEpoch(sdb *statedb.StateDB,
+	batchNum common.BatchNum, seeds []common.AccountIdx) (*EpochOutput, error) {
+	if err := CheckSeeds(seeds); err != nil {
+		return nil, common.Wrap(err)
+	}
+	out, err := inc.applyEpoch(sdb, batchNum, seeds)
+	if err != nil {
+		// the ScoreTree may not match the changed vouches anymore
+		inc.Reset()
+		return nil, common.Wrap(err)
+	}
+	inc.lastBatch = batchNum
+	inc.lastSeeds = append([]common.AccountIdx{}, seeds...)
+	inc.changed = make(map[common.VouchIdx]struct{})
+	inc.changedAccounts = make(map[common.AccountIdx]struct{})
+	return out, nil
+}
+
+func (inc *Incremental) applyEpoch(sdb *statedb.StateDB,
+	batchNum common.BatchNum, seeds []common.AccountIdx) (*EpochOutput, error) {
+	oldRoot := sdb.ScoreTree.Root().BigInt()
+	full := inc.lastBatch == 0 || !EqualSeeds(inc.lastSeeds, seeds)
+	var changed []common.VouchIdx
+	var added []common.AccountIdx
+	if inc.vertices == nil {
+		if err := inc.load(sdb); err != nil {
+			return nil, common.Wrap(err)
+		}
+		full = true
+	} else {
+		var err error
+		added, changed, err = inc.update(sdb, batchNum)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+	}
+	sg := inc.graph(batchNum)
+	sg.setSeeds(seeds)
+
+	var targets []int
+	if full {
+		targets = make([]int, len(sg.vertices))
+		for i := range targets {
+			targets[i] = i
+		}
+	} else {
+		targets = affectedVertices(inc.cfg, sg, changed, added)
+		log.Debugw("Incremental score epoch", "batch", batchNum,
+			"changedVouches", len(changed), "affected", len(targets),
+			"vertices", len(sg.vertices))
+	}
+	scores, err := incrementalPageRank(inc.cfg, sg, targets)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if inc.check {
+		if err := checkScores(inc.cfg, sdb, batchNum, inc.weights, seeds,
+			scores); err != nil {
+			return nil, common.Wrap(err)
+		}
+	}
+
+	updated, err := storeScores(sdb, scores)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return &EpochOutput{
+		OldScoreRoot:  oldRoot,
+		NewScoreRoot:  sdb.ScoreTree.Root().BigInt(),
+		UpdatedScores: updated,
+	}, nil
+}
+
+// load reads the vertices and the active vouches of the graph from the
+// StateDB
+func (inc *Incremental) load(sdb *statedb.StateDB) error {
+	inc.vertices = make(map[common.AccountIdx]struct{})
+	inc.vouches = make(map[common.AccountIdx]map[common.AccountIdx]*common.Vouch)
+	if err := sdb.AccountsIter(func(a *common.Account) (bool, error) {
+		sybil, err := sdb.IsSybil(a.Idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !sybil {
+			inc.vertices[a.Idx] = struct{}{}
+		}
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	graph, err := sdb.VouchGraph()
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for _, vouches := range graph {
+		for _, v := range vouches {
+			inc.setVouch(v.Idx, v)
+		}
+	}
+	return nil
+}
+
+// setVouch sets the vouch idx of the graph, deleting it if vouch is nil or
+// not active
+func (inc *Incremental) setVouch(idx common.VouchIdx, vouch *common.Vouch) {
+	from, to := idx.FromIdx(), idx.ToIdx()
+	if vouch == nil || !vouch.Value {
+		delete(inc.vouches[from], to)
+		if len(inc.vouches[from]) == 0 {
+			delete(inc.vouches, from)
+		}
+		return
+	}
+	if inc.vouches[from] == nil {
+		inc.vouches[from] = make(map[common.AccountIdx]*common.Vouch)
+	}
+	inc.vouches[from][to] = vouch
+}
+
+// update applies to the graph the accounts and vouches changed since the
+// previous epoch, reading them from the StateDB.  It returns the vertices
+// added to the graph, and the changed vouches with the active vouches whose
+// decayed weight is different at batchNum than at the previous epoch, in
+// ascending VouchIdx order.
+func (inc *Incremental) update(sdb *statedb.StateDB, batchNum common.BatchNum) (
+	[]common.AccountIdx, []common.VouchIdx, error) {
+	var added []common.AccountIdx
+	for idx := range inc.changedAccounts {
+		sybil, err := sdb.IsSybil(idx)
+		if err != nil {
+			return nil, nil, common.Wrap(err)
+		}
+		if _, ok := inc.vertices[idx]; sybil {
+			delete(inc.vertices, idx)
+		} else if !ok {
+			inc.vertices[idx] = struct{}{}
+			added = append(added, idx)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+
+	changed := make(map[common.VouchIdx]struct{}, len(inc.changed))
+	for idx := range inc.changed {
+		vouch, err := sdb.GetVouch(idx)
+		if common.Unwrap(err) == db.ErrNotFound {
+			vouch = nil
+		} else if err != nil {
+			return nil, nil, common.Wrap(err)
+		}
+		inc.setVouch(idx, vouch)
+		changed[idx] = struct{}{}
+	}
+	if halfLife := inc.weights.HalfLife; halfLife != 0 {
+		for _, vouches := range inc.vouches {
+			for _, v := range vouches {
+				if v.DecayedWeight(inc.lastBatch, halfLife).Cmp(
+					v.DecayedWeight(batchNum, halfLife)) != 0 {
+					changed[v.Idx] = struct{}{}
+				}
+			}
+		}
+	}
+	idxs := make([]common.VouchIdx, 0, len(changed))
+	for idx := range changed {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	return added, idxs, nil
+}
+
+// graph returns the sparseGraph of the vertices and vouches of the graph,
+// weighted at the batch batchNum like GraphFromStateDB does
+func (inc *Incremental) graph(batchNum common.BatchNum) *sparseGraph {
+	vertices := make([]common.AccountIdx, 0, len(inc.vertices))
+	for idx := range inc.vertices {
+		vertices = append(vertices, idx)
+	}
+	sort.Slice(vertices, func(i, j int) bool { return vertices[i] < vertices[j] })
+	sg := newSparseGraphVertices(vertices)
+	for from, to := range inc.vouches {
+		i, ok := sg.positions[from]
+		if !ok {
+			continue
+		}
+		vouches := make([]*common.Vouch, 0, len(to))
+		for _, v := range to {
+			vouches = append(vouches, v)
+		}
+		weights := inc.weights.weights(batchNum, vouches)
+		for n, v := range vouches {
+			if j, ok := sg.positions[v.Idx.ToIdx()]; ok {
+				sg.addEdge(i, j, weights[n])
+			}
+		}
+	}
+	return sg
+}
+
+// checkScores compares the scores of a full recompute of the graph of the
+// StateDB with the incremental scores, taking the ones of the ScoreTree for
+// the accounts that haven't been recomputed
+func checkScores(cfg PageRankConfig, sdb *statedb.StateDB, batchNum common.BatchNum,
+	weightCfg WeightConfig, seeds []common.AccountIdx,
+	scores map[common.AccountIdx]uint32) error {
+	g, err := GraphFromStateDB(sdb, batchNum, weightCfg)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	g.SetSeeds(seeds)
+	full, err := PageRank(cfg, g)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	for _, idx := range g.Vertices {
+		score, ok := scores[idx]
+		if !ok {
+			stored, err := sdb.GetScore(idx)
+			if err != nil {
+				return common.Wrap(fmt.Errorf("%w: account %d has no score: %v",
+					ErrIncrementalMismatch, idx, err))
+			}
+			score = stored.Value
+		}
+		if score != full[idx] {
+			return common.Wrap(fmt.Errorf("%w: account %d has score %d, expected %d",
+				ErrIncrementalMismatch, idx, score, full[idx]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package scoring
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"os"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAffectedVertices(t *testing.T) {
+	// chain 256 -> 257 -> ... -> 261
+	vertices := []common.AccountIdx{256, 257, 258, 259, 260, 261}
+	g := NewGraph(vertices)
+	for i := 0; i < len(vertices)-1; i++ {
+		require.NoError(t, g.SetWeight(vertices[i], vertices[i+1], big.NewInt(1)))
+	}
+
+	// the walks of the vertices 2 hops behind 258 are affected, and they
+	// reach 2 hops ahead of 258
+	affected := AffectedVertices(DefaultPageRankConfig, g,
+		[]common.VouchIdx{common.GenerateVouchIdx(258, 259)}, nil)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258, 259, 260}, affected)
+
+	// a deleted vouch is still followed
+	require.NoError(t, g.SetWeight(258, 259, big.NewInt(0)))
+	affected = AffectedVertices(DefaultPageRankConfig, g,
+		[]common.VouchIdx{common.GenerateVouchIdx(258, 259)}, nil)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258, 259, 260}, affected)
+
+	// an added vertex affects the vertices reaching it too
+	affected = AffectedVertices(DefaultPageRankConfig, g, nil, []common.AccountIdx{261})
+	assert.Equal(t, []common.AccountIdx{259, 260, 261}, affected)
+
+	// the incremental scores are the ones of a full recompute
+	full, err := PageRank(DefaultPageRankConfig, g)
+	require.NoError(t, err)
+	scores, err := IncrementalPageRank(DefaultPageRankConfig, g, []common.AccountIdx{257, 261})
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{257: full[257], 261: full[261]}, scores)
+}
+
+func TestIncrementalApplyEpoch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+		Type: statedb.TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	createAccount := func(idx common.AccountIdx) {
+		_, err := sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(0),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(idx))),
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		createAccount(common.AccountIdx(256 + i))
+	}
+	vouches := make(map[common.VouchIdx]*common.Vouch)
+	setVouch := func(from, to common.AccountIdx, amount int64) {
+		idx := common.GenerateVouchIdx(from, to)
+		vouch := &common.Vouch{Idx: idx, Value: amount != 0, Amount: big.NewInt(amount)}
+		if _, err := sdb.GetVouch(idx); err == nil {
+			_, err = sdb.UpdateVouch(idx, vouch)
+			require.NoError(t, err)
+		} else {
+			_, err = sdb.CreateVouch(idx, vouch)
+			require.NoError(t, err)
+		}
+		vouches[idx] = vouch
+	}
+	setVouch(256, 257, 1)
+	setVouch(257, 258, 2)
+	setVouch(259, 260, 1)
+	setVouch(260, 259, 3)
+
+	inc, err := NewIncremental(Config{Algorithm: AlgorithmPageRank,
+		PageRank: DefaultPageRankConfig}, true)
+	require.NoError(t, err)
+	scorer, err := NewScorer(Config{Algorithm: AlgorithmPageRank,
+		PageRank: DefaultPageRankConfig})
+	require.NoError(t, err)
+
+	// the first epoch recomputes all the scores
+	out, err := inc.ApplyEpoch(sdb, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(out.UpdatedScores))
+	vouches = make(map[common.VouchIdx]*common.Vouch)
+
+	// the changed vouches and the new account are recomputed, and the
+	// result matches a full recompute
+	setVouch(257, 258, 0)
+	setVouch(258, 256, 4)
+	createAccount(261)
+	inc.AddChangedAccounts(map[common.AccountIdx]*common.Account{261: nil})
+	inc.AddChangedVouches(vouches)
+	out, err = inc.ApplyEpoch(sdb, 2, nil)
+	require.NoError(t, err)
+	g, err := GraphFromStateDB(sdb, 2, WeightConfig{})
+	require.NoError(t, err)
+	full, err := scorer.Scores(g)
+	require.NoError(t, err)
+	for idx, value := range full {
+		score, err := sdb.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, value, score.Value)
+	}
+	assert.Contains(t, out.UpdatedScores, common.AccountIdx(261))
+
+	// the check mode detects a score of the ScoreTree that doesn't match
+	// a full recompute
+	_, err = sdb.UpdateScore(259, &common.Score{Idx: 259, Value: full[259] + 1})
+	require.NoError(t, err)
+	_, err = inc.ApplyEpoch(sdb, 3, nil)
+	assert.True(t, errors.Is(err, ErrIncrementalMismatch))
+
+	// after the error the next epoch is a full recompute, which fixes it
+	_, err = inc.ApplyEpoch(sdb, 4, nil)
+	require.NoError(t, err)
+	score, err := sdb.GetScore(259)
+	require.NoError(t, err)
+	assert.Equal(t, full[259], score.Value)
+
+	// a seed set is rejected without changing the scores
+	root := sdb.ScoreTree.Root()
+	_, err = inc.ApplyEpoch(sdb, 5, []common.AccountIdx{257})
+	assert.True(t, errors.Is(err, ErrSeedsUnsupported))
+	assert.Equal(t, root, sdb.ScoreTree.Root())
+	for _, idx := range []common.AccountIdx{256, 257, 258, 259, 260, 261} {
+		score, err := sdb.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, full[idx], score.Value)
+	}
+
+	_, err = NewIncremental(Config{Algorithm: AlgorithmConductance}, false)
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+}
+
+func TestIncrementalEquivalence(t *testing.T) {
+	cfg := Config{Algorithm: AlgorithmPageRank, PageRank: DefaultPageRankConfig,
+		VouchHalfLife: 3}
+	scorer, err := NewScorer(cfg)
+	require.NoError(t, err)
+	inc, err := NewIncremental(cfg, false)
+	require.NoError(t, err)
+
+	// the same changes are applied to a StateDB scored incrementally and
+	// to one fully recomputed at every epoch
+	var sdbs [2]*statedb.StateDB
+	for i := range sdbs {
+		dir, err := os.MkdirTemp("", "tmpdb")
+		require.NoError(t, err)
+		deleteme = append(deleteme, dir)
+		sdbs[i], err = statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+			Type: statedb.TypeSynchronizer, NLevels: 32})
+		require.NoError(t, err)
+		defer sdbs[i].Close()
+	}
+	sdbInc, sdbFull := sdbs[0], sdbs[1]
+
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec
+	var idxs []common.AccountIdx
+	sybils := make(map[common.AccountIdx]bool)
+	active := make(map[common.VouchIdx]bool)
+	for batchNum := common.BatchNum(1); batchNum <= 8; batchNum++ {
+		accounts := make(map[common.AccountIdx]*common.Account)
+		vouches := make(map[common.VouchIdx]*common.Vouch)
+		setVouch := func(idx common.VouchIdx, amount int64) {
+			vouch := &common.Vouch{Idx: idx, Value: amount != 0,
+				Amount: big.NewInt(amount), BatchNum: batchNum}
+			for _, sdb := range sdbs {
+				if _, err := sdb.GetVouch(idx); err == nil {
+					_, err = sdb.UpdateVouch(idx, vouch)
+					require.NoError(t, err)
+				} else {
+					_, err = sdb.CreateVouch(idx, vouch)
+					require.NoError(t, err)
+				}
+			}
+			active[idx] = vouch.Value
+			vouches[idx] = vouch
+		}
+
+		for i := 0; i < 3; i++ {
+			idx := common.AccountIdx(256 + len(idxs))
+			account := &common.Account{
+				Idx:     idx,
+				Balance: big.NewInt(0),
+				EthAddr: ethCommon.BigToAddress(big.NewInt(int64(idx))),
+			}
+			for _, sdb := range sdbs {
+				_, err := sdb.CreateAccount(idx, account)
+				require.NoError(t, err)
+			}
+			idxs = append(idxs, idx)
+			accounts[idx] = account
+		}
+		for i := 0; i < 6; i++ {
+			from, to := idxs[rnd.Intn(len(idxs))], idxs[rnd.Intn(len(idxs))]
+			if from == to || sybils[from] || sybils[to] {
+				continue
+			}
+			setVouch(common.GenerateVouchIdx(from, to), rnd.Int63n(4)*1000)
+		}
+		// a sybil report removes the vouches of the account and sets its
+		// score to 0, like the txprocessor does
+		var reports []common.SybilReport
+		if batchNum == 5 {
+			sybil := idxs[rnd.Intn(len(idxs))]
+			for idx, ok := range active {
+				if ok && (idx.FromIdx() == sybil || idx.ToIdx() == sybil) {
+					setVouch(idx, 0)
+				}
+			}
+			for _, sdb := range sdbs {
+				require.NoError(t, StoreScores(sdb, map[common.AccountIdx]uint32{sybil: 0}))
+				require.NoError(t, sdb.SetSybil(sybil, batchNum))
+			}
+			sybils[sybil] = true
+			reports = append(reports, common.SybilReport{BatchNum: batchNum, Idx: sybil})
+		}
+		inc.AddChangedAccounts(accounts)
+		inc.AddSybilReports(reports)
+		inc.AddChangedVouches(vouches)
+
+		// the epochs are every 2 batches
+		if batchNum%2 == 0 {
+			outInc, err := inc.ApplyEpoch(sdbInc, batchNum, nil)
+			require.NoError(t, err)
+			outFull, err := ApplyEpoch(sdbFull, scorer, batchNum, cfg.Weights(), nil)
+			require.NoError(t, err)
+			assert.Equal(t, outFull.NewScoreRoot, outInc.NewScoreRoot)
+			assert.Equal(t, sdbFull.ScoreTree.Root(), sdbInc.ScoreTree.Root())
+			assert.Equal(t, outFull.UpdatedScores, outInc.UpdatedScores)
+		}
+		for _, sdb := range sdbs {
+			require.NoError(t, sdb.MakeCheckpoint())
+		}
+	}
+}
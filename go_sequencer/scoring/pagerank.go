@@ -0,0 +1,225 @@
+package scoring
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"tokamak-sybil-resistance/common"
+)
+
+const (
+	// initialResidual is the residual of the seed vertex of each walk
+	initialResidual = 10
+	// rankDenominator divides p*residual when moving residual to the rank
+	rankDenominator = 10
+	// residualDenominator divides (10+p)*residual when decreasing the
+	// residual
+	residualDenominator = 20
+	// maxComparatorBits is the maximum n accepted by LessThan(n)
+	maxComparatorBits = 252
+)
+
+// PageRankConfig contains the parameters of the NewScoringAlgorithm circuit
+// (circuits/new_scoring_circuit.circom).  They must match the parameters the
+// circuit has been compiled with.
+type PageRankConfig struct {
+	// P is the proportion (in tenths) of the residual of a vertex that is
+	// moved to its rank at each step
+	P int64
+	// Q multiplies the degree of a vertex to obtain the threshold that its
+	// residual has to exceed
+	Q int64
+	// NumSteps is the number of steps of each walk
+	NumSteps int
+	// ComparatorBits is the n of the LessThan(n) comparators
+	ComparatorBits uint
+}
+
+// DefaultPageRankConfig matches `NewScoringAlgorithm(num_verts, 2, 1, 2)` with
+// `LessThan(7)` comparators
+var DefaultPageRankConfig = PageRankConfig{
+	P:              2,
+	Q:              1,
+	NumSteps:       2,
+	ComparatorBits: 7,
+}
+
+// Validate checks that the parameters can be used by the circuit
+func (cfg PageRankConfig) Validate() error {
+	if cfg.P < 0 || cfg.P > rankDenominator {
+		// with p>10 the residual becomes negative
+		return common.Wrap(fmt.Errorf("%w: P must be in [0, %d], got %d",
+			ErrInvalidConfig, rankDenominator, cfg.P))
+	}
+	if cfg.Q < 0 {
+		return common.Wrap(fmt.Errorf("%w: Q must be positive, got %d",
+			ErrInvalidConfig, cfg.Q))
+	}
+	if cfg.NumSteps < 1 {
+		return common.Wrap(fmt.Errorf("%w: NumSteps must be at least 1, got %d",
+			ErrInvalidConfig, cfg.NumSteps))
+	}
+	if cfg.ComparatorBits == 0 || cfg.ComparatorBits > maxComparatorBits {
+		return common.Wrap(fmt.Errorf("%w: ComparatorBits must be in [1, %d], got %d",
+			ErrInvalidConfig, maxComparatorBits, cfg.ComparatorBits))
+	}
+	return nil
+}
+
+// MaxDegree returns the maximum degree of a vertex for which the comparators
+// of the circuit are in range: q*deg is compared with a residual of at most
+// 10, so it must be lower than 2^n.  Returns nil if Q is 0, as then the
+// degree is not compared.
+func (cfg PageRankConfig) MaxDegree() *big.Int {
+	if cfg.Q <= 0 {
+		return nil
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), cfg.ComparatorBits)
+	limit.Sub(limit, big.NewInt(1))
+	return limit.Div(limit, big.NewInt(cfg.Q))
+}
+
+// lessThan mirrors the LessThan(n) template: it returns 1 if a<b and 0
+// otherwise.  The circuit decomposes a+2^n-b in n+1 bits, so if that value is
+// negative or doesn't fit, there is no valid witness and an error is returned.
+func lessThan(n uint, a, b *big.Int) (int64, error) {
+	x := new(big.Int).Lsh(big.NewInt(1), n)
+	x.Add(x, a)
+	x.Sub(x, b)
+	if x.Sign() < 0 || x.BitLen() > int(n)+1 {
+		return 0, common.Wrap(fmt.Errorf("%w: LessThan(%d) with in[0]=%s, in[1]=%s",
+			ErrComparatorOutOfRange, n, a, b))
+	}
+	return 1 - int64(x.Bit(int(n))), nil
+}
+
+// NodeRanks computes the output of the NewScoringAlgorithm circuit for the
+// given weights matrix: noderanks[k][i] is the rank of the vertex i in the
+// walk seeded at the vertex k.
+func NodeRanks(cfg PageRankConfig, weights [][]*big.Int) ([][]*big.Int, error) {
+	seeds := make([]int, len(weights))
+	for k := range seeds {
+		seeds[k] = k
+	}
+	return nodeRanks(cfg, weights, seeds)
+}
+
+// nodeRanks computes the ranks of the walks seeded at the given vertices:
+// noderanks[n][i] is the rank of the vertex i in the walk seeded at the
+// vertex seeds[n]
+func nodeRanks(cfg PageRankConfig, weights [][]*big.Int, seeds []int) ([][]*big.Int, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	numVerts := len(weights)
+	q := big.NewInt(cfg.Q)
+
+	// deg[k] = sum_j weights[k][j]
+	deg := make([]*big.Int, numVerts)
+	qDeg := make([]*big.Int, numVerts)
+	for k := 0; k < numVerts; k++ {
+		if len(weights[k]) != numVerts {
+			return nil, common.Wrap(fmt.Errorf("weights row %d has length %d, expected %d",
+				k, len(weights[k]), numVerts))
+		}
+		deg[k] = big.NewInt(0)
+		for j := 0; j < numVerts; j++ {
+			if weights[k][j].Sign() < 0 {
+				return nil, common.Wrap(fmt.Errorf("negative weight at [%d][%d]", k, j))
+			}
+			deg[k].Add(deg[k], weights[k][j])
+		}
+		qDeg[k] = new(big.Int).Mul(q, deg[k])
+	}
+
+	verts := make([]int, numVerts)
+	for v := range verts {
+		verts[v] = v
+	}
+	noderanks := make([][]*big.Int, len(seeds))
+	for n, k := range seeds {
+		rank, err := walk(cfg, qDeg, k, verts)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		noderanks[n] = rank
+	}
+	return noderanks, nil
+}
+
+// walk mirrors the walk of the NewScoringAlgorithm circuit seeded at the
+// vertex k, where qDeg[j] is q times the degree of the vertex j, and returns
+// the rank of each one of the given vertices at the end of the walk.  The
+// vertices outside of verts are left out of the walk, which doesn't change
+// the result as long as they can't be reached from k in NumSteps hops.
+func walk(cfg PageRankConfig, qDeg []*big.Int, k int, verts []int) ([]*big.Int, error) {
+	p := big.NewInt(cfg.P)
+	pPlus10 := big.NewInt(cfg.P + rankDenominator)
+	rankDen := big.NewInt(rankDenominator)
+	residualDen := big.NewInt(residualDenominator)
+
+	rank := make([]*big.Int, len(verts))
+	residual := make([]*big.Int, len(verts))
+	for v := range verts {
+		rank[v] = big.NewInt(0)
+		residual[v] = big.NewInt(0)
+		if verts[v] == k {
+			residual[v] = big.NewInt(initialResidual)
+		}
+	}
+
+	for step := 0; step < cfg.NumSteps-1; step++ {
+		for v, j := range verts {
+			out, err := lessThan(cfg.ComparatorBits, qDeg[j], residual[v])
+			if err != nil {
+				return nil, common.Wrap(err)
+			}
+			if out == 0 {
+				// both increments are multiplied by out
+				continue
+			}
+			// rank + p*out*residual \ 10
+			inc := new(big.Int).Mul(p, residual[v])
+			rank[v] = new(big.Int).Add(rank[v], inc.Div(inc, rankDen))
+			// residual - (10+p)*residual*out \ 20
+			dec := new(big.Int).Mul(pPlus10, residual[v])
+			residual[v] = new(big.Int).Sub(residual[v], dec.Div(dec, residualDen))
+		}
+	}
+	return rank, nil
+}
+
+// PageRank computes the personalized PageRank score of every vertex of the
+// graph, which is the sum of the ranks that the vertex obtains in the walks
+// seeded at each vertex.  A graph with a seed set is rejected with
+// ErrSeedsUnsupported.
+func PageRank(cfg PageRankConfig, g *Graph) (map[common.AccountIdx]uint32, error) {
+	if g.seeded {
+		return nil, common.Wrap(fmt.Errorf("%w: %v", ErrSeedsUnsupported, g.Seeds()))
+	}
+	noderanks, err := NodeRanks(cfg, g.Weights)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	scores := make(map[common.AccountIdx]uint32, len(g.Vertices))
+	for i, idx := range g.Vertices {
+		sum := big.NewInt(0)
+		for k := range noderanks {
+			sum.Add(sum, noderanks[k][i])
+		}
+		score, err := scoreFromRanks(sum)
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		scores[idx] = score
+	}
+	return scores, nil
+}
+
+// scoreFromRanks returns the score of a vertex from the sum of its ranks
+func scoreFromRanks(sum *big.Int) (uint32, error) {
+	if !sum.IsUint64() || sum.Uint64() > math.MaxUint32 {
+		return 0, common.Wrap(common.ErrScoreOverflow)
+	}
+	return uint32(sum.Uint64()), nil
+}
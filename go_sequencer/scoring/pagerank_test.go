@@ -0,0 +1,242 @@
+package scoring
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var deleteme []string
+
+func TestMain(m *testing.M) {
+	exitVal := m.Run()
+	for _, dir := range deleteme {
+		if err := os.RemoveAll(dir); err != nil {
+			panic(err)
+		}
+	}
+	os.Exit(exitVal)
+}
+
+func weightsFromInts(w [][]int64) [][]*big.Int {
+	weights := make([][]*big.Int, len(w))
+	for i := range w {
+		weights[i] = make([]*big.Int, len(w[i]))
+		for j := range w[i] {
+			weights[i][j] = big.NewInt(w[i][j])
+		}
+	}
+	return weights
+}
+
+func TestLessThan(t *testing.T) {
+	out, err := lessThan(7, big.NewInt(3), big.NewInt(10))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), out)
+	out, err = lessThan(7, big.NewInt(10), big.NewInt(10))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), out)
+	out, err = lessThan(7, big.NewInt(0), big.NewInt(0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), out)
+	// limits of Num2Bits(8)
+	out, err = lessThan(7, big.NewInt(127), big.NewInt(0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), out)
+	out, err = lessThan(7, big.NewInt(0), big.NewInt(128))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), out)
+
+	_, err = lessThan(7, big.NewInt(128), big.NewInt(0))
+	assert.True(t, errors.Is(err, ErrComparatorOutOfRange))
+	_, err = lessThan(7, big.NewInt(0), big.NewInt(129))
+	assert.True(t, errors.Is(err, ErrComparatorOutOfRange))
+}
+
+func TestNodeRanks(t *testing.T) {
+	// weights of the circuit main component (5 vertices), where the
+	// vertex 0 has degree 12 and the rest have degree < 10
+	weights := weightsFromInts([][]int64{
+		{0, 6, 6, 0, 0},
+		{1, 0, 1, 1, 0},
+		{0, 0, 0, 0, 9},
+		{0, 0, 0, 0, 0},
+		{5, 0, 0, 4, 0},
+	})
+	noderanks, err := NodeRanks(DefaultPageRankConfig, weights)
+	require.NoError(t, err)
+	// with 2 steps only the seed of each walk can move residual to its
+	// rank: p*10\10 = 2 when q*deg < 10
+	expected := [][]int64{
+		{0, 0, 0, 0, 0},
+		{0, 2, 0, 0, 0},
+		{0, 0, 2, 0, 0},
+		{0, 0, 0, 2, 0},
+		{0, 0, 0, 0, 2},
+	}
+	assert.Equal(t, weightsFromInts(expected), noderanks)
+
+	// 3 steps: the residual of the seed after the first step is
+	// 10 - 12*10\20 = 4, and the second step adds 2*4\10 = 0 to the rank
+	// only if q*deg < 4
+	cfg := PageRankConfig{P: 2, Q: 1, NumSteps: 3, ComparatorBits: 7}
+	noderanks, err = NodeRanks(cfg, weights)
+	require.NoError(t, err)
+	assert.Equal(t, weightsFromInts(expected), noderanks)
+
+	// p=10 moves the whole residual to the rank in the first step
+	cfg = PageRankConfig{P: 10, Q: 0, NumSteps: 3, ComparatorBits: 7}
+	noderanks, err = NodeRanks(cfg, weights)
+	require.NoError(t, err)
+	for k := range noderanks {
+		for i := range noderanks[k] {
+			if i == k {
+				assert.Equal(t, big.NewInt(10), noderanks[k][i])
+			} else {
+				assert.Equal(t, big.NewInt(0), noderanks[k][i])
+			}
+		}
+	}
+
+	// a degree that doesn't fit in the comparator can not be proven
+	weights[0][1] = big.NewInt(200)
+	_, err = NodeRanks(DefaultPageRankConfig, weights)
+	assert.True(t, errors.Is(err, ErrComparatorOutOfRange))
+
+	_, err = NodeRanks(PageRankConfig{P: 11, Q: 1, NumSteps: 2, ComparatorBits: 7}, weights)
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+}
+
+func TestPageRankSeeds(t *testing.T) {
+	g := NewGraph([]common.AccountIdx{256, 257, 258})
+	require.NoError(t, g.SetWeight(256, 257, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(257, 256, big.NewInt(1)))
+	require.NoError(t, g.SetWeight(258, 257, big.NewInt(1)))
+	assert.Nil(t, g.Seeds())
+
+	all, err := PageRank(DefaultPageRankConfig, g)
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{256: 2, 257: 2, 258: 2}, all)
+
+	// the circuit can't prove the scores of a seed set, so the seed sets
+	// are rejected, including the ones without vertices
+	g.SetSeeds([]common.AccountIdx{300, 257})
+	assert.Equal(t, []common.AccountIdx{257}, g.Seeds())
+	_, err = PageRank(DefaultPageRankConfig, g)
+	assert.True(t, errors.Is(err, ErrSeedsUnsupported))
+	_, err = IncrementalPageRank(DefaultPageRankConfig, g, []common.AccountIdx{256, 257})
+	assert.True(t, errors.Is(err, ErrSeedsUnsupported))
+	g.SetSeeds([]common.AccountIdx{300})
+	assert.Equal(t, []common.AccountIdx{}, g.Seeds())
+	_, err = PageRank(DefaultPageRankConfig, g)
+	assert.True(t, errors.Is(err, ErrSeedsUnsupported))
+
+	assert.True(t, errors.Is(CheckSeeds([]common.AccountIdx{257}), ErrSeedsUnsupported))
+	assert.NoError(t, CheckSeeds(nil))
+	assert.NoError(t, CheckSeeds([]common.AccountIdx{}))
+	_, err = NewScorer(Config{Algorithm: AlgorithmPageRank, PageRank: DefaultPageRankConfig,
+		Seeds: []common.AccountIdx{257}})
+	assert.True(t, errors.Is(err, ErrSeedsUnsupported))
+
+	// an empty seed set makes every vertex a seed again
+	g.SetSeeds(nil)
+	scores, err := PageRank(DefaultPageRankConfig, g)
+	require.NoError(t, err)
+	assert.Equal(t, all, scores)
+	g.SetSeeds([]common.AccountIdx{})
+	assert.Nil(t, g.Seeds())
+	scores, err = IncrementalPageRank(DefaultPageRankConfig, g, []common.AccountIdx{256, 257})
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{256: all[256], 257: all[257]}, scores)
+}
+
+func TestUpdateScores(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+		Type: statedb.TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 3; i++ {
+		idx := common.AccountIdx(256 + i)
+		_, err = sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(0),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+		})
+		require.NoError(t, err)
+	}
+	vouches := []common.VouchIdx{
+		common.GenerateVouchIdx(256, 257),
+		common.GenerateVouchIdx(258, 257),
+		common.GenerateVouchIdx(257, 256),
+	}
+	for _, idx := range vouches {
+		_, err = sdb.CreateVouch(idx, &common.Vouch{Idx: idx, Value: true,
+			Amount: big.NewInt(1)})
+		require.NoError(t, err)
+	}
+
+	g, err := GraphFromStateDB(sdb, sdb.CurrentBatch(), WeightConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258}, g.Vertices)
+	assert.Equal(t, weightsFromInts([][]int64{
+		{0, 1, 0},
+		{1, 0, 0},
+		{0, 1, 0},
+	}), g.Weights)
+
+	// the stake is divided by the unit, and the weights of 258, which
+	// add up to more than the maximum degree, are scaled down to it
+	idx := common.GenerateVouchIdx(258, 256)
+	_, err = sdb.CreateVouch(idx, &common.Vouch{Idx: idx, Value: true,
+		Amount: big.NewInt(3)})
+	require.NoError(t, err)
+	g, err = GraphFromStateDB(sdb, sdb.CurrentBatch(), WeightConfig{
+		Unit: big.NewInt(1), MaxDegree: big.NewInt(2)})
+	require.NoError(t, err)
+	assert.Equal(t, weightsFromInts([][]int64{
+		{0, 1, 0},
+		{1, 0, 0},
+		{1, 0, 0},
+	}), g.Weights)
+	_, err = sdb.UpdateVouch(idx, &common.Vouch{Idx: idx, Value: false,
+		Amount: big.NewInt(0)})
+	require.NoError(t, err)
+
+	cfg := Config{Algorithm: AlgorithmPageRank, PageRank: DefaultPageRankConfig,
+		VouchHalfLife: 10, VouchUnit: big.NewInt(1000)}
+	assert.Equal(t, WeightConfig{HalfLife: 10, Unit: big.NewInt(1000),
+		MaxDegree: big.NewInt(127)}, cfg.Weights())
+	cfg.Algorithm = AlgorithmConductance
+	cfg.Conductance = DefaultConductanceConfig
+	assert.Equal(t, big.NewInt(31), cfg.Weights().MaxDegree)
+
+	scorer, err := NewScorer(Config{Algorithm: AlgorithmPageRank,
+		PageRank: DefaultPageRankConfig})
+	require.NoError(t, err)
+	scores, err := UpdateScores(sdb, scorer, WeightConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, map[common.AccountIdx]uint32{256: 2, 257: 2, 258: 2}, scores)
+	for idx, value := range scores {
+		score, err := sdb.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, value, score.Value)
+	}
+
+	// running it again over the same state leaves the ScoreTree untouched
+	root := sdb.ScoreTree.Root()
+	_, err = UpdateScores(sdb, scorer, WeightConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, root, sdb.ScoreTree.Root())
+}
@@ -0,0 +1,128 @@
+package scoring
+
+import (
+	"fmt"
+	"math/big"
+	"tokamak-sybil-resistance/common"
+)
+
+// Algorithm identifies a scoring algorithm
+type Algorithm string
+
+const (
+	// AlgorithmPageRank is the personalized PageRank of
+	// circuits/new_scoring_circuit.circom
+	AlgorithmPageRank Algorithm = "pagerank"
+	// AlgorithmConductance is the subset conductance of
+	// circuits/scoring_algorithm.circom
+	AlgorithmConductance Algorithm = "conductance"
+)
+
+// Config selects the scoring algorithm and contains the parameters of each
+// one of them
+type Config struct {
+	Algorithm   Algorithm
+	PageRank    PageRankConfig
+	Conductance ConductanceConfig
+	// EpochBatches is the number of batches between score epochs, the
+	// batches in which the scores are recomputed and stored in the
+	// ScoreTree.  If 0, the scores are never recomputed.
+	EpochBatches uint32
+	// VouchHalfLife is the number of batches after which the weight of a
+	// vouch in the vouch graph is halved, see common.Vouch.DecayedWeight.
+	// If 0, the weights don't decay.
+	VouchHalfLife uint32
+	// VouchUnit is the stake of a vouch with weight 1 in the vouch graph,
+	// see WeightConfig.Unit.  If nil, the weight is the stake.
+	VouchUnit *big.Int
+	// Seeds is the initial seed set of the PageRank walks, used until an
+	// UpdateScoreSeeds event of the rollup replaces it.  If empty, every
+	// account is a seed.  The circuit doesn't support seed sets yet, so it
+	// must be empty (see ErrSeedsUnsupported).  The conductance algorithm
+	// ignores it.
+	Seeds []common.AccountIdx
+}
+
+// Weights returns the WeightConfig of the graphs scored with the Config,
+// whose MaxDegree keeps the comparators of the circuit of the algorithm in
+// range
+func (cfg Config) Weights() WeightConfig {
+	weightCfg := WeightConfig{
+		HalfLife: cfg.VouchHalfLife,
+		Unit:     cfg.VouchUnit,
+	}
+	switch cfg.Algorithm {
+	case AlgorithmPageRank:
+		weightCfg.MaxDegree = cfg.PageRank.MaxDegree()
+	case AlgorithmConductance:
+		weightCfg.MaxDegree = cfg.Conductance.MaxDegree()
+	}
+	return weightCfg
+}
+
+// Scorer computes the score of every vertex of a vouch graph snapshot
+type Scorer interface {
+	// Algorithm returns the algorithm implemented by the Scorer
+	Algorithm() Algorithm
+	// Scores returns the score of each vertex of the graph
+	Scores(g *Graph) (map[common.AccountIdx]uint32, error)
+}
+
+// NewScorer returns the Scorer of the algorithm selected in the Config.  The
+// conductance algorithm can only be used without score epochs (EpochBatches
+// 0), as its circuit scores at most ConductanceConfig.NumVerts accounts and
+// the epochs score all of them.
+func NewScorer(cfg Config) (Scorer, error) {
+	switch cfg.Algorithm {
+	case AlgorithmPageRank:
+		if err := cfg.PageRank.Validate(); err != nil {
+			return nil, common.Wrap(err)
+		}
+		if err := CheckSeeds(cfg.Seeds); err != nil {
+			return nil, common.Wrap(err)
+		}
+		return &PageRankScorer{cfg: cfg.PageRank}, nil
+	case AlgorithmConductance:
+		if cfg.EpochBatches != 0 {
+			return nil, common.Wrap(fmt.Errorf("%w: the %v algorithm can not be used "+
+				"with score epochs", ErrInvalidConfig, cfg.Algorithm))
+		}
+		if err := cfg.Conductance.Validate(); err != nil {
+			return nil, common.Wrap(err)
+		}
+		return &ConductanceScorer{cfg: cfg.Conductance}, nil
+	default:
+		return nil, common.Wrap(fmt.Errorf("%w: unknown algorithm %q",
+			ErrInvalidConfig, cfg.Algorithm))
+	}
+}
+
+// PageRankScorer is the Scorer of the personalized PageRank algorithm
+type PageRankScorer struct {
+	cfg PageRankConfig
+}
+
+// Algorithm returns AlgorithmPageRank
+func (s *PageRankScorer) Algorithm() Algorithm {
+	return AlgorithmPageRank
+}
+
+// Scores returns the PageRank score of each vertex of the graph
+func (s *PageRankScorer) Scores(g *Graph) (map[common.AccountIdx]uint32, error) {
+	return PageRank(s.cfg, g)
+}
+
+// ConductanceScorer is the Scorer of the subset conductance algorithm
+type ConductanceScorer struct {
+	cfg ConductanceConfig
+}
+
+// Algorithm returns AlgorithmConductance
+func (s *ConductanceScorer) Algorithm() Algorithm {
+	return AlgorithmConductance
+}
+
+// Scores returns the conductance score of each vertex of the graph
+func (s *ConductanceScorer) Scores(g *Graph) (map[common.AccountIdx]uint32, error) {
+	return Conductance(s.cfg, g)
+}
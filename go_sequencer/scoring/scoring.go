@@ -0,0 +1,309 @@
+/*
+Package scoring computes the scores of the accounts from the vouch graph
+stored in the StateDB.
+
+The algorithms implemented here mirror the circom circuits found in the
+`circuits` directory, using the same fixed-point integer arithmetic (same
+scaling, same comparators and same integer divisions), so that the scores
+stored in the ScoreTree are bit-for-bit the ones that a proof of the circuit
+would attest to.
+
+The vouch graph is taken as a snapshot (Graph), where the vertices are all
+the accounts of the StateDB sorted by AccountIdx, and the weight of the edge
+from the vertex i to the vertex j is the weight of the vouch that the account
+Vertices[i] gives to the account Vertices[j].  The weight of a vouch decays
+with its age: it is halved once every half-life batches since the batch in
+which it was created, so a graph is always built for a given batch.
+
+The circuits compare the degrees of the vertices with LessThan(n)
+comparators, so the stake of the vouches is mapped to the input range of the
+circuit when the graph is built (WeightConfig): the decayed stake is divided
+by a stake unit, and the weights given by an account are scaled down if they
+add up to more than the maximum degree accepted by the comparators.  The
+scores of the node and the witnesses of the circuit are computed from the
+same weights.
+
+The PageRank walks restart at the seed set of the graph, the trust anchors
+toward which the scores are personalized.  Without a seed set every vertex is
+a seed, which is what the circuit does.  The walks of the circuit don't
+propagate the residual of the seed to its neighbours, so the scores of a graph
+with a seed set can't be proven with the current circuit, and the seed sets
+are rejected with ErrSeedsUnsupported until it supports a restart vector.
+*/
+package scoring
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+
+	"github.com/iden3/go-merkletree/db"
+)
+
+var (
+	// ErrInvalidConfig is used when the scoring parameters can not be used
+	// by the circuit
+	ErrInvalidConfig = errors.New("invalid scoring config")
+	// ErrComparatorOutOfRange is used when the inputs of a LessThan
+	// comparator don't fit in its number of bits, in which case the
+	// circuit can not generate a witness
+	ErrComparatorOutOfRange = errors.New("comparator inputs out of range")
+	// ErrSeedsUnsupported is used when the PageRank walks are given a seed
+	// set.  The walks of the circuit don't move the residual to the
+	// neighbours of the seed, so with a seed set every other account would
+	// get a score of 0 instead of the rank propagated from the seeds.
+	ErrSeedsUnsupported = errors.New("seed sets are not supported by the scoring circuit")
+)
+
+// CheckSeeds returns an error wrapping ErrSeedsUnsupported if the seed set is
+// not empty, as the circuit can only prove the walks seeded at every account
+func CheckSeeds(seeds []common.AccountIdx) error {
+	if len(seeds) > 0 {
+		return common.Wrap(fmt.Errorf("%w: %v", ErrSeedsUnsupported, seeds))
+	}
+	return nil
+}
+
+// Graph is a snapshot of the vouch graph
+type Graph struct {
+	// Vertices contains the AccountIdx of each vertex, sorted ascending
+	Vertices []common.AccountIdx
+	// Weights[i][j] is the weight of the edge from Vertices[i] to
+	// Vertices[j]
+	Weights [][]*big.Int
+	// positions maps each AccountIdx to its position in Vertices
+	positions map[common.AccountIdx]int
+	// seeds contains the positions of the seed vertices, sorted
+	// ascending, and is only used if seeded is true
+	seeds  []int
+	seeded bool
+}
+
+// NewGraph returns a Graph without edges for the given vertices
+func NewGraph(vertices []common.AccountIdx) *Graph {
+	sorted := make([]common.AccountIdx, len(vertices))
+	copy(sorted, vertices)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	g := &Graph{
+		Vertices:  sorted,
+		Weights:   make([][]*big.Int, len(sorted)),
+		positions: make(map[common.AccountIdx]int, len(sorted)),
+	}
+	for i, idx := range sorted {
+		g.positions[idx] = i
+		g.Weights[i] = make([]*big.Int, len(sorted))
+		for j := range g.Weights[i] {
+			g.Weights[i][j] = big.NewInt(0)
+		}
+	}
+	return g
+}
+
+// Position returns the position of the vertex of the given AccountIdx
+func (g *Graph) Position(idx common.AccountIdx) (int, bool) {
+	i, ok := g.positions[idx]
+	return i, ok
+}
+
+// SetSeeds sets the seed set of the graph, the vertices at which the PageRank
+// walks restart.  The AccountIdx that are not vertices of the graph are
+// ignored.  An empty seed set makes every vertex a seed.
+func (g *Graph) SetSeeds(idxs []common.AccountIdx) {
+	g.seeds = nil
+	g.seeded = len(idxs) > 0
+	for _, idx := range idxs {
+		if i, ok := g.Position(idx); ok {
+			g.seeds = append(g.seeds, i)
+		}
+	}
+	sort.Ints(g.seeds)
+}
+
+// Seeds returns the AccountIdx of the seed vertices, or nil if every vertex
+// is a seed
+func (g *Graph) Seeds() []common.AccountIdx {
+	if !g.seeded {
+		return nil
+	}
+	return g.accountIdxs(g.seeds)
+}
+
+// EqualSeeds returns true if both seed sets contain the same AccountIdx in
+// the same order
+func EqualSeeds(a, b []common.AccountIdx) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetWeight sets the weight of the edge from the vertex of the AccountIdx
+// 'from' to the vertex of the AccountIdx 'to'
+func (g *Graph) SetWeight(from, to common.AccountIdx, weight *big.Int) error {
+	i, ok := g.Position(from)
+	if !ok {
+		return common.Wrap(statedb.ErrIdxNotFound)
+	}
+	j, ok := g.Position(to)
+	if !ok {
+		return common.Wrap(statedb.ErrIdxNotFound)
+	}
+	g.Weights[i][j] = new(big.Int).Set(weight)
+	return nil
+}
+
+// WeightConfig maps the stake of the vouches to the weights of the edges of a
+// Graph
+type WeightConfig struct {
+	// HalfLife is the number of batches after which the stake of a vouch
+	// is halved, see common.Vouch.DecayedWeight.  If 0, the stake doesn't
+	// decay.
+	HalfLife uint32
+	// Unit is the stake of a vouch with weight 1.  The decayed stake is
+	// divided by it, rounding down.  If nil, the weight is the stake.
+	Unit *big.Int
+	// MaxDegree is the maximum sum of the weights of the vouches given by
+	// an account.  If they add up to more, each weight w is scaled down to
+	// w*MaxDegree\sum.  If nil, there is no maximum.
+	MaxDegree *big.Int
+}
+
+// weights returns the weights of the given vouches, all given by the same
+// account, at the batch batchNum
+func (cfg WeightConfig) weights(batchNum common.BatchNum,
+	vouches []*common.Vouch) []*big.Int {
+	weights := make([]*big.Int, len(vouches))
+	sum := big.NewInt(0)
+	for n, v := range vouches {
+		weights[n] = v.DecayedWeight(batchNum, cfg.HalfLife)
+		if cfg.Unit != nil && cfg.Unit.Sign() > 0 {
+			weights[n].Div(weights[n], cfg.Unit)
+		}
+		sum.Add(sum, weights[n])
+	}
+	if cfg.MaxDegree != nil && sum.Cmp(cfg.MaxDegree) > 0 {
+		for _, w := range weights {
+			w.Mul(w, cfg.MaxDegree).Div(w, sum)
+		}
+	}
+	return weights
+}
+
+// StateReader is the state read to build a Graph, implemented by the
+// statedb.StateDB and by the statedb.StateView of a checkpoint
+type StateReader interface {
+	AccountsIter(fn func(a *common.Account) (bool, error)) error
+	IsSybil(idx common.AccountIdx) (bool, error)
+	VouchGraph() (map[common.AccountIdx][]*common.Vouch, error)
+}
+
+// GraphFromStateDB returns the Graph of the state read from sdb at the batch
+// batchNum, where every account is a vertex and every active vouch is an edge
+// weighted by its locked amount mapped with the given WeightConfig.  The
+// accounts reported as sybil are left out of the graph, so that they keep the
+// zero score set by the report.
+func GraphFromStateDB(sdb StateReader, batchNum common.BatchNum,
+	weightCfg WeightConfig) (*Graph, error) {
+	var vertices []common.AccountIdx
+	if err := sdb.AccountsIter(func(a *common.Account) (bool, error) {
+		sybil, err := sdb.IsSybil(a.Idx)
+		if err != nil {
+			return false, common.Wrap(err)
+		}
+		if !sybil {
+			vertices = append(vertices, a.Idx)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, common.Wrap(err)
+	}
+	g := NewGraph(vertices)
+	vouches, err := sdb.VouchGraph()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	for _, from := range vouches {
+		weights := weightCfg.weights(batchNum, from)
+		for n, v := range from {
+			weight := weights[n]
+			if weight.Sign() == 0 {
+				continue
+			}
+			if err := g.SetWeight(v.Idx.FromIdx(), v.Idx.ToIdx(), weight); err != nil {
+				return nil, common.Wrap(err)
+			}
+		}
+	}
+	return g, nil
+}
+
+// UpdateScores computes the scores of all the accounts of the StateDB with
+// the given Scorer, with the vouches mapped with the given WeightConfig at the
+// current batch, and stores them in the ScoreTree. Scores of accounts that
+// don't have a leaf yet are created, the rest are updated only if they
+// changed. Returns the computed scores.
+func UpdateScores(sdb *statedb.StateDB, scorer Scorer,
+	weightCfg WeightConfig) (map[common.AccountIdx]uint32, error) {
+	g, err := GraphFromStateDB(sdb, sdb.CurrentBatch(), weightCfg)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	scores, err := scorer.Scores(g)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	if err := StoreScores(sdb, scores); err != nil {
+		return nil, common.Wrap(err)
+	}
+	return scores, nil
+}
+
+// StoreScores writes the given scores in the StateDB, in ascending
+// AccountIdx order, creating the leafs that don't exist yet
+func StoreScores(sdb *statedb.StateDB, scores map[common.AccountIdx]uint32) error {
+	_, err := storeScores(sdb, scores)
+	return common.Wrap(err)
+}
+
+// storeScores writes the given scores in the StateDB like StoreScores, and
+// returns the scores that have been created or changed
+func storeScores(sdb *statedb.StateDB, scores map[common.AccountIdx]uint32) (
+	map[common.AccountIdx]uint32, error) {
+	idxs := make([]common.AccountIdx, 0, len(scores))
+	for idx := range scores {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+
+	updated := make(map[common.AccountIdx]uint32)
+	for _, idx := range idxs {
+		score := &common.Score{Idx: idx, Value: scores[idx]}
+		old, err := sdb.GetScore(idx)
+		if common.Unwrap(err) == db.ErrNotFound {
+			if _, err := sdb.CreateScore(idx, score); err != nil {
+				return nil, common.Wrap(err)
+			}
+			updated[idx] = score.Value
+			continue
+		} else if err != nil {
+			return nil, common.Wrap(err)
+		}
+		if old.Value == score.Value {
+			continue
+		}
+		if _, err := sdb.UpdateScore(idx, score); err != nil {
+			return nil, common.Wrap(err)
+		}
+		updated[idx] = score.Value
+	}
+	return updated, nil
+}
@@ -0,0 +1,228 @@
+package scoring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+)
+
+const (
+	// WitnessInputFile is the name of the file with the circuit input
+	// written by Witness.WriteFiles
+	WitnessInputFile = "input.json"
+	// WitnessMappingFile is the name of the file with the mapping of the
+	// vertices to AccountIdx written by Witness.WriteFiles
+	WitnessMappingFile = "mapping.json"
+)
+
+// ErrWitnessCut is used when a vertex of a witness vouches for an account
+// outside of the witness, as then the circuit would compute its score with a
+// lower degree than the node
+var ErrWitnessCut = errors.New("witness vertex vouches for an account outside of the witness")
+
+// WitnessConfig contains the parameters used to build the input of a scoring
+// circuit
+type WitnessConfig struct {
+	// Algorithm is the scoring algorithm of the circuit.  The subsets
+	// input is only generated for AlgorithmConductance
+	Algorithm Algorithm
+	// NumVerts is the num_verts of the circuit
+	NumVerts int
+	// FirstIdx is the lowest AccountIdx that can be a vertex of the
+	// witness, allowing to split a graph bigger than NumVerts in windows
+	// that don't vouch for each other
+	FirstIdx common.AccountIdx
+	// Weights maps the stake of the vouches to the weights of the input,
+	// which must be the one used by the score epochs, see Config.Weights
+	Weights WeightConfig
+}
+
+// validate checks that the circuit of the config can take an input
+func (cfg WitnessConfig) validate() error {
+	switch cfg.Algorithm {
+	case AlgorithmPageRank:
+	case AlgorithmConductance:
+		if cfg.NumVerts > maxConductanceVerts {
+			return common.Wrap(fmt.Errorf("%w: NumVerts must be at most %d, got %d",
+				ErrInvalidConfig, maxConductanceVerts, cfg.NumVerts))
+		}
+	default:
+		return common.Wrap(fmt.Errorf("%w: unknown algorithm %q",
+			ErrInvalidConfig, cfg.Algorithm))
+	}
+	if cfg.NumVerts < 1 {
+		return common.Wrap(fmt.Errorf("%w: NumVerts must be at least 1, got %d",
+			ErrInvalidConfig, cfg.NumVerts))
+	}
+	return nil
+}
+
+// WitnessInput is the input of a scoring circuit, in the format of
+// circuits/test_input.json
+type WitnessInput struct {
+	Subsets [][]string `json:"subsets,omitempty"`
+	Weights [][]string `json:"weights"`
+}
+
+// WitnessMapping maps the vertices of a WitnessInput to the accounts of the
+// StateDB
+type WitnessMapping struct {
+	BatchNum  common.BatchNum `json:"batchNum"`
+	Algorithm Algorithm       `json:"algorithm"`
+	NumVerts  int             `json:"numVerts"`
+	// Vertices[i] is the AccountIdx of the vertex i.  Vertices beyond
+	// len(Vertices) are isolated vertices that fill num_verts.
+	Vertices []common.AccountIdx `json:"vertices"`
+}
+
+// Witness contains the input of a scoring circuit for a batch together with
+// the mapping of its vertices to AccountIdx
+type Witness struct {
+	Input   WitnessInput
+	Mapping WitnessMapping
+}
+
+// WitnessVertices returns the vertices of the graph that go into a witness:
+// the first numVerts vertices in ascending AccountIdx order starting at
+// firstIdx.  Returns ErrWitnessCut if any of them vouches for a vertex that
+// is left out, as the degree of each vertex must be the one of the graph for
+// the circuit to compute the scores of the node.
+func WitnessVertices(g *Graph, firstIdx common.AccountIdx, numVerts int) (
+	[]common.AccountIdx, error) {
+	first := sort.Search(len(g.Vertices), func(i int) bool {
+		return g.Vertices[i] >= firstIdx
+	})
+	last := first + numVerts
+	if last > len(g.Vertices) {
+		last = len(g.Vertices)
+	}
+	for i := first; i < last; i++ {
+		for j, w := range g.Weights[i] {
+			if w.Sign() != 0 && (j < first || j >= last) {
+				return nil, common.Wrap(fmt.Errorf("%w: %d vouches for %d",
+					ErrWitnessCut, g.Vertices[i], g.Vertices[j]))
+			}
+		}
+	}
+	return append([]common.AccountIdx{}, g.Vertices[first:last]...), nil
+}
+
+// NewWitness builds the Witness of the given graph of the batch batchNum,
+// with the weights of the graph.  The vertices are the WitnessVertices,
+// padded with isolated ones up to cfg.NumVerts.
+func NewWitness(cfg WitnessConfig, batchNum common.BatchNum, g *Graph) (*Witness, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, common.Wrap(err)
+	}
+	vertices, err := WitnessVertices(g, cfg.FirstIdx, cfg.NumVerts)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+
+	weights := make([][]string, cfg.NumVerts)
+	for i := range weights {
+		weights[i] = make([]string, cfg.NumVerts)
+		for j := range weights[i] {
+			weights[i][j] = "0"
+		}
+	}
+	for i, from := range vertices {
+		gi, _ := g.Position(from)
+		for j, to := range vertices {
+			gj, _ := g.Position(to)
+			weights[i][j] = g.Weights[gi][gj].String()
+		}
+	}
+
+	var subsets [][]string
+	if cfg.Algorithm == AlgorithmConductance {
+		subsetsBool := ConductanceSubsets(cfg.NumVerts)
+		subsets = make([][]string, len(subsetsBool))
+		for i := range subsetsBool {
+			subsets[i] = make([]string, len(subsetsBool[i]))
+			for a, in := range subsetsBool[i] {
+				if in {
+					subsets[i][a] = "1"
+				} else {
+					subsets[i][a] = "0"
+				}
+			}
+		}
+	}
+
+	return &Witness{
+		Input: WitnessInput{
+			Subsets: subsets,
+			Weights: weights,
+		},
+		Mapping: WitnessMapping{
+			BatchNum:  batchNum,
+			Algorithm: cfg.Algorithm,
+			NumVerts:  cfg.NumVerts,
+			Vertices:  vertices,
+		},
+	}, nil
+}
+
+// GraphAtBatch returns the Graph of the checkpoint of the StateDB at the given
+// batchNum, with the vouches mapped with the given WeightConfig at that batch.
+// The checkpoint is read from a StateView, so the given StateDB is not
+// modified.
+func GraphAtBatch(sdb *statedb.StateDB, batchNum common.BatchNum,
+	weightCfg WeightConfig) (*Graph, error) {
+	if batchNum == 0 {
+		// the state before the first batch is empty
+		return NewGraph(nil), nil
+	}
+	view, err := sdb.OpenAt(batchNum)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	defer view.Close()
+	return GraphFromStateDB(view, batchNum, weightCfg)
+}
+
+// WitnessFromView builds the Witness of the checkpoint of the StateView
+func WitnessFromView(cfg WitnessConfig, view *statedb.StateView) (*Witness, error) {
+	g, err := GraphFromStateDB(view, view.BatchNum(), cfg.Weights)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return NewWitness(cfg, view.BatchNum(), g)
+}
+
+// WitnessAtBatch builds the Witness of the checkpoint of the StateDB at the
+// given batchNum
+func WitnessAtBatch(cfg WitnessConfig, sdb *statedb.StateDB,
+	batchNum common.BatchNum) (*Witness, error) {
+	g, err := GraphAtBatch(sdb, batchNum, cfg.Weights)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	return NewWitness(cfg, batchNum, g)
+}
+
+// WriteFiles writes the circuit input and the vertex mapping of the Witness in
+// the WitnessInputFile and WitnessMappingFile of the given directory
+func (w *Witness) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil { //nolint:gomnd
+		return common.Wrap(err)
+	}
+	if err := writeJSON(path.Join(dir, WitnessInputFile), w.Input); err != nil {
+		return common.Wrap(err)
+	}
+	return writeJSON(path.Join(dir, WitnessMappingFile), w.Mapping)
+}
+
+func writeJSON(file string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(os.WriteFile(file, b, 0600)) //nolint:gomnd
+}
@@ -0,0 +1,200 @@
+package scoring
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWitnessSubsetsMatchCircuitInput(t *testing.T) {
+	b, err := os.ReadFile("../../circuits/test_input1.json")
+	require.NoError(t, err)
+	var input WitnessInput
+	require.NoError(t, json.Unmarshal(b, &input))
+
+	g := NewGraph([]common.AccountIdx{256, 257})
+	require.NoError(t, g.SetWeight(256, 257, big.NewInt(1)))
+	witness, err := NewWitness(WitnessConfig{Algorithm: AlgorithmConductance,
+		NumVerts: 7}, 1, g)
+	require.NoError(t, err)
+	assert.Equal(t, input.Subsets, witness.Input.Subsets)
+}
+
+func TestWitnessAtBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+		Type: statedb.TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := 0; i < 4; i++ {
+		idx := common.AccountIdx(256 + i)
+		_, err = sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(0),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+		})
+		require.NoError(t, err)
+	}
+	createVouch := func(from, to common.AccountIdx, batchNum common.BatchNum,
+		amount int64) {
+		idx := common.GenerateVouchIdx(from, to)
+		_, err := sdb.CreateVouch(idx, &common.Vouch{Idx: idx, BatchNum: batchNum,
+			Value: true, Amount: big.NewInt(amount)})
+		require.NoError(t, err)
+	}
+	// batch 1: 256 <-> 258, 257 has no vouches
+	createVouch(256, 258, 1, 1)
+	createVouch(258, 256, 1, 1)
+	require.NoError(t, sdb.MakeCheckpoint())
+	// batch 2: 259 -> 257
+	createVouch(259, 257, 2, 4)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	cfg := WitnessConfig{Algorithm: AlgorithmPageRank, NumVerts: 3}
+	witness, err := WitnessAtBatch(cfg, sdb, 1)
+	require.NoError(t, err)
+	assert.Nil(t, witness.Input.Subsets)
+	assert.Equal(t, [][]string{
+		{"0", "0", "1"},
+		{"0", "0", "0"},
+		{"1", "0", "0"},
+	}, witness.Input.Weights)
+	assert.Equal(t, WitnessMapping{BatchNum: 1, Algorithm: AlgorithmPageRank,
+		NumVerts: 3, Vertices: []common.AccountIdx{256, 257, 258}}, witness.Mapping)
+	// the StateDB is still at the last batch
+	assert.Equal(t, common.BatchNum(2), sdb.CurrentBatch())
+
+	// the vouch of 259 is received by a vertex of the witness
+	witness, err = WitnessAtBatch(cfg, sdb, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258}, witness.Mapping.Vertices)
+	assert.Equal(t, [][]string{
+		{"0", "0", "1"},
+		{"0", "0", "0"},
+		{"1", "0", "0"},
+	}, witness.Input.Weights)
+
+	// but a window starting at 259 would leave its vouch out
+	cfg.FirstIdx = 259
+	_, err = WitnessAtBatch(cfg, sdb, 2)
+	assert.True(t, errors.Is(err, ErrWitnessCut))
+
+	// with a half-life of 1 batch, at batch 2 the weight of the vouches of
+	// batch 1 has been halved to 0, and the one of batch 2 is intact
+	decayCfg := WitnessConfig{Algorithm: AlgorithmPageRank, NumVerts: 4,
+		Weights: WeightConfig{HalfLife: 1}}
+	decayed, err := WitnessAtBatch(decayCfg, sdb, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []common.AccountIdx{256, 257, 258, 259}, decayed.Mapping.Vertices)
+	assert.Equal(t, [][]string{
+		{"0", "0", "0", "0"},
+		{"0", "0", "0", "0"},
+		{"0", "0", "0", "0"},
+		{"0", "4", "0", "0"},
+	}, decayed.Input.Weights)
+
+	outDir := path.Join(dir, "witness")
+	require.NoError(t, witness.WriteFiles(outDir))
+	b, err := os.ReadFile(path.Join(outDir, WitnessMappingFile))
+	require.NoError(t, err)
+	var mapping WitnessMapping
+	require.NoError(t, json.Unmarshal(b, &mapping))
+	assert.Equal(t, witness.Mapping, mapping)
+
+	_, err = WitnessAtBatch(cfg, sdb, 3)
+	assert.Error(t, err)
+
+	// the witness of a checkpoint opened without the StateDB is the same
+	view, err := statedb.OpenCheckpoint(statedb.Config{Path: dir,
+		Type: statedb.TypeSynchronizer}, 1)
+	require.NoError(t, err)
+	defer view.Close()
+	fromView, err := WitnessFromView(WitnessConfig{Algorithm: AlgorithmPageRank,
+		NumVerts: 3}, view)
+	require.NoError(t, err)
+	witness, err = WitnessAtBatch(WitnessConfig{Algorithm: AlgorithmPageRank,
+		NumVerts: 3}, sdb, 1)
+	require.NoError(t, err)
+	assert.Equal(t, witness, fromView)
+}
+
+func TestWitnessMatchesScores(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+		Type: statedb.TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	for i := 0; i < 5; i++ {
+		idx := common.AccountIdx(256 + i)
+		_, err = sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(0),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+		})
+		require.NoError(t, err)
+	}
+	for _, v := range []struct {
+		from, to common.AccountIdx
+		stake    int64
+	}{
+		{256, 257, 200}, {256, 258, 100}, {257, 256, 3},
+		{258, 259, 9}, {258, 256, 2}, {260, 259, 5},
+	} {
+		idx := common.GenerateVouchIdx(v.from, v.to)
+		_, err = sdb.CreateVouch(idx, &common.Vouch{Idx: idx, BatchNum: 1, Value: true,
+			Amount: new(big.Int).Mul(big.NewInt(v.stake), ether)})
+		require.NoError(t, err)
+	}
+	cfg := Config{Algorithm: AlgorithmPageRank, PageRank: DefaultPageRankConfig,
+		VouchHalfLife: 10, VouchUnit: ether}
+	scorer, err := NewScorer(cfg)
+	require.NoError(t, err)
+	_, err = ApplyEpoch(sdb, scorer, 1, cfg.Weights(), nil)
+	require.NoError(t, err)
+	require.NoError(t, sdb.MakeCheckpoint())
+
+	witness, err := WitnessAtBatch(WitnessConfig{Algorithm: AlgorithmPageRank,
+		NumVerts: 8, Weights: cfg.Weights()}, sdb, 1)
+	require.NoError(t, err)
+	// the output of the circuit for the witness input is the score of
+	// each vertex stored by the epoch
+	weights := make([][]*big.Int, len(witness.Input.Weights))
+	for i, row := range witness.Input.Weights {
+		weights[i] = make([]*big.Int, len(row))
+		for j, w := range row {
+			var ok bool
+			weights[i][j], ok = new(big.Int).SetString(w, 10)
+			require.True(t, ok)
+		}
+	}
+	noderanks, err := NodeRanks(cfg.PageRank, weights)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(witness.Mapping.Vertices))
+	for i, idx := range witness.Mapping.Vertices {
+		sum := big.NewInt(0)
+		for k := range noderanks {
+			sum.Add(sum, noderanks[k][i])
+		}
+		score, err := sdb.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(score.Value), sum.Uint64(), "score of %d", idx)
+	}
+}
@@ -0,0 +1,204 @@
+package sybilscan
+
+import (
+	"math/big"
+	"sort"
+	"tokamak-sybil-resistance/database/historydb"
+)
+
+// cliques returns the maximal cliques of at least minSize vertices of the
+// graph of mutual vouches, found with the Bron-Kerbosch algorithm with
+// pivoting.  Each clique is sorted ascending.
+func (a *analysis) cliques(minSize int) [][]int {
+	var cliques [][]int
+	var expand func(r, p, x []int)
+	expand = func(r, p, x []int) {
+		if len(p) == 0 && len(x) == 0 {
+			if len(r) >= minSize {
+				clique := append([]int{}, r...)
+				sort.Ints(clique)
+				cliques = append(cliques, clique)
+			}
+			return
+		}
+		if len(r)+len(p) < minSize {
+			return
+		}
+		// the pivot is the vertex of p∪x with more neighbours in p
+		pivot, best := -1, -1
+		for _, u := range append(append([]int{}, p...), x...) {
+			n := 0
+			for _, v := range p {
+				if a.mutual[u][v] {
+					n++
+				}
+			}
+			if n > best {
+				pivot, best = u, n
+			}
+		}
+		for _, v := range append([]int{}, p...) {
+			if a.mutual[pivot][v] {
+				continue
+			}
+			expand(append(r, v), a.filterMutual(p, v), a.filterMutual(x, v))
+			p = remove(p, v)
+			x = append(x, v)
+		}
+	}
+	all := make([]int, len(a.g.Vertices))
+	for i := range all {
+		all[i] = i
+	}
+	expand(nil, all, nil)
+	sort.Slice(cliques, func(i, j int) bool {
+		if cliques[i][0] != cliques[j][0] {
+			return cliques[i][0] < cliques[j][0]
+		}
+		return len(cliques[i]) > len(cliques[j])
+	})
+	return cliques
+}
+
+// filterMutual returns the vertices of vs that vouch mutually with v
+func (a *analysis) filterMutual(vs []int, v int) []int {
+	var filtered []int
+	for _, u := range vs {
+		if a.mutual[v][u] {
+			filtered = append(filtered, u)
+		}
+	}
+	return filtered
+}
+
+func remove(vs []int, v int) []int {
+	removed := make([]int, 0, len(vs))
+	for _, u := range vs {
+		if u != v {
+			removed = append(removed, u)
+		}
+	}
+	return removed
+}
+
+// ring is a group of vertices created in the same L1 batch
+type ring struct {
+	toForgeL1TxsNum int64
+	members         []int
+}
+
+// rings returns the groups of at least minSize vertices created in the same
+// L1 batch that give at least one vouch and only vouch for vertices of the
+// same batch, split in the components connected by their vouches
+func (a *analysis) rings(creations []historydb.AccountCreation, minSize int) []ring {
+	batchOf := make(map[int]int64)
+	for _, c := range creations {
+		if c.ToForgeL1TxsNum == nil {
+			continue
+		}
+		if i, ok := a.g.Position(c.Idx); ok {
+			batchOf[i] = *c.ToForgeL1TxsNum
+		}
+	}
+	closed := make(map[int]bool)
+	for i, l1TxsNum := range batchOf {
+		if len(a.out[i]) == 0 {
+			continue
+		}
+		closed[i] = true
+		for j := range a.out[i] {
+			if b, ok := batchOf[j]; !ok || b != l1TxsNum {
+				closed[i] = false
+				break
+			}
+		}
+	}
+
+	var rings []ring
+	visited := make(map[int]bool)
+	for i := range a.g.Vertices {
+		if !closed[i] || visited[i] {
+			continue
+		}
+		// connected component of the closed vertices through vouches
+		// in any direction
+		component := []int{i}
+		visited[i] = true
+		for n := 0; n < len(component); n++ {
+			for _, j := range a.neighbours[component[n]] {
+				if closed[j] && !visited[j] && batchOf[j] == batchOf[i] {
+					visited[j] = true
+					component = append(component, j)
+				}
+			}
+		}
+		if len(component) >= minSize {
+			sort.Ints(component)
+			rings = append(rings, ring{toForgeL1TxsNum: batchOf[i], members: component})
+		}
+	}
+	return rings
+}
+
+// communities splits the vertices with vouches in communities with the label
+// propagation algorithm over the undirected weighted graph: each vertex takes
+// the label with more weight among its neighbours, until no label changes or
+// maxIterations rounds.  The vertices are visited in ascending order and ties
+// are resolved with the lowest label, so the result is deterministic.
+func (a *analysis) communities(maxIterations int) [][]int {
+	labels := make([]int, len(a.g.Vertices))
+	for i := range labels {
+		labels[i] = i
+	}
+	for it := 0; it < maxIterations; it++ {
+		changed := false
+		for i := range labels {
+			if len(a.neighbours[i]) == 0 {
+				continue
+			}
+			weights := make(map[int]*big.Int)
+			for _, j := range a.neighbours[i] {
+				w, ok := weights[labels[j]]
+				if !ok {
+					w = big.NewInt(0)
+					weights[labels[j]] = w
+				}
+				w.Add(w, a.g.Weights[i][j])
+				w.Add(w, a.g.Weights[j][i])
+			}
+			best, bestWeight := labels[i], weights[labels[i]]
+			if bestWeight == nil {
+				bestWeight = big.NewInt(0)
+			}
+			for label, w := range weights {
+				if c := w.Cmp(bestWeight); c > 0 || (c == 0 && label < best) {
+					best, bestWeight = label, w
+				}
+			}
+			if best != labels[i] {
+				labels[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	byLabel := make(map[int][]int)
+	var order []int
+	for i, label := range labels {
+		if len(a.neighbours[i]) == 0 {
+			continue
+		}
+		if _, ok := byLabel[label]; !ok {
+			order = append(order, label)
+		}
+		byLabel[label] = append(byLabel[label], i)
+	}
+	communities := make([][]int, 0, len(order))
+	for _, label := range order {
+		communities = append(communities, byLabel[label])
+	}
+	return communities
+}
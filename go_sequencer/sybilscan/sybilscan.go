@@ -0,0 +1,289 @@
+/*
+Package sybilscan looks for structures of the vouch graph that are typical of
+sybil attacks and that the scores alone don't surface:
+
+  - CliqueCluster: groups of accounts that all vouch for each other
+  - RingCluster: accounts created in the same L1 batch (same
+    ToForgeL1TxsNum) that only vouch for accounts of the same batch
+  - CutCluster: communities found by label propagation that are weakly
+    connected with the rest of the graph (low conductance), other than the
+    biggest one, which is taken as the honest region
+
+The graph is a scoring.Graph, usually the one of a StateDB checkpoint read
+from a statedb.StateView (see scoring.GraphFromStateDB), and the creation metadata of the accounts is the one
+stored in the HistoryDB.  The result is a Report with the candidate clusters
+ranked by suspicion, together with the evidence of each one of them.
+*/
+package sybilscan
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"sort"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/historydb"
+	"tokamak-sybil-resistance/scoring"
+)
+
+// ClusterKind identifies the structure in which a cluster has been found
+type ClusterKind string
+
+const (
+	// CliqueCluster is a maximal group of accounts that all vouch for
+	// each other
+	CliqueCluster ClusterKind = "clique"
+	// RingCluster is a group of accounts created in the same L1 batch that
+	// only vouch for each other
+	RingCluster ClusterKind = "ring"
+	// CutCluster is a community with a low conductance cut to the rest of
+	// the graph
+	CutCluster ClusterKind = "cut"
+)
+
+// Config contains the thresholds of the scan
+type Config struct {
+	// MinCliqueSize is the minimum number of accounts of a reported
+	// clique
+	MinCliqueSize int
+	// MinRingSize is the minimum number of accounts of a reported ring
+	MinRingSize int
+	// MinCutSize is the minimum number of accounts of a reported cut
+	MinCutSize int
+	// MaxConductance is the maximum conductance of a reported cut
+	MaxConductance float64
+	// MaxIterations is the maximum number of rounds of the label
+	// propagation
+	MaxIterations int
+}
+
+// DefaultConfig is the Config used by the sybilscan command
+var DefaultConfig = Config{
+	MinCliqueSize:  3,
+	MinRingSize:    2,
+	MinCutSize:     3,
+	MaxConductance: 0.2, //nolint:gomnd
+	MaxIterations:  20,  //nolint:gomnd
+}
+
+// Evidence contains the measures of a cluster that support its suspicion
+type Evidence struct {
+	// InternalVouches is the number of vouches between members
+	InternalVouches int `json:"internalVouches"`
+	// InternalWeight is the weight of the vouches between members
+	InternalWeight string `json:"internalWeight"`
+	// IncomingVouches is the number of vouches from non members to
+	// members
+	IncomingVouches int `json:"incomingVouches"`
+	// OutgoingVouches is the number of vouches from members to non
+	// members
+	OutgoingVouches int `json:"outgoingVouches"`
+	// CutWeight is the weight of the vouches between members and non
+	// members, in both directions
+	CutWeight string `json:"cutWeight"`
+	// Density is the proportion of the ordered pairs of members joined
+	// by a vouch
+	Density float64 `json:"density"`
+	// Conductance is the CutWeight divided by the smallest of the volumes
+	// of the cluster and the rest of the graph
+	Conductance float64 `json:"conductance"`
+	// ToForgeL1TxsNum is the L1 batch that created all the members of a
+	// RingCluster
+	ToForgeL1TxsNum *int64 `json:"toForgeL1TxsNum,omitempty"`
+}
+
+// Cluster is a candidate sybil cluster
+type Cluster struct {
+	Kind    ClusterKind         `json:"kind"`
+	Members []common.AccountIdx `json:"members"`
+	// Suspicion ranks the clusters: the number of members times one minus
+	// the conductance, so big clusters isolated from the rest of the
+	// graph come first
+	Suspicion float64  `json:"suspicion"`
+	Evidence  Evidence `json:"evidence"`
+}
+
+// Report is the result of a scan
+type Report struct {
+	BatchNum common.BatchNum `json:"batchNum"`
+	Accounts int             `json:"accounts"`
+	Vouches  int             `json:"vouches"`
+	Clusters []Cluster       `json:"clusters"`
+}
+
+// Scan looks for the candidate sybil clusters of the graph of the batch
+// batchNum, where creations contains the creation metadata of its accounts
+func Scan(cfg Config, batchNum common.BatchNum, g *scoring.Graph,
+	creations []historydb.AccountCreation) *Report {
+	a := newAnalysis(g)
+	var clusters []Cluster
+	for _, members := range a.cliques(cfg.MinCliqueSize) {
+		clusters = append(clusters, a.cluster(CliqueCluster, members))
+	}
+	for _, ring := range a.rings(creations, cfg.MinRingSize) {
+		c := a.cluster(RingCluster, ring.members)
+		l1TxsNum := ring.toForgeL1TxsNum
+		c.Evidence.ToForgeL1TxsNum = &l1TxsNum
+		clusters = append(clusters, c)
+	}
+	communities := a.communities(cfg.MaxIterations)
+	// the biggest community is taken as the honest region, as both sides
+	// of a cut have the same conductance
+	honest := -1
+	for n, members := range communities {
+		if honest == -1 || len(members) > len(communities[honest]) {
+			honest = n
+		}
+	}
+	for n, members := range communities {
+		if n == honest || len(members) < cfg.MinCutSize {
+			continue
+		}
+		c := a.cluster(CutCluster, members)
+		if c.Evidence.Conductance <= cfg.MaxConductance {
+			clusters = append(clusters, c)
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if clusters[i].Suspicion != clusters[j].Suspicion {
+			return clusters[i].Suspicion > clusters[j].Suspicion
+		}
+		if clusters[i].Kind != clusters[j].Kind {
+			return clusters[i].Kind < clusters[j].Kind
+		}
+		return clusters[i].Members[0] < clusters[j].Members[0]
+	})
+	if clusters == nil {
+		clusters = []Cluster{}
+	}
+	return &Report{
+		BatchNum: batchNum,
+		Accounts: len(g.Vertices),
+		Vouches:  a.nEdges,
+		Clusters: clusters,
+	}
+}
+
+// WriteFile writes the Report as JSON in the given file
+func (r *Report) WriteFile(file string) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return common.Wrap(err)
+	}
+	return common.Wrap(os.WriteFile(file, b, 0600)) //nolint:gomnd
+}
+
+// analysis contains the adjacency of the graph used by the detectors
+type analysis struct {
+	g *scoring.Graph
+	// out[i] are the vertices to which i vouches
+	out []map[int]bool
+	// mutual[i] are the vertices with which i vouches in both directions
+	mutual []map[int]bool
+	// neighbours[i] are the vertices that vouch for i or for which i
+	// vouches, sorted ascending
+	neighbours [][]int
+	// volume[i] is the weight of the vouches given and received by i
+	volume []*big.Int
+	nEdges int
+}
+
+func newAnalysis(g *scoring.Graph) *analysis {
+	n := len(g.Vertices)
+	a := &analysis{
+		g:          g,
+		out:        make([]map[int]bool, n),
+		mutual:     make([]map[int]bool, n),
+		neighbours: make([][]int, n),
+		volume:     make([]*big.Int, n),
+	}
+	for i := 0; i < n; i++ {
+		a.out[i] = make(map[int]bool)
+		a.mutual[i] = make(map[int]bool)
+		a.volume[i] = big.NewInt(0)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			w := g.Weights[i][j]
+			if w.Sign() == 0 {
+				continue
+			}
+			a.nEdges++
+			a.out[i][j] = true
+			a.volume[i].Add(a.volume[i], w)
+			a.volume[j].Add(a.volume[j], w)
+			if g.Weights[j][i].Sign() != 0 {
+				a.mutual[i][j] = true
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if g.Weights[i][j].Sign() != 0 || g.Weights[j][i].Sign() != 0 {
+				a.neighbours[i] = append(a.neighbours[i], j)
+			}
+		}
+	}
+	return a
+}
+
+// cluster returns the Cluster of the given vertices with its evidence
+func (a *analysis) cluster(kind ClusterKind, members []int) Cluster {
+	in := make(map[int]bool, len(members))
+	for _, i := range members {
+		in[i] = true
+	}
+	var ev Evidence
+	internal := big.NewInt(0)
+	cut := big.NewInt(0)
+	volume := big.NewInt(0)
+	total := big.NewInt(0)
+	for i := range a.g.Vertices {
+		total.Add(total, a.volume[i])
+		if in[i] {
+			volume.Add(volume, a.volume[i])
+		}
+		for j := range a.out[i] {
+			w := a.g.Weights[i][j]
+			switch {
+			case in[i] && in[j]:
+				ev.InternalVouches++
+				internal.Add(internal, w)
+			case in[i]:
+				ev.OutgoingVouches++
+				cut.Add(cut, w)
+			case in[j]:
+				ev.IncomingVouches++
+				cut.Add(cut, w)
+			}
+		}
+	}
+	ev.InternalWeight = internal.String()
+	ev.CutWeight = cut.String()
+	if len(members) > 1 {
+		ev.Density = float64(ev.InternalVouches) /
+			float64(len(members)*(len(members)-1))
+	}
+	// the volume of the rest of the graph
+	rest := new(big.Int).Sub(total, volume)
+	minVolume := volume
+	if rest.Cmp(minVolume) < 0 {
+		minVolume = rest
+	}
+	// the cut is part of both volumes, so the conductance is at most 1
+	if minVolume.Sign() > 0 {
+		ev.Conductance, _ = new(big.Rat).SetFrac(cut, minVolume).Float64()
+	}
+
+	idxs := make([]common.AccountIdx, len(members))
+	for n, i := range members {
+		idxs[n] = a.g.Vertices[i]
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	return Cluster{
+		Kind:      kind,
+		Members:   idxs,
+		Suspicion: float64(len(members)) * (1 - ev.Conductance),
+		Evidence:  ev,
+	}
+}
@@ -0,0 +1,89 @@
+package sybilscan
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/historydb"
+	"tokamak-sybil-resistance/scoring"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	g := scoring.NewGraph([]common.AccountIdx{256, 257, 258, 259, 260, 261, 262, 263})
+	setWeight := func(from, to common.AccountIdx, weight int64) {
+		require.NoError(t, g.SetWeight(from, to, big.NewInt(weight)))
+	}
+	// honest region: a cycle 256 -> 257 -> 258 -> 259 -> 256
+	setWeight(256, 257, 10)
+	setWeight(257, 258, 10)
+	setWeight(258, 259, 10)
+	setWeight(259, 256, 10)
+	// sybil region: 260, 261 and 262 vouch for each other, and have a
+	// single attack edge from the honest region
+	for _, from := range []common.AccountIdx{260, 261, 262} {
+		for _, to := range []common.AccountIdx{260, 261, 262} {
+			if from != to {
+				setWeight(from, to, 10)
+			}
+		}
+	}
+	setWeight(256, 260, 1)
+	// 263 has no vouches
+
+	l1TxsNum := func(n int64) *int64 { return &n }
+	creations := []historydb.AccountCreation{
+		{Idx: 256, ToForgeL1TxsNum: l1TxsNum(1)},
+		{Idx: 257, ToForgeL1TxsNum: l1TxsNum(1)},
+		{Idx: 258, ToForgeL1TxsNum: l1TxsNum(2)},
+		{Idx: 259, ToForgeL1TxsNum: l1TxsNum(2)},
+		{Idx: 260, ToForgeL1TxsNum: l1TxsNum(5)},
+		{Idx: 261, ToForgeL1TxsNum: l1TxsNum(5)},
+		{Idx: 262, ToForgeL1TxsNum: l1TxsNum(5)},
+		{Idx: 263, ToForgeL1TxsNum: l1TxsNum(5)},
+	}
+
+	report := Scan(DefaultConfig, 3, g, creations)
+	assert.Equal(t, common.BatchNum(3), report.BatchNum)
+	assert.Equal(t, 8, report.Accounts)
+	assert.Equal(t, 11, report.Vouches)
+
+	// the sybil region is found as a clique, a low conductance cut and a
+	// ring of accounts created in the same L1 batch
+	require.Equal(t, 3, len(report.Clusters))
+	sybils := []common.AccountIdx{260, 261, 262}
+	for n, kind := range []ClusterKind{CliqueCluster, CutCluster, RingCluster} {
+		cluster := report.Clusters[n]
+		assert.Equal(t, kind, cluster.Kind)
+		assert.Equal(t, sybils, cluster.Members)
+		assert.Equal(t, 6, cluster.Evidence.InternalVouches)
+		assert.Equal(t, "60", cluster.Evidence.InternalWeight)
+		assert.Equal(t, 1, cluster.Evidence.IncomingVouches)
+		assert.Equal(t, 0, cluster.Evidence.OutgoingVouches)
+		assert.Equal(t, 1.0, cluster.Evidence.Density)
+		// the cut of weight 1 over the volume of the honest region
+		assert.InDelta(t, 1.0/81, cluster.Evidence.Conductance, 1e-9)
+		assert.InDelta(t, 3*(1-1.0/81), cluster.Suspicion, 1e-9)
+	}
+	assert.Equal(t, int64(5), *report.Clusters[2].Evidence.ToForgeL1TxsNum)
+
+	dir, err := os.MkdirTemp("", "sybilscan")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) //nolint:errcheck
+	file := path.Join(dir, "report.json")
+	require.NoError(t, report.WriteFile(file))
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var read Report
+	require.NoError(t, json.Unmarshal(b, &read))
+	assert.Equal(t, *report, read)
+
+	// without vouches there are no clusters
+	report = Scan(DefaultConfig, 0, scoring.NewGraph([]common.AccountIdx{256}), nil)
+	assert.Equal(t, []Cluster{}, report.Clusters)
+}
@@ -15,6 +15,7 @@ import (
 	"tokamak-sybil-resistance/eth"
 	"tokamak-sybil-resistance/log"
 	"tokamak-sybil-resistance/metric"
+	"tokamak-sybil-resistance/scoring"
 	"tokamak-sybil-resistance/txprocessor"
 
 	"github.com/ethereum/go-ethereum"
@@ -114,6 +115,20 @@ type Config struct {
 	StatsUpdateBlockNumDiffThreshold uint16
 	StatsUpdateFrequencyDivider      uint16
 	ChainID                          uint16
+	// Scoring selects the algorithm that computes the scores of the
+	// synchronized batches
+	Scoring scoring.Config
+	// IncrementalScoring recomputes in the score epochs only the scores
+	// of the accounts affected by the vouches changed since the previous
+	// epoch, see scoring.Incremental
+	IncrementalScoring bool
+	// CheckIncrementalScoring compares the incremental scores of every
+	// epoch with a full recompute, failing the sync if they differ
+	CheckIncrementalScoring bool
+	// VouchRules are the protocol rules of the vouches, applied to the
+	// synchronized batches with the same values as the coordinator that
+	// forged them
+	VouchRules txprocessor.VouchRules
 }
 
 // Synchronizer implements the Synchronizer type
@@ -124,6 +139,9 @@ type Synchronizer struct {
 	l2DB             *l2db.L2DB
 	stateDB          *statedb.StateDB
 	cfg              Config
+	scorer           scoring.Scorer
+	incremental      *scoring.Incremental
+	scoreSeeds       []common.AccountIdx
 	initVars         common.SCVariables
 	startBlockNum    int64
 	vars             common.SCVariables
@@ -149,6 +167,21 @@ func NewSynchronizer(ethClient eth.ClientInterface, historyDB *historydb.History
 		return nil, common.Wrap(err)
 	}
 
+	scorer, err := scoring.NewScorer(cfg.Scoring)
+	if err != nil {
+		return nil, common.Wrap(fmt.Errorf("NewSynchronizer scoring.NewScorer: %w", err))
+	}
+	if err := cfg.VouchRules.Validate(); err != nil {
+		return nil, common.Wrap(fmt.Errorf("NewSynchronizer VouchRules.Validate: %w", err))
+	}
+	var incremental *scoring.Incremental
+	if cfg.IncrementalScoring {
+		incremental, err = scoring.NewIncremental(cfg.Scoring, cfg.CheckIncrementalScoring)
+		if err != nil {
+			return nil, common.Wrap(fmt.Errorf("NewSynchronizer scoring.NewIncremental: %w", err))
+		}
+	}
+
 	stats := NewStatsHolder(startBlockNum, cfg.StatsUpdateBlockNumDiffThreshold, cfg.StatsUpdateFrequencyDivider)
 	s := &Synchronizer{
 		EthClient:     ethClient,
@@ -157,6 +190,8 @@ func NewSynchronizer(ethClient eth.ClientInterface, historyDB *historydb.History
 		l2DB:          l2DB,
 		stateDB:       stateDB,
 		cfg:           cfg,
+		scorer:        scorer,
+		incremental:   incremental,
 		initVars:      *initVars,
 		startBlockNum: startBlockNum,
 		stats:         stats,
@@ -518,6 +553,19 @@ func (s *Synchronizer) resetState(block *common.Block) error {
 	if err != nil {
 		return common.Wrap(fmt.Errorf("stateDB.Reset: %w", err))
 	}
+	if s.incremental != nil {
+		// the vouches changed since the last epoch are unknown
+		s.incremental.Reset()
+	}
+
+	s.scoreSeeds, err = s.historyDB.GetScoreSeeds(s.cfg.Scoring.Seeds)
+	if err != nil {
+		return common.Wrap(fmt.Errorf("historyDB.GetScoreSeeds: %w", err))
+	}
+	if err := scoring.CheckSeeds(s.scoreSeeds); err != nil {
+		log.Warnw("Ignoring the seed set of the last governance update", "err", err)
+		s.scoreSeeds = nil
+	}
 
 	lastL1BatchBlockNum, err := s.historyDB.GetLastL1BatchBlockNum()
 	if err != nil && common.Unwrap(err) != sql.ErrNoRows {
@@ -554,6 +602,12 @@ func (s *Synchronizer) SCVars() *common.SCVariables {
 	}
 }
 
+// ScoreSeeds returns a copy of the seed set of the PageRank walks that the
+// next synchronized batches use, empty if every account is a seed
+func (s *Synchronizer) ScoreSeeds() []common.AccountIdx {
+	return append([]common.AccountIdx{}, s.scoreSeeds...)
+}
+
 // rollupSync retrieves all the Rollup Smart Contract Data that happened at
 // ethBlock.blockNum with ethBlock.Hash.
 func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, error) {
@@ -703,6 +757,16 @@ func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, e
 			ChainID:  s.cfg.ChainID,
 			MaxFeeTx: common.RollupConstMaxFeeIdxCoordinator,
 			MaxL1Tx:  common.RollupConstMaxL1Tx,
+			// the score epochs, the vouch expiries, the
+			// sybil reports and the vouch limits are replayed
+			// with the same rules as the coordinator that
+			// forged the batch
+			ScoreEpochBatches: s.cfg.Scoring.EpochBatches,
+			Scorer:            s.scorer,
+			ScoreWeights:      s.cfg.Scoring.Weights(),
+			Incremental:       s.incremental,
+			ScoreSeeds:        s.scoreSeeds,
+			VouchRules:        s.cfg.VouchRules,
 		}
 		tp := txprocessor.NewTxProcessor(s.stateDB, tpc)
 
@@ -717,11 +781,16 @@ func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, e
 				"evtForgeBatch.BatchNum = (%v)",
 				s.stateDB.CurrentBatch(), batchNum))
 		}
-		// if s.stateDB.AccountTree.Root().BigInt().Cmp(forgeBatchArgs.NewStRoot) != 0 {
-		// 	return nil, common.Wrap(fmt.Errorf("stateDB.MTRoot (%v) != "+
-		// 		"forgeBatchArgs.NewStRoot (%v)",
-		// 		s.stateDB.AccountTree.Root().BigInt(), forgeBatchArgs.NewStRoot))
-		// }
+		stateRoot, err := s.stateDB.StateRoot()
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		if stateRoot.Cmp(forgeBatchArgs.NewStRoot) != 0 {
+			return nil, common.Wrap(fmt.Errorf("stateDB.StateRoot (%v) != "+
+				"forgeBatchArgs.NewStRoot (%v)",
+				stateRoot, forgeBatchArgs.NewStRoot))
+		}
+		treeRoots := s.stateDB.TreeRoots()
 
 		l2Txs := make([]common.L2Tx, len(poolL2Txs))
 		for i, tx := range poolL2Txs {
@@ -771,6 +840,11 @@ func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, e
 				})
 		}
 
+		for i := range processTxsOut.SybilReports {
+			processTxsOut.SybilReports[i].EthBlockNum = blockNum
+		}
+		batchData.SybilReports = processTxsOut.SybilReports
+
 		// slotNum := int64(0)
 		// if ethBlock.Num >= s.consts.Auction.GenesisBlockNum {
 		// 	slotNum = (ethBlock.Num - s.consts.Auction.GenesisBlockNum) /
@@ -790,8 +864,13 @@ func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, e
 			LastIdx:            forgeBatchArgs.NewLastIdx,
 			ExitRoot:           forgeBatchArgs.NewExitRoot,
 			// SlotNum:            slotNum,
-			GasUsed:  gasUsed,
-			GasPrice: gasPrice,
+			GasUsed:        gasUsed,
+			GasPrice:       gasPrice,
+			ScoreAlgorithm: string(s.scorer.Algorithm()),
+			AccountRoot:    treeRoots.Account.BigInt(),
+			VouchRoot:      treeRoots.Vouch.BigInt(),
+			ScoreRoot:      treeRoots.Score.BigInt(),
+			ScoreSeeds:     s.ScoreSeeds(),
 		}
 		nextForgeL1TxsNumCpy := nextForgeL1TxsNum
 		if forgeBatchArgs.L1Batch {
@@ -862,6 +941,27 @@ func (s *Synchronizer) rollupSync(ethBlock *common.Block) (*common.RollupData, e
 	// 	}
 	// }
 
+	// the seed set updated in this block is used from the batches forged
+	// in the next blocks, as the batches of this block may have been
+	// forged before the update
+	rollupData.ScoreSeedsUpdates = make([]common.ScoreSeedsUpdate, 0,
+		len(rollupEvents.UpdateScoreSeeds))
+	for _, evt := range rollupEvents.UpdateScoreSeeds {
+		// the update is stored but not applied if the circuit can't
+		// prove the scores of its seed set
+		if err := scoring.CheckSeeds(evt.Seeds); err != nil {
+			log.Warnw("Ignoring the seed set of a governance update",
+				"blockNum", blockNum, "err", err)
+		} else {
+			s.scoreSeeds = evt.Seeds
+		}
+		rollupData.ScoreSeedsUpdates = append(rollupData.ScoreSeedsUpdates,
+			common.ScoreSeedsUpdate{
+				EthBlockNum: blockNum,
+				Seeds:       evt.Seeds,
+			})
+	}
+
 	varsUpdate := false
 
 	for _, evt := range rollupEvents.UpdateForgeL1L2BatchTimeout {
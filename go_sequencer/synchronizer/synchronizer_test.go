@@ -14,13 +14,16 @@ import (
 	"tokamak-sybil-resistance/database/historydb"
 	"tokamak-sybil-resistance/database/l2db"
 	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/scoring"
 	"tokamak-sybil-resistance/test"
 	"tokamak-sybil-resistance/test/til"
+	"tokamak-sybil-resistance/txprocessor"
 
 	dbUtils "tokamak-sybil-resistance/database"
 
 	ethCommon "github.com/ethereum/go-ethereum/common"
 
+	"github.com/iden3/go-iden3-crypto/poseidon"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -119,6 +122,27 @@ func checkSyncBlock(t *testing.T, s *Synchronizer, blockNum int, block,
 		batch.Batch.TotalFeesUSD = syncBatch.Batch.TotalFeesUSD
 		assert.Equal(t, batch.CreatedAccounts, syncBatch.CreatedAccounts)
 		batch.Batch.NumAccounts = len(batch.CreatedAccounts)
+		// The synchronizer is created with the PageRank scorer
+		batch.Batch.ScoreAlgorithm = string(scoring.AlgorithmPageRank)
+		// and without a seed set
+		batch.Batch.ScoreSeeds = []common.AccountIdx{}
+		// The roots of the trees are set by setStateRoots.  Compare
+		// them by value, as a zero root read from the HistoryDB
+		// doesn't keep the internal representation of the computed one
+		for _, roots := range [][3]**big.Int{
+			{&batch.Batch.AccountRoot, &syncBatch.Batch.AccountRoot, &dbBatch.AccountRoot},
+			{&batch.Batch.VouchRoot, &syncBatch.Batch.VouchRoot, &dbBatch.VouchRoot},
+			{&batch.Batch.ScoreRoot, &syncBatch.Batch.ScoreRoot, &dbBatch.ScoreRoot},
+		} {
+			assert.Equal(t, 0, (*roots[0]).Cmp(*roots[1]))
+			assert.Equal(t, 0, (*roots[0]).Cmp(*roots[2]))
+			*roots[1], *roots[2] = *roots[0], *roots[0]
+		}
+		// The synced StateRoot commits to the synced roots of the trees
+		stateRoot, err := poseidon.Hash([]*big.Int{syncBatch.Batch.AccountRoot,
+			syncBatch.Batch.VouchRoot, syncBatch.Batch.ScoreRoot})
+		require.NoError(t, err)
+		assert.Equal(t, stateRoot, syncBatch.Batch.StateRoot)
 
 		// Test field by field to facilitate debugging of errors
 		assert.Equal(t, len(batch.L1UserTxs), len(syncBatch.L1UserTxs))
@@ -285,6 +309,39 @@ func newBigInt(s string) *big.Int {
 	return v
 }
 
+// setStateRoots sets the roots of the trees of the batches of the blocks (til
+// doesn't set them), by processing their txs in a new StateDB like the
+// synchronizer does, and the StateRoot as the Poseidon hash of them
+func setStateRoots(t *testing.T, blocks []common.BlockData, tpc txprocessor.Config) {
+	dir, err := ioutil.TempDir("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128,
+		Type: statedb.TypeSynchronizer, NLevels: 32})
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	for i := range blocks {
+		for j := range blocks[i].Rollup.Batches {
+			batch := &blocks[i].Rollup.Batches[j]
+			l1UserTxs := append([]common.L1Tx{}, batch.L1UserTxs...)
+			l1CoordinatorTxs := append([]common.L1Tx{}, batch.L1CoordinatorTxs...)
+			tp := txprocessor.NewTxProcessor(sdb, tpc)
+			_, err := tp.ProcessTxs(batch.Batch.FeeIdxsCoordinator, l1UserTxs,
+				l1CoordinatorTxs, common.L2TxsToPoolL2Txs(batch.L2Txs))
+			require.NoError(t, err)
+			roots := sdb.TreeRoots()
+			batch.Batch.AccountRoot = roots.Account.BigInt()
+			batch.Batch.VouchRoot = roots.Vouch.BigInt()
+			batch.Batch.ScoreRoot = roots.Score.BigInt()
+			batch.Batch.StateRoot, err = poseidon.Hash([]*big.Int{
+				batch.Batch.AccountRoot, batch.Batch.VouchRoot,
+				batch.Batch.ScoreRoot})
+			require.NoError(t, err)
+		}
+	}
+}
+
 func TestSyncGeneral(t *testing.T) {
 	//
 	// Setup
@@ -303,6 +360,10 @@ func TestSyncGeneral(t *testing.T) {
 	s, err := NewSynchronizer(client, historyDB, l2DB, stateDB, Config{
 		StatsUpdateBlockNumDiffThreshold: 100,
 		StatsUpdateFrequencyDivider:      100,
+		Scoring: scoring.Config{
+			Algorithm: scoring.AlgorithmPageRank,
+			PageRank:  scoring.DefaultPageRankConfig,
+		},
 	})
 	require.NoError(t, err)
 
@@ -359,7 +420,7 @@ func TestSyncGeneral(t *testing.T) {
 		ForceExit A: 100
 		ForceExit B: 80
 
-		CreateVouch C-A
+		CreateVouch C-A: 100
 		Exit C: 50
 		Exit D: 30
 
@@ -383,28 +444,39 @@ func TestSyncGeneral(t *testing.T) {
 	require.Equal(t, 2, len(blocks[i].Rollup.Batches))
 	// require.Equal(t, 2, len(blocks[i].Rollup.Batches[0].L1CoordinatorTxs))
 
-	// Set StateRoots for batches manually (til doesn't set it)
-	blocks[i].Rollup.Batches[0].Batch.StateRoot =
-		newBigInt("11432094872416618651837327395264042968926668786266585816625577088890451620254")
-	blocks[i].Rollup.Batches[1].Batch.StateRoot =
-		newBigInt("16914212635847451457076355431350059348585556180740555407203882688922702410093")
 	// blocks 1 (blockNum=3)
 	i = 1
 	require.Equal(t, 3, int(blocks[i].Block.Num))
 	require.Equal(t, 2, len(blocks[i].Rollup.L1UserTxs))
 	require.Equal(t, 2, len(blocks[i].Rollup.Batches))
 	require.Equal(t, 3, len(blocks[i].Rollup.Batches[0].L2Txs))
-	// Set StateRoots for batches manually (til doesn't set it)
-	blocks[i].Rollup.Batches[0].Batch.StateRoot =
-		newBigInt("13535760140937349829640752733057594576151546047374619177689224612061148090678")
-	blocks[i].Rollup.Batches[1].Batch.StateRoot =
-		newBigInt("19413739476363469870744893742469056615496274423228302914851564791727474664804")
 
 	err = tc.FillBlocksExtra(blocks, &tilCfgExtra)
 	require.NoError(t, err)
 	tc.FillBlocksL1UserTxsBatchNum(blocks)
 	err = tc.FillBlocksForgedL1UserTxs(blocks)
 	require.NoError(t, err)
+	verifier := clientSetup.RollupConstants.Verifiers[0]
+	setStateRoots(t, blocks, txprocessor.Config{
+		NLevels:  uint32(verifier.NLevels),
+		MaxTx:    uint32(verifier.MaxTx),
+		ChainID:  chainID,
+		MaxFeeTx: common.RollupConstMaxFeeIdxCoordinator,
+		MaxL1Tx:  common.RollupConstMaxL1Tx,
+	})
+	// The first batch forges no txs, so its StateRoot is the one of the
+	// empty trees: Poseidon(0, 0, 0)
+	assert.Equal(t,
+		newBigInt("5317387130258456662214331362918410991734007599705406860481038345552731150762"),
+		blocks[0].Rollup.Batches[0].Batch.StateRoot)
+	// The second batch creates the accounts of C, A, D and B, whose keys til
+	// derives from the sorted user names
+	assert.Equal(t,
+		newBigInt("19116290137312612117384756852906111664048056036961736477982354444670605501025"),
+		blocks[0].Rollup.Batches[1].Batch.AccountRoot)
+	assert.Equal(t,
+		newBigInt("7498988289340021327218524779604148363272954512704081326923347917208670445583"),
+		blocks[0].Rollup.Batches[1].Batch.StateRoot)
 
 	// Add block data to the smart contracts
 	err = client.CtlAddBlocks(blocks)
@@ -454,4 +526,31 @@ func TestSyncGeneral(t *testing.T) {
 	blocks[1].Rollup.Batches[1].Batch.GasPrice = syncBlock.Rollup.Batches[1].Batch.GasPrice
 
 	checkSyncBlock(t, s, 3, &blocks[1], syncBlock)
+
+	// Block 4: the governance updates the seed set, which is stored but
+	// not used by the next batches, as the circuit can't prove the scores
+	// of a seed set
+
+	assert.Equal(t, []common.AccountIdx{}, s.ScoreSeeds())
+	seeds := []common.AccountIdx{256, 258}
+	_, err = client.RollupUpdateScoreSeeds(seeds)
+	require.NoError(t, err)
+	client.CtlMineBlock()
+
+	syncBlock, discards, err = s.Sync(ctx, nil)
+	require.NoError(t, err)
+	require.Nil(t, discards)
+	require.NotNil(t, syncBlock)
+	assert.Equal(t, int64(4), syncBlock.Block.Num)
+	assert.Equal(t, []common.ScoreSeedsUpdate{{EthBlockNum: 4, Seeds: seeds}},
+		syncBlock.Rollup.ScoreSeedsUpdates)
+	assert.Equal(t, []common.AccountIdx{}, s.ScoreSeeds())
+	seedsUpdate, err := s.historyDB.GetLastScoreSeedsUpdate()
+	require.NoError(t, err)
+	assert.Equal(t, seeds, seedsUpdate.Seeds)
+
+	// the seed set restored from the HistoryDB is ignored as well
+	s.scoreSeeds = seeds
+	require.NoError(t, s.resetIntermediateState())
+	assert.Equal(t, []common.AccountIdx{}, s.ScoreSeeds())
 }
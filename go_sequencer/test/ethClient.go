@@ -767,6 +767,25 @@ func (c *Client) RollupUpdateForgeL1L2BatchTimeout(newForgeL1Timeout int64) (tx
 	return r.addTransaction(c.newTransaction("updateForgeL1L2BatchTimeout", newForgeL1Timeout)), nil
 }
 
+// RollupUpdateScoreSeeds is the interface to call the smart contract function
+func (c *Client) RollupUpdateScoreSeeds(seeds []common.AccountIdx) (tx *types.Transaction,
+	err error) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	cpy := c.nextBlock().copy()
+	defer func() { c.revertIfErr(err, cpy) }()
+	if c.addr == nil {
+		return nil, common.Wrap(eth.ErrAccountNil)
+	}
+
+	nextBlock := c.nextBlock()
+	r := nextBlock.Rollup
+	r.Events.UpdateScoreSeeds = append(r.Events.UpdateScoreSeeds,
+		eth.RollupEventUpdateScoreSeeds{Seeds: seeds})
+
+	return r.addTransaction(c.newTransaction("updateScoreSeeds", seeds)), nil
+}
+
 // RollupUpdateFeeAddToken is the interface to call the smart contract function
 func (c *Client) RollupUpdateFeeAddToken(newFeeAddToken *big.Int) (tx *types.Transaction,
 	err error) {
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/log"
 )
@@ -368,6 +370,21 @@ func (p *parser) parseLine(setType setType) (*Instruction, error) {
 		c.To = lit
 		line, _ := p.s.r.ReadString('\n')
 		c.Literal += line
+		// the amount staked by a vouch is optional: `CreateVouch A-B: 10`
+		if i := strings.Index(line, "//"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ":") {
+			lit = strings.TrimSpace(line[1:])
+			amount, ok := new(big.Int).SetString(lit, 10)
+			if !ok {
+				return c, common.Wrap(fmt.Errorf("Can not parse number for Amount: %s", lit))
+			}
+			c.Amount = amount
+		} else if line != "" {
+			return c, common.Wrap(fmt.Errorf("Expected ':' or end of line, found '%s'", line))
+		}
 	} else {
 		if lit != ":" {
 			line, _ := p.s.r.ReadString('\n')
@@ -478,6 +495,6 @@ func (p *parser) parse() (*parsedSet, error) {
 	for u := range users {
 		ps.users = append(ps.users, u)
 	}
-	// sort.Strings(ps.users)
+	sort.Strings(ps.users)
 	return ps, nil
 }
@@ -207,8 +207,12 @@ func (tc *Context) generateBlocks() ([]common.BlockData, error) {
 				return nil, common.Wrap(err)
 			}
 		case common.TxTypeCreateVouch:
+			amount := big.NewInt(0)
+			if inst.Amount != nil {
+				amount = inst.Amount
+			}
 			tx := common.L2Tx{
-				Amount: big.NewInt(0),
+				Amount: amount,
 				// Fee:         common.FeeSelector(inst.Fee),
 				Type:        common.TxTypeCreateVouch,
 				EthBlockNum: tc.blockNum,
@@ -496,6 +500,9 @@ func (tc *Context) generatePoolL2Txs() ([]common.PoolL2Tx, error) {
 				RqToBJJ:     common.EmptyBJJComp,
 				Type:        inst.Typ,
 			}
+			if inst.Amount != nil {
+				tx.Amount = inst.Amount
+			}
 			tc.Accounts[inst.From].Nonce++
 			if tx.Type == common.TxTypeCreateVouch || tx.Type == common.TxTypeDeleteVouch {
 				tx.ToIdx = tc.Accounts[inst.To].Idx
@@ -59,7 +59,7 @@ func TestGenerateBlocks(t *testing.T) {
 		> batchL1 // batchNum = 2
 
 		CreateVouch A-B
-		CreateVouch B-A
+		CreateVouch B-A: 3 // staking 3
 		CreateVouch A-C
 		DeleteVouch A-B
 
@@ -102,9 +102,9 @@ func TestGenerateBlocks(t *testing.T) {
 	// #5: CreateVouch A-B
 	tc.checkL2TxParams(t, blocks[0].Rollup.Batches[2].L2Txs[0], common.TxTypeCreateVouch, "A",
 		"B", nil, common.BatchNum(3))
-	// #6: CreateVouch B-A
+	// #6: CreateVouch B-A: 3
 	tc.checkL2TxParams(t, blocks[0].Rollup.Batches[2].L2Txs[1], common.TxTypeCreateVouch, "B",
-		"A", nil, common.BatchNum(3))
+		"A", big.NewInt(3), common.BatchNum(3))
 	// #7: CreateVouch A-C
 	tc.checkL2TxParams(t, blocks[0].Rollup.Batches[2].L2Txs[2], common.TxTypeCreateVouch, "A",
 		"C", nil, common.BatchNum(3))
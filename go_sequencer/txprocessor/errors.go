@@ -1,6 +1,28 @@
 package txprocessor
 
+import "errors"
+
 var (
 	// ErrInvalidRqOffset RqOffset must be a value between 0 and 7 (both included)
 	ErrInvalidRqOffset = "RqOffset must be a value between 0 and 7 (both included)"
+	// ErrSelfVouch is used when a CreateVouch or DeleteVouch tx has the
+	// same FromIdx and ToIdx
+	ErrSelfVouch = errors.New("can not vouch for the same account")
+	// ErrVouchNotFound is used when a DeleteVouch tx targets a vouch that
+	// does not exist or that has already been deleted
+	ErrVouchNotFound = errors.New("can not delete vouch because it does not exist")
+	// ErrInvalidVouchAmount is used when a CreateVouch tx doesn't lock a
+	// positive amount
+	ErrInvalidVouchAmount = errors.New("vouch amount must be positive")
+	// ErrSybilAccount is used when a CreateVouch tx is sent by or to an
+	// account that has been reported as sybil
+	ErrSybilAccount = errors.New("can not vouch with an account reported as sybil")
+	// ErrMaxOutVouches is used when a CreateVouch tx is sent by an account
+	// that already gives Config.MaxOutVouches active vouches
+	ErrMaxOutVouches = errors.New("the sender already gives the maximum number of vouches")
+	// ErrVouchCooldown is used when a CreateVouch or DeleteVouch tx changes
+	// a vouch that has changed less than Config.VouchCooldown batches ago
+	ErrVouchCooldown = errors.New("the vouch has changed too recently")
+	// ErrInvalidVouchRules is used when the VouchRules can not be applied
+	ErrInvalidVouchRules = errors.New("invalid vouch rules")
 )
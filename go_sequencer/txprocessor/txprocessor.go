@@ -9,7 +9,7 @@ depending on the Type of the StateDB of the TxProcessor:
   - The StateDB contains the full State MerkleTree, where the leafs are
     the accounts
   - Updates the StateDB and as output returns: ExitInfos, CreatedAccounts,
-    CoordinatorIdxsMap, CollectedFees, UpdatedAccounts
+    CoordinatorIdxsMap, CollectedFees, UpdatedAccounts, UpdatedVouches
   - Internally computes the ExitTree
 
 - TypeTxSelector:
@@ -20,7 +20,8 @@ depending on the Type of the StateDB of the TxProcessor:
 - TypeBatchBuilder:
   - The StateDB contains the full State MerkleTree, where the leafs are
     the accounts
-  - Updates the StateDB. As output returns: ZKInputs, CoordinatorIdxsMap
+  - Updates the StateDB. As output returns: ZKInputs, CoordinatorIdxsMap,
+    UpdatedVouches
   - Internally computes the ZKInputs
 
 Packages dependency overview:
@@ -62,6 +63,8 @@ The structure of the TxProcessor can be understand as:
 The main exposed method of the TxProcessor is `ProcessTxs`, which as general
 lines does:
   - if type==(Synchronizer || BatchBuilder), creates an ephemeral ExitTree
+  - removes the vouches older than Config.VouchExpiry batches, unlocking
+    their stake to the sender Balance as a DeleteVouch would
   - processes:
   - L1UserTxs --> for each tx calls ProcessL1Tx()
   - L1CoordinatorTxs --> for each tx calls ProcessL1Tx()
@@ -75,7 +78,24 @@ lines does:
     Accounts (leafs))
   - in case of Synchronizer & BatchBuilder, updates the ExitTree
     for the txs of type Exit (L1 & L2)
-  - in case of BatchBuilder, computes the ZKInputs while processing the txs
+  - for the txs of type CreateVouch & DeleteVouch, updates the
+    Vouch MerkleTree, locking (CreateVouch) or unlocking (DeleteVouch)
+    the stake of the vouch from the sender Balance, as long as the sender
+    gives less than Config.MaxOutVouches vouches (CreateVouch) and the
+    vouch hasn't changed in the last Config.VouchCooldown batches
+  - for the L1Txs of type ReportSybil sent by Config.SybilReporter,
+    slashes Config.SybilSlashPerMille of the stake of each vouch received
+    by the reported account, unlocking the rest, removes the vouches given
+    by it and sets its score to 0
+  - in case of BatchBuilder, computes the ZKInputs while processing the txs,
+    where the old & new state roots are the StateRoot of the StateDB, which
+    commits to the Account, Vouch & Score MerkleTrees
+  - if the batch is a score epoch (every Config.ScoreEpochBatches batches),
+    once all the txs are processed, recomputes the scores from the vouch
+    graph with the Config.Scorer, where the stake of each vouch is mapped to
+    the weights of the circuit with the Config.ScoreWeights (or only the
+    affected scores with the Config.Incremental), and updates the Score MerkleTree, which
+    the BatchBuilder includes in the ZKInputs as the old & new score roots
   - if type==Synchronizer, once all the txs are processed, for each Exit
     it generates the ExitInfo data
 */
@@ -91,7 +111,9 @@ import (
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/database/statedb"
 	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/scoring"
 
+	ethCommon "github.com/ethereum/go-ethereum/common"
 	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/iden3/go-merkletree"
 	"github.com/iden3/go-merkletree/db"
@@ -110,7 +132,13 @@ type TxProcessor struct {
 	// updatedAccounts stores the last version of the account when it has
 	// been created/updated by any of the processed transactions.
 	updatedAccounts map[common.AccountIdx]*common.Account
-	config          Config
+	// updatedVouches stores the last version of the vouch when it has
+	// been created/updated by any of the processed transactions.
+	updatedVouches map[common.VouchIdx]*common.Vouch
+	// sybilReports stores the accounts reported as sybil by the
+	// processed transactions
+	sybilReports []common.SybilReport
+	config       Config
 }
 
 // Config contains the TxProcessor configuration parameters
@@ -122,6 +150,65 @@ type Config struct {
 	MaxL1Tx  uint32
 	// ChainID of the blockchain
 	ChainID uint16
+	// ScoreEpochBatches is the number of batches between score epochs,
+	// see scoring.IsEpoch
+	ScoreEpochBatches uint32
+	// Scorer computes the scores in the score epochs.  If nil, the
+	// scores are not recomputed.
+	Scorer scoring.Scorer
+	// Incremental, if not nil, computes the scores in the score epochs
+	// instead of the Scorer, recomputing only the accounts affected by
+	// the vouches changed since the previous epoch.  It must be used with
+	// the same StateDB in all the batches.
+	Incremental *scoring.Incremental
+	// ScoreWeights maps the stake of the vouches to the weights of the
+	// vouch graph in the score epochs, see scoring.Config.Weights
+	ScoreWeights scoring.WeightConfig
+	// ScoreSeeds is the seed set of the PageRank walks in the score
+	// epochs, see scoring.Graph.SetSeeds.  If empty, every account is a
+	// seed.  The epochs fail with scoring.ErrSeedsUnsupported if it's not
+	// empty.
+	ScoreSeeds []common.AccountIdx
+	// VouchRules are the protocol rules of the vouches
+	VouchRules
+}
+
+// VouchRules contains the protocol parameters that limit, expire and slash
+// the vouches.  All the nodes of the network must use the same values.
+type VouchRules struct {
+	// VouchExpiry is the number of batches after which a vouch is removed
+	// at the start of a batch, see common.Vouch.IsExpired.  If 0, the
+	// vouches never expire.
+	VouchExpiry uint32
+	// SybilReporter is the only address whose ReportSybil L1Txs are
+	// applied.  If it is the zero address, every report is ignored.
+	SybilReporter ethCommon.Address
+	// SybilSlashPerMille is the part, in thousandths, of the stake of
+	// each vouch received by an account reported as sybil that is
+	// slashed.  The rest of the stake is unlocked to the voucher.  It can
+	// not be bigger than 1000, see VouchRules.Validate.
+	SybilSlashPerMille uint32
+	// MaxOutVouches is the maximum number of active vouches that an
+	// account can give.  If 0, there is no limit.
+	MaxOutVouches uint32
+	// VouchCooldown is the minimum number of batches between two changes
+	// (CreateVouch or DeleteVouch) of the vouch of the same pair of
+	// accounts.  If 0, there is no cooldown.
+	VouchCooldown uint32
+}
+
+// sybilSlashDenominator divides Config.SybilSlashPerMille
+const sybilSlashDenominator = 1000
+
+// Validate returns an error wrapping ErrInvalidVouchRules if the rules can not
+// be applied.  It's checked once when the node is set up, so the txs that
+// apply the rules don't check them again.
+func (r VouchRules) Validate() error {
+	if r.SybilSlashPerMille > sybilSlashDenominator {
+		return common.Wrap(fmt.Errorf("%w: SybilSlashPerMille (%d) can not be bigger than %d",
+			ErrInvalidVouchRules, r.SybilSlashPerMille, sybilSlashDenominator))
+	}
+	return nil
 }
 
 type processedExit struct {
@@ -141,6 +228,15 @@ type ProcessTxOutput struct {
 	// UpdatedAccounts returns the current state of each account
 	// created/updated by any of the processed transactions.
 	UpdatedAccounts map[common.AccountIdx]*common.Account
+	// UpdatedVouches returns the current state of each vouch
+	// created/updated by any of the processed transactions.
+	UpdatedVouches map[common.VouchIdx]*common.Vouch
+	// ScoreEpoch contains the changes applied to the ScoreTree when the
+	// batch is a score epoch, and nil otherwise
+	ScoreEpoch *scoring.EpochOutput
+	// SybilReports contains the accounts reported as sybil by any of the
+	// processed transactions
+	SybilReports []common.SybilReport
 }
 
 func newErrorNotEnoughBalance(tx common.Tx) error {
@@ -160,10 +256,11 @@ func newErrorNotEnoughBalance(tx common.Tx) error {
 // NewTxProcessor returns a new TxProcessor with the given *StateDB & Config
 func NewTxProcessor(state *statedb.StateDB, config Config) *TxProcessor {
 	return &TxProcessor{
-		state:   state,
-		zki:     nil,
-		txIndex: 0,
-		config:  config,
+		state:          state,
+		zki:            nil,
+		txIndex:        0,
+		config:         config,
+		updatedVouches: make(map[common.VouchIdx]*common.Vouch),
 	}
 }
 
@@ -215,6 +312,19 @@ func (txProcessor *TxProcessor) ProcessTxs(coordIdxs []common.AccountIdx, l1user
 	if txProcessor.state.Type() == statedb.TypeSynchronizer {
 		txProcessor.updatedAccounts = make(map[common.AccountIdx]*common.Account)
 	}
+	var oldStateRoot *big.Int
+	if txProcessor.state.Type() == statedb.TypeBatchBuilder {
+		oldStateRoot, err = txProcessor.state.StateRoot()
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+	}
+	// the ScoreTree changes in the score epochs, and in any batch with a
+	// ReportSybil, which sets the score of the reported account to 0
+	oldScoreRoot := txProcessor.state.ScoreTree.Root().BigInt()
+	if err := txProcessor.StartBatch(); err != nil {
+		return nil, common.Wrap(err)
+	}
 
 	exits := make([]processedExit, nTx)
 
@@ -497,6 +607,32 @@ func (txProcessor *TxProcessor) ProcessTxs(coordIdxs []common.AccountIdx, l1user
 	// 	}
 	// }
 
+	// once all the txs are processed, recompute the scores if the batch is
+	// a score epoch, so that they are computed from the vouches of the
+	// batch
+	var scoreEpoch *scoring.EpochOutput
+	if txProcessor.config.Incremental != nil {
+		txProcessor.config.Incremental.AddChangedAccounts(txProcessor.updatedAccounts)
+		txProcessor.config.Incremental.AddSybilReports(txProcessor.sybilReports)
+		txProcessor.config.Incremental.AddChangedVouches(txProcessor.updatedVouches)
+	}
+	if (txProcessor.config.Scorer != nil || txProcessor.config.Incremental != nil) &&
+		scoring.IsEpoch(txProcessor.state.CurrentBatch()+1, txProcessor.config.ScoreEpochBatches) {
+		if txProcessor.config.Incremental != nil {
+			scoreEpoch, err = txProcessor.config.Incremental.ApplyEpoch(txProcessor.state,
+				txProcessor.state.CurrentBatch()+1, txProcessor.config.ScoreSeeds)
+		} else {
+			scoreEpoch, err = scoring.ApplyEpoch(txProcessor.state, txProcessor.config.Scorer,
+				txProcessor.state.CurrentBatch()+1, txProcessor.config.ScoreWeights,
+				txProcessor.config.ScoreSeeds)
+		}
+		if err != nil {
+			return nil, common.Wrap(err)
+		}
+		log.Debugw("Score epoch applied", "batch", txProcessor.state.CurrentBatch()+1,
+			"updatedScores", len(scoreEpoch.UpdatedScores))
+	}
+
 	if txProcessor.state.Type() == statedb.TypeTxSelector {
 		return nil, nil
 	}
@@ -543,9 +679,31 @@ func (txProcessor *TxProcessor) ProcessTxs(coordIdxs []common.AccountIdx, l1user
 			// CoordinatorIdxsMap: coordIdxsMap,
 			// CollectedFees:      collectedFees,
 			UpdatedAccounts: txProcessor.updatedAccounts,
+			UpdatedVouches:  txProcessor.updatedVouches,
+			ScoreEpoch:      scoreEpoch,
+			SybilReports:    txProcessor.sybilReports,
 		}, nil
 	}
 
+	if txProcessor.zki == nil {
+		// the inputs of the txs are not generated yet, but the
+		// inputs of the ScoreTree are already known
+		txProcessor.zki = &common.ZKInputs{
+			CurrentNumBatch: (txProcessor.state.CurrentBatch() + 1).BigInt(),
+			GlobalChainID:   big.NewInt(int64(txProcessor.config.ChainID)),
+		}
+	}
+	txProcessor.zki.Metadata.ScoreEpoch = scoreEpoch != nil
+	txProcessor.zki.OldScoreRoot = oldScoreRoot
+	txProcessor.zki.NewScoreRoot = txProcessor.state.ScoreTree.Root().BigInt()
+	// the state roots commit to the account, vouch and score trees
+	newStateRoot, err := txProcessor.state.StateRoot()
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	txProcessor.zki.OldStateRoot = oldStateRoot
+	txProcessor.zki.Metadata.NewStateRootRaw = merkletree.NewHashFromBigInt(newStateRoot)
+
 	// // compute last ZKInputs parameters
 	// txProcessor.zki.GlobalChainID = big.NewInt(int64(txProcessor.config.ChainID))
 	// txProcessor.zki.Metadata.NewStateRootRaw = txProcessor.state.AccountTree.Root()
@@ -557,7 +715,9 @@ func (txProcessor *TxProcessor) ProcessTxs(coordIdxs []common.AccountIdx, l1user
 		ExitInfos:       nil,
 		CreatedAccounts: nil,
 		// CoordinatorIdxsMap: coordIdxsMap,
-		CollectedFees: nil,
+		CollectedFees:  nil,
+		UpdatedVouches: txProcessor.updatedVouches,
+		ScoreEpoch:     scoreEpoch,
 	}, nil
 }
 
@@ -644,6 +804,16 @@ func (txProcessor *TxProcessor) ProcessL1Tx(exitTree *merkletree.MerkleTree, tx
 			return nil, nil, false, nil, common.Wrap(err)
 		}
 		return &tx.FromIdx, exitAccount, newExit, nil, nil
+	case common.TxTypeReportSybil:
+		// a report doesn't move funds
+		tx.EffectiveAmount = big.NewInt(0)
+		tx.EffectiveDepositAmount = big.NewInt(0)
+
+		err := txProcessor.applyReportSybil(tx)
+		if err != nil {
+			log.Error(err)
+			return nil, nil, false, nil, common.Wrap(err)
+		}
 	default:
 	}
 
@@ -765,9 +935,9 @@ func (txProcessor *TxProcessor) ProcessL2Tx(exitTree *merkletree.MerkleTree,
 
 	switch tx.Type {
 	case common.TxTypeCreateVouch, common.TxTypeDeleteVouch:
-		// go to the MT account of sender and receiver, and update
-		// balance & nonce
-		err = txProcessor.applyTransfer(nil, nil, tx.Tx(), tx.AuxToIdx)
+		// go to the MT account of sender to update the nonce, and to
+		// the vouch MT to create or delete the vouch
+		err = txProcessor.applyVouch(tx.Tx(), tx.AuxToIdx)
 		if err != nil {
 			log.Error(err)
 			return nil, nil, false, common.Wrap(err)
@@ -855,6 +1025,32 @@ func (txProcessor *TxProcessor) updateAccount(idx common.AccountIdx, account *co
 	return txProcessor.state.UpdateAccount(idx, account)
 }
 
+// createVouch is a wrapper over the StateDB.CreateVouch method that also
+// stores the created vouch in the updatedVouches map once it is written
+func (txProcessor *TxProcessor) createVouch(idx common.VouchIdx, vouch *common.Vouch) (
+	*merkletree.CircomProcessorProof, error) {
+	vouch.Idx = idx
+	p, err := txProcessor.state.CreateVouch(idx, vouch)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	txProcessor.updatedVouches[idx] = vouch
+	return p, nil
+}
+
+// updateVouch is a wrapper over the StateDB.UpdateVouch method that also
+// stores the updated vouch in the updatedVouches map once it is written
+func (txProcessor *TxProcessor) updateVouch(idx common.VouchIdx, vouch *common.Vouch) (
+	*merkletree.CircomProcessorProof, error) {
+	vouch.Idx = idx
+	p, err := txProcessor.state.UpdateVouch(idx, vouch)
+	if err != nil {
+		return nil, common.Wrap(err)
+	}
+	txProcessor.updatedVouches[idx] = vouch
+	return p, nil
+}
+
 // applyDeposit updates the balance in the account of the depositer, if
 // andTransfer parameter is set to true, the method will also apply the
 // Transfer of the L1Tx/DepositTransfer
@@ -1060,6 +1256,300 @@ func (txProcessor *TxProcessor) applyTransfer(coordIdxsMap map[common.TokenID]co
 	return nil
 }
 
+// applyVouch increments the nonce of the sender and creates (CreateVouch) or
+// removes (DeleteVouch) the vouch from the sender to the receiver in the
+// VouchTree. CreateVouch locks the tx.Amount from the sender balance as the
+// stake of the vouch, and DeleteVouch unlocks it. A vouch that has been
+// deleted keeps its leaf with the value set to false and no amount, so
+// vouching again updates the existing leaf instead of adding a new one.
+// Parameter 'auxToIdx' follows the same rules as in applyTransfer.
+func (txProcessor *TxProcessor) applyVouch(tx common.Tx, auxToIdx common.AccountIdx) error {
+	if auxToIdx == common.AccountIdx(0) {
+		auxToIdx = tx.ToIdx
+	}
+	if auxToIdx == tx.FromIdx {
+		return common.Wrap(ErrSelfVouch)
+	}
+	accSender, err := txProcessor.state.GetAccount(tx.FromIdx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	// check that the receiver exists
+	if _, err := txProcessor.state.GetAccount(auxToIdx); err != nil {
+		return common.Wrap(err)
+	}
+	if tx.Type == common.TxTypeCreateVouch {
+		for _, idx := range []common.AccountIdx{tx.FromIdx, auxToIdx} {
+			sybil, err := txProcessor.state.IsSybil(idx)
+			if err != nil {
+				return common.Wrap(err)
+			}
+			if sybil {
+				return common.Wrap(ErrSybilAccount)
+			}
+		}
+	}
+
+	vouchIdx := common.GenerateVouchIdx(tx.FromIdx, auxToIdx)
+	if err := txProcessor.checkVouchLimits(tx.Type, vouchIdx); err != nil {
+		return common.Wrap(err)
+	}
+	vouch, err := txProcessor.state.GetVouch(vouchIdx)
+	exists := true
+	if common.Unwrap(err) == db.ErrNotFound {
+		exists = false
+	} else if err != nil {
+		return common.Wrap(err)
+	}
+
+	switch tx.Type {
+	case common.TxTypeCreateVouch:
+		if exists && vouch.Value {
+			return common.Wrap(statedb.ErrAlreadyVouched)
+		}
+		if tx.Amount == nil || tx.Amount.Sign() <= 0 {
+			return common.Wrap(ErrInvalidVouchAmount)
+		}
+		// lock the amount from the sender balance
+		accSender.Balance = new(big.Int).Sub(accSender.Balance, tx.Amount)
+		if accSender.Balance.Sign() == -1 { // balance<0
+			return newErrorNotEnoughBalance(tx)
+		}
+		newVouch := &common.Vouch{
+			BatchNum: txProcessor.state.CurrentBatch() + 1,
+			Value:    true,
+			Amount:   new(big.Int).Set(tx.Amount),
+		}
+		if exists {
+			_, err = txProcessor.updateVouch(vouchIdx, newVouch)
+		} else {
+			_, err = txProcessor.createVouch(vouchIdx, newVouch)
+		}
+		if err != nil {
+			return common.Wrap(err)
+		}
+	case common.TxTypeDeleteVouch:
+		if !exists || !vouch.Value {
+			return common.Wrap(ErrVouchNotFound)
+		}
+		// unlock the amount of the vouch to the sender balance
+		accSender.Balance = new(big.Int).Add(accSender.Balance, vouch.Amount)
+		if _, err := txProcessor.updateVouch(vouchIdx, &common.Vouch{
+			BatchNum: vouch.BatchNum,
+			Value:    false,
+			Amount:   big.NewInt(0),
+		}); err != nil {
+			return common.Wrap(err)
+		}
+	default:
+		return common.Wrap(fmt.Errorf("invalid vouch tx type: %s", tx.Type))
+	}
+
+	if !tx.IsL1 { // L2
+		// increment nonce
+		accSender.Nonce++
+	}
+	if _, err := txProcessor.updateAccount(tx.FromIdx, accSender); err != nil {
+		return common.Wrap(err)
+	}
+	return nil
+}
+
+// checkVouchLimits checks that a vouch tx of the given type on the vouch
+// vouchIdx respects the Config.MaxOutVouches of the sender and the
+// Config.VouchCooldown of the pair
+func (txProcessor *TxProcessor) checkVouchLimits(txType common.TxType,
+	vouchIdx common.VouchIdx) error {
+	if txType == common.TxTypeCreateVouch && txProcessor.config.MaxOutVouches != 0 {
+		count, err := txProcessor.state.OutVouchCount(vouchIdx.FromIdx())
+		if err != nil {
+			return common.Wrap(err)
+		}
+		if count >= txProcessor.config.MaxOutVouches {
+			return common.Wrap(ErrMaxOutVouches)
+		}
+	}
+	if txProcessor.config.VouchCooldown != 0 {
+		changed, err := txProcessor.state.VouchChangeBatch(vouchIdx)
+		if err != nil {
+			return common.Wrap(err)
+		}
+		batchNum := txProcessor.state.CurrentBatch() + 1
+		if changed != 0 &&
+			batchNum-changed < common.BatchNum(txProcessor.config.VouchCooldown) {
+			return common.Wrap(ErrVouchCooldown)
+		}
+	}
+	return nil
+}
+
+// StartBatch prepares the TxProcessor to process the txs of the next batch: it
+// resets the vouches and sybil reports updated in the batch, and removes the
+// vouches that expire in it before any tx is processed, so that they can be
+// created again in the same batch.  ProcessTxs calls it, and so does the
+// TxSelector before checking the txs of the pool, so that both process them
+// over the same state.
+func (txProcessor *TxProcessor) StartBatch() error {
+	txProcessor.updatedVouches = make(map[common.VouchIdx]*common.Vouch)
+	txProcessor.sybilReports = nil
+	return common.Wrap(txProcessor.expireVouches(txProcessor.state.CurrentBatch() + 1))
+}
+
+// expireVouches removes the active vouches that are expired at the batch
+// batchNum, in ascending VouchIdx order, unlocking their amount to the sender
+// balance like a DeleteVouch does.  The vouches are read from the index of the
+// StateDB by creation batch, so that only the vouches created VouchExpiry
+// batches ago are read.
+func (txProcessor *TxProcessor) expireVouches(batchNum common.BatchNum) error {
+	expiry := common.BatchNum(txProcessor.config.VouchExpiry)
+	if expiry == 0 || batchNum < expiry {
+		return nil
+	}
+	vouches, err := txProcessor.state.VouchesCreatedUpTo(batchNum - expiry)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	var expired []*common.Vouch
+	for _, vouch := range vouches {
+		if vouch.IsExpired(batchNum, txProcessor.config.VouchExpiry) {
+			expired = append(expired, vouch)
+		}
+	}
+
+	for _, vouch := range expired {
+		if err := txProcessor.removeVouch(vouch, vouch.Amount); err != nil {
+			return common.Wrap(err)
+		}
+	}
+	if err := txProcessor.state.SetVouchesExpiredUpTo(batchNum - expiry); err != nil {
+		return common.Wrap(err)
+	}
+	if len(expired) > 0 {
+		log.Debugw("Vouches expired", "batch", batchNum, "vouches", len(expired))
+	}
+	return nil
+}
+
+// removeVouch deactivates the given active vouch without a tx, unlocking the
+// given part of its amount to the sender balance.  The rest of the amount is
+// burned.
+func (txProcessor *TxProcessor) removeVouch(vouch *common.Vouch, unlocked *big.Int) error {
+	fromIdx := vouch.Idx.FromIdx()
+	accSender, err := txProcessor.state.GetAccount(fromIdx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	accSender.Balance = new(big.Int).Add(accSender.Balance, unlocked)
+	if _, err := txProcessor.updateVouch(vouch.Idx, &common.Vouch{
+		BatchNum: vouch.BatchNum,
+		Value:    false,
+		Amount:   big.NewInt(0),
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	if _, err := txProcessor.updateAccount(fromIdx, accSender); err != nil {
+		return common.Wrap(err)
+	}
+	return nil
+}
+
+// applyReportSybil applies a ReportSybil L1Tx, which marks the tx.FromIdx
+// account as sybil.  Each vouch received by the account is removed, slashing
+// Config.SybilSlashPerMille of its stake and unlocking the rest to the
+// voucher, each vouch given by the account is removed unlocking its whole
+// stake, and the score of the account is set to 0.  The account is left out
+// of the vouch graph of the next score epochs, and can't vouch nor be vouched
+// anymore.  Reports that don't come from Config.SybilReporter, or that target
+// an account that doesn't exist or that is already sybil, are ignored like
+// the rest of invalid L1Txs.
+func (txProcessor *TxProcessor) applyReportSybil(tx *common.L1Tx) error {
+	if txProcessor.config.SybilReporter == common.EmptyAddr ||
+		tx.FromEthAddr != txProcessor.config.SybilReporter {
+		log.Debugf("ReportSybil ignored: tx.FromEthAddr (%s) is not the sybil reporter (%s)",
+			tx.FromEthAddr.Hex(), txProcessor.config.SybilReporter.Hex())
+		return nil
+	}
+	if _, err := txProcessor.state.GetAccount(tx.FromIdx); common.Unwrap(err) == db.ErrNotFound {
+		log.Debugf("ReportSybil ignored: can not get account for tx.FromIdx: %d", tx.FromIdx)
+		return nil
+	} else if err != nil {
+		return common.Wrap(err)
+	}
+	sybil, err := txProcessor.state.IsSybil(tx.FromIdx)
+	if err != nil {
+		return common.Wrap(err)
+	}
+	if sybil {
+		log.Debugf("ReportSybil ignored: account %d is already sybil", tx.FromIdx)
+		return nil
+	}
+
+	batchNum := txProcessor.state.CurrentBatch() + 1
+	report := common.SybilReport{
+		BatchNum: batchNum,
+		Idx:      tx.FromIdx,
+		Slashed:  big.NewInt(0),
+	}
+	// the vouches are collected before removing them, as removing a vouch
+	// changes the index being iterated
+	var received, given []*common.Vouch
+	if err := txProcessor.state.VouchesTo(tx.FromIdx, func(v *common.Vouch) (bool, error) {
+		received = append(received, v)
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	if err := txProcessor.state.VouchesFrom(tx.FromIdx, func(v *common.Vouch) (bool, error) {
+		given = append(given, v)
+		return true, nil
+	}); err != nil {
+		return common.Wrap(err)
+	}
+	for _, vouch := range received {
+		slashed := new(big.Int).Mul(vouch.Amount,
+			big.NewInt(int64(txProcessor.config.SybilSlashPerMille)))
+		slashed.Div(slashed, big.NewInt(sybilSlashDenominator))
+		unlocked := new(big.Int).Sub(vouch.Amount, slashed)
+		if err := txProcessor.removeVouch(vouch, unlocked); err != nil {
+			return common.Wrap(err)
+		}
+		report.Slashed.Add(report.Slashed, slashed)
+		report.Slashes = append(report.Slashes, common.VouchSlash{
+			BatchNum: batchNum,
+			SybilIdx: tx.FromIdx,
+			FromIdx:  vouch.Idx.FromIdx(),
+			ToIdx:    vouch.Idx.ToIdx(),
+			Slashed:  slashed,
+			Unlocked: unlocked,
+		})
+	}
+	for _, vouch := range given {
+		if err := txProcessor.removeVouch(vouch, vouch.Amount); err != nil {
+			return common.Wrap(err)
+		}
+		report.Slashes = append(report.Slashes, common.VouchSlash{
+			BatchNum: batchNum,
+			SybilIdx: tx.FromIdx,
+			FromIdx:  vouch.Idx.FromIdx(),
+			ToIdx:    vouch.Idx.ToIdx(),
+			Slashed:  big.NewInt(0),
+			Unlocked: new(big.Int).Set(vouch.Amount),
+		})
+	}
+
+	if err := scoring.StoreScores(txProcessor.state,
+		map[common.AccountIdx]uint32{tx.FromIdx: 0}); err != nil {
+		return common.Wrap(err)
+	}
+	if err := txProcessor.state.SetSybil(tx.FromIdx, batchNum); err != nil {
+		return common.Wrap(err)
+	}
+	txProcessor.sybilReports = append(txProcessor.sybilReports, report)
+	log.Debugw("Account reported as sybil", "batch", batchNum, "idx", tx.FromIdx,
+		"vouches", len(report.Slashes), "slashed", report.Slashed)
+	return nil
+}
+
 // It returns the ExitAccount and a boolean determining if the Exit created a
 // new Leaf in the ExitTree.
 func (txProcessor *TxProcessor) applyExit(coordIdxsMap map[common.TokenID]common.AccountIdx,
@@ -0,0 +1,612 @@
+package txprocessor
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/scoring"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var deleteme []string
+
+func init() {
+	log.Init("debug", []string{"stdout"})
+}
+
+func TestMain(m *testing.M) {
+	exitVal := m.Run()
+	for _, dir := range deleteme {
+		if err := os.RemoveAll(dir); err != nil {
+			panic(err)
+		}
+	}
+	os.Exit(exitVal)
+}
+
+var testConfig = Config{
+	NLevels:  32,
+	MaxFeeTx: 64,
+	MaxTx:    512,
+	MaxL1Tx:  16,
+	ChainID:  uint16(0),
+}
+
+// newTestStateDB returns a StateDB of the given type with nAccounts accounts
+// created, starting at Idx 256
+func newTestStateDB(t *testing.T, typ statedb.TypeStateDB, nAccounts int) *statedb.StateDB {
+	dir, err := os.MkdirTemp("", "tmpdb")
+	require.NoError(t, err)
+	deleteme = append(deleteme, dir)
+
+	sdb, err := statedb.NewStateDB(statedb.Config{Path: dir, Keep: 128, Type: typ,
+		NLevels: 32})
+	require.NoError(t, err)
+	for i := 0; i < nAccounts; i++ {
+		idx := common.AccountIdx(256 + i)
+		_, err = sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(1000),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+		})
+		require.NoError(t, err)
+	}
+	return sdb
+}
+
+func vouchTx(txType common.TxType, from, to common.AccountIdx, amount int64) common.PoolL2Tx {
+	return common.PoolL2Tx{
+		FromIdx: from,
+		ToIdx:   to,
+		Amount:  big.NewInt(amount),
+		Type:    txType,
+	}
+}
+
+func TestProcessVouchTxs(t *testing.T) {
+	sdb := newTestStateDB(t, statedb.TypeSynchronizer, 3)
+	defer sdb.Close()
+	tp := NewTxProcessor(sdb, testConfig)
+
+	// 256 and 258 vouch for 257, 257 vouches for 256
+	l2Txs := []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+		vouchTx(common.TxTypeCreateVouch, 258, 257, 200),
+		vouchTx(common.TxTypeCreateVouch, 257, 256, 300),
+	}
+	ptOut, err := tp.ProcessTxs(nil, nil, nil, l2Txs)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(ptOut.UpdatedVouches))
+	for _, tx := range l2Txs {
+		idx := common.GenerateVouchIdx(tx.FromIdx, tx.ToIdx)
+		vouch, err := sdb.GetVouch(idx)
+		require.NoError(t, err)
+		assert.True(t, vouch.Value)
+		assert.Equal(t, tx.Amount, vouch.Amount)
+		assert.Equal(t, common.BatchNum(1), vouch.BatchNum)
+		assert.Equal(t, vouch.Value, ptOut.UpdatedVouches[idx].Value)
+
+		// the amount is locked from the sender balance
+		acc, err := sdb.GetAccount(tx.FromIdx)
+		require.NoError(t, err)
+		assert.Equal(t, common.Nonce(1), acc.Nonce)
+		assert.Equal(t, new(big.Int).Sub(big.NewInt(1000), tx.Amount), acc.Balance)
+	}
+
+	// the leaf is the hash of the weight and the creation batch
+	idx := common.GenerateVouchIdx(256, 257)
+	leaf, err := (&common.Vouch{BatchNum: 1, Value: true,
+		Amount: big.NewInt(100)}).HashValue()
+	require.NoError(t, err)
+	proof, err := sdb.MTGetVouchProof(idx)
+	require.NoError(t, err)
+	assert.Equal(t, leaf, proof.Value.BigInt())
+
+	// delete a vouch, which unlocks its amount, and vouch again for the
+	// same account, which updates the existing leaf
+	require.NoError(t, sdb.MakeCheckpoint())
+	tp = NewTxProcessor(sdb, testConfig)
+	ptOut, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeDeleteVouch, 256, 257, 0),
+	})
+	require.NoError(t, err)
+	assert.False(t, ptOut.UpdatedVouches[idx].Value)
+	vouch, err := sdb.GetVouch(idx)
+	require.NoError(t, err)
+	assert.False(t, vouch.Value)
+	assert.Equal(t, 0, vouch.Weight().Sign())
+	acc, err := sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(1000), acc.Balance)
+
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 1000),
+	})
+	require.NoError(t, err)
+	vouch, err = sdb.GetVouch(idx)
+	require.NoError(t, err)
+	assert.True(t, vouch.Value)
+	assert.Equal(t, big.NewInt(1000), vouch.Weight())
+	assert.Equal(t, common.BatchNum(2), vouch.BatchNum)
+	acc, err = sdb.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, 0, acc.Balance.Sign())
+}
+
+func TestProcessVouchTxsErrors(t *testing.T) {
+	sdb := newTestStateDB(t, statedb.TypeSynchronizer, 2)
+	defer sdb.Close()
+
+	tp := NewTxProcessor(sdb, testConfig)
+	_, err := tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 256, 100),
+	})
+	assert.Equal(t, ErrSelfVouch, common.Unwrap(err))
+
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeDeleteVouch, 256, 257, 0),
+	})
+	assert.Equal(t, ErrVouchNotFound, common.Unwrap(err))
+
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 0),
+	})
+	assert.Equal(t, ErrInvalidVouchAmount, common.Unwrap(err))
+
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 1001),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough balance")
+
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+	})
+	assert.Equal(t, statedb.ErrAlreadyVouched, common.Unwrap(err))
+}
+
+func TestCreateVouchUpdatedVouches(t *testing.T) {
+	sdb := newTestStateDB(t, statedb.TypeSynchronizer, 2)
+	defer sdb.Close()
+
+	idx := common.GenerateVouchIdx(256, 257)
+	tp := NewTxProcessor(sdb, testConfig)
+	_, err := tp.createVouch(idx, &common.Vouch{BatchNum: 1, Value: true,
+		Amount: big.NewInt(100)})
+	require.NoError(t, err)
+	require.Contains(t, tp.updatedVouches, idx)
+
+	// a vouch that fails to be written is not stored in updatedVouches
+	tp = NewTxProcessor(sdb, testConfig)
+	_, err = tp.createVouch(idx, &common.Vouch{BatchNum: 1, Value: true,
+		Amount: big.NewInt(100)})
+	assert.Equal(t, statedb.ErrAlreadyVouched, common.Unwrap(err))
+	assert.NotContains(t, tp.updatedVouches, idx)
+}
+
+func TestProcessVouchLimits(t *testing.T) {
+	config := testConfig
+	config.MaxOutVouches = 2
+	config.VouchCooldown = 2
+
+	sdb := newTestStateDB(t, statedb.TypeSynchronizer, 4)
+	defer sdb.Close()
+
+	// batch 1
+	_, err := NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+		vouchTx(common.TxTypeCreateVouch, 256, 258, 100),
+	})
+	require.NoError(t, err)
+	count, err := sdb.OutVouchCount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), count)
+	changed, err := sdb.VouchChangeBatch(common.GenerateVouchIdx(256, 257))
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(1), changed)
+
+	// 256 already gives 2 vouches
+	_, err = NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 259, 100),
+	})
+	assert.Equal(t, ErrMaxOutVouches, common.Unwrap(err))
+	// the vouch 256 -> 257 has changed 1 batch ago
+	_, err = NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeDeleteVouch, 256, 257, 0),
+	})
+	assert.Equal(t, ErrVouchCooldown, common.Unwrap(err))
+
+	// batch 2
+	_, err = NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// batch 3: once the cooldown is over the vouch can be deleted, which
+	// allows to give a new vouch in the same batch
+	_, err = NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeDeleteVouch, 256, 257, 0),
+		vouchTx(common.TxTypeCreateVouch, 256, 259, 100),
+	})
+	require.NoError(t, err)
+	count, err = sdb.OutVouchCount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), count)
+	changed, err = sdb.VouchChangeBatch(common.GenerateVouchIdx(256, 257))
+	require.NoError(t, err)
+	assert.Equal(t, common.BatchNum(3), changed)
+
+	// the deleted vouch can not be created again until the cooldown is
+	// over
+	_, err = NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+	})
+	assert.Equal(t, ErrVouchCooldown, common.Unwrap(err))
+
+	// without limits the same txs are valid
+	_, err = NewTxProcessor(sdb, testConfig).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 257, 256, 100),
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+	})
+	require.NoError(t, err)
+	count, err = sdb.OutVouchCount(256)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), count)
+}
+
+func TestProcessScoreEpoch(t *testing.T) {
+	scorer, err := scoring.NewScorer(scoring.Config{Algorithm: scoring.AlgorithmPageRank,
+		PageRank: scoring.DefaultPageRankConfig})
+	require.NoError(t, err)
+	config := testConfig
+	config.ScoreEpochBatches = 2
+	config.Scorer = scorer
+
+	syncDB := newTestStateDB(t, statedb.TypeSynchronizer, 3)
+	defer syncDB.Close()
+	bbDB := newTestStateDB(t, statedb.TypeBatchBuilder, 3)
+	defer bbDB.Close()
+
+	l2Txs := []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+		vouchTx(common.TxTypeCreateVouch, 258, 257, 100),
+		vouchTx(common.TxTypeCreateVouch, 257, 256, 100),
+	}
+	// batch 1 is not a score epoch
+	ptOut, err := NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, l2Txs)
+	require.NoError(t, err)
+	assert.Nil(t, ptOut.ScoreEpoch)
+	assert.Equal(t, 0, syncDB.ScoreTree.Root().BigInt().Sign())
+	ptOut, err = NewTxProcessor(bbDB, config).ProcessTxs(nil, nil, nil, l2Txs)
+	require.NoError(t, err)
+	assert.False(t, ptOut.ZKInputs.Metadata.ScoreEpoch)
+	assert.Equal(t, ptOut.ZKInputs.OldScoreRoot, ptOut.ZKInputs.NewScoreRoot)
+
+	// batch 2 recomputes the scores from the vouches
+	syncOut, err := NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.NotNil(t, syncOut.ScoreEpoch)
+	assert.Equal(t, 0, syncOut.ScoreEpoch.OldScoreRoot.Sign())
+	assert.Equal(t, syncDB.ScoreTree.Root().BigInt(), syncOut.ScoreEpoch.NewScoreRoot)
+	assert.Equal(t, 3, len(syncOut.ScoreEpoch.UpdatedScores))
+	for idx, value := range syncOut.ScoreEpoch.UpdatedScores {
+		score, err := syncDB.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, value, score.Value)
+	}
+
+	// the batch builder obtains the same score root, which goes into the
+	// ZKInputs
+	bbOut, err := NewTxProcessor(bbDB, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	assert.True(t, bbOut.ZKInputs.Metadata.ScoreEpoch)
+	assert.Equal(t, 0, bbOut.ZKInputs.OldScoreRoot.Sign())
+	assert.Equal(t, syncOut.ScoreEpoch.NewScoreRoot, bbOut.ZKInputs.NewScoreRoot)
+
+	// batch 3 is not a score epoch and doesn't change the scores
+	ptOut, err = NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, ptOut.ScoreEpoch)
+	assert.Equal(t, syncOut.ScoreEpoch.NewScoreRoot, syncDB.ScoreTree.Root().BigInt())
+}
+
+func TestProcessScoreEpochStake(t *testing.T) {
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	stake := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), ether) }
+	newDB := func() *statedb.StateDB {
+		sdb := newTestStateDB(t, statedb.TypeSynchronizer, 0)
+		for i := 0; i < 3; i++ {
+			idx := common.AccountIdx(256 + i)
+			_, err := sdb.CreateAccount(idx, &common.Account{
+				Idx:     idx,
+				Balance: stake(1000),
+				EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+			})
+			require.NoError(t, err)
+		}
+		return sdb
+	}
+	// 256 vouches 200 ether, over the 127 of the LessThan(7) comparators,
+	// and 258 vouches 5 ether
+	l2Txs := []common.PoolL2Tx{
+		{FromIdx: 256, ToIdx: 257, Amount: stake(200), Type: common.TxTypeCreateVouch},
+		{FromIdx: 258, ToIdx: 257, Amount: stake(5), Type: common.TxTypeCreateVouch},
+	}
+	scoringCfg := scoring.Config{Algorithm: scoring.AlgorithmPageRank,
+		PageRank: scoring.DefaultPageRankConfig, EpochBatches: 1,
+		VouchHalfLife: 1000, VouchUnit: ether}
+	scorer, err := scoring.NewScorer(scoringCfg)
+	require.NoError(t, err)
+	config := testConfig
+	config.ScoreEpochBatches = scoringCfg.EpochBatches
+	config.Scorer = scorer
+
+	// the stake in wei doesn't fit in the comparators
+	rawDB := newDB()
+	defer rawDB.Close()
+	config.ScoreWeights = scoring.WeightConfig{HalfLife: scoringCfg.VouchHalfLife}
+	_, err = NewTxProcessor(rawDB, config).ProcessTxs(nil, nil, nil, l2Txs)
+	assert.True(t, errors.Is(err, scoring.ErrComparatorOutOfRange))
+
+	// the weights of the scoring config are mapped to their range
+	sdb := newDB()
+	defer sdb.Close()
+	config.ScoreWeights = scoringCfg.Weights()
+	ptOut, err := NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, l2Txs)
+	require.NoError(t, err)
+	require.NotNil(t, ptOut.ScoreEpoch)
+	// the degree of 256 is scaled down to 127, which is not lower than
+	// the residual of its walk, so it obtains no rank, while 257 and 258
+	// have a degree lower than 10
+	for idx, value := range map[common.AccountIdx]uint32{256: 0, 257: 2, 258: 2} {
+		score, err := sdb.GetScore(idx)
+		require.NoError(t, err)
+		assert.Equal(t, value, score.Value, "score of %d", idx)
+	}
+}
+
+func TestProcessVouchExpiry(t *testing.T) {
+	config := testConfig
+	config.VouchExpiry = 2
+
+	syncDB := newTestStateDB(t, statedb.TypeSynchronizer, 2)
+	defer syncDB.Close()
+	bbDB := newTestStateDB(t, statedb.TypeBatchBuilder, 2)
+	defer bbDB.Close()
+
+	batches := [][]common.PoolL2Tx{
+		// batch 1
+		{vouchTx(common.TxTypeCreateVouch, 256, 257, 100)},
+		// batch 2
+		{vouchTx(common.TxTypeCreateVouch, 257, 256, 100)},
+		// batch 3: the vouch of batch 1 expires and can be created again
+		{vouchTx(common.TxTypeCreateVouch, 256, 257, 50)},
+	}
+	var ptOut *ProcessTxOutput
+	for _, l2Txs := range batches {
+		var err error
+		ptOut, err = NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, l2Txs)
+		require.NoError(t, err)
+		_, err = NewTxProcessor(bbDB, config).ProcessTxs(nil, nil, nil, l2Txs)
+		require.NoError(t, err)
+	}
+	idx := common.GenerateVouchIdx(256, 257)
+	vouch, err := syncDB.GetVouch(idx)
+	require.NoError(t, err)
+	assert.True(t, vouch.Value)
+	assert.Equal(t, common.BatchNum(3), vouch.BatchNum)
+	assert.Equal(t, big.NewInt(50), vouch.Amount)
+	assert.Equal(t, vouch.Amount, ptOut.UpdatedVouches[idx].Amount)
+	// the stake of the expired vouch has been unlocked before locking the
+	// new one
+	acc, err := syncDB.GetAccount(256)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(950), acc.Balance)
+
+	// the vouch of batch 2 is still active
+	vouch, err = syncDB.GetVouch(common.GenerateVouchIdx(257, 256))
+	require.NoError(t, err)
+	assert.True(t, vouch.Value)
+
+	// batch 4 expires the vouch of batch 2 without any tx
+	ptOut, err = NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	_, err = NewTxProcessor(bbDB, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	expiredIdx := common.GenerateVouchIdx(257, 256)
+	require.Contains(t, ptOut.UpdatedVouches, expiredIdx)
+	assert.False(t, ptOut.UpdatedVouches[expiredIdx].Value)
+	assert.Equal(t, big.NewInt(1000), ptOut.UpdatedAccounts[257].Balance)
+	assert.NotContains(t, ptOut.UpdatedVouches, idx)
+
+	// the batch builder removes the same vouches
+	syncRoot, err := syncDB.StateRoot()
+	require.NoError(t, err)
+	bbRoot, err := bbDB.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, syncRoot, bbRoot)
+}
+
+func reportSybilTx(t *testing.T, reporter ethCommon.Address, idx common.AccountIdx) common.L1Tx {
+	tx := common.L1Tx{
+		FromIdx:       idx,
+		ToIdx:         common.ReportSybilIdx,
+		FromEthAddr:   reporter,
+		Amount:        big.NewInt(0),
+		DepositAmount: big.NewInt(0),
+	}
+	require.NoError(t, tx.SetType())
+	require.Equal(t, common.TxTypeReportSybil, tx.Type)
+	return tx
+}
+
+func TestProcessReportSybil(t *testing.T) {
+	scorer, err := scoring.NewScorer(scoring.Config{Algorithm: scoring.AlgorithmPageRank,
+		PageRank: scoring.DefaultPageRankConfig})
+	require.NoError(t, err)
+	reporter := ethCommon.HexToAddress("0x5000000000000000000000000000000000000005")
+	config := testConfig
+	config.ScoreEpochBatches = 1
+	config.Scorer = scorer
+	config.SybilReporter = reporter
+	config.SybilSlashPerMille = 500
+
+	syncDB := newTestStateDB(t, statedb.TypeSynchronizer, 4)
+	defer syncDB.Close()
+	bbDB := newTestStateDB(t, statedb.TypeBatchBuilder, 4)
+	defer bbDB.Close()
+
+	// batch 1: 256 and 257 vouch for 258, which vouches for 259
+	l2Txs := []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 258, 100),
+		vouchTx(common.TxTypeCreateVouch, 257, 258, 201),
+		vouchTx(common.TxTypeCreateVouch, 258, 259, 5),
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 50),
+	}
+	for _, sdb := range []*statedb.StateDB{syncDB, bbDB} {
+		_, err := NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, l2Txs)
+		require.NoError(t, err)
+	}
+	// 258 gives less weight than the threshold of its walk, so it has a
+	// score
+	score, err := syncDB.GetScore(258)
+	require.NoError(t, err)
+	assert.NotEqual(t, uint32(0), score.Value)
+
+	// batch 2: the report of an address other than the reporter is
+	// ignored, and the report of the reporter marks 258 as sybil
+	l1UserTxs := []common.L1Tx{
+		reportSybilTx(t, ethCommon.BigToAddress(big.NewInt(1)), 257),
+		reportSybilTx(t, reporter, 258),
+	}
+	ptOut, err := NewTxProcessor(syncDB, config).ProcessTxs(nil, l1UserTxs, nil, nil)
+	require.NoError(t, err)
+	_, err = NewTxProcessor(bbDB, config).ProcessTxs(nil, l1UserTxs, nil, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(ptOut.SybilReports))
+	report := ptOut.SybilReports[0]
+	assert.Equal(t, common.AccountIdx(258), report.Idx)
+	assert.Equal(t, common.BatchNum(2), report.BatchNum)
+	// half of the stake of each voucher is slashed, rounding down
+	assert.Equal(t, big.NewInt(50+100), report.Slashed)
+	assert.Equal(t, []common.VouchSlash{
+		{BatchNum: 2, SybilIdx: 258, FromIdx: 256, ToIdx: 258,
+			Slashed: big.NewInt(50), Unlocked: big.NewInt(50)},
+		{BatchNum: 2, SybilIdx: 258, FromIdx: 257, ToIdx: 258,
+			Slashed: big.NewInt(100), Unlocked: big.NewInt(101)},
+		{BatchNum: 2, SybilIdx: 258, FromIdx: 258, ToIdx: 259,
+			Slashed: big.NewInt(0), Unlocked: big.NewInt(5)},
+	}, report.Slashes)
+	for _, tx := range l1UserTxs {
+		assert.Equal(t, 0, tx.EffectiveAmount.Sign())
+		assert.Equal(t, 0, tx.EffectiveDepositAmount.Sign())
+	}
+
+	// the vouches of 258 are removed, and the one between 256 and 257 is
+	// kept
+	for _, vouchIdx := range []common.VouchIdx{
+		common.GenerateVouchIdx(256, 258),
+		common.GenerateVouchIdx(257, 258),
+		common.GenerateVouchIdx(258, 259),
+	} {
+		vouch, err := syncDB.GetVouch(vouchIdx)
+		require.NoError(t, err)
+		assert.False(t, vouch.Value)
+		assert.Equal(t, 0, vouch.Amount.Sign())
+		assert.False(t, ptOut.UpdatedVouches[vouchIdx].Value)
+	}
+	vouch, err := syncDB.GetVouch(common.GenerateVouchIdx(256, 257))
+	require.NoError(t, err)
+	assert.True(t, vouch.Value)
+	for idx, balance := range map[common.AccountIdx]int64{
+		256: 1000 - 50 - 50,
+		257: 1000 - 100,
+		258: 1000,
+		259: 1000,
+	} {
+		acc, err := syncDB.GetAccount(idx)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(balance), acc.Balance, idx)
+	}
+
+	// the score of 258 is 0, and the score epoch of the batch keeps it
+	score, err = syncDB.GetScore(258)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), score.Value)
+	sybil, err := syncDB.IsSybil(258)
+	require.NoError(t, err)
+	assert.True(t, sybil)
+	sybil, err = syncDB.IsSybil(257)
+	require.NoError(t, err)
+	assert.False(t, sybil)
+
+	// the batch builder applies the same report
+	syncRoot, err := syncDB.StateRoot()
+	require.NoError(t, err)
+	bbRoot, err := bbDB.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, syncRoot, bbRoot)
+
+	// batch 3: reporting 258 again is ignored
+	ptOut, err = NewTxProcessor(syncDB, config).ProcessTxs(nil,
+		[]common.L1Tx{reportSybilTx(t, reporter, 258)}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(ptOut.SybilReports))
+
+	// 258 can't vouch nor be vouched anymore
+	_, err = NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 259, 258, 100),
+	})
+	assert.Equal(t, ErrSybilAccount, common.Unwrap(err))
+	_, err = NewTxProcessor(syncDB, config).ProcessTxs(nil, nil, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 258, 259, 100),
+	})
+	assert.Equal(t, ErrSybilAccount, common.Unwrap(err))
+}
+
+func TestVouchRulesValidate(t *testing.T) {
+	assert.NoError(t, VouchRules{}.Validate())
+	assert.NoError(t, VouchRules{SybilSlashPerMille: 1000}.Validate())
+	err := VouchRules{SybilSlashPerMille: 1001}.Validate()
+	assert.True(t, errors.Is(err, ErrInvalidVouchRules))
+}
+
+func TestProcessReportSybilZKInputs(t *testing.T) {
+	reporter := ethCommon.HexToAddress("0x5000000000000000000000000000000000000005")
+	config := testConfig
+	config.SybilReporter = reporter
+	config.SybilSlashPerMille = 500
+
+	bbDB := newTestStateDB(t, statedb.TypeBatchBuilder, 2)
+	defer bbDB.Close()
+	_, err := bbDB.CreateScore(257, &common.Score{Idx: 257, Value: 5})
+	require.NoError(t, err)
+	oldScoreRoot := bbDB.ScoreTree.Root().BigInt()
+
+	// the batch is not a score epoch, but the report sets the score of 257
+	// to 0, so the inputs of the ScoreTree change
+	ptOut, err := NewTxProcessor(bbDB, config).ProcessTxs(nil,
+		[]common.L1Tx{reportSybilTx(t, reporter, 257)}, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, ptOut.ScoreEpoch)
+	zki := ptOut.ZKInputs
+	assert.False(t, zki.Metadata.ScoreEpoch)
+	assert.Equal(t, oldScoreRoot, zki.OldScoreRoot)
+	assert.Equal(t, bbDB.ScoreTree.Root().BigInt(), zki.NewScoreRoot)
+	assert.NotEqual(t, zki.OldScoreRoot, zki.NewScoreRoot)
+	score, err := bbDB.GetScore(257)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), score.Value)
+}
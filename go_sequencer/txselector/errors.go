@@ -0,0 +1,35 @@
+package txselector
+
+const (
+	// ErrMaxOutVouches error message returned when a CreateVouch tx is
+	// sent by an account that already gives the maximum number of vouches
+	ErrMaxOutVouches = "Tx not selected because the sender already gives the maximum number of vouches"
+	// ErrMaxOutVouchesCode error code
+	ErrMaxOutVouchesCode int = 1
+	// ErrMaxOutVouchesType error type
+	ErrMaxOutVouchesType string = "ErrMaxOutVouches"
+
+	// ErrVouchCooldown error message returned when a CreateVouch or
+	// DeleteVouch tx changes a vouch that is still in its cooldown
+	ErrVouchCooldown = "Tx not selected because the vouch has changed too recently"
+	// ErrVouchCooldownCode error code
+	ErrVouchCooldownCode int = 2
+	// ErrVouchCooldownType error type
+	ErrVouchCooldownType string = "ErrVouchCooldown"
+
+	// ErrInvalidVouch error message returned when a CreateVouch or
+	// DeleteVouch tx can not be processed for any other reason
+	ErrInvalidVouch = "Tx not selected because the vouch can not be processed"
+	// ErrInvalidVouchCode error code
+	ErrInvalidVouchCode int = 3
+	// ErrInvalidVouchType error type
+	ErrInvalidVouchType string = "ErrInvalidVouch"
+
+	// ErrInvalidTx error message returned when a tx that is not a
+	// CreateVouch or DeleteVouch can not be processed
+	ErrInvalidTx = "Tx not selected because it can not be processed"
+	// ErrInvalidTxCode error code
+	ErrInvalidTxCode int = 4
+	// ErrInvalidTxType error type
+	ErrInvalidTxType string = "ErrInvalidTx"
+)
@@ -20,6 +20,12 @@ Transaction constrains (this takes into consideration the txs fetched from the p
   - In case of transfer to Ethereum address: if the account doesn't exists, it can be created through a `l1CoordinatorTx` IF there is a valid `AccountCreationAuthorization`
   - In case of transfer to BJJ: if the account doesn't exists, it can be created through a `l1CoordinatorTx` (no need for `AccountCreationAuthorization`)
 
+- Vouch limits: a `CreateVouch` can not be selected if the sender already gives `MaxOutVouches` active vouches,
+and a `CreateVouch` or `DeleteVouch` can not be selected if the vouch of the same pair has changed in the last
+`VouchCooldown` batches (see `txprocessor.Config`).  They are checked by the `TxProcessor` in the selection loop of
+`GetL2TxSelection`, and the rejected txs are updated in the pool with the `Info`, `ErrorCode` and `ErrorType`
+defined in errors.go
+
 - Atomic transactions: requested transaction exist and can be linked,
 according to the `RqOffset` spec: https://docs.hermez.io/#/developers/protocol/hermez-protocol/circuits/circuits?id=rq-tx-verifier
 
@@ -55,19 +61,23 @@ the group will be marked as invalid and the entire process will reboot from the
 txs belonging to failed atomic groups will be discarded before reaching the `Selection loop`.
 This is done this way because the state is altered sequentially, so if a transaction belonging to an atomic group is selected,
 but later on a transaction from the same group can't be selected, the selection will be invalid since there will be a selected tx that depends on a tx that
-doesn't exist in the selection. Right now the mechanism that the StateDB has to revert changes is to go back to a previous checkpoint (checkpoints are created per batch).
-This limitation forces the txselector to restart from the beginning of the batch selection.
-This should be improved once the StateDB has more granular mechanisms to revert the effects of processed txs.
+doesn't exist in the selection. The StateDB can revert the effects of the processed txs inside a batch with savepoints
+(`StateDB.Savepoint`, `StateDB.RollbackTo` and `StateDB.Release`), so a failed group can be undone from a savepoint
+made before its first tx instead of restarting from the beginning of the batch selection, which would otherwise be the
+only option, as the checkpoints are created per batch.
 */
 package txselector
 
 // current: very simple version of TxSelector
 
 import (
+	"fmt"
+	"sort"
 	"tokamak-sybil-resistance/common"
 	"tokamak-sybil-resistance/database/kvdb"
 	"tokamak-sybil-resistance/database/l2db"
 	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/txprocessor"
 
 	ethCommon "github.com/ethereum/go-ethereum/common"
 	"github.com/iden3/go-iden3-crypto/babyjub"
@@ -96,12 +106,13 @@ func NewTxSelector(coordAccount *CoordAccount, dbpath string,
 	synchronizerStateDB *statedb.StateDB, l2 *l2db.L2DB) (*TxSelector, error) {
 	localAccountsDB, err := statedb.NewLocalStateDB(
 		statedb.Config{
-			Path:    dbpath,
-			Keep:    kvdb.DefaultKeep,
-			Type:    statedb.TypeTxSelector,
-			NLevels: 0,
+			Path:     dbpath,
+			Keep:     kvdb.DefaultKeep,
+			Type:     statedb.TypeTxSelector,
+			NLevels:  0,
+			InMemory: true,
 		},
-		synchronizerStateDB) // without merkletree
+		synchronizerStateDB) // without merkletree, nor disk I/O
 	if err != nil {
 		return nil, common.Wrap(err)
 	}
@@ -112,3 +123,133 @@ func NewTxSelector(coordAccount *CoordAccount, dbpath string,
 		coordAccount:    coordAccount,
 	}, nil
 }
+
+// Reset tells the TxSelector to get it's internal AccountsDB from the
+// required `batchNum`.  If `fromSynchronizer` is true, the AccountsDB is a copy
+// of the rollup state from the Synchronizer at that `batchNum`, otherwise it's
+// a roll back of its own copy.
+func (txsel *TxSelector) Reset(batchNum common.BatchNum, fromSynchronizer bool) error {
+	return common.Wrap(txsel.localAccountsDB.Reset(batchNum, fromSynchronizer))
+}
+
+// GetL2TxSelection returns the L2Txs of the pool that can be forged in the
+// next batch after the given L1UserTxs, processing them over the
+// LocalStateDB, and the discarded ones.  The pending txs of the pool are
+// sorted (see sortL2Txs) and processed in that order, so that each tx is
+// checked against the state left by the previous ones, including the vouch
+// limits of the selectionConfig.  The writes of a discarded tx are undone from
+// a savepoint, and the discarded txs are updated in the L2DB with the reason
+// of the rejection, while they stay pending to be selected in a later batch.
+func (txsel *TxSelector) GetL2TxSelection(selectionConfig txprocessor.Config,
+	l1UserTxs []common.L1Tx) ([]common.PoolL2Tx, []common.PoolL2Tx, error) {
+	l2Txs, err := txsel.l2db.GetPendingTxs()
+	if err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	sdb := txsel.localAccountsDB.StateDB
+	selected, discarded, err := selectL2Txs(sdb, selectionConfig, l1UserTxs, sortL2Txs(l2Txs))
+	if err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	if err := txsel.l2db.UpdateTxsInfo(discarded, sdb.CurrentBatch()+1); err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	return selected, discarded, nil
+}
+
+// sortL2Txs sorts the L2Txs by AbsoluteFee, and then by Nonce, so that the
+// txs of each sender are processed in the order of their nonces, and the txs
+// with the same nonce are processed from the highest to the lowest fee.  The
+// txs with the same nonce and fee keep the order of the pool.
+func sortL2Txs(l2Txs []common.PoolL2Tx) []common.PoolL2Tx {
+	sort.SliceStable(l2Txs, func(i, j int) bool {
+		return l2Txs[i].AbsoluteFee > l2Txs[j].AbsoluteFee
+	})
+	sort.SliceStable(l2Txs, func(i, j int) bool {
+		return l2Txs[i].Nonce < l2Txs[j].Nonce
+	})
+	return l2Txs
+}
+
+// selectL2Txs processes the L2Txs in order over the StateDB, in the same order
+// as ProcessTxs does: after removing the vouches that expire in the next batch
+// and processing the L1UserTxs of the batch.  It returns the L2Txs that have
+// been processed and the ones that have been rejected by the TxProcessor, with
+// their Info, ErrorCode and ErrorType set.  All the writes are undone once the
+// txs are selected, so that the StateDB stays at the state of its last batch.
+func selectL2Txs(sdb *statedb.StateDB, selectionConfig txprocessor.Config,
+	l1UserTxs []common.L1Tx, l2Txs []common.PoolL2Tx) ([]common.PoolL2Tx, []common.PoolL2Tx, error) {
+	sp := sdb.Savepoint()
+	selected, discarded, err := processSelection(sdb, selectionConfig, l1UserTxs, l2Txs)
+	if rbErr := sdb.RollbackTo(sp); rbErr != nil && err == nil {
+		err = rbErr
+	}
+	if relErr := sdb.Release(sp); relErr != nil && err == nil {
+		err = relErr
+	}
+	if err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	return selected, discarded, nil
+}
+
+// processSelection processes the txs of selectL2Txs over the StateDB.  A
+// rejected L1UserTx fails the selection, as it's mandatory to forge them.
+func processSelection(sdb *statedb.StateDB, selectionConfig txprocessor.Config,
+	l1UserTxs []common.L1Tx, l2Txs []common.PoolL2Tx) ([]common.PoolL2Tx, []common.PoolL2Tx, error) {
+	tp := txprocessor.NewTxProcessor(sdb, selectionConfig)
+	if err := tp.StartBatch(); err != nil {
+		return nil, nil, common.Wrap(err)
+	}
+	for i := range l1UserTxs {
+		// the txs are copied, as the TxProcessor sets their effective
+		// amounts
+		tx := l1UserTxs[i]
+		if _, _, _, _, err := tp.ProcessL1Tx(nil, &tx); err != nil {
+			return nil, nil, common.Wrap(err)
+		}
+	}
+	var selected, discarded []common.PoolL2Tx
+	for i := range l2Txs {
+		tx := l2Txs[i]
+		sp := sdb.Savepoint()
+		if _, _, _, err := tp.ProcessL2Tx(nil, &tx); err != nil {
+			if err := sdb.RollbackTo(sp); err != nil {
+				return nil, nil, common.Wrap(err)
+			}
+			setTxError(&tx, err)
+			discarded = append(discarded, tx)
+		} else {
+			selected = append(selected, tx)
+		}
+		if err := sdb.Release(sp); err != nil {
+			return nil, nil, common.Wrap(err)
+		}
+	}
+	return selected, discarded, nil
+}
+
+// setTxError sets the Info, ErrorCode and ErrorType of a tx that has been
+// rejected by the TxProcessor with the given error
+func setTxError(tx *common.PoolL2Tx, err error) {
+	switch common.Unwrap(err) {
+	case txprocessor.ErrMaxOutVouches:
+		tx.Info = ErrMaxOutVouches
+		tx.ErrorCode = ErrMaxOutVouchesCode
+		tx.ErrorType = ErrMaxOutVouchesType
+	case txprocessor.ErrVouchCooldown:
+		tx.Info = ErrVouchCooldown
+		tx.ErrorCode = ErrVouchCooldownCode
+		tx.ErrorType = ErrVouchCooldownType
+	default:
+		if tx.Type == common.TxTypeCreateVouch || tx.Type == common.TxTypeDeleteVouch {
+			tx.Info = fmt.Sprintf("%s: %s", ErrInvalidVouch, common.Unwrap(err))
+			tx.ErrorCode = ErrInvalidVouchCode
+			tx.ErrorType = ErrInvalidVouchType
+		} else {
+			tx.Info = fmt.Sprintf("%s: %s", ErrInvalidTx, common.Unwrap(err))
+			tx.ErrorCode = ErrInvalidTxCode
+			tx.ErrorType = ErrInvalidTxType
+		}
+	}
+}
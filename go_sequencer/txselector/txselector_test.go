@@ -0,0 +1,130 @@
+package txselector
+
+import (
+	"math/big"
+	"testing"
+	"tokamak-sybil-resistance/common"
+	"tokamak-sybil-resistance/database/statedb"
+	"tokamak-sybil-resistance/log"
+	"tokamak-sybil-resistance/txprocessor"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-merkletree/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	log.Init("debug", []string{"stdout"})
+}
+
+var testConfig = txprocessor.Config{
+	NLevels:  32,
+	MaxFeeTx: 64,
+	MaxTx:    512,
+	MaxL1Tx:  16,
+	ChainID:  uint16(0),
+}
+
+// newTestStateDB returns an in-memory StateDB of the TxSelector with
+// nAccounts accounts created, starting at Idx 256
+func newTestStateDB(t *testing.T, nAccounts int) *statedb.StateDB {
+	sdb, err := statedb.NewStateDB(statedb.Config{Keep: 128, Type: statedb.TypeTxSelector,
+		InMemory: true})
+	require.NoError(t, err)
+	for i := 0; i < nAccounts; i++ {
+		idx := common.AccountIdx(256 + i)
+		_, err = sdb.CreateAccount(idx, &common.Account{
+			Idx:     idx,
+			Balance: big.NewInt(1000),
+			EthAddr: ethCommon.BigToAddress(big.NewInt(int64(i + 1))),
+		})
+		require.NoError(t, err)
+	}
+	return sdb
+}
+
+func vouchTx(txType common.TxType, from, to common.AccountIdx, amount int64) common.PoolL2Tx {
+	return common.PoolL2Tx{
+		FromIdx: from,
+		ToIdx:   to,
+		Amount:  big.NewInt(amount),
+		Type:    txType,
+	}
+}
+
+func TestSelectL2TxsVouchExpiry(t *testing.T) {
+	config := testConfig
+	config.VouchExpiry = 2
+	config.MaxOutVouches = 1
+
+	sdb := newTestStateDB(t, 3)
+	defer sdb.Close()
+
+	// batch 1 creates the vouch 256 -> 257, and batch 2 is empty
+	_, err := txprocessor.NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil,
+		[]common.PoolL2Tx{vouchTx(common.TxTypeCreateVouch, 256, 257, 100)})
+	require.NoError(t, err)
+	_, err = txprocessor.NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// the vouch expires in batch 3, so the selection accepts a new vouch
+	// of the same pair, which then counts for MaxOutVouches
+	selected, discarded, err := selectL2Txs(sdb, config, nil, []common.PoolL2Tx{
+		vouchTx(common.TxTypeCreateVouch, 256, 257, 50),
+		vouchTx(common.TxTypeCreateVouch, 256, 258, 50),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(selected))
+	assert.Equal(t, common.AccountIdx(257), selected[0].ToIdx)
+	require.Equal(t, 1, len(discarded))
+	assert.Equal(t, common.AccountIdx(258), discarded[0].ToIdx)
+	assert.Equal(t, ErrMaxOutVouchesCode, discarded[0].ErrorCode)
+}
+
+func TestSelectL2TxsL1UserTxs(t *testing.T) {
+	reporter := ethCommon.HexToAddress("0x5000000000000000000000000000000000000005")
+	config := testConfig
+	config.SybilReporter = reporter
+	config.SybilSlashPerMille = 500
+
+	sdb := newTestStateDB(t, 3)
+	defer sdb.Close()
+	_, err := txprocessor.NewTxProcessor(sdb, config).ProcessTxs(nil, nil, nil, nil)
+	require.NoError(t, err)
+	stateRoot, err := sdb.StateRoot()
+	require.NoError(t, err)
+
+	// the L2Txs are checked after the ReportSybil of the batch, so the
+	// vouch for the reported account is rejected
+	report := common.L1Tx{
+		FromIdx:       258,
+		ToIdx:         common.ReportSybilIdx,
+		FromEthAddr:   reporter,
+		Amount:        big.NewInt(0),
+		DepositAmount: big.NewInt(0),
+	}
+	require.NoError(t, report.SetType())
+	require.Equal(t, common.TxTypeReportSybil, report.Type)
+	selected, discarded, err := selectL2Txs(sdb, config, []common.L1Tx{report},
+		[]common.PoolL2Tx{
+			vouchTx(common.TxTypeCreateVouch, 256, 258, 100),
+			vouchTx(common.TxTypeCreateVouch, 256, 257, 100),
+		})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(selected))
+	assert.Equal(t, common.AccountIdx(257), selected[0].ToIdx)
+	require.Equal(t, 1, len(discarded))
+	assert.Equal(t, common.AccountIdx(258), discarded[0].ToIdx)
+	assert.Equal(t, ErrInvalidVouchCode, discarded[0].ErrorCode)
+
+	// the writes of the selection are undone
+	sybil, err := sdb.IsSybil(258)
+	require.NoError(t, err)
+	assert.False(t, sybil)
+	_, err = sdb.GetVouch(common.GenerateVouchIdx(256, 257))
+	assert.Equal(t, db.ErrNotFound, common.Unwrap(err))
+	root, err := sdb.StateRoot()
+	require.NoError(t, err)
+	assert.Equal(t, stateRoot, root)
+}